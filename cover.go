@@ -0,0 +1,236 @@
+package epub
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"image/color"
+	"strings"
+)
+
+const (
+	defaultGeneratedCoverHeight = 2400
+	defaultGeneratedCoverWidth  = 1600
+	generatedCoverSVGTemplate   = `<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" version="1.1" width="%d" height="%d" viewBox="0 0 %d %d">
+  <rect width="100%%" height="100%%" fill="%s" />
+%s</svg>
+`
+	generatedCoverTextTemplate = `  <text x="%d" y="%d" font-family="serif" font-size="%d" text-anchor="middle" fill="%s">%s</text>
+`
+)
+
+var (
+	defaultGeneratedCoverBackground = color.RGBA{R: 0x33, G: 0x33, B: 0x33, A: 0xff}
+	defaultGeneratedCoverForeground = color.White
+)
+
+// CoverOptions configures the cover image generated by SetGeneratedCover.
+type CoverOptions struct {
+	// The title shown on the cover. If it's empty, the title of the EPUB is used.
+	Title string
+	// The author shown below the title. If it's empty, the author of the EPUB is
+	// used.
+	Author string
+	// The dimensions of the cover image in pixels. If either is zero, the cover
+	// will be 1600x2400.
+	Width  int
+	Height int
+	// The background color of the cover. If it's nil, dark gray is used.
+	Background color.Color
+	// The color of the title and author. If it's nil, white is used.
+	Foreground color.Color
+	// The internal path to an already-added CSS file to be used for the cover,
+	// the same as for SetCover. If it's empty, default CSS will be used.
+	CSSPath string
+}
+
+// SetGeneratedCover generates a placeholder cover image showing the title
+// centered on the cover and the author below it, adds it to the EPUB, and sets
+// the cover page for the EPUB using it, which is handy for drafts and proofs.
+// It returns a relative path to the cover image file that can be used in EPUB
+// sections in the format: ../ImageFolderName/internalFilename
+//
+// The cover image is an SVG image, since text can't be drawn into GIF, JPEG, or
+// PNG images without bundling a font. If the width or height is negative,
+// ErrInvalidImage will be returned and the cover won't be changed.
+func (e *Epub) SetGeneratedCover(opts CoverOptions) (string, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if opts.Width < 0 || opts.Height < 0 {
+		return "", ErrInvalidImage
+	}
+	if opts.Width == 0 || opts.Height == 0 {
+		opts.Width = defaultGeneratedCoverWidth
+		opts.Height = defaultGeneratedCoverHeight
+	}
+	if opts.Title == "" {
+		opts.Title = e.title
+	}
+	if opts.Author == "" {
+		opts.Author = e.author
+	}
+	if opts.Background == nil {
+		opts.Background = defaultGeneratedCoverBackground
+	}
+	if opts.Foreground == nil {
+		opts.Foreground = defaultGeneratedCoverForeground
+	}
+
+	// If the default filename is already used, e.g. by a previously generated
+	// cover, use another one rather than replacing the existing file
+	imageFilename := fmt.Sprintf(defaultCoverImgFormat, ".svg")
+	if _, ok := e.images[imageFilename]; ok {
+		imageFilename = renameDuplicate(imageFilename, e.images)
+	}
+
+	imagePath, err := e.addMediaFromBytes(generateCoverSVG(opts), imageFilename, e.imageFilenameFormat, ImageFolderName, e.images)
+	if err != nil {
+		// This shouldn't cause an error
+		panic(fmt.Sprintf("Error adding generated cover image: %s", err))
+	}
+	e.setCover(imagePath, opts.CSSPath, "")
+
+	return imagePath, nil
+}
+
+// The data a cover template is executed with
+type coverTemplateData struct {
+	// The internal path to the cover image, e.g. ../images/cover.png
+	ImagePath string
+	// The internal path to the CSS file of the cover page
+	CSSPath string
+	// The title of the EPUB
+	Title string
+	// The dimensions of the cover image in pixels, or zero if they're unknown
+	Width  int
+	Height int
+}
+
+// SetCoverTemplate sets the template used to generate the body of the cover page
+// by the next call to SetCover, SetCoverFromBytes, or SetGeneratedCover, e.g. to
+// show the cover in an SVG element or to add custom markup. The template uses
+// the syntax of html/template, which escapes the values, and can use the
+// {{.ImagePath}}, {{.CSSPath}}, and {{.Title}} placeholders, e.g.:
+//     <div class="cover"><img src="{{.ImagePath}}" alt="{{.Title}}" /></div>
+//
+// The {{.Width}} and {{.Height}} placeholders are the dimensions of the cover
+// image (see CoverDimensions), e.g. to declare them on the <img> element.
+//
+// If the template can't be parsed or doesn't generate well-formed XHTML,
+// ErrInvalidCoverTemplate will be returned and the template won't be changed.
+// An empty template restores the default, which shows the image in an <img>
+// element. SetSVGCover doesn't use the template.
+func (e *Epub) SetCoverTemplate(tmpl string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if tmpl == "" {
+		e.coverTemplate = nil
+		return nil
+	}
+
+	t, err := template.New("cover").Parse(tmpl)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidCoverTemplate, err)
+	}
+	// Check the template with placeholder values so that errors are caught now
+	// rather than when the cover is set
+	body, err := executeCoverTemplate(t, coverTemplateData{
+		ImagePath: "../" + ImageFolderName + "/" + fmt.Sprintf(defaultCoverImgFormat, ".png"),
+		CSSPath:   "../" + CSSFolderName + "/" + defaultCoverCSSFilename,
+		Title:     e.title,
+		Width:     defaultGeneratedCoverWidth,
+		Height:    defaultGeneratedCoverHeight,
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidCoverTemplate, err)
+	}
+	if err := newXhtml(body).validate(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidCoverTemplate, err)
+	}
+	e.coverTemplate = t
+
+	return nil
+}
+
+// Generate the body of a cover page from a cover template
+func executeCoverTemplate(t *template.Template, data coverTemplateData) (string, error) {
+	var body bytes.Buffer
+	if err := t.Execute(&body, data); err != nil {
+		return "", err
+	}
+
+	return body.String(), nil
+}
+
+// Generate an SVG image with the title centered and the author below it
+func generateCoverSVG(opts CoverOptions) []byte {
+	fill := svgColor(opts.Foreground)
+	titleSize := opts.Width / 10
+	authorSize := opts.Width / 20
+	// Serif glyphs are roughly half as wide as they are tall on average, so
+	// this keeps the lines within 80% of the width of the cover
+	titleLines := wrapWords(opts.Title, opts.Width*8/10/(titleSize/2+1))
+
+	var text bytes.Buffer
+	lineHeight := titleSize * 6 / 5
+	y := opts.Height*2/5 - lineHeight*(len(titleLines)-1)/2
+	for _, line := range titleLines {
+		text.WriteString(fmt.Sprintf(generatedCoverTextTemplate, opts.Width/2, y, titleSize, fill, escapeXMLText(line)))
+		y += lineHeight
+	}
+	if opts.Author != "" {
+		y += authorSize * 2
+		text.WriteString(fmt.Sprintf(generatedCoverTextTemplate, opts.Width/2, y, authorSize, fill, escapeXMLText(opts.Author)))
+	}
+
+	return []byte(fmt.Sprintf(
+		generatedCoverSVGTemplate,
+		opts.Width,
+		opts.Height,
+		opts.Width,
+		opts.Height,
+		svgColor(opts.Background),
+		text.String(),
+	))
+}
+
+// Split text into lines of at most the given number of characters, breaking
+// only between words. Words longer than a line are kept on their own line.
+func wrapWords(text string, maxChars int) []string {
+	lines := []string{}
+	line := ""
+	for _, word := range strings.Fields(text) {
+		if line != "" && len([]rune(line))+1+len([]rune(word)) > maxChars {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// Get a color in the format used by SVG, e.g. #333333
+func svgColor(c color.Color) string {
+	r, g, b, _ := c.RGBA()
+
+	return fmt.Sprintf("#%02x%02x%02x", r>>8, g>>8, b>>8)
+}
+
+func escapeXMLText(s string) string {
+	var b bytes.Buffer
+	// Writing to a bytes.Buffer doesn't return errors
+	xml.EscapeText(&b, []byte(s))
+
+	return b.String()
+}
@@ -0,0 +1,172 @@
+package epub
+
+import (
+	"io/ioutil"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Matches @font-face rules in a stylesheet
+var cssFontFacePattern = regexp.MustCompile(`(?is)@font-face\s*\{[^}]*\}`)
+
+// Matches the url() references in a CSS rule, with the URL as the second or
+// third submatch depending on whether it's quoted
+var cssURLPattern = regexp.MustCompile(`(?i)url\(\s*(?:(["'])(.*?)["']|([^"')\s]+))\s*\)`)
+
+// AddCSSWithFonts adds a CSS file to the EPUB along with the fonts its
+// @font-face rules refer to, and returns a relative path to the CSS file that
+// can be used in EPUB sections in the format:
+// ../CSSFolderName/internalFilename
+//
+// Relative font URLs, such as url(fonts/foo.ttf), are resolved against the
+// location of the CSS source, and each font is added the same way as with
+// AddFont without an internal filename, using the filename from the URL without
+// any query or fragment. The URLs in the stored CSS file are rewritten to point
+// to the fonts in the EPUB. Fonts that have already been added from the same
+// source aren't added again, and data URLs are left as-is. URLs of fonts in
+// formats that aren't supported in EPUB files, such as the .eot fallbacks often
+// listed alongside other formats, are also left as-is, and those fonts aren't
+// added.
+//
+// If the CSS file or any of its fonts can't be retrieved, ErrRetrievingFile
+// will be returned, and if the filename of a font isn't valid,
+// ErrInvalidFilename will be returned. In either case nothing will be added.
+// The internal filename is handled the same way as for AddCSS.
+func (e *Epub) AddCSSWithFonts(cssSource string, internalFilename string) (string, error) {
+	// Retrieve the CSS file and check the fonts without locking the Epub, since
+	// they might need to be downloaded
+	client := e.lockedClient()
+	r, err := fetchMediaWithClient(e.fs, client, cssSource)
+	if err != nil {
+		return "", ErrRetrievingFile
+	}
+	defer func() {
+		if err := r.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", ErrRetrievingFile
+	}
+
+	// Make sure all of the fonts can be added before adding any of them
+	var fontURLs []string
+	fontSources := make(map[string]string)
+	for _, rule := range cssFontFacePattern.FindAllString(string(data), -1) {
+		for _, match := range cssURLPattern.FindAllStringSubmatch(rule, -1) {
+			fontURL := match[2] + match[3]
+			if _, ok := fontSources[fontURL]; ok || strings.HasPrefix(fontURL, dataURLPrefix) {
+				continue
+			}
+			fontSource, err := resolveCSSURL(cssSource, fontURL)
+			if err != nil {
+				return "", ErrRetrievingFile
+			}
+			filename := cssFontFilename(fontSource)
+			if extensionMediaTypes[strings.ToLower(filepath.Ext(filename))] == "" {
+				continue
+			}
+			if !isFilenameValid(filename) {
+				return "", ErrInvalidFilename
+			}
+			if !isMediaSourceValid(e.fs, client, fontSource) {
+				return "", ErrRetrievingFile
+			}
+			fontURLs = append(fontURLs, fontURL)
+			fontSources[fontURL] = fontSource
+		}
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	var addedFonts []string
+	fontPaths := make(map[string]string)
+	for _, fontURL := range fontURLs {
+		fontSource := fontSources[fontURL]
+		fontPath := ""
+		for filename, source := range e.fonts {
+			if source == fontSource {
+				fontPath = filepath.Join("..", FontFolderName, filename)
+			}
+		}
+		if fontPath == "" {
+			filename := mediaFilename(cssFontFilename(fontSource), "", e.fontFilenameFormat, e.fonts)
+			fontPath, err = e.addMedia(fontSource, filename, e.fontFilenameFormat, FontFolderName, e.fonts)
+			if err != nil {
+				e.removeFonts(addedFonts)
+				return "", err
+			}
+			addedFonts = append(addedFonts, filepath.Base(fontPath))
+		}
+		// The CSS files and sections are in sibling folders, so the path
+		// relative to the sections works for the CSS file as well
+		fontPaths[fontURL] = filepath.ToSlash(fontPath)
+	}
+
+	css := cssFontFacePattern.ReplaceAllStringFunc(string(data), func(rule string) string {
+		return cssURLPattern.ReplaceAllStringFunc(rule, func(u string) string {
+			match := cssURLPattern.FindStringSubmatch(u)
+			fontPath, ok := fontPaths[match[2]+match[3]]
+			if !ok {
+				return u
+			}
+			return `url("` + fontPath + `")`
+		})
+	})
+
+	internalFilename = mediaFilename(cssSource, internalFilename, e.cssFilenameFormat, e.css)
+	cssPath, err := e.addMediaFromBytes([]byte(css), internalFilename, e.cssFilenameFormat, CSSFolderName, e.css)
+	if err != nil {
+		e.removeFonts(addedFonts)
+		return "", err
+	}
+
+	return cssPath, nil
+}
+
+// Remove fonts that were added by AddCSSWithFonts if the CSS file can't be
+// added after all
+func (e *Epub) removeFonts(filenames []string) {
+	for _, filename := range filenames {
+		delete(e.fonts, filename)
+	}
+}
+
+// Get the filename of a font referenced by a stylesheet from its source,
+// leaving out the query and fragment if the source is a URL
+func cssFontFilename(fontSource string) string {
+	if !isLocalSource(fontSource) {
+		if u, err := url.Parse(fontSource); err == nil {
+			return path.Base(u.Path)
+		}
+	}
+
+	return filepath.Base(fontSource)
+}
+
+// Get the source of a file referenced by a URL in a stylesheet, resolving
+// relative URLs against the source of the stylesheet
+func resolveCSSURL(cssSource string, ref string) (string, error) {
+	refURL, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	if refURL.IsAbs() {
+		return ref, nil
+	}
+
+	cssURL, err := url.Parse(cssSource)
+	if err == nil && (cssURL.Scheme == "http" || cssURL.Scheme == "https") {
+		return cssURL.ResolveReference(refURL).String(), nil
+	}
+
+	// Otherwise the stylesheet is a local file. Queries and fragments, such as
+	// the ?#iefix used for old versions of Internet Explorer, aren't part of the
+	// path.
+	return filepath.Join(filepath.Dir(cssSource), filepath.FromSlash(path.Clean(refURL.Path))), nil
+}
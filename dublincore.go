@@ -0,0 +1,78 @@
+package epub
+
+import (
+	"strings"
+)
+
+// The Dublin Core elements that don't have a setter of their own, which are set
+// with SetDublinCore
+var dublinCoreElements = map[string]bool{
+	"contributor": true,
+	"coverage":    true,
+	"date":        true,
+	"description": true,
+	"format":      true,
+	"publisher":   true,
+	"relation":    true,
+	"type":        true,
+}
+
+// SetDublinCore sets a Dublin Core element of the metadata of the EPUB, for the
+// elements the library doesn't otherwise support, such as "coverage",
+// "publisher", or "type". The element may be given with or without the dc:
+// prefix, e.g. "dc:type" or "type", and the value is escaped when the EPUB is
+// written. Setting an element that was already set replaces its value, and an
+// empty value removes it.
+//
+// The elements that have setters of their own are passed on to them: "creator"
+// to SetAuthor, "identifier" to SetIdentifier, "language" to SetLang, "rights"
+// to SetRights, "source" to SetSource, and "title" to SetTitle, while "subject"
+// adds a subject with AddSubject since an EPUB can have several. If the element
+// isn't one of the fifteen Dublin Core elements, ErrInvalidDublinCoreElement
+// will be returned.
+func (e *Epub) SetDublinCore(element string, value string) error {
+	element = strings.TrimPrefix(element, "dc:")
+
+	switch element {
+	case "creator":
+		e.SetAuthor(value)
+		return nil
+	case "identifier":
+		e.SetIdentifier(value)
+		return nil
+	case "language":
+		return e.SetLang(value)
+	case "rights":
+		e.SetRights(value)
+		return nil
+	case "source":
+		e.SetSource(value)
+		return nil
+	case "subject":
+		e.AddSubject(value)
+		return nil
+	case "title":
+		e.SetTitle(value)
+		return nil
+	}
+	if !dublinCoreElements[element] {
+		return ErrInvalidDublinCoreElement
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.pkg.setDublinCore(element, value)
+
+	return nil
+}
+
+// DublinCore returns the value of a Dublin Core element set with SetDublinCore,
+// given with or without the dc: prefix, or an empty string if it isn't set. The
+// elements that have getters of their own, such as Title, aren't returned.
+func (e *Epub) DublinCore(element string) string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.pkg.dublinCore(strings.TrimPrefix(element, "dc:"))
+}
@@ -0,0 +1,152 @@
+package epub
+
+import (
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	encryptionFilename = "encryption.xml"
+	// The number of bytes at the start of a font file that are obfuscated
+	fontObfuscationLength = 1040
+	// The algorithm URI of the IDPF font obfuscation algorithm
+	// Spec: http://www.idpf.org/epub/301/spec/epub-ocf.html#fobfus-specifying
+	fontObfuscationAlgorithm = "http://www.idpf.org/2008/embedding"
+	xmlnsContainer           = "urn:oasis:names:tc:opendocument:xmlns:container"
+	xmlnsEnc                 = "http://www.w3.org/2001/04/xmlenc#"
+)
+
+// The encryption file (encryption.xml), which lists the obfuscated resources
+// Ex: <encryption xmlns="urn:oasis:names:tc:opendocument:xmlns:container" xmlns:enc="http://www.w3.org/2001/04/xmlenc#">...</encryption>
+type encryptionRoot struct {
+	XMLName       xml.Name                  `xml:"encryption"`
+	Xmlns         string                    `xml:"xmlns,attr"`
+	XmlnsEnc      string                    `xml:"xmlns:enc,attr"`
+	EncryptedData []encryptionEncryptedData `xml:"enc:EncryptedData"`
+}
+
+// An obfuscated resource
+// Ex: <enc:EncryptedData><enc:EncryptionMethod Algorithm="..."/><enc:CipherData>...</enc:CipherData></enc:EncryptedData>
+type encryptionEncryptedData struct {
+	EncryptionMethod encryptionMethod `xml:"enc:EncryptionMethod"`
+	CipherReference  cipherReference  `xml:"enc:CipherData>enc:CipherReference"`
+}
+
+type encryptionMethod struct {
+	Algorithm string `xml:"Algorithm,attr"`
+}
+
+type cipherReference struct {
+	URI string `xml:"URI,attr"`
+}
+
+// fontObfuscator obfuscates (or de-obfuscates) a font file as it's read, using
+// the IDPF font obfuscation algorithm
+//
+// Spec: http://www.idpf.org/epub/301/spec/epub-ocf.html#fobfus-keygen
+type fontObfuscator struct {
+	key    []byte
+	offset int
+	r      io.ReadCloser
+}
+
+// Constructor for fontObfuscator. The key is derived from the unique
+// identifier of the EPUB.
+func newFontObfuscator(r io.ReadCloser, identifier string) *fontObfuscator {
+	return &fontObfuscator{
+		key: fontObfuscationKey(identifier),
+		r:   r,
+	}
+}
+
+func (o *fontObfuscator) Read(p []byte) (int, error) {
+	n, err := o.r.Read(p)
+	for i := 0; i < n && o.offset < fontObfuscationLength; i++ {
+		p[i] ^= o.key[o.offset%len(o.key)]
+		o.offset++
+	}
+
+	return n, err
+}
+
+func (o *fontObfuscator) Close() error {
+	return o.r.Close()
+}
+
+// Whether the media file at the given path should be obfuscated. The path is
+// relative to the content folder, e.g. fonts/font.otf
+func (e *Epub) isObfuscated(mediaFolderName string, mediaFilename string) bool {
+	return e.obfuscated[path.Join(mediaFolderName, mediaFilename)]
+}
+
+// Get the font obfuscation key, which is the SHA-1 digest of the unique
+// identifier with all whitespace removed
+func fontObfuscationKey(identifier string) []byte {
+	identifier = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, identifier)
+	key := sha1.Sum([]byte(identifier))
+
+	return key[:]
+}
+
+// Write the encryption file (encryption.xml) listing the obfuscated resources
+// to the temporary directory. The file is only written if there are any
+// obfuscated resources, so as not to affect EPUBs without them.
+func (e *Epub) writeEncryptionFile(tempDir string) {
+	var obfuscatedPaths []string
+	for obfuscatedPath := range e.obfuscated {
+		obfuscatedPaths = append(obfuscatedPaths, obfuscatedPath)
+	}
+	if len(obfuscatedPaths) == 0 {
+		return
+	}
+	sort.Strings(obfuscatedPaths)
+
+	encryptionXML := &encryptionRoot{
+		Xmlns:    xmlnsContainer,
+		XmlnsEnc: xmlnsEnc,
+	}
+	for _, obfuscatedPath := range obfuscatedPaths {
+		encryptionXML.EncryptedData = append(encryptionXML.EncryptedData, encryptionEncryptedData{
+			EncryptionMethod: encryptionMethod{
+				Algorithm: fontObfuscationAlgorithm,
+			},
+			CipherReference: cipherReference{
+				// The path is relative to the root of the EPUB
+				URI: path.Join(e.contentFolder, obfuscatedPath),
+			},
+		})
+	}
+
+	encryptionFileContent, err := marshalXML(encryptionXML, "", e.minifyXML)
+	if err != nil {
+		panic(fmt.Sprintf(
+			"Error marshalling XML for encryption file: %s\n"+
+				"\tXML=%#v",
+			err,
+			encryptionXML))
+	}
+
+	// Add the xml header to the output
+	encryptionFileContent = append([]byte(xml.Header), encryptionFileContent...)
+	// It's generally nice to have files end with a newline
+	encryptionFileContent = append(encryptionFileContent, "\n"...)
+
+	encryptionFilePath := filepath.Join(tempDir, metaInfFolderName, encryptionFilename)
+	if err := afero.WriteFile(e.fs, encryptionFilePath, encryptionFileContent, filePermissions); err != nil {
+		panic(fmt.Sprintf("Error writing encryption file: %s", err))
+	}
+}
@@ -26,36 +26,307 @@ Basic usage:
 package epub
 
 import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"html"
+	"html/template"
+	"image"
+	// Register the image formats whose dimensions can be determined
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"github.com/spf13/afero"
+	"golang.org/x/text/language"
 )
 
 // ErrFilenameAlreadyUsed is thrown by AddCSS, AddFont, AddImage, or AddSection
-// if the same filename is used more than once
+// if the same filename is used more than once (see SetOnDuplicate)
 var ErrFilenameAlreadyUsed = errors.New("Filename already used")
 
-// ErrRetrievingFile is thrown by AddCSS, AddFont, or AddImage if there was a
-// problem retrieving the source file that was provided
+// ErrFileNotFound is thrown by FileContents if no section or media file with
+// the internal path has been added to the EPUB
+var ErrFileNotFound = errors.New("File not found")
+
+// ErrFilenameRequired is thrown by AddCSSFromBytes, AddFontFromBytes,
+// AddImageFromBytes, their io.Reader equivalents, or SetCoverFromBytes if no
+// internal filename is provided, since the filename is needed to determine the
+// media type
+var ErrFilenameRequired = errors.New("Internal filename is required")
+
+// ErrIndexOutOfRange is thrown by InsertSectionAtIndex if the index is outside
+// of the range of existing sections
+var ErrIndexOutOfRange = errors.New("Index out of range")
+
+// ErrInvalidCoverTemplate is thrown by SetCoverTemplate if the template can't
+// be parsed or doesn't generate well-formed XHTML
+var ErrInvalidCoverTemplate = errors.New("Invalid cover template")
+
+// ErrInvalidCompressionLevel is thrown by SetCompressionLevel if the level
+// isn't between 0 and 9, CompressionLevelDefault, or CompressionLevelStore
+var ErrInvalidCompressionLevel = errors.New("Invalid compression level")
+
+// ErrInvalidPackageFilename is thrown by SetPackageFilename if the filename
+// doesn't end in .opf or isn't a valid filename
+var ErrInvalidPackageFilename = errors.New("Invalid package filename")
+
+// ErrInvalidCollection is thrown by AddCollection or AddSubCollection if the
+// name is empty, the collection type isn't one of CollectionTypeSeries or
+// CollectionTypeSet, or the parent collection doesn't exist
+var ErrInvalidCollection = errors.New("Invalid collection")
+
+// ErrInvalidContentFolder is thrown by SetContentFolder if the folder name is
+// empty, isn't a valid filename, or would clash with the other files at the
+// root of the EPUB
+var ErrInvalidContentFolder = errors.New("Invalid content folder")
+
+// ErrInvalidDublinCoreElement is thrown by SetDublinCore if the element isn't
+// one of the Dublin Core elements
+var ErrInvalidDublinCoreElement = errors.New("Invalid Dublin Core element")
+
+// ErrInvalidDuplicateMode is thrown by SetOnDuplicate if the mode isn't one of
+// OnDuplicateError, OnDuplicateOverwrite, or OnDuplicateRename
+var ErrInvalidDuplicateMode = errors.New("Invalid duplicate mode")
+
+// ErrInvalidEpubType is thrown by AddSectionWithEpubType if the epub:type isn't
+// one of the types of the EPUB structural semantics vocabulary that can be used
+// for sections, such as "dedication" or "epigraph"
+var ErrInvalidEpubType = errors.New("Invalid epub:type")
+
+// ErrInvalidFilenameFormat is thrown by SetSectionFilenameFormat,
+// SetImageFilenameFormat, SetCSSFilenameFormat, or SetFontFilenameFormat if the
+// format doesn't contain exactly one integer verb, such as %04d
+var ErrInvalidFilenameFormat = errors.New("Invalid filename format")
+
+// ErrInvalidImage is thrown by SetSVGCover if the image hasn't been added or its
+// dimensions can't be determined, or by SetGeneratedCover if the dimensions are
+// negative
+var ErrInvalidImage = errors.New("Invalid image")
+
+// ErrInvalidLang is thrown by SetLang or AddLang if the language isn't a
+// well-formed BCP 47 language tag, such as "en" or "zh-Hant"
+var ErrInvalidLang = errors.New("Invalid language")
+
+// ErrInvalidMeta is thrown by AddMeta if the property or value is empty, or if
+// the property contains whitespace
+var ErrInvalidMeta = errors.New("Invalid meta")
+
+// ErrInvalidMediaType is thrown by AddAudio or AddVideo if the extension of the
+// file isn't one of a supported audio or video format
+var ErrInvalidMediaType = errors.New("Invalid media type")
+
+// ErrInvalidFilename is thrown by AddSection, AddImage, and the other methods
+// that add sections or media files if the internal filename isn't allowed in an
+// EPUB file, such as a path like ../image.png or a filename containing a
+// character that's reserved on common filesystems, e.g. a colon
+var ErrInvalidFilename = errors.New("Invalid filename")
+
+// ErrInvalidFixedLayout is thrown by SetFixedLayout if the width or height is
+// negative, or if only one of them is zero
+var ErrInvalidFixedLayout = errors.New("Invalid fixed layout")
+
+// ErrInvalidIdentifierScheme is thrown by SetIdentifierWithScheme if the
+// scheme isn't one of IdentifierSchemeDOI, IdentifierSchemeISBN, or
+// IdentifierSchemeUUID, or if an ISBN doesn't have 10 or 13 digits
+var ErrInvalidIdentifierScheme = errors.New("Invalid identifier scheme")
+
+// ErrInvalidLandmark is thrown by AddLandmark if no landmark type is provided
+var ErrInvalidLandmark = errors.New("Invalid landmark")
+
+// ErrInvalidPageMarker is thrown by AddPageMarker if the page name or anchor ID
+// is empty, or if the anchor ID is already used by another page marker in the
+// same section
+var ErrInvalidPageMarker = errors.New("Invalid page marker")
+
+// ErrInvalidMetadataDir is thrown by SetMetadataDir if the direction isn't one
+// of DirLtr or DirRtl
+var ErrInvalidMetadataDir = errors.New("Invalid metadata direction")
+
+// ErrInvalidPpd is thrown by SetPpd and SetPageProgressionDirection if the page
+// progression direction isn't one of PpdDefault, PpdLtr, or PpdRtl
+var ErrInvalidPpd = errors.New("Invalid page progression direction")
+
+// ErrInvalidPageSpread is thrown by SetPageSpread if the page spread isn't one
+// of PageSpreadCenter, PageSpreadLeft, or PageSpreadRight
+var ErrInvalidPageSpread = errors.New("Invalid page spread")
+
+// ErrInvalidRenditionFlow is thrown by SetRenditionFlow if the flow isn't one
+// of RenditionFlowAuto, RenditionFlowPaginated, RenditionFlowScrolledContinuous,
+// or RenditionFlowScrolledDoc
+var ErrInvalidRenditionFlow = errors.New("Invalid rendition flow")
+
+// ErrInvalidSpineAttribute is thrown by SetSpineAttribute if the name isn't a
+// valid XML attribute name or is an attribute that's set by other methods
+var ErrInvalidSpineAttribute = errors.New("Invalid spine attribute")
+
+// ErrInvalidSpineProperty is thrown by AddSectionWithSpineProperties if a
+// property isn't one of the properties EPUB 3 defines for the package spine
+var ErrInvalidSpineProperty = errors.New("Invalid spine property")
+
+// ErrInvalidUniqueIdentifierID is thrown by SetUniqueIdentifierID if the ID
+// isn't a valid XML ID or is already used by another element of the package
+// file
+var ErrInvalidUniqueIdentifierID = errors.New("Invalid unique identifier ID")
+
+// ErrInvalidVocabularyPrefix is thrown by AddVocabularyPrefix if the prefix
+// isn't a valid XML name without a colon, or if the URI isn't absolute
+var ErrInvalidVocabularyPrefix = errors.New("Invalid vocabulary prefix")
+
+// ErrInvalidVersion is thrown by SetVersion if the version isn't one of
+// EpubVersion2 or EpubVersion3
+var ErrInvalidVersion = errors.New("Invalid EPUB version")
+
+// ErrInvalidXML is thrown by AddSection, AddRawSection, or any of the other
+// functions that add a section if the section's XHTML isn't well-formed XML.
+// The returned error wraps ErrInvalidXML and describes the problem.
+var ErrInvalidXML = errors.New("Invalid XML")
+
+// ErrRawSection is thrown by AddScriptToSection if the section was added with
+// AddRawSection, since raw sections are written without any changes
+var ErrRawSection = errors.New("Section is raw")
+
+// ErrUnsupportedMediaType is thrown by AddImage, AddCSS, and the other methods
+// that add media files if the media type of the file can't be determined from
+// the extension of its internal filename, e.g. image.xyz, since every file in
+// the EPUB must have a media type
+var ErrUnsupportedMediaType = errors.New("Unsupported media type")
+
+// ErrRetrievingFile is thrown by AddCSS, AddFont, or AddImage (or their
+// io.Reader equivalents) if there was a problem retrieving the source file that
+// was provided
 var ErrRetrievingFile = errors.New("Error retrieving file from source")
 
+// ErrSectionNotFound is thrown by methods that take the internal filename of a
+// section if no section with that filename has been added
+var ErrSectionNotFound = errors.New("Section not found")
+
 // Folder names used for resources inside the EPUB
 const (
-	CSSFolderName   = "css"
-	FontFolderName  = "fonts"
-	ImageFolderName = "images"
+	AudioFolderName      = "audio"
+	CSSFolderName        = "css"
+	FontFolderName       = "fonts"
+	ImageFolderName      = "images"
+	JavaScriptFolderName = "js"
+	VideoFolderName      = "video"
+)
+
+// EPUB versions that can be used with SetVersion
+const (
+	// EPUB 2.0.1, for compatibility with older reading systems. The EPUB will
+	// only contain the EPUB 2 table of contents (toc.ncx), and EPUB 3 features
+	// such as page spreads will be left out.
+	EpubVersion2 = "2.0"
+	// EPUB 3, the default
+	EpubVersion3 = "3.0"
+)
+
+// Compression levels that can be used with SetCompressionLevel, in addition to
+// the levels from 1 (fastest) to 9 (smallest)
+const (
+	// The default compression level, which balances speed and size
+	CompressionLevelDefault = flate.DefaultCompression
+	// Files are compressed using the deflate format but aren't actually
+	// compressed
+	CompressionLevelNone = flate.NoCompression
+	// Files are stored in the EPUB without using the deflate format at all
+	CompressionLevelStore = -3
+)
+
+// Collection types that can be used with AddCollection and AddSubCollection
+const (
+	// A sequence of related works that are meant to be read in order, such as a
+	// trilogy
+	CollectionTypeSeries = "series"
+	// A group of related works, such as a boxed set
+	CollectionTypeSet = "set"
+)
+
+// Identifier schemes that can be used with SetIdentifierWithScheme
+const (
+	// Digital Object Identifier, e.g. 10.1000/182
+	IdentifierSchemeDOI = "DOI"
+	// International Standard Book Number, either ISBN-10 or ISBN-13, e.g.
+	// 978-3-16-148410-0
+	IdentifierSchemeISBN = "ISBN"
+	// Universally Unique Identifier as a URN, e.g.
+	// urn:uuid:fe93046f-af57-475a-a0cb-a0d4bc99ba6d
+	IdentifierSchemeUUID = "UUID"
+)
+
+// Modes that can be used with SetOnDuplicate, which control what happens when a
+// media file (CSS, font, image, etc) is added with an internal filename that's
+// already used by a file of the same kind
+const (
+	// ErrFilenameAlreadyUsed is returned and the file isn't added (the default)
+	OnDuplicateError = "error"
+	// The file replaces the file that was added with the same filename
+	OnDuplicateOverwrite = "overwrite"
+	// The file is added with a numeric suffix before the extension, e.g.
+	// cover-2.png, and the path with the new filename is returned
+	OnDuplicateRename = "rename"
+)
+
+// Page spread values used by SetPageSpread. These control which side of a
+// two-page spread a section is placed on when rendered as a synthetic spread,
+// which is mostly useful for fixed-layout content such as comics.
+const (
+	PageSpreadCenter = "center"
+	PageSpreadLeft   = "left"
+	PageSpreadRight  = "right"
+)
+
+// Text directions that can be used with SetMetadataDir
+const (
+	DirLtr = "ltr"
+	DirRtl = "rtl"
+)
+
+// Page progression directions that can be used with SetPpd
+const (
+	// Lets the reading system choose the direction
+	PpdDefault = "default"
+	PpdLtr     = "ltr"
+	PpdRtl     = "rtl"
+)
+
+// Ways the content can flow that can be used with SetRenditionFlow
+const (
+	// Lets the reading system choose how the content flows
+	RenditionFlowAuto = "auto"
+	// Dynamically paginates the content
+	RenditionFlowPaginated = "paginated"
+	// Scrolls through all of the sections as one continuous document
+	RenditionFlowScrolledContinuous = "scrolled-continuous"
+	// Scrolls through each section as a separate document
+	RenditionFlowScrolledDoc = "scrolled-doc"
 )
 
 const (
-	cssFileFormat          = "css%04d%s"
-	defaultCoverBody       = `<img src="%s" alt="Cover Image" />`
+	audioFileFormat     = "audio%04d%s"
+	cssFileFormat       = "css%04d%s"
+	dataURLPrefix       = "data:"
+	defaultCoverAltText = "Cover Image"
+	defaultCoverBody    = `<img src="%s" alt="%s" />`
+	// The cover is scaled to fill the page while keeping its aspect ratio
+	defaultCoverSVGBody    = `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" version="1.1" width="100%%" height="100%%" viewBox="0 0 %d %d" preserveAspectRatio="xMidYMid meet"><image width="%d" height="%d" xlink:href="%s" /></svg>`
 	defaultCoverCSSContent = `body {
   background-color: #FFFFFF;
   margin-bottom: 0px;
@@ -76,44 +347,365 @@ img {
 	defaultEpubLang           = "en"
 	fontFileFormat            = "font%04d%s"
 	imageFileFormat           = "image%04d%s"
-	sectionFileFormat         = "section%04d.xhtml"
-	urnUUIDPrefix             = "urn:uuid:"
+	// Characters that aren't allowed in file names in EPUB files, which are
+	// reserved on common filesystems, along with the path separators
+	invalidFilenameChars = `"*:<>?/\`
+	javaScriptFileFormat = "script%04d%s"
+	// The maximum length of file names in EPUB files in bytes
+	maxFilenameLength = 255
+	// ONIX code list 5 identifier types
+	// Spec: https://ns.editeur.org/onix/en/5
+	onixIdentifierTypeDOI    = "06"
+	onixIdentifierTypeISBN10 = "02"
+	onixIdentifierTypeISBN13 = "15"
+	onixIdentifierTypeURN    = "22"
+	pageSpreadPropertyPrefix = "rendition:page-spread-"
+	// EPUB 3 also defines page spreads without the rendition prefix
+	unprefixedPageSpreadProperty = "page-spread-"
+	sectionFileFormat            = "section%04d.xhtml"
+	// The number of bytes of a file considered when determining its media type
+	// from its content (see http.DetectContentType)
+	sniffLen        = 512
+	urnUUIDPrefix   = "urn:uuid:"
+	videoFileFormat = "video%04d%s"
 )
 
-// Epub implements an EPUB file.
+// The properties that can be set on sections in the package spine
+// Spec: https://www.w3.org/TR/epub-33/#app-itemref-properties-vocab
+var validSpineProperties = map[string]bool{
+	"page-spread-left":                          true,
+	"page-spread-right":                         true,
+	"rendition:align-x-center":                  true,
+	"rendition:flow-auto":                       true,
+	"rendition:flow-paginated":                  true,
+	"rendition:flow-scrolled-continuous":        true,
+	"rendition:flow-scrolled-doc":               true,
+	"rendition:layout-pre-paginated":            true,
+	"rendition:layout-reflowable":               true,
+	"rendition:orientation-auto":                true,
+	"rendition:orientation-landscape":           true,
+	"rendition:orientation-portrait":            true,
+	pageSpreadPropertyPrefix + PageSpreadCenter: true,
+	pageSpreadPropertyPrefix + PageSpreadLeft:   true,
+	pageSpreadPropertyPrefix + PageSpreadRight:  true,
+	"rendition:spread-auto":                     true,
+	"rendition:spread-both":                     true,
+	"rendition:spread-landscape":                true,
+	"rendition:spread-none":                     true,
+}
+
+// The types of the EPUB structural semantics vocabulary that can be set on the
+// <body> of sections, i.e. the document partitions, divisions, sections, and
+// components
+// Spec: https://www.w3.org/TR/epub-ssv-11/
+var validSectionEpubTypes = map[string]bool{
+	"abstract":         true,
+	"acknowledgments":  true,
+	"afterword":        true,
+	"appendix":         true,
+	"backmatter":       true,
+	"bibliography":     true,
+	"bodymatter":       true,
+	"chapter":          true,
+	"colophon":         true,
+	"conclusion":       true,
+	"contributors":     true,
+	"copyright-page":   true,
+	"cover":            true,
+	"credits":          true,
+	"dedication":       true,
+	"division":         true,
+	"endnotes":         true,
+	"epigraph":         true,
+	"epilogue":         true,
+	"errata":           true,
+	"foreword":         true,
+	"frontmatter":      true,
+	"glossary":         true,
+	"halftitlepage":    true,
+	"imprimatur":       true,
+	"imprint":          true,
+	"index":            true,
+	"introduction":     true,
+	"keywords":         true,
+	"loa":              true,
+	"loi":              true,
+	"lot":              true,
+	"lov":              true,
+	"other-credits":    true,
+	"part":             true,
+	"preamble":         true,
+	"preface":          true,
+	"prologue":         true,
+	"revision-history": true,
+	"seriespage":       true,
+	"titlepage":        true,
+	"volume":           true,
+}
+
+// Matches the <body> element of an HTML document, capturing its contents
+var htmlBodyPattern = regexp.MustCompile(`(?is)<body(?:\s[^>]*)?>(.*)</body\s*>`)
+
+// Matches valid XML IDs, which can't contain colons or start with a digit
+// Spec: https://www.w3.org/TR/xml-names/#NT-NCName
+var xmlIDPattern = regexp.MustCompile(`^[\p{L}_][\p{L}\p{N}._\-]*$`)
+
+// Matches valid XML attribute names, which are XML IDs optionally preceded by a
+// namespace prefix, e.g. ibooks:version
+var xmlAttrNamePattern = regexp.MustCompile(`^(?:[\p{L}_][\p{L}\p{N}._\-]*:)?[\p{L}_][\p{L}\p{N}._\-]*$`)
+
+// Matches well-formed BCP 47 language tags, e.g. fr, pt-BR, or zh-Hant-TW. Tags
+// are only checked against the syntax, not the registry of subtags.
+// Spec: https://www.rfc-editor.org/rfc/rfc5646#section-2.1
+var langTagPattern = regexp.MustCompile(`(?i)^(?:` +
+	// Language, with optional extended language subtags
+	`(?:[a-z]{2,3}(?:-[a-z]{3}){0,3}|[a-z]{4,8})` +
+	// Script
+	`(?:-[a-z]{4})?` +
+	// Region
+	`(?:-(?:[a-z]{2}|[0-9]{3}))?` +
+	// Variants
+	`(?:-(?:[a-z0-9]{5,8}|[0-9][a-z0-9]{3}))*` +
+	// Extensions
+	`(?:-[0-9a-wyz](?:-[a-z0-9]{2,8})+)*` +
+	// Private use
+	`(?:-x(?:-[a-z0-9]{1,8})+)?` +
+	`|x(?:-[a-z0-9]{1,8})+)$`)
+
+// Matches the verbs of a printf-style format, including %%
+var formatVerbPattern = regexp.MustCompile(`%[-+# 0]*[0-9]*(?:\.[0-9]*)?(.)`)
+
+// Epub implements an EPUB file. Its methods are safe to call from multiple
+// goroutines at once.
 type Epub struct {
+	// schema.org accessibility features, such as "tableOfContents"
+	accessibilityFeatures []string
+	// A human-readable description of the accessibility of the EPUB
+	accessibilitySummary string
+	// The key is the audio filename, the value is the audio source
+	audios map[string]string
 	author string
-	cover  *epubCover
+	// Used to generate the body of the cover page, if set
+	coverTemplate *template.Template
+	// Collections the EPUB belongs to other than the series, in the order they
+	// were added
+	collections []epubCollection
+	// The compression level of the files in the EPUB
+	compressionLevel int
+	// The folder containing the package file and all other content
+	contentFolder string
+	// The filename of the package file within the content folder
+	packageFilename string
+	cover           *epubCover
 	// The key is the css filename, the value is the css source
 	css map[string]string
+	// The formats of the filenames generated for CSS files, fonts, images, and
+	// sections
+	cssFilenameFormat     string
+	fontFilenameFormat    string
+	imageFilenameFormat   string
+	sectionFilenameFormat string
+	// Whether to write the EPUB so that it's byte-for-byte identical each time
+	deterministic bool
+	// The size of the viewport of fixed-layout EPUBs, or zero if the EPUB is
+	// reflowable
+	fixedLayoutHeight int
+	fixedLayoutWidth  int
 	// The key is the font filename, the value is the font source
-	fonts      map[string]string
-	fs         afero.Fs
+	fonts map[string]string
+	fs    afero.Fs
+	// The software that produced the EPUB
+	generator string
+	// The HTTP client used to retrieve media files from URLs, or nil to use
+	// http.DefaultClient
+	httpClient *http.Client
 	identifier string
+	// The scheme of the identifier, if one was set
+	identifierScheme string
 	// The key is the image filename, the value is the image source
 	images map[string]string
+	// The key is the image filename, the value is the alt text of the image
+	imageAltTexts map[string]string
+	// The key is the JavaScript filename, the value is the JavaScript source
+	javaScripts map[string]string
+	// The paths of the resources to obfuscate, relative to the content folder
+	obfuscated map[string]bool
+	// Media types that override the ones determined from the extensions of the
+	// filenames, by path relative to the content folder
+	mediaTypes map[string]string
+	// The contents of the media files added from memory rather than from a
+	// source, by path relative to the content folder. Their sources are empty.
+	mediaData map[string][]byte
+	// The key is the video filename, the value is the video source
+	videos map[string]string
+	// What to do when a media file is added with a filename that's already used
+	onDuplicate string
+	// Landmarks for the EPUB v3 TOC
+	landmarks []epubLandmark
 	// Language
 	lang string
+	// The language of the generated text, such as the TOC heading
+	locale language.Tag
+	// Languages other than the primary language, e.g. for bilingual editions
+	additionalLangs []string
+	// The language and base direction of the text of the metadata
+	metadataLang string
+	metadataDir  string
 	// Page progression direction
 	ppd string
+	// How the content flows (see SetRenditionFlow)
+	renditionFlow string
 	// The package file (package.opf)
 	pkg      *pkg
 	sections []epubSection
-	title    string
+	// Copyright or licensing statement
+	rights string
+	// The publication the EPUB is derived from, such as the print edition
+	source string
+	// Subjects (genres, keywords, etc) in the order they were added
+	subjects []string
+	// Prefixes of the vocabularies used by meta properties, in the order they
+	// were added
+	vocabularyPrefixes []epubVocabularyPrefix
+	// Whether to sanitize the bodies of sections when they're added
+	sanitizeHTML bool
+	// Whether to write the generated XML files without indentation
+	minifyXML bool
+	// Whether to include the EPUB 2 TOC file (toc.ncx) in EPUB 3 files
+	includeNCX bool
+	// The number of levels of sub-sections included in the TOC, or 0 for all
+	tocDepth int
+	// The lowest level of headings within sections added to the TOC, or 0 if
+	// they aren't added
+	tocHeadingLevel int
+	// TOC files written as-is instead of the generated ones, if set
+	navDocument string
+	ncxDocument string
+	// Series the EPUB belongs to, and its position in the series
+	series      string
+	seriesIndex float64
+	title       string
 	// Table of contents
 	toc *toc
+	// Guards the Epub so that it can be used by multiple goroutines at once
+	mutex sync.Mutex
+	// Whether to verify the EPUB file after writing it
+	verifyAfterWrite bool
+	// Whether to check the links in the sections before writing the EPUB
+	checkLinksOnWrite bool
+	// Called as each file is added to the EPUB file by Write
+	writeProgress func(current, total int)
+	// The total size of the files above which Write builds the EPUB file in a
+	// temp file on the spool filesystem, or 0 to never do so
+	spoolThreshold int64
+	// The filesystem of the temp file, or nil to use the OS filesystem
+	spoolFs afero.Fs
+	// Local media files that Write adds to the EPUB file straight from their
+	// sources, by their paths within the EPUB
+	streamedFiles map[string]epubStreamedFile
+	// EPUB version
+	version string
+}
+
+// ImageOptions holds optional settings for an image added with
+// AddImageWithOptions.
+type ImageOptions struct {
+	// A text alternative to the image for readers who can't see it. It's used
+	// for the cover page if the image is used as the cover (see SetCover), and
+	// can be retrieved with ImageAltText for use in sections.
+	AltText string
+	// The media type of the image, such as "image/jpeg", which overrides the
+	// media type determined from the extension of the internal filename, e.g.
+	// for images without an extension. It must be the media type of a GIF,
+	// JPEG, PNG, SVG, or WebP image; otherwise ErrUnsupportedMediaType will be
+	// returned.
+	MediaType string
+}
+
+// ManifestItem describes a file listed in the manifest of the package file, as
+// returned by Manifest.
+type ManifestItem struct {
+	// The ID of the item, which is unique within the manifest
+	ID string
+	// The path of the file relative to the package file, such as
+	// "images/cover.png"
+	Href      string
+	MediaType string
+	// Space-separated properties of the item, such as "cover-image" or "nav"
+	Properties string
+}
+
+// SectionInfo describes a section that has been added to the EPUB, as
+// returned by Sections.
+type SectionInfo struct {
+	// The internal filename of the section
+	Filename string
+	// The zero-based position of the section in the reading order
+	Index int
+	// Whether the section is part of the default reading order (see
+	// AddNonLinearSection)
+	Linear bool
+	// The internal filename of the parent section, if this is a sub-section
+	ParentFilename string
+	// The title of the section
+	Title string
 }
 
 type epubCover struct {
 	cssFilename   string
-	cssTempFile   string
 	imageFilename string
 	xhtmlFilename string
+	// The dimensions of the cover image, or zero if they're unknown
+	width  int
+	height int
+}
+
+type epubLandmark struct {
+	epubType string
+	target   string
+	title    string
+}
+
+type epubCollection struct {
+	id             string
+	name           string
+	collectionType string
+	position       float64
+	// The ID of the collection this collection is nested within, if any
+	parentID string
+}
+
+type epubStreamedFile struct {
+	// Whether the file is a font that needs to be obfuscated
+	obfuscated bool
+	source     string
+}
+
+type epubVocabularyPrefix struct {
+	prefix string
+	uri    string
+}
+
+type epubPageMarker struct {
+	anchorID string
+	pageName string
 }
 
 type epubSection struct {
 	filename string
-	xhtml    *xhtml
+	// The SMIL document synchronizing audio with the section, if any
+	mediaOverlay string
+	// The title shown in the TOC, if it differs from the title of the section
+	navTitle string
+	// Whether the section is excluded from the default reading order
+	nonLinear bool
+	// Page breaks of the print edition within the section
+	pageMarkers []epubPageMarker
+	// The internal filename of the parent section, if this is a sub-section
+	parentFilename string
+	// Properties of the section's <itemref> in the package spine
+	spineProperties []string
+	xhtml           *xhtml
 }
 
 // NewEpub returns a new Epub.
@@ -121,20 +713,36 @@ func NewEpub(title string) *Epub {
 	e := &Epub{}
 	e.cover = &epubCover{
 		cssFilename:   "",
-		cssTempFile:   "",
 		imageFilename: "",
 		xhtmlFilename: "",
 	}
+	e.audios = make(map[string]string)
+	e.compressionLevel = CompressionLevelDefault
+	e.contentFolder = contentFolderName
+	e.packageFilename = pkgFilename
 	e.css = make(map[string]string)
+	e.cssFilenameFormat = cssFileFormat
+	e.fontFilenameFormat = fontFileFormat
+	e.imageFilenameFormat = imageFileFormat
+	e.includeNCX = true
+	e.sectionFilenameFormat = sectionFileFormat
 	e.fonts = make(map[string]string)
 	e.fs = afero.NewOsFs()
 	e.images = make(map[string]string)
+	e.imageAltTexts = make(map[string]string)
+	e.javaScripts = make(map[string]string)
+	e.obfuscated = make(map[string]bool)
+	e.mediaTypes = make(map[string]string)
+	e.mediaData = make(map[string][]byte)
+	e.onDuplicate = OnDuplicateError
 	e.pkg = newPackage()
 	e.toc = newToc()
+	e.videos = make(map[string]string)
 	// Set minimal required attributes
 	e.SetIdentifier(urnUUIDPrefix + uuid.New().String())
 	e.SetLang(defaultEpubLang)
 	e.SetTitle(title)
+	e.SetVersion(EpubVersion3)
 
 	return e
 }
@@ -151,6 +759,116 @@ func NewEpubWithFs(title string, fs afero.Fs) *Epub {
 	return e
 }
 
+// NewEpubFromTemplate returns a new Epub with the given title that starts from
+// another EPUB used as a template, such as one set up with a publisher's
+// stylesheets, fonts, language, rights statement, and settings. Everything is
+// copied from the template the same way as Clone, except for what belongs to a
+// particular book: the new EPUB has no sections, landmarks, or cover, its title
+// isn't sorted differently (see SetTitleFileAs), and it gets a new unique
+// identifier. The new EPUB can be changed without changing the template, and
+// vice versa.
+func NewEpubFromTemplate(title string, tmpl *Epub) *Epub {
+	e := tmpl.Clone()
+
+	e.removeCover("")
+	e.sections = nil
+	e.landmarks = nil
+	e.setIdentifier(urnUUIDPrefix + uuid.New().String())
+	e.pkg.setTitleFileAs("")
+	e.SetTitle(title)
+
+	return e
+}
+
+// AddAccessibilityFeature adds a schema.org accessibility feature of the EPUB,
+// such as "tableOfContents", "alternativeText", or "readingOrder", which is
+// written to the package file as a schema:accessibilityFeature meta element.
+// Once any accessibility metadata has been set, the access modes of the EPUB
+// ("textual", "visual", and "auditory") are added based on its content. Empty
+// and duplicate features are ignored.
+//
+// See https://www.w3.org/2021/a11y-discov-vocab/latest/ for the list of
+// features.
+func (e *Epub) AddAccessibilityFeature(feature string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if feature == "" {
+		return
+	}
+	for _, f := range e.accessibilityFeatures {
+		if f == feature {
+			return
+		}
+	}
+	e.accessibilityFeatures = append(e.accessibilityFeatures, feature)
+}
+
+// AddAudio adds an audio file to the EPUB and returns a relative path to the
+// audio file that can be used in EPUB sections in the format:
+// ../AudioFolderName/internalFilename
+//
+// The audio source should either be a URL or a path to a local file; in either
+// case, the audio file will be retrieved and stored in the EPUB. The file must
+// be MP3, AAC (.m4a), or Ogg; its format is determined by the extension of the
+// internal filename, or of the source if no filename is provided. If it's
+// another format, ErrInvalidMediaType will be returned.
+//
+// The internal filename will be used when storing the audio file in the EPUB
+// and must be unique among all audio files. If the same filename is used more
+// than once, ErrFilenameAlreadyUsed will be returned. The internal filename is
+// optional; if no filename is provided, one will be generated.
+func (e *Epub) AddAudio(source string, internalFilename string) (string, error) {
+	if !hasMediaTypePrefix(source, internalFilename, mediaTypeAudioPrefix) {
+		return "", ErrInvalidMediaType
+	}
+	// Check the source without locking the Epub, since that can mean
+	// downloading it
+	if err := e.checkMediaSource(source); err != nil {
+		return "", err
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.addMedia(source, internalFilename, audioFileFormat, AudioFolderName, e.audios)
+}
+
+// AddCollection adds a collection the EPUB belongs to, such as a boxed set,
+// and returns the ID of the collection, which can be used to nest other
+// collections within it with AddSubCollection. The collection type should be
+// CollectionTypeSet or CollectionTypeSeries, or empty if it's neither; the
+// position is the position of the EPUB in the collection, or 0 if it doesn't
+// have one. Collections are written as EPUB 3 belongs-to-collection meta
+// elements, so they're left out of EPUB 2 files.
+//
+// For a single series, SetSeries is simpler and is also understood by Calibre.
+//
+// If the name is empty or the collection type isn't valid, ErrInvalidCollection
+// will be returned.
+func (e *Epub) AddCollection(name string, collectionType string, position float64) (string, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.addCollection("", name, collectionType, position)
+}
+
+// AddSubCollection adds a collection nested within a collection that has
+// already been added, such as a trilogy that's part of a larger set, and
+// returns the ID of the collection. The parent ID must be an ID returned by
+// AddCollection or AddSubCollection; otherwise ErrInvalidCollection will be
+// returned. The remaining parameters are the same as for AddCollection.
+func (e *Epub) AddSubCollection(parentID string, name string, collectionType string, position float64) (string, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.collectionIndex(parentID) == -1 {
+		return "", ErrInvalidCollection
+	}
+
+	return e.addCollection(parentID, name, collectionType, position)
+}
+
 // AddCSS adds a CSS file to the EPUB and returns a relative path to the CSS
 // file that can be used in EPUB sections in the format:
 // ../CSSFolderName/internalFilename
@@ -163,7 +881,44 @@ func NewEpubWithFs(title string, fs afero.Fs) *Epub {
 // than once, ErrFilenameAlreadyUsed will be returned. The internal filename is
 // optional; if no filename is provided, one will be generated.
 func (e *Epub) AddCSS(source string, internalFilename string) (string, error) {
-	return e.addMedia(source, internalFilename, cssFileFormat, CSSFolderName, e.css)
+	// Check the source without locking the Epub, since that can mean
+	// downloading it
+	if err := e.checkMediaSource(source); err != nil {
+		return "", err
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.addMedia(source, internalFilename, e.cssFilenameFormat, CSSFolderName, e.css)
+}
+
+// AddCSSFromBytes adds a CSS file to the EPUB from the provided data and
+// returns a relative path to the CSS file that can be used in EPUB sections in
+// the format:
+// ../CSSFolderName/internalFilename
+//
+// The internal filename will be used when storing the CSS file in the EPUB and
+// must be unique among all CSS files. Since the media type of the file is
+// determined by the extension of the internal filename, it is required; if no
+// filename is provided, ErrFilenameRequired will be returned. If the same
+// filename is used more than once, ErrFilenameAlreadyUsed will be returned.
+func (e *Epub) AddCSSFromBytes(data []byte, internalFilename string) (string, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.addMediaFromBytes(data, internalFilename, e.cssFilenameFormat, CSSFolderName, e.css)
+}
+
+// AddCSSFromReader adds a CSS file to the EPUB by reading its contents from
+// the provided reader. It otherwise behaves the same as AddCSSFromBytes.
+func (e *Epub) AddCSSFromReader(r io.Reader, internalFilename string) (string, error) {
+	data, err := readMediaFromReader(r, internalFilename)
+	if err != nil {
+		return "", err
+	}
+
+	return e.AddCSSFromBytes(data, internalFilename)
 }
 
 // AddFont adds a font file to the EPUB and returns a relative path to the font
@@ -178,7 +933,103 @@ func (e *Epub) AddCSS(source string, internalFilename string) (string, error) {
 // than once, ErrFilenameAlreadyUsed will be returned. The internal filename is
 // optional; if no filename is provided, one will be generated.
 func (e *Epub) AddFont(source string, internalFilename string) (string, error) {
-	return e.addMedia(source, internalFilename, fontFileFormat, FontFolderName, e.fonts)
+	// Check the source without locking the Epub, since that can mean
+	// downloading it
+	if err := e.checkMediaSource(source); err != nil {
+		return "", err
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.addMedia(source, internalFilename, e.fontFilenameFormat, FontFolderName, e.fonts)
+}
+
+// AddFontFromBytes adds a font file to the EPUB from the provided data and
+// returns a relative path to the font file that can be used in EPUB sections in
+// the format:
+// ../FontFolderName/internalFilename
+//
+// The internal filename will be used when storing the font file in the EPUB
+// and must be unique among all font files. Since the media type of the file is
+// determined by the extension of the internal filename, it is required; if no
+// filename is provided, ErrFilenameRequired will be returned. If the same
+// filename is used more than once, ErrFilenameAlreadyUsed will be returned.
+func (e *Epub) AddFontFromBytes(data []byte, internalFilename string) (string, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.addMediaFromBytes(data, internalFilename, e.fontFilenameFormat, FontFolderName, e.fonts)
+}
+
+// AddFontFromReader adds a font file to the EPUB by reading its contents from
+// the provided reader. It otherwise behaves the same as AddFontFromBytes.
+func (e *Epub) AddFontFromReader(r io.Reader, internalFilename string) (string, error) {
+	data, err := readMediaFromReader(r, internalFilename)
+	if err != nil {
+		return "", err
+	}
+
+	return e.AddFontFromBytes(data, internalFilename)
+}
+
+// AddObfuscatedFont adds a font file to the EPUB the same way as AddFont, but
+// obfuscates the font when the EPUB is written. This is required by the
+// licenses of some fonts in order to embed them.
+//
+// The font is obfuscated using the IDPF font obfuscation algorithm, keyed off
+// the unique identifier of the EPUB (see SetIdentifier), and listed in the
+// encryption file (META-INF/encryption.xml) so that reading systems can
+// de-obfuscate it.
+//
+// Spec: http://www.idpf.org/epub/301/spec/epub-ocf.html#font-obfuscation
+func (e *Epub) AddObfuscatedFont(source string, internalFilename string) (string, error) {
+	// Check the source without locking the Epub, since that can mean
+	// downloading it
+	if err := e.checkMediaSource(source); err != nil {
+		return "", err
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	fontPath, err := e.addMedia(source, internalFilename, e.fontFilenameFormat, FontFolderName, e.fonts)
+	if err != nil {
+		return "", err
+	}
+	e.obfuscated[path.Join(FontFolderName, filepath.Base(fontPath))] = true
+
+	return fontPath, nil
+}
+
+// AddVideo adds a video file to the EPUB and returns a relative path to the
+// video file that can be used in EPUB sections in the format:
+// ../VideoFolderName/internalFilename
+//
+// The video source should either be a URL or a path to a local file; in either
+// case, the video file will be retrieved and stored in the EPUB. The file must
+// be MP4 (.mp4 or .m4v) or WebM; its format is determined by the extension of
+// the internal filename, or of the source if no filename is provided. If it's
+// another format, ErrInvalidMediaType will be returned.
+//
+// The internal filename will be used when storing the video file in the EPUB
+// and must be unique among all video files. If the same filename is used more
+// than once, ErrFilenameAlreadyUsed will be returned. The internal filename is
+// optional; if no filename is provided, one will be generated.
+func (e *Epub) AddVideo(source string, internalFilename string) (string, error) {
+	if !hasMediaTypePrefix(source, internalFilename, mediaTypeVideoPrefix) {
+		return "", ErrInvalidMediaType
+	}
+	// Check the source without locking the Epub, since that can mean
+	// downloading it
+	if err := e.checkMediaSource(source); err != nil {
+		return "", err
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.addMedia(source, internalFilename, videoFileFormat, VideoFolderName, e.videos)
 }
 
 // AddImage adds an image to the EPUB and returns a relative path to the image
@@ -192,8 +1043,156 @@ func (e *Epub) AddFont(source string, internalFilename string) (string, error) {
 // and must be unique among all image files. If the same filename is used more
 // than once, ErrFilenameAlreadyUsed will be returned. The internal filename is
 // optional; if no filename is provided, one will be generated.
+//
+// The media type of the image is determined by the extension of the internal
+// filename, or of the source if no filename is provided. If the extension isn't
+// one of a known media type, e.g. for a PNG image named image.dat, it's
+// determined from the content of the image instead; if the content isn't a
+// GIF, JPEG, PNG, or WebP image, ErrUnsupportedMediaType will be returned.
 func (e *Epub) AddImage(source string, imageFilename string) (string, error) {
-	return e.addMedia(source, imageFilename, imageFileFormat, ImageFolderName, e.images)
+	// Check the source and determine the media type without locking the Epub,
+	// since that can mean downloading the image
+	client := e.lockedClient()
+	if !isMediaSourceValid(e.fs, client, source) {
+		return "", ErrRetrievingFile
+	}
+	mediaType := sniffImageSourceMediaType(e.fs, client, source, imageFilename)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.addMediaFile(source, nil, imageFilename, mediaType, e.imageFilenameFormat, ImageFolderName, e.images)
+}
+
+// AddImageWithOptions adds an image to the EPUB the same way as AddImage, along
+// with the given options, such as the alt text of the image.
+func (e *Epub) AddImageWithOptions(source string, imageFilename string, opts ImageOptions) (string, error) {
+	if opts.MediaType != "" && !isImageMediaType(opts.MediaType) {
+		return "", ErrUnsupportedMediaType
+	}
+
+	// Check the source and determine the media type without locking the Epub,
+	// since that can mean downloading the image
+	client := e.lockedClient()
+	if !isMediaSourceValid(e.fs, client, source) {
+		return "", ErrRetrievingFile
+	}
+	mediaType := opts.MediaType
+	if mediaType == "" {
+		mediaType = sniffImageSourceMediaType(e.fs, client, source, imageFilename)
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	imagePath, err := e.addMediaFile(source, nil, imageFilename, mediaType, e.imageFilenameFormat, ImageFolderName, e.images)
+	if err != nil {
+		return "", err
+	}
+	if opts.AltText != "" {
+		e.imageAltTexts[filepath.Base(imagePath)] = opts.AltText
+	} else {
+		delete(e.imageAltTexts, filepath.Base(imagePath))
+	}
+
+	return imagePath, nil
+}
+
+// AddImageFromBytes adds an image to the EPUB from the provided data and
+// returns a relative path to the image file that can be used in EPUB sections
+// in the format:
+// ../ImageFolderName/internalFilename
+//
+// The internal filename will be used when storing the image file in the EPUB
+// and must be unique among all image files. Since the media type of the image
+// is determined by the extension of the internal filename, it is required; if
+// no filename is provided, ErrFilenameRequired will be returned. If the same
+// filename is used more than once, ErrFilenameAlreadyUsed will be returned. If
+// the extension isn't one of a known media type, the media type is determined
+// from the data the same way as AddImage.
+func (e *Epub) AddImageFromBytes(data []byte, internalFilename string) (string, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.addImageFromBytes(data, internalFilename)
+}
+
+// AddImageFromReader adds an image to the EPUB by reading its contents from
+// the provided reader. It otherwise behaves the same as AddImageFromBytes.
+func (e *Epub) AddImageFromReader(r io.Reader, internalFilename string) (string, error) {
+	data, err := readMediaFromReader(r, internalFilename)
+	if err != nil {
+		return "", err
+	}
+
+	return e.AddImageFromBytes(data, internalFilename)
+}
+
+// AddImageFromURLContext adds an image to the EPUB by downloading it from the
+// provided http or https URL and returns a relative path to the image file that
+// can be used in EPUB sections in the format:
+// ../ImageFolderName/internalFilename
+//
+// Unlike AddImage, which downloads the image again when the EPUB is written,
+// the image is downloaded once, with the context used for the request, so that
+// the download can be cancelled or given a timeout. If the context is cancelled
+// or its deadline is exceeded before the image has been downloaded, the error
+// of the context is returned. If the image can't be downloaded otherwise,
+// ErrRetrievingFile will be returned.
+//
+// The internal filename is optional; if no filename is provided, the filename
+// from the URL is used, or one is generated if that's already used. If the URL
+// doesn't have a filename either, ErrFilenameRequired will be returned. It
+// otherwise behaves the same as AddImageFromBytes.
+func (e *Epub) AddImageFromURLContext(ctx context.Context, imageURL string, internalFilename string) (string, error) {
+	u, err := url.Parse(imageURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", ErrRetrievingFile
+	}
+	if internalFilename == "" && (path.Base(u.Path) == "." || path.Base(u.Path) == "/") {
+		return "", ErrFilenameRequired
+	}
+
+	// Download the image without locking the Epub so that other changes can be
+	// made in the meantime
+	data, err := downloadMedia(ctx, e.lockedClient(), imageURL)
+	if err != nil {
+		return "", err
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if internalFilename == "" {
+		internalFilename = mediaFilename(path.Base(u.Path), "", e.imageFilenameFormat, e.images)
+	}
+
+	return e.addImageFromBytes(data, internalFilename)
+}
+
+// AddScriptToSection links an already-added JavaScript file (as returned by
+// AddJavaScript) from the <head> of an already-added section. Scripts are
+// linked in the order they're added. Sections that contain scripts are marked
+// as scripted in the package file, as required by EPUB 3.
+//
+// If the section doesn't exist, ErrSectionNotFound will be returned. Since raw
+// sections (see AddRawSection) are written without any changes, scripts can't
+// be added to them; ErrRawSection will be returned instead.
+func (e *Epub) AddScriptToSection(sectionFilename string, internalJavaScriptPath string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	i := e.sectionIndex(sectionFilename)
+	if i == -1 {
+		return ErrSectionNotFound
+	}
+	if e.sections[i].xhtml.raw != "" {
+		return ErrRawSection
+	}
+
+	e.sections[i].xhtml.addScript(internalJavaScriptPath)
+
+	return nil
 }
 
 // AddSection adds a new section (chapter, etc) to the EPUB and returns a
@@ -201,7 +1200,14 @@ func (e *Epub) AddImage(source string, imageFilename string) (string, error) {
 // links).
 //
 // The body must be valid XHTML that will go between the <body> tags of the
-// section XHTML file. The content will not be validated.
+// section XHTML file. The section XHTML file is checked to be well-formed XML
+// (e.g. no unclosed tags or unescaped ampersands); if it isn't, an error
+// wrapping ErrInvalidXML will be returned. The content is otherwise not
+// validated. If the body is a complete HTML document (starting with
+// <!DOCTYPE>, <html>, or <body>), only the content of its <body> element is
+// used, and its <head> element is discarded; use AddRawSection to add a complete
+// document as-is. If it's a complete document without a <body> element, an
+// error wrapping ErrInvalidXML will be returned.
 //
 // The title will be used for the table of contents. The section will be shown
 // in the table of contents in the same order it was added to the EPUB. The
@@ -216,234 +1222,2460 @@ func (e *Epub) AddImage(source string, imageFilename string) (string, error) {
 // The internal path to an already-added CSS file (as returned by AddCSS) to be
 // used for the section is optional.
 func (e *Epub) AddSection(body string, sectionTitle string, internalFilename string, internalCSSPath string) (string, error) {
-	// Generate a filename if one isn't provided
-	if internalFilename == "" {
-		internalFilename = fmt.Sprintf(sectionFileFormat, len(e.sections)+1)
-	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
 
-	for _, section := range e.sections {
-		if section.filename == internalFilename {
-			return "", ErrFilenameAlreadyUsed
-		}
+	s, err := e.newSection(body, sectionTitle, internalFilename, internalCSSPath)
+	if err != nil {
+		return "", err
 	}
+	e.sections = append(e.sections, s)
 
-	x := newXhtml(body)
-	x.setTitle(sectionTitle)
+	return s.filename, nil
+}
 
-	if internalCSSPath != "" {
-		x.setCSS(internalCSSPath)
+// AddJavaScript adds a JavaScript file to the EPUB and returns a relative path
+// to the JavaScript file that can be used in EPUB sections in the format:
+// ../JavaScriptFolderName/internalFilename
+//
+// The JavaScript source should either be a URL or a path to a local file; in
+// either case, the JavaScript file will be retrieved and stored in the EPUB.
+// Use AddScriptToSection to link the JavaScript file from a section.
+//
+// The internal filename will be used when storing the JavaScript file in the
+// EPUB and must be unique among all JavaScript files. If the same filename is
+// used more than once, ErrFilenameAlreadyUsed will be returned. The internal
+// filename is optional; if no filename is provided, one will be generated.
+func (e *Epub) AddJavaScript(source string, internalFilename string) (string, error) {
+	// Check the source without locking the Epub, since that can mean
+	// downloading it
+	if err := e.checkMediaSource(source); err != nil {
+		return "", err
 	}
 
-	s := epubSection{
-		filename: internalFilename,
-		xhtml:    x,
-	}
-	e.sections = append(e.sections, s)
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
 
-	return internalFilename, nil
+	return e.addMedia(source, internalFilename, javaScriptFileFormat, JavaScriptFolderName, e.javaScripts)
 }
 
-// Author returns the author of the EPUB.
-func (e *Epub) Author() string {
-	return e.author
-}
+// AddLang adds a language to the EPUB in addition to the primary language set
+// by SetLang, such as for a bilingual edition. Languages are listed in the
+// order they were added, and languages that were already added are ignored.
+//
+// The language must be a BCP 47 language tag such as "fr" or "zh-Hant";
+// otherwise ErrInvalidLang will be returned.
+func (e *Epub) AddLang(lang string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
 
-// Identifier returns the unique identifier of the EPUB.
-func (e *Epub) Identifier() string {
-	return e.identifier
-}
+	if !langTagPattern.MatchString(lang) {
+		return ErrInvalidLang
+	}
+	for _, l := range e.langs() {
+		if l == lang {
+			return nil
+		}
+	}
+	e.additionalLangs = append(e.additionalLangs, lang)
+	e.pkg.setLangs(e.langs())
 
-// Lang returns the language of the EPUB.
-func (e *Epub) Lang() string {
-	return e.lang
+	return nil
 }
 
-// Ppd returns the page progression direction of the EPUB.
+// AddLandmark adds a landmark to the EPUB, which reading systems can use to
+// jump to important parts of the EPUB. Landmarks are listed in the EPUB 3 table
+// of contents file in the order they were added.
+//
+// The landmark type is the epub:type of the landmark, such as "cover", "toc", or
+// "bodymatter" (see https://www.w3.org/TR/epub-ssv-11/); if it's empty,
+// ErrInvalidLandmark will be returned. The title is the text of the landmark
+// and is optional; if no title is provided, the landmark type will be used.
+//
+// The target filename must be the internal filename of an already-added
+// section (as returned by AddSection), optionally followed by a fragment
+// identifier (e.g. section0001.xhtml#chapter1), or the filename of the table of
+// contents (nav.xhtml). If the target doesn't exist, ErrSectionNotFound will be
+// returned.
+func (e *Epub) AddLandmark(epubType string, title string, targetFilename string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if epubType == "" {
+		return ErrInvalidLandmark
+	}
+	if _, ok := e.landmarkPath(targetFilename); !ok {
+		return ErrSectionNotFound
+	}
+	if title == "" {
+		title = epubType
+	}
+
+	e.landmarks = append(e.landmarks, epubLandmark{
+		epubType: epubType,
+		target:   targetFilename,
+		title:    title,
+	})
+
+	return nil
+}
+
+// AddMediaOverlay adds a media overlay to an already-added section, which
+// reading systems use to play audio narration in sync with the text. The SMIL
+// document is stored next to the section with the same name and a .smil
+// extension (e.g. section0001.smil), so paths in it are relative to the
+// section files, and it replaces any media overlay already added to the
+// section. Media overlays are only supported by EPUB 3.
+//
+// The SMIL document must be well-formed XML; if it isn't, an error wrapping
+// ErrInvalidXML will be returned. Each <audio> element must reference an audio
+// file that has been added with AddAudio and have a clipEnd, which are used to
+// record the duration of the media overlay; if not, an error wrapping
+// ErrInvalidMediaOverlay will be returned. If the section doesn't exist,
+// ErrSectionNotFound will be returned.
+//
+// Spec: http://www.idpf.org/epub/301/spec/epub-mediaoverlays.html
+func (e *Epub) AddMediaOverlay(sectionFilename string, smilDocument string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	i := e.sectionIndex(sectionFilename)
+	if i == -1 {
+		return ErrSectionNotFound
+	}
+	if err := validateXML(smilDocument); err != nil {
+		return err
+	}
+	if _, err := e.mediaOverlayDuration(smilDocument); err != nil {
+		return err
+	}
+
+	e.sections[i].mediaOverlay = smilDocument
+
+	return nil
+}
+
+// AddMeta adds a meta element with the given property and value to the
+// metadata of the package file, for metadata the library doesn't otherwise
+// support. The property is either a term of the default vocabulary or a
+// prefixed term such as "dcterms:audience", whose prefix must be reserved by
+// EPUB 3 or declared with AddVocabularyPrefix (see Validate). Meta elements are
+// listed in the order they were added, and are left out of EPUB 2 files.
+//
+// If the property or value is empty, or the property contains whitespace,
+// ErrInvalidMeta will be returned.
+func (e *Epub) AddMeta(property string, value string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if property == "" || value == "" || strings.ContainsAny(property, " \t\r\n") {
+		return ErrInvalidMeta
+	}
+	e.pkg.addMeta(property, value)
+
+	return nil
+}
+
+// AddNonLinearSection adds a new section to the EPUB that isn't part of the
+// default reading order, such as a page of footnotes or answers to exercises,
+// and returns a relative path to the section that can be used from another
+// section (for links). Reading systems will skip the section when paging
+// through the EPUB, so it should be linked to from another section.
+//
+// The parameters are the same as for AddSection.
+func (e *Epub) AddNonLinearSection(body string, sectionTitle string, internalFilename string, internalCSSPath string) (string, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	s, err := e.newSection(body, sectionTitle, internalFilename, internalCSSPath)
+	if err != nil {
+		return "", err
+	}
+	s.nonLinear = true
+	e.sections = append(e.sections, s)
+
+	return s.filename, nil
+}
+
+// AddSectionWithCSS adds a new section to the EPUB the same way as AddSection,
+// but links to any number of already-added CSS files (as returned by AddCSS)
+// instead of just one. The stylesheets are linked in the order given, so rules
+// in later stylesheets take precedence. The CSS paths are optional; if none are
+// provided, the section won't link to any stylesheets.
+func (e *Epub) AddSectionWithCSS(body string, sectionTitle string, internalFilename string, internalCSSPaths []string) (string, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	s, err := e.newSection(body, sectionTitle, internalFilename, internalCSSPaths...)
+	if err != nil {
+		return "", err
+	}
+	e.sections = append(e.sections, s)
+
+	return s.filename, nil
+}
+
+// AddSectionWithNavTitle adds a new section to the EPUB the same way as
+// AddSection, but with a separate title for the table of contents. The section
+// title is used for the section's <title> element, such as "Chapter 1: The Long
+// Descriptive Name", while the nav title is shown in the table of contents, such
+// as "Chapter 1". If the nav title is empty, the section title is used for both.
+func (e *Epub) AddSectionWithNavTitle(body string, sectionTitle string, navTitle string, internalFilename string, internalCSSPath string) (string, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	s, err := e.newSection(body, sectionTitle, internalFilename, internalCSSPath)
+	if err != nil {
+		return "", err
+	}
+	s.navTitle = navTitle
+	e.sections = append(e.sections, s)
+
+	return s.filename, nil
+}
+
+// AddSectionWithEpubType adds a new section to the EPUB the same way as
+// AddSection, with an epub:type on the section's <body> describing its role in
+// the EPUB, such as "dedication", "epigraph", or "chapter", which reading
+// systems can use to style or skip it. The section is also added to the
+// landmarks (see AddLandmark) with the section title as the title of the
+// landmark.
+//
+// If the epub:type isn't one of the types of the EPUB structural semantics
+// vocabulary that can be used for sections, ErrInvalidEpubType will be
+// returned and the section won't be added. The epub:type is left out of EPUB 2
+// files, which don't support it.
+//
+// Spec: https://www.w3.org/TR/epub-ssv-11/
+func (e *Epub) AddSectionWithEpubType(body string, sectionTitle string, epubType string, internalFilename string, internalCSSPath string) (string, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if !validSectionEpubTypes[epubType] {
+		return "", ErrInvalidEpubType
+	}
+
+	s, err := e.newSection(body, sectionTitle, internalFilename, internalCSSPath)
+	if err != nil {
+		return "", err
+	}
+	s.xhtml.setBodyEpubType(epubType)
+	e.sections = append(e.sections, s)
+
+	landmarkTitle := sectionTitle
+	if landmarkTitle == "" {
+		landmarkTitle = epubType
+	}
+	e.landmarks = append(e.landmarks, epubLandmark{
+		epubType: epubType,
+		target:   s.filename,
+		title:    landmarkTitle,
+	})
+
+	return s.filename, nil
+}
+
+// AddSectionWithLang adds a new section to the EPUB the same way as AddSection,
+// with the language of the section if it differs from the primary language of
+// the EPUB (see SetLang), e.g. for a bilingual edition. The language is set on
+// the <html> element of the section with the lang and xml:lang attributes, so
+// that reading systems can hyphenate and pronounce the text correctly.
+//
+// The language must be a BCP 47 language tag such as "de" or "pt-BR"; if it
+// isn't, ErrInvalidLang will be returned and the section won't be added. The
+// language should also be added to the EPUB with AddLang.
+func (e *Epub) AddSectionWithLang(body string, sectionTitle string, lang string, internalFilename string, internalCSSPath string) (string, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if !langTagPattern.MatchString(lang) {
+		return "", ErrInvalidLang
+	}
+
+	s, err := e.newSection(body, sectionTitle, internalFilename, internalCSSPath)
+	if err != nil {
+		return "", err
+	}
+	s.xhtml.setLang(lang)
+	e.sections = append(e.sections, s)
+
+	return s.filename, nil
+}
+
+// AddSectionWithSpineProperties adds a new section to the EPUB the same way as
+// AddSection, along with properties for the section's <itemref> in the package
+// spine, which override the rendition settings of the EPUB for the section.
+// For example, "page-spread-left" places a fixed-layout page on the left side of
+// a two-page spread, and "rendition:layout-reflowable" makes the section
+// reflowable in an otherwise fixed-layout EPUB (see SetFixedLayout).
+//
+// If any of the properties isn't one of the properties EPUB 3 defines for the
+// spine, ErrInvalidSpineProperty will be returned and the section won't be
+// added. Spine properties are left out of EPUB 2 files.
+func (e *Epub) AddSectionWithSpineProperties(body string, sectionTitle string, internalFilename string, internalCSSPath string, spineProperties []string) (string, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for _, property := range spineProperties {
+		if !validSpineProperties[property] {
+			return "", ErrInvalidSpineProperty
+		}
+	}
+
+	s, err := e.newSection(body, sectionTitle, internalFilename, internalCSSPath)
+	if err != nil {
+		return "", err
+	}
+	added := make(map[string]bool)
+	for _, property := range spineProperties {
+		if !added[property] {
+			s.spineProperties = append(s.spineProperties, property)
+			added[property] = true
+		}
+	}
+	e.sections = append(e.sections, s)
+
+	return s.filename, nil
+}
+
+// AddSubject adds a subject to the EPUB, such as a genre or keyword, which
+// reading systems and library apps can use to categorize the EPUB. Subjects are
+// listed in the order they were added. Empty subjects are ignored.
+func (e *Epub) AddSubject(subject string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if subject == "" {
+		return
+	}
+	e.subjects = append(e.subjects, subject)
+	e.pkg.addSubject(subject)
+}
+
+// AddVocabularyPrefix declares a prefix for a metadata vocabulary in the
+// prefix attribute of the package file, so that its terms can be used as meta
+// properties with AddMeta, e.g. AddVocabularyPrefix("foaf",
+// "http://xmlns.com/foaf/spec/"). Prefixes reserved by EPUB 3, such as
+// "dcterms" and "schema", don't need to be declared. Adding a prefix that was
+// already added replaces its URI. Prefixes are left out of EPUB 2 files.
+//
+// If the prefix isn't a valid XML name without a colon, or the URI isn't an
+// absolute URI, ErrInvalidVocabularyPrefix will be returned.
+func (e *Epub) AddVocabularyPrefix(prefix string, uri string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if !xmlIDPattern.MatchString(prefix) || strings.Contains(prefix, ":") {
+		return ErrInvalidVocabularyPrefix
+	}
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || strings.ContainsAny(uri, " \t\r\n") {
+		return ErrInvalidVocabularyPrefix
+	}
+
+	replaced := false
+	for i := range e.vocabularyPrefixes {
+		if e.vocabularyPrefixes[i].prefix == prefix {
+			e.vocabularyPrefixes[i].uri = uri
+			replaced = true
+		}
+	}
+	if !replaced {
+		e.vocabularyPrefixes = append(e.vocabularyPrefixes, epubVocabularyPrefix{prefix: prefix, uri: uri})
+	}
+
+	declarations := make([]string, len(e.vocabularyPrefixes))
+	for i, p := range e.vocabularyPrefixes {
+		declarations[i] = p.prefix + ": " + p.uri
+	}
+	e.pkg.setPrefix(strings.Join(declarations, " "))
+
+	return nil
+}
+
+// AddSubSection adds a new section to the EPUB as a child of an already-added
+// section and returns a relative path to the section that can be used from
+// another section (for links).
+//
+// The parent filename must be the internal filename of an already-added
+// section (as returned by AddSection or AddSubSection); if it isn't,
+// ErrSectionNotFound will be returned. The section will be nested under its
+// parent in the table of contents, and will be placed in the reading order
+// after its parent and any of its parent's existing sub-sections.
+//
+// The remaining parameters are the same as for AddSection.
+func (e *Epub) AddSubSection(parentFilename string, body string, sectionTitle string, internalFilename string, internalCSSPath string) (string, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	parentIndex := e.sectionIndex(parentFilename)
+	if parentIndex == -1 {
+		return "", ErrSectionNotFound
+	}
+
+	s, err := e.newSection(body, sectionTitle, internalFilename, internalCSSPath)
+	if err != nil {
+		return "", err
+	}
+	s.parentFilename = parentFilename
+
+	// Place the section after the parent's last descendant
+	i := parentIndex + 1
+	for i < len(e.sections) && e.isDescendant(e.sections[i], parentFilename) {
+		i++
+	}
+	e.insertSection(i, s)
+
+	return s.filename, nil
+}
+
+// AssignPageSpreads sets the page spread of each of the provided sections (see
+// SetPageSpread), alternating between left and right so that consecutive
+// sections form two-page spreads.
+//
+// The internal filenames of the sections should be given in reading order. If
+// centerFirst is true, the first section (e.g. a title page) will be centered
+// and the alternation will start with the second section. The first page of a
+// spread is placed on the right for left-to-right books and on the left for
+// right-to-left books (see SetPpd).
+func (e *Epub) AssignPageSpreads(internalFilenames []string, centerFirst bool) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for _, filename := range internalFilenames {
+		if e.sectionIndex(filename) == -1 {
+			return ErrSectionNotFound
+		}
+	}
+
+	spreads := []string{PageSpreadRight, PageSpreadLeft}
+	if e.ppd == PpdRtl {
+		spreads = []string{PageSpreadLeft, PageSpreadRight}
+	}
+
+	for i, filename := range internalFilenames {
+		spread := spreads[i%2]
+		if centerFirst {
+			if i == 0 {
+				spread = PageSpreadCenter
+			} else {
+				spread = spreads[(i-1)%2]
+			}
+		}
+
+		if err := e.setPageSpread(filename, spread); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddRawSection adds a complete XHTML document to the EPUB as a new section and
+// returns the internal filename of the section. Unlike AddSection, the document
+// isn't wrapped in a template and is stored exactly as provided, so it must
+// include the XML declaration, doctype, head, and any namespaces it uses. The
+// document is only checked to be well-formed XML; if it isn't, an error
+// wrapping ErrInvalidXML will be returned.
+//
+// Since the section doesn't have a title, it isn't added to the table of
+// contents. Page breaks for page markers (see AddPageMarker) aren't added to
+// raw sections, so the document must already contain the anchors.
+//
+// The internal filename will be used when storing the section in the EPUB and
+// must be unique among all section files. If the same filename is used more
+// than once, ErrFilenameAlreadyUsed will be returned. The internal filename is
+// optional; if no filename is provided, one will be generated.
+func (e *Epub) AddRawSection(fullXhtml string, internalFilename string) (string, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	x := newRawXhtml(fullXhtml)
+	if err := x.validate(); err != nil {
+		return "", err
+	}
+
+	internalFilename, err := e.newSectionFilename(internalFilename)
+	if err != nil {
+		return "", err
+	}
+
+	e.sections = append(e.sections, epubSection{
+		filename: internalFilename,
+		xhtml:    x,
+	})
+
+	return internalFilename, nil
+}
+
+// AddSectionFromFile adds a new section to the EPUB using the contents of the
+// <body> element of an HTML file at the provided path as the section body, or
+// the entire contents of the file if it doesn't have a <body> element. The file
+// is read from the filesystem used by the Epub (see NewEpubWithFs). If there
+// was a problem reading the file, ErrRetrievingFile will be returned. It
+// otherwise behaves the same as AddSection.
+func (e *Epub) AddSectionFromFile(sourcePath string, sectionTitle string, internalFilename string, internalCSSPath string) (string, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	contents, err := afero.ReadFile(e.fs, sourcePath)
+	if err != nil {
+		return "", ErrRetrievingFile
+	}
+	body := string(contents)
+	if match := htmlBodyPattern.FindStringSubmatch(body); match != nil {
+		body = strings.TrimSpace(match[1])
+	}
+
+	s, err := e.newSection(body, sectionTitle, internalFilename, internalCSSPath)
+	if err != nil {
+		return "", err
+	}
+	e.sections = append(e.sections, s)
+
+	return s.filename, nil
+}
+
+// AddSectionFromReader adds a new section to the EPUB by reading its body from
+// the provided reader. If there was a problem reading the body,
+// ErrRetrievingFile will be returned. It otherwise behaves the same as
+// AddSection.
+func (e *Epub) AddSectionFromReader(r io.Reader, sectionTitle string, internalFilename string, internalCSSPath string) (string, error) {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", ErrRetrievingFile
+	}
+
+	return e.AddSection(string(body), sectionTitle, internalFilename, internalCSSPath)
+}
+
+// Clone returns a copy of the EPUB, including its metadata, media files,
+// sections, and settings, which can be changed without changing the original.
+// This makes it possible to set up an EPUB once as a template, with the
+// publisher, language, stylesheets, etc, and clone it for each book.
+//
+// Media files aren't retrieved again; the clone refers to the same sources as
+// the original. The clone uses the same filesystem as the original, and calls
+// the same write progress function, if any.
+func (e *Epub) Clone() *Epub {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	c := &Epub{
+		accessibilityFeatures: append([]string(nil), e.accessibilityFeatures...),
+		accessibilitySummary:  e.accessibilitySummary,
+		audios:                copyStringMap(e.audios),
+		author:                e.author,
+		coverTemplate:         e.coverTemplate,
+		collections:           append([]epubCollection(nil), e.collections...),
+		compressionLevel:      e.compressionLevel,
+		contentFolder:         e.contentFolder,
+		packageFilename:       e.packageFilename,
+		css:                   copyStringMap(e.css),
+		cssFilenameFormat:     e.cssFilenameFormat,
+		fontFilenameFormat:    e.fontFilenameFormat,
+		imageFilenameFormat:   e.imageFilenameFormat,
+		sectionFilenameFormat: e.sectionFilenameFormat,
+		deterministic:         e.deterministic,
+		fixedLayoutHeight:     e.fixedLayoutHeight,
+		fixedLayoutWidth:      e.fixedLayoutWidth,
+		fonts:                 copyStringMap(e.fonts),
+		fs:                    e.fs,
+		generator:             e.generator,
+		httpClient:            e.httpClient,
+		identifier:            e.identifier,
+		identifierScheme:      e.identifierScheme,
+		images:                copyStringMap(e.images),
+		imageAltTexts:         copyStringMap(e.imageAltTexts),
+		javaScripts:           copyStringMap(e.javaScripts),
+		obfuscated:            make(map[string]bool),
+		mediaTypes:            copyStringMap(e.mediaTypes),
+		mediaData:             make(map[string][]byte),
+		videos:                copyStringMap(e.videos),
+		onDuplicate:           e.onDuplicate,
+		landmarks:             append([]epubLandmark(nil), e.landmarks...),
+		lang:                  e.lang,
+		locale:                e.locale,
+		additionalLangs:       append([]string(nil), e.additionalLangs...),
+		metadataLang:          e.metadataLang,
+		metadataDir:           e.metadataDir,
+		ppd:                   e.ppd,
+		renditionFlow:         e.renditionFlow,
+		pkg:                   e.pkg.copy(),
+		rights:                e.rights,
+		source:                e.source,
+		subjects:              append([]string(nil), e.subjects...),
+		vocabularyPrefixes:    append([]epubVocabularyPrefix(nil), e.vocabularyPrefixes...),
+		sanitizeHTML:          e.sanitizeHTML,
+		minifyXML:             e.minifyXML,
+		includeNCX:            e.includeNCX,
+		tocDepth:              e.tocDepth,
+		tocHeadingLevel:       e.tocHeadingLevel,
+		navDocument:           e.navDocument,
+		ncxDocument:           e.ncxDocument,
+		series:                e.series,
+		seriesIndex:           e.seriesIndex,
+		title:                 e.title,
+		toc:                   e.toc.copy(),
+		verifyAfterWrite:      e.verifyAfterWrite,
+		checkLinksOnWrite:     e.checkLinksOnWrite,
+		writeProgress:         e.writeProgress,
+		spoolThreshold:        e.spoolThreshold,
+		spoolFs:               e.spoolFs,
+		version:               e.version,
+	}
+	cover := *e.cover
+	c.cover = &cover
+	for path, obfuscated := range e.obfuscated {
+		c.obfuscated[path] = obfuscated
+	}
+	// The data isn't changed once it's added, so it can be shared
+	for path, data := range e.mediaData {
+		c.mediaData[path] = data
+	}
+	for _, section := range e.sections {
+		section.pageMarkers = append([]epubPageMarker(nil), section.pageMarkers...)
+		section.spineProperties = append([]string(nil), section.spineProperties...)
+		section.xhtml = section.xhtml.copy()
+		c.sections = append(c.sections, section)
+	}
+
+	return c
+}
+
+// Author returns the author of the EPUB.
+func (e *Epub) Author() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.author
+}
+
+// CoverDimensions returns the width and height in pixels of the cover image.
+// They're determined from the image when the cover is set, for GIF, JPEG, PNG,
+// and SVG images, unless they're set with SetCoverDimensions. If there's no
+// cover image or its dimensions couldn't be determined, they're both zero.
+func (e *Epub) CoverDimensions() (int, int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.cover.width, e.cover.height
+}
+
+// FileContents returns the contents of a section or media file (CSS, font,
+// image, audio, video, or JavaScript) that has been added to the EPUB as it will
+// be written to the EPUB file, e.g. to compute a hash of it. Sections are
+// returned as the complete XHTML document, and obfuscated fonts are returned
+// obfuscated. The internal path is the path returned when the file was added,
+// such as ../images/image0001.png or section0001.xhtml for a section.
+//
+// If no file with the internal path has been added, ErrFileNotFound will be
+// returned. If a media file can't be retrieved from its source,
+// ErrRetrievingFile will be returned.
+func (e *Epub) FileContents(internalPath string) ([]byte, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	folderName, filename := path.Split(strings.TrimPrefix(path.Clean(filepath.ToSlash(internalPath)), "../"))
+	folderName = strings.TrimSuffix(folderName, "/")
+
+	if folderName == "" || folderName == xhtmlFolderName {
+		if i := e.sectionIndex(filename); i != -1 {
+			return e.sectionXhtml(e.sections[i]).content(e.minifyXML), nil
+		}
+		return nil, ErrFileNotFound
+	}
+
+	if _, ok := e.mediaFolders()[folderName][filename]; !ok {
+		return nil, ErrFileNotFound
+	}
+	r, err := e.openMedia(folderName, filename)
+	if err != nil {
+		return nil, ErrRetrievingFile
+	}
+	if e.isObfuscated(folderName, filename) {
+		r = newFontObfuscator(r, e.identifier)
+	}
+	defer func() {
+		if err := r.Close(); err != nil {
+			panic(err)
+		}
+	}()
+
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, ErrRetrievingFile
+	}
+
+	return contents, nil
+}
+
+// Generator returns the software that produced the EPUB, as set by
+// SetGenerator.
+func (e *Epub) Generator() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.generator
+}
+
+// Identifier returns the unique identifier of the EPUB.
+func (e *Epub) Identifier() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.identifier
+}
+
+// IdentifierScheme returns the scheme of the unique identifier of the EPUB, as
+// set by SetIdentifierWithScheme, or an empty string if no scheme was set.
+func (e *Epub) IdentifierScheme() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.identifierScheme
+}
+
+// ImageAltText returns the alt text of an already-added image (as set by
+// AddImageWithOptions), or an empty string if the image doesn't have any. The
+// alt text isn't escaped.
+func (e *Epub) ImageAltText(internalImagePath string) string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.imageAltTexts[filepath.Base(internalImagePath)]
+}
+
+// Lang returns the primary language of the EPUB.
+func (e *Epub) Lang() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.lang
+}
+
+// Langs returns all of the languages of the EPUB, starting with the primary
+// language followed by any added with AddLang.
+func (e *Epub) Langs() []string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.langs()
+}
+
+// Manifest returns the items that will be listed in the manifest of the package
+// file when the EPUB is written, in the same order: media files, sections and
+// their media overlays, and then the TOC files.
+func (e *Epub) Manifest() []ManifestItem {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	items := []ManifestItem{}
+	// The media files are written in this order
+	for _, media := range []struct {
+		folderName string
+		mediaMap   map[string]string
+	}{
+		{AudioFolderName, e.audios},
+		{CSSFolderName, e.css},
+		{FontFolderName, e.fonts},
+		{ImageFolderName, e.images},
+		{JavaScriptFolderName, e.javaScripts},
+		{VideoFolderName, e.videos},
+	} {
+		for _, mediaFilename := range sortedFilenames(media.mediaMap) {
+			items = append(items, e.mediaManifestItem(mediaFilename, media.folderName))
+		}
+	}
+
+	for _, section := range e.sections {
+		items = append(items, sectionManifestItem(section))
+		// EPUB 2 doesn't support media overlays
+		if section.mediaOverlay != "" && e.version != EpubVersion2 {
+			items = append(items, mediaOverlayManifestItem(section))
+		}
+	}
+
+	// EPUB 2 doesn't support the EPUB 3 TOC file
+	if e.version != EpubVersion2 {
+		items = append(items, ManifestItem{ID: tocNavItemID, Href: tocNavFilename, MediaType: mediaTypeXhtml, Properties: tocNavItemProperties})
+	}
+	items = append(items, ManifestItem{ID: tocNcxItemID, Href: tocNcxFilename, MediaType: mediaTypeNcx})
+
+	for i := range items {
+		items[i].Href = filepath.ToSlash(items[i].Href)
+		// EPUB 2 doesn't support the properties attribute
+		if e.version == EpubVersion2 {
+			items[i].Properties = ""
+		}
+	}
+
+	return items
+}
+
+// MetadataDir returns the base direction of the text of the metadata, as set
+// by SetMetadataDir.
+func (e *Epub) MetadataDir() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.metadataDir
+}
+
+// MetadataLang returns the language of the text of the metadata, as set by
+// SetMetadataLang.
+func (e *Epub) MetadataLang() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.metadataLang
+}
+
+// Ppd returns the page progression direction of the EPUB.
 func (e *Epub) Ppd() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
 	return e.ppd
 }
 
-// SetAuthor sets the author of the EPUB.
-func (e *Epub) SetAuthor(author string) {
-	e.author = author
-	e.pkg.setAuthor(author)
+// RenditionFlow returns how the content of the EPUB flows, as set by
+// SetRenditionFlow.
+func (e *Epub) RenditionFlow() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.renditionFlow
+}
+
+// Rights returns the copyright or licensing statement of the EPUB.
+func (e *Epub) Rights() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.rights
+}
+
+// Source returns the publication the EPUB is derived from.
+func (e *Epub) Source() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.source
+}
+
+// Series returns the name of the series the EPUB belongs to and its position in
+// the series.
+func (e *Epub) Series() (string, float64) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.series, e.seriesIndex
+}
+
+// InsertSectionAtIndex adds a new section to the EPUB at the given zero-based
+// position in the reading order and returns a relative path to the section
+// that can be used from another section (for links). The section currently at
+// that position and any sections after it are shifted down by one. If a cover
+// has been set, it occupies the first position.
+//
+// The index must be between 0 and the number of sections that have already
+// been added (inclusive, which appends the section); otherwise
+// ErrIndexOutOfRange will be returned.
+//
+// The remaining parameters are the same as for AddSection.
+func (e *Epub) InsertSectionAtIndex(index int, body string, sectionTitle string, internalFilename string, internalCSSPath string) (string, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.insertSectionAtIndex(index, body, sectionTitle, internalFilename, internalCSSPath)
+}
+
+// RemoveSection removes a previously added section from the EPUB, including
+// its entries in the table of contents and the reading order. Any sub-sections
+// of the removed section (see AddSubSection) are kept and moved up a level, to
+// the removed section's parent. If no section with the internal filename
+// exists, ErrSectionNotFound will be returned.
+func (e *Epub) RemoveSection(internalFilename string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	i := e.sectionIndex(internalFilename)
+	if i == -1 {
+		return ErrSectionNotFound
+	}
+
+	removed := e.sections[i]
+	e.sections = append(e.sections[:i], e.sections[i+1:]...)
+
+	// Any sub-sections of the removed section move up a level
+	for j := range e.sections {
+		if e.sections[j].parentFilename == internalFilename {
+			e.sections[j].parentFilename = removed.parentFilename
+		}
+	}
+
+	// Removing the cover XHTML leaves the cover image in place, but the EPUB no
+	// longer has a cover page
+	if internalFilename == e.cover.xhtmlFilename {
+		e.cover.xhtmlFilename = ""
+	}
+
+	return nil
+}
+
+// ReorderSections changes the reading order of the sections that have already
+// been added to the EPUB, e.g. when they were added out of order. The order is
+// a list of the internal filenames of the sections in the new reading order.
+// Sections that aren't in the list keep their relative order and follow the
+// listed sections, except for the cover page, which stays first unless it's
+// listed. A filename listed more than once keeps its first position.
+//
+// The table of contents follows the new order when the EPUB is written.
+// Sub-sections (see AddSubSection) stay nested under their parent sections in
+// the table of contents as long as they come after them in the new order. If
+// no section with one of the internal filenames exists, ErrSectionNotFound will
+// be returned and the order won't be changed.
+func (e *Epub) ReorderSections(order []string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	listed := make(map[string]bool)
+	for _, filename := range order {
+		if e.sectionIndex(filename) == -1 {
+			return ErrSectionNotFound
+		}
+		listed[filename] = true
+	}
+
+	sections := make([]epubSection, 0, len(e.sections))
+	if e.cover.xhtmlFilename != "" && !listed[e.cover.xhtmlFilename] {
+		if i := e.sectionIndex(e.cover.xhtmlFilename); i != -1 {
+			sections = append(sections, e.sections[i])
+			listed[e.cover.xhtmlFilename] = true
+		}
+	}
+	added := make(map[string]bool)
+	for _, filename := range order {
+		if added[filename] {
+			continue
+		}
+		added[filename] = true
+		sections = append(sections, e.sections[e.sectionIndex(filename)])
+	}
+	for _, section := range e.sections {
+		if !listed[section.filename] {
+			sections = append(sections, section)
+		}
+	}
+	e.sections = sections
+
+	return nil
+}
+
+// Sections returns information about each section that has been added to the
+// EPUB (including the cover page, if one has been set) in reading order.
+func (e *Epub) Sections() []SectionInfo {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	sections := make([]SectionInfo, len(e.sections))
+	for i, section := range e.sections {
+		sections[i] = SectionInfo{
+			Filename:       section.filename,
+			Index:          i,
+			Linear:         !section.nonLinear,
+			ParentFilename: section.parentFilename,
+			Title:          section.xhtml.Title(),
+		}
+	}
+
+	return sections
+}
+
+// SetAccessibilitySummary sets a human-readable description of the
+// accessibility of the EPUB, such as "This publication meets basic
+// accessibility requirements", which is written to the package file as a
+// schema:accessibilitySummary meta element. If the summary is empty, it won't be
+// included.
+func (e *Epub) SetAccessibilitySummary(summary string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.accessibilitySummary = summary
+}
+
+// SetAuthor sets the author of the EPUB.
+func (e *Epub) SetAuthor(author string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.author = author
+	e.pkg.setAuthor(author)
+}
+
+// SetAuthorFileAs sets the name of the author used for sorting, such as
+// "McCringleberry, Hingle" for "Hingle McCringleberry". It's only included in
+// the EPUB if an author is set. If the name is empty, it won't be included.
+func (e *Epub) SetAuthorFileAs(fileAs string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.pkg.setAuthorFileAs(fileAs)
+}
+
+// SetCompressionLevel sets the compression level of the files in the EPUB,
+// from 1 (fastest) to 9 (smallest), which is used when the EPUB is written.
+// The level can also be CompressionLevelDefault (the default),
+// CompressionLevelNone to use the deflate format without compression, or
+// CompressionLevelStore to store the files without using the deflate format.
+// Lower levels are faster, which can be useful for EPUBs with lots of images
+// that don't compress well. If the level isn't valid,
+// ErrInvalidCompressionLevel will be returned.
+func (e *Epub) SetCompressionLevel(level int) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if level != CompressionLevelStore && (level < flate.DefaultCompression || level > flate.BestCompression) {
+		return ErrInvalidCompressionLevel
+	}
+	e.compressionLevel = level
+
+	return nil
+}
+
+// SetStoreOnly sets whether the files in the EPUB are stored without
+// compression, which makes the EPUB file larger but makes it easier to inspect
+// and compare with other tools, e.g. when debugging. It's the same as setting
+// the compression level to CompressionLevelStore with SetCompressionLevel;
+// disabling it restores the default compression level.
+func (e *Epub) SetStoreOnly(storeOnly bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if storeOnly {
+		e.compressionLevel = CompressionLevelStore
+	} else if e.compressionLevel == CompressionLevelStore {
+		e.compressionLevel = CompressionLevelDefault
+	}
+}
+
+// SetContentFolder sets the name of the folder at the root of the EPUB that
+// contains the package file and all other content, such as "OEBPS". The default
+// is "EPUB". Internal paths are relative to the content folder, so the folder can
+// be changed at any time, even after files have been added.
+//
+// If the name is empty, contains a path separator or another character that
+// isn't allowed in filenames, such as < or >, or is one of ".", "..",
+// "META-INF", or "mimetype", ErrInvalidContentFolder will be returned.
+func (e *Epub) SetContentFolder(name string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	switch name {
+	case "", ".", "..", metaInfFolderName, mimetypeFilename:
+		return ErrInvalidContentFolder
+	}
+	if !isFilenameValid(name) {
+		return ErrInvalidContentFolder
+	}
+	e.contentFolder = name
+
+	return nil
+}
+
+// SetPackageFilename sets the filename of the package file, which is stored in
+// the content folder (see SetContentFolder), such as "content.opf". The default
+// is "package.opf". The container file (META-INF/container.xml) always points
+// to the package file.
+//
+// If the filename doesn't end in .opf or contains a path separator or another
+// character that isn't allowed in filenames, such as < or >,
+// ErrInvalidPackageFilename will be returned.
+func (e *Epub) SetPackageFilename(filename string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if len(filename) <= len(pkgFileExt) || !strings.HasSuffix(strings.ToLower(filename), pkgFileExt) {
+		return ErrInvalidPackageFilename
+	}
+	if !isFilenameValid(filename) {
+		return ErrInvalidPackageFilename
+	}
+	e.packageFilename = filename
+
+	return nil
+}
+
+// SetCover sets the cover page for the EPUB using the provided image source and
+// optional CSS.
+//
+// The internal path to an already-added image file (as returned by AddImage) is
+// required.
+//
+// The internal path to an already-added CSS file (as returned by AddCSS) to be
+// used for the cover is optional. If the CSS path isn't provided, default CSS
+// will be used.
+//
+// The dimensions of the image are recorded if they can be determined (see
+// CoverDimensions); if they can't, the cover is still set.
+func (e *Epub) SetCover(internalImagePath string, internalCSSPath string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.setCover(internalImagePath, internalCSSPath, "")
+}
+
+// SetCoverImageOnly sets the cover image of the EPUB without adding a cover
+// page, for reading systems that show the cover image on their own. The image
+// is marked as the cover image in the package file, including with the meta
+// element used by EPUB 2 reading systems, but isn't added to the reading order.
+// Any cover page set by SetCover is removed.
+//
+// The internal path to an already-added image file (as returned by AddImage) is
+// required; if the image hasn't been added, ErrInvalidImage will be returned
+// and the cover won't be changed.
+func (e *Epub) SetCoverImageOnly(internalImagePath string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	imageFilename := filepath.Base(internalImagePath)
+	if _, ok := e.images[imageFilename]; !ok {
+		return ErrInvalidImage
+	}
+	e.removeCover(imageFilename)
+	e.setCoverImage(imageFilename)
+
+	return nil
+}
+
+// SetCoverDimensions sets the width and height in pixels of the cover image,
+// replacing the dimensions determined when the cover was set (see
+// CoverDimensions), e.g. for images whose dimensions can't be determined. If no
+// cover image has been set, or the width or height isn't positive,
+// ErrInvalidImage will be returned and the dimensions won't be changed. Setting
+// a new cover replaces the dimensions.
+func (e *Epub) SetCoverDimensions(width int, height int) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.cover.imageFilename == "" || width <= 0 || height <= 0 {
+		return ErrInvalidImage
+	}
+	e.cover.width = width
+	e.cover.height = height
+
+	return nil
+}
+
+// SetCoverFromBytes adds a cover image to the EPUB from the provided data and
+// sets the cover page for the EPUB using it and the optional CSS, which is the
+// same as calling AddImageFromBytes followed by SetCover. It returns a relative
+// path to the cover image file that can be used in EPUB sections in the format:
+// ../ImageFolderName/internalFilename
+//
+// The internal filename of the image is required since the media type of the
+// image is determined by its extension; if no filename is provided,
+// ErrFilenameRequired will be returned. If the filename is already used by
+// another image, ErrFilenameAlreadyUsed will be returned and the cover won't be
+// changed.
+func (e *Epub) SetCoverFromBytes(data []byte, internalFilename string, internalCSSPath string) (string, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	imagePath, err := e.addImageFromBytes(data, internalFilename)
+	if err != nil {
+		return "", err
+	}
+	e.setCover(imagePath, internalCSSPath, "")
+
+	return imagePath, nil
+}
+
+// SetSVGCover sets the cover page for the EPUB the same way as SetCover, but the
+// image is placed in an inline SVG element that scales it to fill the page
+// while keeping its aspect ratio, which some reading systems need in order to
+// show a full-bleed cover. The image can be an SVG image (see AddImage) or a
+// GIF, JPEG, or PNG image.
+//
+// The dimensions of the image are used for the viewBox of the SVG element. If
+// the image hasn't been added or its dimensions can't be determined,
+// ErrInvalidImage will be returned and the cover won't be changed.
+func (e *Epub) SetSVGCover(internalImagePath string, internalCSSPath string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	imageFilename := filepath.Base(internalImagePath)
+	if _, ok := e.images[imageFilename]; !ok {
+		return ErrInvalidImage
+	}
+	width, height, err := e.imageDimensions(imageFilename)
+	if err != nil {
+		return ErrInvalidImage
+	}
+
+	coverBody := fmt.Sprintf(defaultCoverSVGBody, width, height, width, height, internalImagePath)
+	e.setCover(internalImagePath, internalCSSPath, coverBody)
+
+	return nil
+}
+
+// SetDeterministic sets whether Write should produce the same EPUB file, byte
+// for byte, each time the same Epub is written, e.g. for reproducible builds.
+// If enabled, the modified date in the package file and the modification times
+// of the files in the EPUB are set to a fixed date (1980-01-01) instead of the
+// current time. Files are always stored in the EPUB and listed in the package
+// file in a fixed order.
+func (e *Epub) SetDeterministic(deterministic bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.deterministic = deterministic
+}
+
+// SetFixedLayout makes the EPUB fixed-layout (pre-paginated), where each
+// section is shown as a page of the given size in CSS pixels rather than
+// reflowing its content, as for comics and photo books. The rendition:layout,
+// rendition:orientation, and rendition:spread meta elements are added to the
+// package file, and a viewport meta element with the size is added to the head
+// of each section, except sections added with AddRawSection, which must include
+// their own.
+//
+// A width and height of zero makes the EPUB reflowable again, which is the
+// default. If the width or height is negative, or only one of them is zero,
+// ErrInvalidFixedLayout will be returned. Fixed layout isn't supported by EPUB
+// 2, so it's left out of EPUB 2 files.
+func (e *Epub) SetFixedLayout(width int, height int) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if width < 0 || height < 0 || (width == 0) != (height == 0) {
+		return ErrInvalidFixedLayout
+	}
+	e.fixedLayoutWidth = width
+	e.fixedLayoutHeight = height
+	e.pkg.setFixedLayout(width > 0)
+
+	return nil
+}
+
+// SetGenerator sets the software that produced the EPUB, such as
+// "MyConverter 1.2.0", which is added to the package file in a generator meta
+// element so that other tools can tell where the EPUB came from. This is free
+// text. If the generator is empty, which is the default, it won't be included
+// in the EPUB.
+func (e *Epub) SetGenerator(generator string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.generator = generator
+	e.pkg.setGenerator(generator)
+}
+
+// SetHTTPClient sets the HTTP client used to retrieve media files from URLs,
+// e.g. to add headers such as authorization or a user agent with a custom
+// transport, or to use a proxy. It's used by AddImage and the other methods
+// that add media files from URLs, by AddImageFromURLContext, and when the
+// media files are retrieved again while writing the EPUB. A nil client, the
+// default, uses http.DefaultClient.
+func (e *Epub) SetHTTPClient(c *http.Client) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.httpClient = c
+}
+
+// SetIdentifier sets the unique identifier of the EPUB, such as a UUID, DOI,
+// ISBN or ISSN. If no identifier is set, a UUID will be automatically
+// generated.
+func (e *Epub) SetIdentifier(identifier string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.setIdentifier(identifier)
+}
+
+// SetIdentifierWithScheme sets the unique identifier of the EPUB the same way
+// as SetIdentifier, and also declares what kind of identifier it is so that
+// stores and reading systems can handle it properly. The scheme must be one of
+// IdentifierSchemeDOI, IdentifierSchemeISBN, or IdentifierSchemeUUID; if it
+// isn't, ErrInvalidIdentifierScheme will be returned and the identifier won't
+// be changed. ISBNs may contain hyphens or spaces, and must have 10 or 13
+// digits.
+//
+// The scheme is written as an ONIX code list 5 identifier type (e.g. 15 for
+// ISBN-13), or as the opf:scheme attribute for EPUB 2.
+func (e *Epub) SetIdentifierWithScheme(identifier string, scheme string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	code, err := identifierTypeCode(identifier, scheme)
+	if err != nil {
+		return err
+	}
+
+	e.setIdentifier(identifier)
+	e.identifierScheme = scheme
+	e.pkg.setIdentifierScheme(scheme, code)
+
+	return nil
+}
+
+// SetUniqueIdentifierID sets the ID of the unique identifier of the EPUB (see
+// SetIdentifier) in the package file, which is "pub-id" by default. The ID is
+// used for both the id attribute of the <dc:identifier> element and the
+// unique-identifier attribute of the <package> element.
+//
+// If the ID is empty, isn't a valid XML ID, or is already used by another
+// element of the package file, such as an internal filename,
+// ErrInvalidUniqueIdentifierID will be returned.
+func (e *Epub) SetUniqueIdentifierID(id string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if !xmlIDPattern.MatchString(id) {
+		return ErrInvalidUniqueIdentifierID
+	}
+	switch id {
+	case pkgAuthorID, pkgCreatorID, pkgSeriesID, pkgTitleID, tocNavItemID, tocNcxItemID:
+		return ErrInvalidUniqueIdentifierID
+	}
+	if e.sectionIndex(id) != -1 || e.collectionIndex(id) != -1 {
+		return ErrInvalidUniqueIdentifierID
+	}
+	for _, mediaMap := range e.mediaFolders() {
+		if _, ok := mediaMap[id]; ok {
+			return ErrInvalidUniqueIdentifierID
+		}
+	}
+	e.pkg.setUniqueIdentifierID(id)
+
+	return nil
+}
+
+// SetIncludeNCX sets whether the EPUB 2 table of contents file (toc.ncx) is
+// included in EPUB 3 files, which it is by default so that older reading
+// systems can show the table of contents. EPUB 3 reading systems only use the
+// EPUB 3 table of contents file (nav.xhtml), so leaving the NCX file out makes
+// the EPUB file smaller. The NCX file is always included in EPUB 2 files,
+// which require it.
+func (e *Epub) SetIncludeNCX(include bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.includeNCX = include
+}
+
+// SetTocDepth sets how many levels of sections are included in the table of
+// contents, e.g. 2 to include the top-level sections and their sub-sections
+// (see AddSubSection) but leave out any sub-sections below them, which can make
+// the table of contents of deeply nested EPUBs easier to use. The sections
+// that are left out are still part of the EPUB. A depth of 0, the default,
+// includes all levels, as does a negative depth.
+func (e *Epub) SetTocDepth(depth int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if depth < 0 {
+		depth = 0
+	}
+	e.tocDepth = depth
+}
+
+// SetLang sets the primary language of the EPUB, which must be a BCP 47
+// language tag such as "en", "pt-BR", or "zh-Hant-TW"; otherwise ErrInvalidLang
+// will be returned. An empty language removes the language, which is required
+// (see Validate).
+func (e *Epub) SetLang(lang string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if lang != "" && !langTagPattern.MatchString(lang) {
+		return ErrInvalidLang
+	}
+	e.lang = lang
+	e.pkg.setLangs(e.langs())
+
+	return nil
+}
+
+// AddPageMarker records a page break of the print edition of the book in an
+// already-added section, so that readers can find the content corresponding to
+// a given page. The page name is the page number as it would appear in print,
+// such as "7" or "xii".
+//
+// When the EPUB is written, each page is listed in a page list in the EPUB 3
+// table of contents file, linked to the anchor ID in the section, and a page
+// break (e.g. <span epub:type="pagebreak" id="page7" title="7"></span>) is
+// added to the start of the section body. If the section body already contains
+// an element with the anchor ID, for example to mark a page break in the middle
+// of the section, no page break is added and the existing element is linked to
+// instead. Pages are listed in reading order, and in the order they were added
+// within each section.
+//
+// If the section doesn't exist, ErrSectionNotFound will be returned. If the page
+// name or anchor ID is empty, or the anchor ID is already used by another page
+// marker in the section, ErrInvalidPageMarker will be returned.
+func (e *Epub) AddPageMarker(sectionFilename string, pageName string, anchorID string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	i := e.sectionIndex(sectionFilename)
+	if i == -1 {
+		return ErrSectionNotFound
+	}
+	if pageName == "" || anchorID == "" {
+		return ErrInvalidPageMarker
+	}
+	for _, marker := range e.sections[i].pageMarkers {
+		if marker.anchorID == anchorID {
+			return ErrInvalidPageMarker
+		}
+	}
+
+	e.sections[i].pageMarkers = append(e.sections[i].pageMarkers, epubPageMarker{
+		anchorID: anchorID,
+		pageName: pageName,
+	})
+
+	return nil
+}
+
+// SetMetadataDir sets the base direction of the text of the metadata, such as
+// the title and author, which must be DirLtr or DirRtl; otherwise
+// ErrInvalidMetadataDir will be returned. Library apps use it to show the
+// metadata of right-to-left languages such as Arabic and Hebrew correctly. It
+// doesn't affect the content of the EPUB (see SetPpd). An empty direction
+// removes it. The direction is set on the package element of the package file,
+// and is left out of EPUB 2 files, which don't support it.
+func (e *Epub) SetMetadataDir(dir string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	switch dir {
+	case "", DirLtr, DirRtl:
+	default:
+		return ErrInvalidMetadataDir
+	}
+	e.metadataDir = dir
+	e.pkg.setDir(dir)
+
+	return nil
+}
+
+// SetMetadataLang sets the language of the text of the metadata, such as the
+// title and author, if it differs from the language of the EPUB (see SetLang).
+// It must be a BCP 47 language tag such as "ar" or "he"; otherwise
+// ErrInvalidLang will be returned. An empty language removes it. The language
+// is set on the package element of the package file with the xml:lang
+// attribute, and is left out of EPUB 2 files, which don't support it.
+func (e *Epub) SetMetadataLang(lang string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if lang != "" && !langTagPattern.MatchString(lang) {
+		return ErrInvalidLang
+	}
+	e.metadataLang = lang
+	e.pkg.setXMLLang(lang)
+
+	return nil
+}
+
+// SetMinifyXML sets whether the XML files generated when writing the EPUB, such
+// as the package file, the TOC files, and the sections, are written without
+// indentation, which makes the EPUB file smaller. By default they're indented
+// to make them easier to read. The bodies of sections and sections added with
+// AddRawSection are written as-is either way.
+func (e *Epub) SetMinifyXML(minify bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.minifyXML = minify
+}
+
+// SetOnDuplicate sets what happens when a media file (CSS, font, image, audio,
+// video, or JavaScript) is added with an internal filename that's already used
+// by a file of the same kind. The mode must be one of OnDuplicateError (the default),
+// OnDuplicateOverwrite, or OnDuplicateRename; otherwise ErrInvalidDuplicateMode
+// will be returned. Sections always return ErrFilenameAlreadyUsed, since
+// other sections may link to them.
+func (e *Epub) SetOnDuplicate(mode string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	switch mode {
+	case OnDuplicateError, OnDuplicateOverwrite, OnDuplicateRename:
+	default:
+		return ErrInvalidDuplicateMode
+	}
+	e.onDuplicate = mode
+
+	return nil
+}
+
+// SetSectionFilenameFormat sets the printf-style format of the filenames
+// generated for sections added without an internal filename, such as
+// "chapter-%04d.xhtml". The format must contain exactly one integer verb, which
+// is replaced with the position of the section; otherwise
+// ErrInvalidFilenameFormat will be returned. The default format is
+// "section%04d.xhtml".
+func (e *Epub) SetSectionFilenameFormat(format string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if !isFilenameFormatValid(format) {
+		return ErrInvalidFilenameFormat
+	}
+	e.sectionFilenameFormat = format
+
+	return nil
+}
+
+// SetCSSFilenameFormat sets the printf-style format of the filenames generated
+// for CSS files, such as "style-%02d". A filename is generated when a CSS file
+// is added without an internal filename and the filename of its source is
+// already used. The format must contain exactly one integer verb, which is
+// replaced with a number, and the extension of the source is appended to it;
+// otherwise ErrInvalidFilenameFormat will be returned. The default format is
+// "css%04d".
+func (e *Epub) SetCSSFilenameFormat(format string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if !isFilenameFormatValid(format) {
+		return ErrInvalidFilenameFormat
+	}
+	e.cssFilenameFormat = format + "%s"
+
+	return nil
+}
+
+// SetFontFilenameFormat sets the printf-style format of the filenames generated
+// for fonts, the same way as SetCSSFilenameFormat. The default format is
+// "font%04d".
+func (e *Epub) SetFontFilenameFormat(format string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if !isFilenameFormatValid(format) {
+		return ErrInvalidFilenameFormat
+	}
+	e.fontFilenameFormat = format + "%s"
+
+	return nil
+}
+
+// SetImageFilenameFormat sets the printf-style format of the filenames
+// generated for images, the same way as SetCSSFilenameFormat. The default
+// format is "image%04d".
+func (e *Epub) SetImageFilenameFormat(format string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if !isFilenameFormatValid(format) {
+		return ErrInvalidFilenameFormat
+	}
+	e.imageFilenameFormat = format + "%s"
+
+	return nil
+}
+
+// SetPageSpread sets the page spread of an already-added section, which will
+// be emitted as a rendition:page-spread-* property on the section's spine
+// item. The spread must be one of PageSpreadCenter, PageSpreadLeft, or
+// PageSpreadRight; otherwise ErrInvalidPageSpread will be returned. An empty
+// spread removes any page spread previously set for the section.
+//
+// If no section with the internal filename exists, ErrSectionNotFound will be
+// returned.
+func (e *Epub) SetPageSpread(internalFilename string, spread string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.setPageSpread(internalFilename, spread)
+}
+
+// SetPpd sets the page progression direction of the EPUB, which must be one of
+// PpdLtr, PpdRtl, or PpdDefault; otherwise ErrInvalidPpd will be returned. An
+// empty direction removes the page progression direction.
+func (e *Epub) SetPpd(direction string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	switch direction {
+	case "", PpdDefault, PpdLtr, PpdRtl:
+	default:
+		return ErrInvalidPpd
+	}
+	e.ppd = direction
+	e.pkg.setPpd(direction)
+
+	return nil
+}
+
+// SetPageProgressionDirection is the same as SetPpd.
+func (e *Epub) SetPageProgressionDirection(direction string) error {
+	return e.SetPpd(direction)
+}
+
+// SetRenditionFlow sets how reading systems flow the content of the EPUB, which
+// must be RenditionFlowAuto, RenditionFlowPaginated,
+// RenditionFlowScrolledContinuous, or RenditionFlowScrolledDoc; otherwise
+// ErrInvalidRenditionFlow will be returned. For example, webtoons and other
+// content meant to be read in one long strip can be scrolled rather than paged
+// through. An empty flow removes it. The flow is set with a rendition:flow meta
+// element, which is left out of EPUB 2 files.
+func (e *Epub) SetRenditionFlow(flow string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	switch flow {
+	case "", RenditionFlowAuto, RenditionFlowPaginated, RenditionFlowScrolledContinuous, RenditionFlowScrolledDoc:
+	default:
+		return ErrInvalidRenditionFlow
+	}
+	e.renditionFlow = flow
+	e.pkg.setRenditionFlow(flow)
+
+	return nil
+}
+
+// SetRights sets the copyright or licensing statement of the EPUB, such as
+// "Copyright © 2017 Hingle McCringleberry" or "CC BY-SA 4.0". This is free
+// text. If the rights statement is empty, it won't be included in the EPUB.
+func (e *Epub) SetRights(rights string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.rights = rights
+	e.pkg.setRights(rights)
+}
+
+// SetSpineAttribute sets an attribute of the spine element of the package file,
+// such as an attribute defined by a newer version of the EPUB specification or
+// one that's specific to a reading system. If the attribute has already been
+// set, its value is replaced; an empty value removes it.
+//
+// The name must be a valid XML attribute name. The toc and
+// page-progression-direction attributes are set when the EPUB is written and by
+// SetPpd, so they, as well as namespace declarations, can't be set with
+// SetSpineAttribute. Otherwise, ErrInvalidSpineAttribute will be returned.
+func (e *Epub) SetSpineAttribute(name string, value string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if !xmlAttrNamePattern.MatchString(name) || strings.HasPrefix(name, "xmlns") {
+		return ErrInvalidSpineAttribute
+	}
+	switch name {
+	case pkgSpineTocAttr, pkgSpinePpdAttr:
+		return ErrInvalidSpineAttribute
+	}
+	e.pkg.setSpineAttribute(name, value)
+
+	return nil
+}
+
+// SetSource sets the publication the EPUB is derived from, such as the ISBN or
+// URL of the print edition of a reprint, e.g. "urn:isbn:9780261103344". If the
+// source is empty, it won't be included in the EPUB.
+func (e *Epub) SetSource(source string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.source = source
+	e.pkg.setSource(source)
+}
+
+// SetSpoolFs sets the filesystem of the temp file Write builds large EPUB files
+// in (see SetSpoolThreshold). A nil filesystem, the default, uses the temp
+// directory of the OS filesystem.
+func (e *Epub) SetSpoolFs(fs afero.Fs) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.spoolFs = fs
+}
+
+// SetSpoolThreshold sets the total size in bytes of the files of the EPUB above
+// which Write builds the EPUB file in a temp file (see SetSpoolFs) and then
+// copies it to the destination, rather than building it in the destination.
+// This bounds the memory used while writing large EPUBs when the EPUB uses an
+// in-memory filesystem (see NewEpubWithFs). A threshold of 0, the default,
+// never uses a temp file, as does a negative threshold.
+func (e *Epub) SetSpoolThreshold(threshold int64) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if threshold < 0 {
+		threshold = 0
+	}
+	e.spoolThreshold = threshold
+}
+
+// SetSeries sets the series the EPUB belongs to and its position in the
+// series, such as 2 for the second book or 1.5 for a novella set between the
+// first and second books. The series is written both as an EPUB 3 collection
+// and as the meta elements used by Calibre. If the name is empty, the series
+// will be cleared.
+func (e *Epub) SetSeries(name string, index float64) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if name == "" {
+		index = 0
+	}
+	e.series = name
+	e.seriesIndex = index
+	e.pkg.setSeries(name, index)
+}
+
+// SetNavDocument sets the content of the EPUB 3 table of contents file
+// (nav.xhtml), which is written as-is instead of the generated file, e.g. to
+// keep a table of contents written by hand when migrating an existing book. The
+// document must be a complete XHTML document; it isn't checked other than being
+// well-formed XML, so it's up to the caller to make sure it's a valid EPUB 3
+// navigation document that links to the right sections. If it isn't
+// well-formed, an error wrapping ErrInvalidXML will be returned.
+//
+// Landmarks, page markers, and the titles of sections aren't added to the
+// document, and SetTocTitle has no effect. An empty document restores the
+// generated file.
+func (e *Epub) SetNavDocument(xhtml string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if xhtml != "" {
+		if err := validateXML(xhtml); err != nil {
+			return err
+		}
+	}
+	e.navDocument = xhtml
+
+	return nil
+}
+
+// SetNCXDocument sets the content of the EPUB 2 table of contents file
+// (toc.ncx), which is written as-is instead of the generated file, the same
+// way as SetNavDocument. The file is still left out of EPUB 3 files if
+// SetIncludeNCX has been used to disable it.
+func (e *Epub) SetNCXDocument(ncx string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if ncx != "" {
+		if err := validateXML(ncx); err != nil {
+			return err
+		}
+	}
+	e.ncxDocument = ncx
+
+	return nil
+}
+
+// SetTocTitle sets the title and visible heading of the EPUB 3 table of
+// contents (nav.xhtml), e.g. "Sommaire" for a French EPUB. By default, the
+// heading is "Table of Contents" and the title is the title of the EPUB.
+// Setting an empty title restores the defaults.
+func (e *Epub) SetTocTitle(title string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.toc.setNavTitle(title)
+}
+
+// SetTitleFileAs sets the title used for sorting, such as "Hobbit, The" for
+// "The Hobbit". If the title is empty, it won't be included in the EPUB.
+func (e *Epub) SetTitleFileAs(fileAs string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.pkg.setTitleFileAs(fileAs)
+}
+
+// SetVersion sets the version of the EPUB specification the EPUB will conform
+// to, either EpubVersion3 (the default) or EpubVersion2 for older reading
+// systems that don't support EPUB 3. Any other version will return
+// ErrInvalidVersion.
+func (e *Epub) SetVersion(version string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if version != EpubVersion2 && version != EpubVersion3 {
+		return ErrInvalidVersion
+	}
+
+	e.version = version
+	e.pkg.setVersion(version)
+
+	return nil
+}
+
+// SetVerifyAfterWrite sets whether Write should verify the EPUB file after
+// writing it. If enabled, Write will reopen the file and check that it's a
+// readable zip archive, that the mimetype file is the first entry and is
+// stored uncompressed, and that the package file can be parsed. If any of
+// these checks fail, Write will return ErrVerificationFailed.
+func (e *Epub) SetVerifyAfterWrite(verify bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.verifyAfterWrite = verify
+}
+
+// SetWriteProgress sets a function that will be called by Write each time a
+// file is added to the EPUB file, with the number of files written so far and
+// the total number of files, e.g. to show a progress bar. The function is
+// called from the goroutine calling Write and never after Write returns. The
+// Epub isn't locked while the function is called, so it can call methods of the
+// Epub, such as Title, but changes made before Write returns don't affect the
+// EPUB file being written. A nil function disables progress reporting.
+func (e *Epub) SetWriteProgress(progress func(current, total int)) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.writeProgress = progress
+}
+
+// SetTitle sets the title of the EPUB.
+func (e *Epub) SetTitle(title string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.title = title
+	e.pkg.setTitle(title)
+	e.toc.setTitle(title)
+}
+
+// Subjects returns the subjects of the EPUB in the order they were added.
+func (e *Epub) Subjects() []string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	subjects := make([]string, len(e.subjects))
+	copy(subjects, e.subjects)
+
+	return subjects
+}
+
+// Title returns the title of the EPUB.
+func (e *Epub) Title() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.title
+}
+
+// Version returns the version of the EPUB specification the EPUB conforms to.
+func (e *Epub) Version() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.version
+}
+
+// Insert a section without locking the Epub
+func (e *Epub) insertSectionAtIndex(index int, body string, sectionTitle string, internalFilename string, internalCSSPath string) (string, error) {
+	if index < 0 || index > len(e.sections) {
+		return "", ErrIndexOutOfRange
+	}
+
+	s, err := e.newSection(body, sectionTitle, internalFilename, internalCSSPath)
+	if err != nil {
+		return "", err
+	}
+	e.insertSection(index, s)
+
+	return s.filename, nil
+}
+
+// Set the cover page with the given body without locking the Epub. If the body
+// is empty, it's generated from the cover template (see SetCoverTemplate).
+func (e *Epub) setCover(internalImagePath string, internalCSSPath string, coverBody string) {
+	e.removeCover(filepath.Base(internalImagePath))
+	e.setCoverImage(filepath.Base(internalImagePath))
+
+	// Use default cover stylesheet if one isn't provided
+	if internalCSSPath == "" {
+		// The default CSS is stored in memory so that it's still available if the
+		// EPUB is written more than once
+		coverCSSFilename := defaultCoverCSSFilename
+		// If that's already used, generate a filename rather than replacing or
+		// renaming the existing file (see SetOnDuplicate)
+		if _, ok := e.css[coverCSSFilename]; ok {
+			coverCSSFilename = fmt.Sprintf(
+				e.cssFilenameFormat,
+				len(e.css)+1,
+				".css",
+			)
+		}
+
+		var err error
+		internalCSSPath, err = e.addMediaFromBytes([]byte(defaultCoverCSSContent), coverCSSFilename, e.cssFilenameFormat, CSSFolderName, e.css)
+		if err != nil {
+			// This shouldn't cause an error
+			panic(fmt.Sprintf("Error adding default cover CSS file: %s", err))
+		}
+	}
+	e.cover.cssFilename = filepath.Base(internalCSSPath)
+
+	// The body can only be generated once the CSS path is known
+	if coverBody == "" {
+		coverBody = e.coverBody(internalImagePath, internalCSSPath)
+	}
+
+	// Title won't be used since the cover won't be added to the TOC
+	// First try to use the default cover filename
+	// The cover is placed first so it shows up first in the reading order
+	coverPath, err := e.insertSectionAtIndex(0, coverBody, "", defaultCoverXhtmlFilename, internalCSSPath)
+	// If that doesn't work, generate a filename
+	if err == ErrFilenameAlreadyUsed {
+		coverPath, err = e.insertSectionAtIndex(0, coverBody, "", "", internalCSSPath)
+		if err == ErrFilenameAlreadyUsed {
+			// This shouldn't cause an error since we're not specifying a filename
+			panic(fmt.Sprintf("Error adding default cover XHTML file: %s", err))
+		}
+	}
+	e.cover.xhtmlFilename = filepath.Base(coverPath)
+}
+
+// Set the cover image and record its dimensions. The dimensions are left at
+// zero if they can't be determined, e.g. if the image can't be retrieved or
+// decoded, since they're optional.
+func (e *Epub) setCoverImage(imageFilename string) {
+	e.cover.imageFilename = imageFilename
+	e.cover.width, e.cover.height = 0, 0
+	if _, ok := e.images[imageFilename]; ok {
+		if width, height, err := e.imageDimensions(imageFilename); err == nil {
+			e.cover.width, e.cover.height = width, height
+		}
+	}
+}
+
+// Remove the current cover page, if any, along with its image, unless it's the
+// image of the new cover, and its CSS
+func (e *Epub) removeCover(newImageFilename string) {
+	if e.cover.xhtmlFilename == "" && e.cover.imageFilename == "" {
+		return
+	}
+
+	// Remove the xhtml file
+	for i, section := range e.sections {
+		if e.cover.xhtmlFilename != "" && section.filename == e.cover.xhtmlFilename {
+			e.sections = append(e.sections[:i], e.sections[i+1:]...)
+			break
+		}
+	}
+
+	// Remove the image
+	if e.cover.imageFilename != newImageFilename {
+		delete(e.images, e.cover.imageFilename)
+		delete(e.mediaTypes, path.Join(ImageFolderName, e.cover.imageFilename))
+		delete(e.mediaData, path.Join(ImageFolderName, e.cover.imageFilename))
+		delete(e.imageAltTexts, e.cover.imageFilename)
+	}
+
+	// Remove the CSS
+	if e.cover.cssFilename != "" {
+		delete(e.css, e.cover.cssFilename)
+	}
+
+	e.cover.cssFilename = ""
+	e.cover.imageFilename = ""
+	e.cover.width = 0
+	e.cover.height = 0
+	e.cover.xhtmlFilename = ""
+}
+
+// Get the body of a cover page showing the image, using the cover template if
+// one has been set or the alt text of the image if it has one
+func (e *Epub) coverBody(internalImagePath string, internalCSSPath string) string {
+	if e.coverTemplate != nil {
+		body, err := executeCoverTemplate(e.coverTemplate, coverTemplateData{
+			CSSPath:   internalCSSPath,
+			ImagePath: internalImagePath,
+			Title:     e.title,
+			Width:     e.cover.width,
+			Height:    e.cover.height,
+		})
+		if err != nil {
+			// The template was checked when it was set
+			panic(fmt.Sprintf("Error executing cover template: %s", err))
+		}
+		return body
+	}
+
+	altText, ok := e.imageAltTexts[filepath.Base(internalImagePath)]
+	if !ok {
+		altText = e.messages().coverAltText
+	}
+
+	return fmt.Sprintf(defaultCoverBody, html.EscapeString(internalImagePath), html.EscapeString(altText))
+}
+
+// Set the unique identifier without locking the Epub
+func (e *Epub) setIdentifier(identifier string) {
+	e.identifier = identifier
+	e.identifierScheme = ""
+	e.pkg.setIdentifier(identifier)
+	e.pkg.setIdentifierScheme("", "")
+	e.toc.setIdentifier(identifier)
+}
+
+// Set the page spread of a section without locking the Epub
+func (e *Epub) setPageSpread(internalFilename string, spread string) error {
+	switch spread {
+	case "", PageSpreadCenter, PageSpreadLeft, PageSpreadRight:
+	default:
+		return ErrInvalidPageSpread
+	}
+
+	i := e.sectionIndex(internalFilename)
+	if i == -1 {
+		return ErrSectionNotFound
+	}
+
+	// Replace any page spread that's already been set, including the unprefixed
+	// page spreads that can be set by AddSectionWithSpineProperties
+	properties := []string{}
+	for _, property := range e.sections[i].spineProperties {
+		if !strings.HasPrefix(property, pageSpreadPropertyPrefix) && !strings.HasPrefix(property, unprefixedPageSpreadProperty) {
+			properties = append(properties, property)
+		}
+	}
+	if spread != "" {
+		properties = append(properties, pageSpreadPropertyPrefix+spread)
+	}
+	e.sections[i].spineProperties = properties
+
+	return nil
+}
+
+// Add a media file to the EPUB and return the path relative to the EPUB section
+// files. The source must already have been checked (see checkMediaSource).
+func (e *Epub) addMedia(source string, internalFilename string, mediaFileFormat string, mediaFolderName string, mediaMap map[string]string) (string, error) {
+	return e.addMediaFile(source, nil, internalFilename, "", mediaFileFormat, mediaFolderName, mediaMap)
+}
+
+// Add a media file to the EPUB from either its source or its data, which is
+// kept in memory in place of the source if it isn't nil. The given media type
+// is used instead of the one determined from the extension of the filename if
+// it isn't empty.
+func (e *Epub) addMediaFile(source string, data []byte, internalFilename string, mediaType string, mediaFileFormat string, mediaFolderName string, mediaMap map[string]string) (string, error) {
+	internalFilename = mediaFilename(source, internalFilename, mediaFileFormat, mediaMap)
+	if !isFilenameValid(internalFilename) {
+		return "", ErrInvalidFilename
+	}
+	if mediaType == "" && extensionMediaTypes[strings.ToLower(filepath.Ext(internalFilename))] == "" {
+		return "", ErrUnsupportedMediaType
+	}
+
+	if _, ok := mediaMap[internalFilename]; ok {
+		switch e.onDuplicate {
+		case OnDuplicateOverwrite:
+			// The file that's replaced might have been obfuscated or had its media
+			// type set
+			delete(e.obfuscated, path.Join(mediaFolderName, internalFilename))
+			delete(e.mediaTypes, path.Join(mediaFolderName, internalFilename))
+			delete(e.mediaData, path.Join(mediaFolderName, internalFilename))
+		case OnDuplicateRename:
+			internalFilename = renameDuplicate(internalFilename, mediaMap)
+		default:
+			return "", ErrFilenameAlreadyUsed
+		}
+	}
+
+	mediaMap[internalFilename] = source
+	if mediaType != "" {
+		e.mediaTypes[path.Join(mediaFolderName, internalFilename)] = mediaType
+	}
+	if data != nil {
+		e.mediaData[path.Join(mediaFolderName, internalFilename)] = data
+	}
+
+	return filepath.Join(
+		"..",
+		mediaFolderName,
+		internalFilename,
+	), nil
+}
+
+// Add a media file to the EPUB from the provided data and return the path
+// relative to the EPUB section files
+func (e *Epub) addMediaFromBytes(data []byte, internalFilename string, mediaFileFormat string, mediaFolderName string, mediaMap map[string]string) (string, error) {
+	if internalFilename == "" {
+		return "", ErrFilenameRequired
+	}
+
+	// Copy the data so that the caller can reuse it
+	return e.addMediaFile("", append([]byte{}, data...), internalFilename, "", mediaFileFormat, mediaFolderName, mediaMap)
 }
 
-// SetCover sets the cover page for the EPUB using the provided image source and
-// optional CSS.
-//
-// The internal path to an already-added image file (as returned by AddImage) is
-// required.
-//
-// The internal path to an already-added CSS file (as returned by AddCSS) to be
-// used for the cover is optional. If the CSS path isn't provided, default CSS
-// will be used.
-func (e *Epub) SetCover(internalImagePath string, internalCSSPath string) {
-	// If a cover already exists
-	if e.cover.xhtmlFilename != "" {
-		// Remove the xhtml file
-		for i, section := range e.sections {
-			if section.filename == e.cover.xhtmlFilename {
-				e.sections = append(e.sections[:i], e.sections[i+1:]...)
-				break
-			}
+// Add an image from the provided data without locking the Epub, determining the
+// media type from the data if it can't be determined from the filename
+func (e *Epub) addImageFromBytes(data []byte, internalFilename string) (string, error) {
+	if internalFilename != "" && extensionMediaTypes[strings.ToLower(filepath.Ext(internalFilename))] == "" {
+		if mediaType := sniffImageMediaType(data); mediaType != "" {
+			return e.addMediaFile("", append([]byte{}, data...), internalFilename, mediaType, e.imageFilenameFormat, ImageFolderName, e.images)
 		}
+	}
 
-		// Remove the image
-		delete(e.images, e.cover.imageFilename)
+	return e.addMediaFromBytes(data, internalFilename, e.imageFilenameFormat, ImageFolderName, e.images)
+}
 
-		// Remove the CSS
-		delete(e.css, e.cover.cssFilename)
+// Get the media type of an image from its content if it can't be determined
+// from the extension of the internal filename, or of the source if no filename
+// is provided. Returns an empty string if it can be determined from the
+// extension or the content isn't a supported image.
+func sniffImageSourceMediaType(fs afero.Fs, client *http.Client, source string, internalFilename string) string {
+	filename := internalFilename
+	if filename == "" {
+		filename = filepath.Base(source)
+	}
+	if extensionMediaTypes[strings.ToLower(filepath.Ext(filename))] != "" {
+		return ""
+	}
 
-		if e.cover.cssTempFile != "" {
-			e.fs.Remove(e.cover.cssTempFile)
-		}
+	r, err := fetchMediaWithClient(fs, client, source)
+	if err != nil {
+		// This will be reported when the image is added
+		return ""
 	}
+	defer r.Close()
 
-	e.cover.imageFilename = filepath.Base(internalImagePath)
+	data := make([]byte, sniffLen)
+	n, _ := io.ReadFull(r, data)
 
-	// Use default cover stylesheet if one isn't provided
-	if internalCSSPath == "" {
-		// Create a temporary file to hold the default cover CSS
-		tempFile, err := afero.TempFile(e.fs, "", tempDirPrefix)
-		if err != nil {
-			panic(fmt.Sprintf("Error creating temp file: %s", err))
-		}
-		defer func() {
-			if err := tempFile.Close(); err != nil {
-				panic(fmt.Sprintf("Error closing temp file: %s", err))
-			}
-		}()
-		e.cover.cssTempFile = tempFile.Name()
+	return sniffImageMediaType(data[:n])
+}
+
+// Get the media type of an image from its content, or an empty string if it
+// isn't a supported image. Only image types are returned so that other files,
+// such as an HTML error page, aren't added as images.
+func sniffImageMediaType(data []byte) string {
+	mediaType := http.DetectContentType(data)
+	if isImageMediaType(mediaType) {
+		return mediaType
+	}
+
+	return ""
+}
+
+// Get the media type of a media file, which is the media type it was added
+// with, if any, or the media type determined from the extension of its filename
+func (e *Epub) mediaType(mediaFolderName string, mediaFilename string) string {
+	if mediaType, ok := e.mediaTypes[path.Join(mediaFolderName, mediaFilename)]; ok {
+		return mediaType
+	}
+
+	return extensionMediaTypes[strings.ToLower(filepath.Ext(mediaFilename))]
+}
 
-		// Write the default cover CSS to the temp file
-		if _, err = tempFile.WriteString(defaultCoverCSSContent); err != nil {
-			panic(fmt.Sprintf("Error writing CSS file: %s", err))
+// Whether the media type is the media type of a supported image format
+func isImageMediaType(mediaType string) bool {
+	for _, imageMediaType := range extensionMediaTypes {
+		if imageMediaType == mediaType && strings.HasPrefix(mediaType, "image/") {
+			return true
 		}
+	}
 
-		internalCSSPath, err = e.AddCSS(e.cover.cssTempFile, defaultCoverCSSFilename)
-		// If that doesn't work, generate a filename
-		if err == ErrFilenameAlreadyUsed {
-			coverCSSFilename := fmt.Sprintf(
-				cssFileFormat,
-				len(e.css)+1,
-				".css",
-			)
+	return false
+}
+
+// Check whether the media type of a file starts with the prefix (e.g. audio/),
+// using the extension of the internal filename, or of the source if no filename
+// is provided
+func hasMediaTypePrefix(source string, internalFilename string, prefix string) bool {
+	filename := internalFilename
+	if filename == "" {
+		filename = source
+	}
+	mediaType := extensionMediaTypes[strings.ToLower(filepath.Ext(filename))]
+
+	return strings.HasPrefix(mediaType, prefix)
+}
 
-			internalCSSPath, err = e.AddCSS(e.cover.cssTempFile, coverCSSFilename)
-			if err == ErrFilenameAlreadyUsed {
-				// This shouldn't cause an error
-				panic(fmt.Sprintf("Error adding default cover CSS file: %s", err))
+// Check that a filename format contains exactly one integer verb
+func isFilenameFormatValid(format string) bool {
+	verbs := 0
+	for _, match := range formatVerbPattern.FindAllStringSubmatch(format, -1) {
+		switch match[1] {
+		case "%":
+			// A literal percent sign can't have flags
+			if match[0] != "%%" {
+				return false
 			}
-		}
-		if err != nil && err != ErrFilenameAlreadyUsed {
-			panic(err)
+		case "b", "d", "o", "x", "X":
+			verbs++
+		default:
+			return false
 		}
 	}
-	e.cover.cssFilename = filepath.Base(internalCSSPath)
 
-	coverBody := fmt.Sprintf(defaultCoverBody, internalImagePath)
-	// Title won't be used since the cover won't be added to the TOC
-	// First try to use the default cover filename
-	coverPath, err := e.AddSection(coverBody, "", defaultCoverXhtmlFilename, internalCSSPath)
-	// If that doesn't work, generate a filename
-	if err == ErrFilenameAlreadyUsed {
-		coverPath, err = e.AddSection(coverBody, "", "", internalCSSPath)
-		if err == ErrFilenameAlreadyUsed {
-			// This shouldn't cause an error since we're not specifying a filename
-			panic(fmt.Sprintf("Error adding default cover XHTML file: %s", err))
+	return verbs == 1 && !strings.HasSuffix(strings.ReplaceAll(format, "%%", ""), "%")
+}
+
+// Get the internal filename of a media file. If a filename isn't provided, the
+// filename from the source is used, or one is generated if that's already used.
+func mediaFilename(source string, internalFilename string, mediaFileFormat string, mediaMap map[string]string) string {
+	if internalFilename != "" {
+		return internalFilename
+	}
+
+	internalFilename = filepath.Base(source)
+	if _, ok := mediaMap[internalFilename]; ok {
+		internalFilename = fmt.Sprintf(
+			mediaFileFormat,
+			len(mediaMap)+1,
+			strings.ToLower(filepath.Ext(source)),
+		)
+	}
+
+	return internalFilename
+}
+
+// Add a collection without locking the Epub
+func (e *Epub) addCollection(parentID string, name string, collectionType string, position float64) (string, error) {
+	if name == "" {
+		return "", ErrInvalidCollection
+	}
+	switch collectionType {
+	case "", CollectionTypeSeries, CollectionTypeSet:
+	default:
+		return "", ErrInvalidCollection
+	}
+
+	// Make sure the ID isn't used by the unique identifier
+	id := ""
+	for n := len(e.collections) + 1; id == "" || id == e.pkg.xml.Metadata.Identifier.ID; n++ {
+		id = fmt.Sprintf(pkgCollectionIDFormat, n)
+	}
+
+	e.collections = append(e.collections, epubCollection{
+		id:             id,
+		name:           name,
+		collectionType: collectionType,
+		position:       position,
+		parentID:       parentID,
+	})
+	e.pkg.addCollection(id, name, collectionType, position, parentID)
+
+	return id, nil
+}
+
+// Get the index of the collection with the given ID, or -1 if it doesn't exist
+func (e *Epub) collectionIndex(id string) int {
+	for i, collection := range e.collections {
+		if collection.id == id {
+			return i
 		}
 	}
-	e.cover.xhtmlFilename = filepath.Base(coverPath)
+
+	return -1
 }
 
-// SetIdentifier sets the unique identifier of the EPUB, such as a UUID, DOI,
-// ISBN or ISSN. If no identifier is set, a UUID will be automatically
-// generated.
-func (e *Epub) SetIdentifier(identifier string) {
-	e.identifier = identifier
-	e.pkg.setIdentifier(identifier)
-	e.toc.setIdentifier(identifier)
+func copyStringMap(m map[string]string) map[string]string {
+	r := make(map[string]string, len(m))
+	for k, v := range m {
+		r[k] = v
+	}
+
+	return r
 }
 
-// SetLang sets the language of the EPUB.
-func (e *Epub) SetLang(lang string) {
-	e.lang = lang
-	e.pkg.setLang(lang)
+// Add a numeric suffix to the filename so that it isn't used by any of the
+// files in the map, e.g. cover-2.png
+func renameDuplicate(filename string, mediaMap map[string]string) string {
+	ext := filepath.Ext(filename)
+	name := strings.TrimSuffix(filename, ext)
+	for n := 2; ; n++ {
+		renamed := fmt.Sprintf("%s-%d%s", name, n, ext)
+		if _, ok := mediaMap[renamed]; !ok {
+			return renamed
+		}
+	}
 }
 
-// SetPpd sets the page progression direction of the EPUB.
-func (e *Epub) SetPpd(direction string) {
-	e.ppd = direction
-	e.pkg.setPpd(direction)
+// Get the width and height of an image that has been added to the EPUB. The
+// dimensions of SVG images come from the viewBox, or the width and height if
+// there isn't one.
+func (e *Epub) imageDimensions(imageFilename string) (int, int, error) {
+	r, err := e.openMedia(ImageFolderName, imageFilename)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err == nil {
+		return config.Width, config.Height, nil
+	}
+
+	svg := struct {
+		ViewBox string `xml:"viewBox,attr"`
+		Width   string `xml:"width,attr"`
+		Height  string `xml:"height,attr"`
+	}{}
+	if err := xml.Unmarshal(data, &svg); err != nil {
+		return 0, 0, err
+	}
+	var width, height float64
+	if fields := strings.Fields(strings.Replace(svg.ViewBox, ",", " ", -1)); len(fields) == 4 {
+		width, _ = strconv.ParseFloat(fields[2], 64)
+		height, _ = strconv.ParseFloat(fields[3], 64)
+	} else {
+		width, _ = strconv.ParseFloat(strings.TrimSuffix(svg.Width, "px"), 64)
+		height, _ = strconv.ParseFloat(strings.TrimSuffix(svg.Height, "px"), 64)
+	}
+	if width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("unable to determine the dimensions of the SVG image")
+	}
+
+	return int(math.Ceil(width)), int(math.Ceil(height)), nil
 }
 
-// SetTitle sets the title of the EPUB.
-func (e *Epub) SetTitle(title string) {
-	e.title = title
-	e.pkg.setTitle(title)
-	e.toc.setTitle(title)
+// Read a media file from the provided reader so that it can be added to the
+// EPUB
+func readMediaFromReader(r io.Reader, internalFilename string) ([]byte, error) {
+	// Check this before reading so we don't read data we can't use
+	if internalFilename == "" {
+		return nil, ErrFilenameRequired
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, ErrRetrievingFile
+	}
+
+	return data, nil
 }
 
-// Title returns the title of the EPUB.
-func (e *Epub) Title() string {
-	return e.title
+// Get the HTTP client used to retrieve media files from URLs
+func (e *Epub) client() *http.Client {
+	if e.httpClient == nil {
+		return http.DefaultClient
+	}
+
+	return e.httpClient
 }
 
-// Add a media file to the EPUB and return the path relative to the EPUB section
-// files
-func (e *Epub) addMedia(source string, internalFilename string, mediaFileFormat string, mediaFolderName string, mediaMap map[string]string) (string, error) {
-	// Make sure the source file is valid before proceeding
-	if e.isFileSourceValid(source) == false {
-		return "", ErrRetrievingFile
+// Get the HTTP client the same way as client, locking the Epub only while
+// doing so, for retrieving media files without locking the Epub
+func (e *Epub) lockedClient() *http.Client {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.client()
+}
+
+// Download a media file using the context for the request. Returns the error of
+// the context if it's done before the download finishes, or ErrRetrievingFile
+// for any other error.
+func downloadMedia(ctx context.Context, client *http.Client, mediaURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mediaURL, nil)
+	if err != nil {
+		return nil, ErrRetrievingFile
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, ErrRetrievingFile
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, ErrRetrievingFile
 	}
 
-	if internalFilename == "" {
-		// If a filename isn't provided, use the filename from the source
-		internalFilename = filepath.Base(source)
-		// If that's already used, try to generate a unique filename
-		if _, ok := mediaMap[internalFilename]; ok {
-			internalFilename = fmt.Sprintf(
-				mediaFileFormat,
-				len(mediaMap)+1,
-				strings.ToLower(filepath.Ext(source)),
-			)
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
+		return nil, ErrRetrievingFile
 	}
 
-	if _, ok := mediaMap[internalFilename]; ok {
-		return "", ErrFilenameAlreadyUsed
+	return data, nil
+}
+
+// Open a media file that has been added to the EPUB, from memory if it was
+// added from memory, or otherwise from its source
+func (e *Epub) openMedia(mediaFolderName string, mediaFilename string) (io.ReadCloser, error) {
+	if data, ok := e.mediaData[path.Join(mediaFolderName, mediaFilename)]; ok {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
 	}
 
-	mediaMap[internalFilename] = source
+	return e.fetchMedia(e.mediaFolders()[mediaFolderName][mediaFilename])
+}
 
-	return filepath.Join(
-		"..",
-		mediaFolderName,
-		internalFilename,
-	), nil
+// Open the media file at the given source, which can be a URL or a path to a
+// local file
+func (e *Epub) fetchMedia(source string) (io.ReadCloser, error) {
+	return fetchMediaWithClient(e.fs, e.client(), source)
 }
 
-func (e *Epub) isFileSourceValid(source string) bool {
+// Open the media file at the given source the same way as fetchMedia, using
+// the given filesystem and HTTP client so that the Epub doesn't need to be
+// locked
+func fetchMediaWithClient(fs afero.Fs, client *http.Client, source string) (io.ReadCloser, error) {
 	u, err := url.Parse(source)
 	if err != nil {
-		return false
+		return nil, err
 	}
 
-	var r io.ReadCloser
-	var resp *http.Response
-	// If it's a URL
-	if u.Scheme == "http" || u.Scheme == "https" {
-		resp, err = http.Get(source)
+	switch u.Scheme {
+	case "http", "https":
+		resp, err := client.Get(source)
 		if err != nil {
-			return false
+			return nil, err
 		}
-		r = resp.Body
+		return resp.Body, nil
+	}
 
-		// Otherwise, assume it's a local file
-	} else {
-		r, err = e.fs.Open(source)
+	// Otherwise, assume it's a local file
+	return fs.Open(source)
+}
+
+// Whether the source of a media file is a local file rather than a URL
+func isLocalSource(source string) bool {
+	u, err := url.Parse(source)
+	if err != nil {
+		return false
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return false
 	}
+
+	return true
+}
+
+func (e *Epub) isFileSourceValid(source string) bool {
+	return isMediaSourceValid(e.fs, e.client(), source)
+}
+
+// Make sure the source of a media file can be retrieved before it's added,
+// without locking the Epub while retrieving it
+func (e *Epub) checkMediaSource(source string) error {
+	if !isMediaSourceValid(e.fs, e.lockedClient(), source) {
+		return ErrRetrievingFile
+	}
+
+	return nil
+}
+
+// Check whether the media file at the given source can be retrieved, using the
+// given filesystem and HTTP client
+func isMediaSourceValid(fs afero.Fs, client *http.Client, source string) bool {
+	r, err := fetchMediaWithClient(fs, client, source)
 	if err != nil {
 		return false
 	}
@@ -455,3 +3687,163 @@ func (e *Epub) isFileSourceValid(source string) bool {
 
 	return true
 }
+
+// Insert a section at the given index of the sections
+func (e *Epub) insertSection(index int, s epubSection) {
+	e.sections = append(e.sections, epubSection{})
+	copy(e.sections[index+1:], e.sections[index:])
+	e.sections[index] = s
+}
+
+// Check whether a section is a descendant (sub-section, sub-sub-section, etc)
+// of the section with the given internal filename
+func (e *Epub) isDescendant(s epubSection, ancestorFilename string) bool {
+	for s.parentFilename != "" {
+		if s.parentFilename == ancestorFilename {
+			return true
+		}
+		i := e.sectionIndex(s.parentFilename)
+		if i == -1 {
+			return false
+		}
+		s = e.sections[i]
+	}
+
+	return false
+}
+
+// Create a new section, generating a filename if one isn't provided
+func (e *Epub) newSection(body string, sectionTitle string, internalFilename string, internalCSSPaths ...string) (epubSection, error) {
+	internalFilename, err := e.newSectionFilename(internalFilename)
+	if err != nil {
+		return epubSection{}, err
+	}
+
+	body, err = documentBody(body)
+	if err != nil {
+		return epubSection{}, err
+	}
+	if e.sanitizeHTML {
+		body = sanitizeHTML(body)
+	}
+	x := newXhtml(body)
+	x.setTitle(sectionTitle)
+	x.setCSS(internalCSSPaths...)
+
+	// Catch malformed XHTML here rather than when the EPUB is read
+	if err := x.validate(); err != nil {
+		return epubSection{}, err
+	}
+
+	return epubSection{
+		filename: internalFilename,
+		xhtml:    x,
+	}, nil
+}
+
+// Get the ONIX code list 5 identifier type of an identifier with the given
+// scheme
+func identifierTypeCode(identifier string, scheme string) (string, error) {
+	switch scheme {
+	case IdentifierSchemeDOI:
+		return onixIdentifierTypeDOI, nil
+	case IdentifierSchemeUUID:
+		return onixIdentifierTypeURN, nil
+	case IdentifierSchemeISBN:
+		digits := strings.NewReplacer("-", "", " ", "").Replace(identifier)
+		switch len(digits) {
+		case 10:
+			return onixIdentifierTypeISBN10, nil
+		case 13:
+			return onixIdentifierTypeISBN13, nil
+		}
+	}
+
+	return "", ErrInvalidIdentifierScheme
+}
+
+// Get the internal filename for a new section, generating one if it isn't
+// provided
+func (e *Epub) newSectionFilename(internalFilename string) (string, error) {
+	// Generate a filename if one isn't provided
+	if internalFilename == "" {
+		// Sections can be removed, so make sure the generated name isn't in use
+		for n := len(e.sections) + 1; internalFilename == "" || e.sectionIndex(internalFilename) != -1; n++ {
+			internalFilename = fmt.Sprintf(e.sectionFilenameFormat, n)
+		}
+	}
+
+	if !isFilenameValid(internalFilename) {
+		return "", ErrInvalidFilename
+	}
+	if e.sectionIndex(internalFilename) != -1 {
+		return "", ErrFilenameAlreadyUsed
+	}
+
+	return internalFilename, nil
+}
+
+// Check that an internal filename is a single path element, since files are
+// stored directly in the folder for their kind, and that it follows the rules
+// for file names in EPUB files, so that it can be extracted on any filesystem.
+// This also rules out relative paths such as "..", which end with a full stop.
+// Spec: https://www.w3.org/TR/epub-33/#sec-container-filenames
+func isFilenameValid(filename string) bool {
+	if filename == "" || len(filename) > maxFilenameLength || !utf8.ValidString(filename) ||
+		strings.ContainsAny(filename, invalidFilenameChars) || strings.HasSuffix(filename, ".") {
+		return false
+	}
+	for _, r := range filename {
+		// Control characters, private use characters, and noncharacters
+		if unicode.IsControl(r) || unicode.Is(unicode.Co, r) || (r >= 0xfdd0 && r <= 0xfdef) || r&0xfffe == 0xfffe {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Get the path of a landmark target relative to the EPUB 3 TOC file, and
+// whether the target exists
+func (e *Epub) landmarkPath(target string) (string, bool) {
+	filename := target
+	if i := strings.Index(target, "#"); i != -1 {
+		filename = target[:i]
+	}
+
+	if filename == tocNavFilename {
+		return target, true
+	}
+	if e.sectionIndex(filename) == -1 {
+		return "", false
+	}
+
+	return filepath.Join(xhtmlFolderName, target), true
+}
+
+// Get the primary language followed by any additional languages
+func (e *Epub) langs() []string {
+	return append([]string{e.lang}, e.additionalLangs...)
+}
+
+// Get the index of the section with the given internal filename, or -1 if
+// there isn't one
+func (e *Epub) sectionIndex(internalFilename string) int {
+	for i, section := range e.sections {
+		if section.filename == internalFilename {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Get the title of the section to show in the TOC, or an empty string if the
+// section shouldn't be in the TOC
+func (s epubSection) tocTitle() string {
+	if s.navTitle != "" {
+		return s.navTitle
+	}
+
+	return s.xhtml.Title()
+}
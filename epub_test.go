@@ -3,23 +3,38 @@ package epub
 import (
 	"archive/zip"
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/spf13/afero"
+	"golang.org/x/text/language"
 )
 
 const (
 	doCleanup             = true
+	testAudioSource       = "testdata/narration.mp3"
 	testAuthorTemplate    = `<dc:creator id="creator">%s</dc:creator>`
 	testContainerContents = `<?xml version="1.0" encoding="UTF-8"?>
 <container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
@@ -40,25 +55,91 @@ const (
     <img src="%s" alt="Cover Image" />
   </body>
 </html>`
-	testCSSLinkTemplate       = `<link rel="stylesheet" type="text/css" href="%s"></link>`
-	testDirPerm               = 0775
-	testEpubAuthor            = "Hingle McCringleberry"
-	testEpubcheckJarfile      = "epubcheck.jar"
-	testEpubcheckPrefix       = "epubcheck"
-	testEpubFilename          = "My EPUB.epub"
-	testEpubIdentifier        = "urn:uuid:51b7c9ea-b2a2-49c6-9d8c-522790786d15"
-	testEpubLang              = "fr"
-	testEpubPpd               = "rtl"
-	testEpubTitle             = "My title"
-	testFontFromFileSource    = "testdata/redacted-script-regular.ttf"
-	testIdentifierTemplate    = `<dc:identifier id="pub-id">%s</dc:identifier>`
-	testImageFromFileFilename = "testfromfile.png"
-	testImageFromFileSource   = "testdata/gophercolor16x16.png"
-	testImageFromURLSource    = "https://golang.org/doc/gopher/gophercolor16x16.png"
-	testLangTemplate          = `<dc:language>%s</dc:language>`
-	testPpdTemplate           = `page-progression-direction="%s"`
-	testMimetypeContents      = "application/epub+zip"
-	testPkgContentTemplate    = `<?xml version="1.0" encoding="UTF-8"?>
+	testCSSFromBytesFilename     = "testfrombytes.css"
+	testCSSItemTemplate          = `<item id="%s" href="css/%s" media-type="text/css"></item>`
+	testCSSLinkTemplate          = `<link rel="stylesheet" type="text/css" href="%s"></link>`
+	testCSSWithFontsSource       = "testdata/fonts.css"
+	testDirPerm                  = 0775
+	testEpub2CoverMetaTemplate   = `<meta name="cover" content="%s"></meta>`
+	testEpub2DoctypeElement      = `<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.1//EN" "http://www.w3.org/TR/xhtml11/DTD/xhtml11.dtd">`
+	testEpub2PkgTemplate         = `<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="pub-id" version="2.0">`
+	testEpubAuthor               = "Hingle McCringleberry"
+	testEpubcheckJarfile         = "epubcheck.jar"
+	testEpubcheckPrefix          = "epubcheck"
+	testEpubFilename             = "My EPUB.epub"
+	testEpubIdentifier           = "urn:uuid:51b7c9ea-b2a2-49c6-9d8c-522790786d15"
+	testEpubISBN                 = "978-3-16-148410-0"
+	testEpubLang                 = "fr"
+	testEpubPpd                  = "rtl"
+	testEpubRights               = "Copyright © 2017 Hingle McCringleberry & Jamie Sneed"
+	testEpubSource               = "https://example.com/books?isbn=9780261103344&edition=1"
+	testEpubTitle                = "My title"
+	testFontFromBytesFilename    = "testfrombytes.ttf"
+	testFontFromFileSource       = "testdata/redacted-script-regular.ttf"
+	testFontItemTemplate         = `<item id="%s" href="fonts/%s" media-type="application/x-font-ttf"></item>`
+	testIdentifierTemplate       = `<dc:identifier id="pub-id">%s</dc:identifier>`
+	testImageFromFileFilename    = "testfromfile.png"
+	testImageFromFileSource      = "testdata/gophercolor16x16.png"
+	testImageFromBytesFilename   = "testfrombytes.png"
+	testImageFromReaderFilename  = "testfromreader.png"
+	testImageFromURLSource       = "https://golang.org/doc/gopher/gophercolor16x16.png"
+	testImageItemTemplate        = `<item id="%s" href="images/%s" media-type="%s"></item>`
+	testImageWebpSource          = "testdata/pixel.webp"
+	testImageWebpItemTemplate    = `<item id="%s" href="images/%s" media-type="image/webp" properties="cover-image"></item>`
+	testItemrefIdrefTemplate     = `<itemref idref="%s"`
+	testItemrefNonLinearTemplate = `<itemref idref="%s" linear="no"></itemref>`
+	testItemrefTemplate          = `<itemref idref="%s" properties="%s"></itemref>`
+	testJavaScriptSource         = "testdata/quiz.js"
+	testLandmarkTemplate         = `<a epub:type="%s" href="%s">%s</a>`
+	testLangTemplate             = `<dc:language>%s</dc:language>`
+	testLinkTemplate             = `<link rel="stylesheet" type="text/css" href="%s"></link>`
+	testMediaOverlay             = `<smil xmlns="http://www.w3.org/ns/SMIL" xmlns:epub="http://www.idpf.org/2007/ops" version="3.0">
+  <body>
+    <seq epub:textref="section0001.xhtml">
+      <par id="par1"><text src="section0001.xhtml#p1" /><audio src="../audio/narration.mp3" clipBegin="0:00:00" clipEnd="0:00:02.5" /></par>
+      <par id="par2"><text src="section0001.xhtml#p2" /><audio src="../audio/narration.mp3" clipBegin="2.5s" clipEnd="5500ms" /></par>
+    </seq>
+  </body>
+</smil>`
+	testMetaProperty      = "foaf:name"
+	testMetaValue         = "Example Publisher"
+	testNavLinkTemplate   = `<a href="xhtml/%s">%s</a>`
+	testNavNestedContents = `<ol>
+        <li>
+          <a href="xhtml/section0001.xhtml">Chapter 1</a>
+          <ol>
+            <li>
+              <a href="xhtml/section0002.xhtml">Section 1.1</a>
+            </li>
+            <li>
+              <a href="xhtml/section0003.xhtml">Section 1.2</a>
+            </li>
+          </ol>
+        </li>
+        <li>
+          <a href="xhtml/section0004.xhtml">Chapter 2</a>
+        </li>
+      </ol>`
+	testNcxNestedContents = `<navPoint id="navPoint-0" playOrder="1">
+      <navLabel>
+        <text>Chapter 1</text>
+      </navLabel>
+      <content src="xhtml/section0001.xhtml"></content>
+      <navPoint id="navPoint-1" playOrder="2">
+        <navLabel>
+          <text>Section 1.1</text>
+        </navLabel>
+        <content src="xhtml/section0002.xhtml"></content>
+      </navPoint>`
+	testPackageFilename = "content.opf"
+	testPlainText       = "Chapter 1\nIt was a dark and stormy night…\nTom & Jerry ran.\nThe end.\n\nSecond section"
+	testPlainTextBody1  = `<h1>Chapter  1</h1>
+	<p>It was a <em>dark</em> and <b>storm<i>y</i></b> night&#8230;</p><script>var x = 1;</script>
+	<p>Tom &amp; Jerry&#160;ran.<br/>The end.</p>`
+	testPlainTextBody2     = `<p>Second   section</p>`
+	testPpdTemplate        = `page-progression-direction="%s"`
+	testMimetypeContents   = "application/epub+zip"
+	testPkgContentTemplate = `<?xml version="1.0" encoding="UTF-8"?>
 <package xmlns="http://www.idpf.org/2007/opf" unique-identifier="pub-id" version="3.0">
   <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
     <dc:identifier id="pub-id">%s</dc:identifier>
@@ -72,7 +153,8 @@ const (
   </manifest>
   <spine toc="ncx"></spine>
 </package>`
-	testSectionBody = `    <h1>Section 1</h1>
+	testRightsTemplate = `<dc:rights>%s</dc:rights>`
+	testSectionBody    = `    <h1>Section 1</h1>
 	<p>This is a paragraph.</p>`
 	testSectionContentTemplate = `<?xml version="1.0" encoding="UTF-8"?>
 <!DOCTYPE html>
@@ -84,12 +166,35 @@ const (
     %s
   </body>
 </html>`
-	testSectionFilename = "section0001.xhtml"
-	testSectionTitle    = "Section 1"
-	testTempDirPrefix   = "go-epub"
-	testTitleTemplate   = `<dc:title>%s</dc:title>`
+	testSectionFilename       = "section0001.xhtml"
+	testSectionFromFileSource = "testdata/chapter.html"
+	testSectionTitle          = "Section 1"
+	testSeriesName            = "The Stormlight Archive"
+	testSourceTemplate        = `<dc:source>%s</dc:source>`
+	testSVGImage              = `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 600 800"><rect width="600" height="800" fill="navy" /></svg>`
+	testTempDirPrefix         = "go-epub"
+	testTitleTemplate         = `<dc:title>%s</dc:title>`
+	testTocTitle              = "Sommaire"
+	testVideoSource           = "testdata/trailer.mp4"
+	testVocabularyPrefix      = "foaf"
+	testVocabularyURI         = "http://xmlns.com/foaf/spec/"
 )
 
+// A complete XHTML document, including things that would be lost if it were
+// wrapped in the section template
+const testRawSectionContents = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" lang="en">
+<head>
+<title>Raw section</title>
+<script type="text/javascript">var x = 1;</script>
+</head>
+<body>
+<section epub:type="chapter"><p>Raw&#160;section</p></section>
+</body>
+</html>
+`
+
 func getFs() afero.Fs {
 	fsFlag := os.Getenv("TESTFS")
 
@@ -107,9 +212,15 @@ func getFs() afero.Fs {
 
 func copyTestData(fs afero.Fs) {
 	testFiles := []string{
+		testAudioSource,
 		testCoverCSSSource,
+		testCSSWithFontsSource,
 		testImageFromFileSource,
 		testFontFromFileSource,
+		testImageWebpSource,
+		testJavaScriptSource,
+		testSectionFromFileSource,
+		testVideoSource,
 	}
 
 	for _, filename := range testFiles {
@@ -193,6 +304,98 @@ func TestEpubWrite(t *testing.T) {
 	cleanup(e.fs, testEpubFilename, tempDir)
 }
 
+func TestEpubMimetypeFirstAndStored(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+
+	err := e.Write(testEpubFilename)
+	if err != nil {
+		t.Errorf("Unexpected error writing EPUB: %s", err)
+	}
+
+	f, err := e.fs.Open(testEpubFilename)
+	if err != nil {
+		t.Fatalf("Unexpected error opening EPUB: %s", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Unexpected error getting EPUB file info: %s", err)
+	}
+	r, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB: %s", err)
+	}
+
+	if r.File[0].Name != mimetypeFilename {
+		t.Errorf(
+			"First file in EPUB doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			r.File[0].Name,
+			mimetypeFilename)
+	}
+	if r.File[0].Method != zip.Store {
+		t.Errorf(
+			"Mimetype compression method doesn't match\n"+
+				"Got: %d\n"+
+				"Expected: %d",
+			r.File[0].Method,
+			zip.Store)
+	}
+
+	cleanup(e.fs, testEpubFilename, "")
+}
+
+func TestStoreIncompressibleMedia(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	var jpegData bytes.Buffer
+	err := jpeg.Encode(&jpegData, image.NewGray(image.Rect(0, 0, 16, 16)), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error encoding JPEG: %s", err)
+	}
+	testJpegPath, _ := e.AddImageFromBytes(jpegData.Bytes(), "test.jpg")
+	testSectionPath, _ := e.AddSection(testSectionBody, testSectionTitle, "", "")
+
+	err = e.Write(testEpubFilename)
+	if err != nil {
+		t.Errorf("Unexpected error writing EPUB: %s", err)
+	}
+
+	contents, err := afero.ReadFile(e.fs, testEpubFilename)
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB file: %s", err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(contents), int64(len(contents)))
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB: %s", err)
+	}
+
+	expectedMethods := map[string]uint16{
+		path.Join(contentFolderName, ImageFolderName, filepath.Base(testJpegPath)): zip.Store,
+		path.Join(contentFolderName, xhtmlFolderName, testSectionPath):             zip.Deflate,
+	}
+	for _, f := range r.File {
+		if expectedMethod, ok := expectedMethods[f.Name]; ok {
+			if f.Method != expectedMethod {
+				t.Errorf(
+					"Compression method of %s doesn't match\n"+
+						"Got: %d\n"+
+						"Expected: %d",
+					f.Name,
+					f.Method,
+					expectedMethod)
+			}
+			delete(expectedMethods, f.Name)
+		}
+	}
+	if len(expectedMethods) > 0 {
+		t.Errorf("Files not found in EPUB: %v", expectedMethods)
+	}
+
+	cleanup(e.fs, testEpubFilename, "")
+}
+
 func TestAddCSS(t *testing.T) {
 	e := NewEpubWithFs(testEpubTitle, getFs())
 	testCSS1Path, err := e.AddCSS(testCoverCSSSource, testCoverCSSFilename)
@@ -265,6 +468,76 @@ func TestAddCSS(t *testing.T) {
 	cleanup(e.fs, testEpubFilename, tempDir)
 }
 
+func TestAddCSSAndFontFromBytes(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testCSSContents, err := afero.ReadFile(e.fs, testCoverCSSSource)
+	if err != nil {
+		t.Errorf("Unexpected error reading testdata CSS file: %s", err)
+	}
+	testFontContents, err := afero.ReadFile(e.fs, testFontFromFileSource)
+	if err != nil {
+		t.Errorf("Unexpected error reading testdata font file: %s", err)
+	}
+
+	testCSSPath, err := e.AddCSSFromBytes(testCSSContents, testCSSFromBytesFilename)
+	if err != nil {
+		t.Errorf("Error adding CSS: %s", err)
+	}
+	testFontPath, err := e.AddFontFromBytes(testFontContents, testFontFromBytesFilename)
+	if err != nil {
+		t.Errorf("Error adding font: %s", err)
+	}
+
+	_, err = e.AddCSSFromBytes(testCSSContents, testCSSFromBytesFilename)
+	if err != ErrFilenameAlreadyUsed {
+		t.Errorf("Expected ErrFilenameAlreadyUsed, got: %v", err)
+	}
+	_, err = e.AddFontFromBytes(testFontContents, "")
+	if err != ErrFilenameRequired {
+		t.Errorf("Expected ErrFilenameRequired, got: %v", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	// The CSS and font paths are relative to the XHTML folder
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testCSSPath))
+	if err != nil {
+		t.Errorf("Unexpected error reading CSS file from EPUB: %s", err)
+	}
+	if bytes.Compare(contents, testCSSContents) != 0 {
+		t.Errorf("CSS file contents don't match")
+	}
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testFontPath))
+	if err != nil {
+		t.Errorf("Unexpected error reading font file from EPUB: %s", err)
+	}
+	if bytes.Compare(contents, testFontContents) != 0 {
+		t.Errorf("Font file contents don't match")
+	}
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	testItemElements := []string{
+		fmt.Sprintf(testCSSItemTemplate, testCSSFromBytesFilename, testCSSFromBytesFilename),
+		fmt.Sprintf(testFontItemTemplate, testFontFromBytesFilename, testFontFromBytesFilename),
+	}
+	for _, testItemElement := range testItemElements {
+		if !strings.Contains(string(contents), testItemElement) {
+			t.Errorf(
+				"Manifest item doesn't match\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				testItemElement)
+		}
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
 func TestAddFont(t *testing.T) {
 	e := NewEpubWithFs(testEpubTitle, getFs())
 	testFontFromFilePath, err := e.AddFont(testFontFromFileSource, "")
@@ -291,6 +564,114 @@ func TestAddFont(t *testing.T) {
 	cleanup(e.fs, testEpubFilename, tempDir)
 }
 
+func TestAddObfuscatedFont(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	// Whitespace in the identifier should be ignored when generating the key
+	e.SetIdentifier(" " + testEpubIdentifier + "\n")
+	testFontPath, err := e.AddObfuscatedFont(testFontFromFileSource, "")
+	if err != nil {
+		t.Errorf("Error adding obfuscated font: %s", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	// The font path is relative to the XHTML folder
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testFontPath))
+	if err != nil {
+		t.Errorf("Unexpected error reading font file from EPUB: %s", err)
+	}
+	testFontContents, err := afero.ReadFile(e.fs, testFontFromFileSource)
+	if err != nil {
+		t.Errorf("Unexpected error reading testdata font file: %s", err)
+	}
+
+	if len(contents) != len(testFontContents) {
+		t.Fatalf("Obfuscated font size doesn't match: got %d, expected %d", len(contents), len(testFontContents))
+	}
+	if bytes.Equal(contents[:fontObfuscationLength], testFontContents[:fontObfuscationLength]) {
+		t.Errorf("Font file wasn't obfuscated")
+	}
+	if !bytes.Equal(contents[fontObfuscationLength:], testFontContents[fontObfuscationLength:]) {
+		t.Errorf("Font file contents after the obfuscated bytes don't match")
+	}
+
+	// De-obfuscate the font the way a reading system would
+	key := sha1.Sum([]byte(testEpubIdentifier))
+	for i := 0; i < fontObfuscationLength; i++ {
+		contents[i] ^= key[i%len(key)]
+	}
+	if !bytes.Equal(contents, testFontContents) {
+		t.Errorf("De-obfuscated font file contents don't match")
+	}
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, metaInfFolderName, encryptionFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading encryption file: %s", err)
+	}
+	testCipherReference := fmt.Sprintf(
+		`<enc:CipherReference URI="%s"></enc:CipherReference>`,
+		filepath.ToSlash(filepath.Join(contentFolderName, FontFolderName, filepath.Base(testFontPath))))
+	if !strings.Contains(string(contents), testCipherReference) {
+		t.Errorf(
+			"Encryption file doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testCipherReference)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestEncryptionFile(t *testing.T) {
+	// The encryption file shouldn't be written if nothing is obfuscated
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.AddFont(testFontFromFileSource, "")
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	_, err := e.fs.Stat(filepath.Join(tempDir, metaInfFolderName, encryptionFilename))
+	if !os.IsNotExist(err) {
+		t.Errorf("Encryption file was written without any obfuscated resources")
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+
+	e = NewEpubWithFs(testEpubTitle, getFs())
+	e.AddFont(testFontFromFileSource, "plain.ttf")
+	e.AddObfuscatedFont(testFontFromFileSource, "obfuscated2.ttf")
+	e.AddObfuscatedFont(testFontFromFileSource, "obfuscated1.ttf")
+
+	tempDir = writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, metaInfFolderName, encryptionFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading encryption file: %s", err)
+	}
+
+	if strings.Count(string(contents), fontObfuscationAlgorithm) != 2 {
+		t.Errorf("Encryption algorithm doesn't match: %s", contents)
+	}
+	var uris []string
+	for _, match := range regexp.MustCompile(`URI="([^"]*)"`).FindAllStringSubmatch(string(contents), -1) {
+		uris = append(uris, match[1])
+	}
+	testURIs := []string{
+		contentFolderName + "/" + FontFolderName + "/obfuscated1.ttf",
+		contentFolderName + "/" + FontFolderName + "/obfuscated2.ttf",
+	}
+	if !reflect.DeepEqual(uris, testURIs) {
+		t.Errorf(
+			"Obfuscated resources don't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			uris,
+			testURIs)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
 func TestAddImage(t *testing.T) {
 	e := NewEpubWithFs(testEpubTitle, getFs())
 	testImageFromFilePath, err := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
@@ -339,40 +720,98 @@ func TestAddImage(t *testing.T) {
 	cleanup(e.fs, testEpubFilename, tempDir)
 }
 
-func TestAddSection(t *testing.T) {
+func TestAddImageFromBytes(t *testing.T) {
 	e := NewEpubWithFs(testEpubTitle, getFs())
-	testSection1Path, err := e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+	testImageContents, err := afero.ReadFile(e.fs, testImageFromFileSource)
 	if err != nil {
-		t.Errorf("Error adding section: %s", err)
+		t.Errorf("Unexpected error reading testdata image file: %s", err)
 	}
 
-	testSection2Path, err := e.AddSection(testSectionBody, testSectionTitle, "", "")
+	testImagePath, err := e.AddImageFromBytes(testImageContents, testImageFromBytesFilename)
 	if err != nil {
-		t.Errorf("Error adding section: %s", err)
+		t.Errorf("Error adding image: %s", err)
+	}
+	if testImagePath != filepath.Join("..", ImageFolderName, testImageFromBytesFilename) {
+		t.Errorf("Unexpected image path: %s", testImagePath)
+	}
+
+	_, err = e.AddImageFromBytes(testImageContents, testImageFromBytesFilename)
+	if err != ErrFilenameAlreadyUsed {
+		t.Errorf("Expected ErrFilenameAlreadyUsed, got: %v", err)
+	}
+	_, err = e.AddImageFromBytes(testImageContents, "")
+	if err != ErrFilenameRequired {
+		t.Errorf("Expected ErrFilenameRequired, got: %v", err)
 	}
 
 	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
 
-	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSection1Path))
+	// The image path is relative to the XHTML folder
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testImagePath))
 	if err != nil {
-		t.Errorf("Unexpected error reading section file: %s", err)
+		t.Errorf("Unexpected error reading image file from EPUB: %s", err)
+	}
+	if bytes.Compare(contents, testImageContents) != 0 {
+		t.Errorf("Image file contents don't match")
 	}
 
-	testSectionContents := fmt.Sprintf(testSectionContentTemplate, testSectionTitle, testSectionBody)
-	if trimAllSpace(string(contents)) != trimAllSpace(testSectionContents) {
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	testImageItemElement := fmt.Sprintf(testImageItemTemplate, testImageFromBytesFilename, testImageFromBytesFilename, "image/png")
+	if !strings.Contains(string(contents), testImageItemElement) {
 		t.Errorf(
-			"Section file contents don't match\n"+
+			"Image manifest item doesn't match\n"+
 				"Got: %s\n"+
 				"Expected: %s",
 			contents,
-			testSectionContents)
+			testImageItemElement)
 	}
 
-	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSection2Path))
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestAddFromReader(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testImageContents, err := afero.ReadFile(e.fs, testImageFromFileSource)
 	if err != nil {
-		t.Errorf("Unexpected error reading section file: %s", err)
+		t.Errorf("Unexpected error reading testdata image file: %s", err)
+	}
+
+	testImagePath, err := e.AddImageFromReader(bytes.NewReader(testImageContents), testImageFromReaderFilename)
+	if err != nil {
+		t.Errorf("Error adding image: %s", err)
+	}
+	_, err = e.AddImageFromReader(bytes.NewReader(testImageContents), "")
+	if err != ErrFilenameRequired {
+		t.Errorf("Expected ErrFilenameRequired, got: %v", err)
+	}
+	_, err = e.AddCSSFromReader(iotest.ErrReader(io.ErrUnexpectedEOF), testCoverCSSFilename)
+	if err != ErrRetrievingFile {
+		t.Errorf("Expected ErrRetrievingFile, got: %v", err)
+	}
+
+	testSectionPath, err := e.AddSectionFromReader(strings.NewReader(testSectionBody), testSectionTitle, "", "")
+	if err != nil {
+		t.Errorf("Error adding section: %s", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testImagePath))
+	if err != nil {
+		t.Errorf("Unexpected error reading image file from EPUB: %s", err)
+	}
+	if bytes.Compare(contents, testImageContents) != 0 {
+		t.Errorf("Image file contents don't match")
 	}
 
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSectionPath))
+	if err != nil {
+		t.Errorf("Unexpected error reading section file: %s", err)
+	}
+	testSectionContents := fmt.Sprintf(testSectionContentTemplate, testSectionTitle, testSectionBody)
 	if trimAllSpace(string(contents)) != trimAllSpace(testSectionContents) {
 		t.Errorf(
 			"Section file contents don't match\n"+
@@ -385,18 +824,14 @@ func TestAddSection(t *testing.T) {
 	cleanup(e.fs, testEpubFilename, tempDir)
 }
 
-func TestEpubAuthor(t *testing.T) {
+func TestAddImageWebp(t *testing.T) {
 	e := NewEpubWithFs(testEpubTitle, getFs())
-	e.SetAuthor(testEpubAuthor)
-
-	if e.Author() != testEpubAuthor {
-		t.Errorf(
-			"Author doesn't match\n"+
-				"Got: %s\n"+
-				"Expected: %s",
-			e.Author(),
-			testEpubAuthor)
+	testImagePath, err := e.AddImage(testImageWebpSource, "")
+	if err != nil {
+		t.Errorf("Error adding image: %s", err)
 	}
+	// Use the image as the cover to make sure WebP covers are handled as well
+	e.SetCover(testImagePath, "")
 
 	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
 
@@ -405,207 +840,4890 @@ func TestEpubAuthor(t *testing.T) {
 		t.Errorf("Unexpected error reading package file: %s", err)
 	}
 
-	testAuthorElement := fmt.Sprintf(testAuthorTemplate, testEpubAuthor)
-	if !strings.Contains(string(contents), testAuthorElement) {
+	testImageFilename := filepath.Base(testImagePath)
+	testImageItemElement := fmt.Sprintf(testImageWebpItemTemplate, testImageFilename, testImageFilename)
+	if !strings.Contains(string(contents), testImageItemElement) {
 		t.Errorf(
-			"Author doesn't match\n"+
+			"Image manifest item doesn't match\n"+
 				"Got: %s\n"+
 				"Expected: %s",
 			contents,
-			testAuthorElement)
+			testImageItemElement)
 	}
 
 	cleanup(e.fs, testEpubFilename, tempDir)
 }
 
-func TestEpubLang(t *testing.T) {
+func TestAddJavaScript(t *testing.T) {
 	e := NewEpubWithFs(testEpubTitle, getFs())
-	e.SetLang(testEpubLang)
-
-	if e.Lang() != testEpubLang {
-		t.Errorf(
-			"Language doesn't match\n"+
-				"Got: %s\n"+
-				"Expected: %s",
-			e.Lang(),
-			testEpubLang)
+	testJavaScriptPath, err := e.AddJavaScript(testJavaScriptSource, "")
+	if err != nil {
+		t.Errorf("Error adding JavaScript: %s", err)
+	}
+	testScriptedSectionPath, _ := e.AddSection(testSectionBody, testSectionTitle, "", "")
+	err = e.AddScriptToSection(testScriptedSectionPath, testJavaScriptPath)
+	if err != nil {
+		t.Errorf("Error adding script to section: %s", err)
+	}
+	testSectionPath, _ := e.AddSection(testSectionBody, testSectionTitle, "", "")
+	err = e.AddScriptToSection("nonexistent.xhtml", testJavaScriptPath)
+	if err != ErrSectionNotFound {
+		t.Errorf("Adding a script to a nonexistent section should return ErrSectionNotFound, got: %v", err)
 	}
 
 	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
 
-	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	// The JavaScript path is relative to the XHTML folder
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testJavaScriptPath))
 	if err != nil {
-		t.Errorf("Unexpected error reading package file: %s", err)
+		t.Errorf("Unexpected error reading JavaScript file from EPUB: %s", err)
+	}
+	testJavaScriptContents, err := afero.ReadFile(e.fs, testJavaScriptSource)
+	if err != nil {
+		t.Errorf("Unexpected error reading testdata JavaScript file: %s", err)
+	}
+	if !bytes.Equal(contents, testJavaScriptContents) {
+		t.Errorf("JavaScript file contents don't match")
 	}
 
-	testLangElement := fmt.Sprintf(testLangTemplate, testEpubLang)
-	if !strings.Contains(string(contents), testLangElement) {
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testScriptedSectionPath))
+	if err != nil {
+		t.Errorf("Unexpected error reading section file: %s", err)
+	}
+	testScriptElement := fmt.Sprintf(`<script type="application/javascript" src="%s"></script>`, testJavaScriptPath)
+	if !strings.Contains(string(contents), testScriptElement) {
 		t.Errorf(
-			"Language doesn't match\n"+
-				"Got: %s"+
+			"Script element doesn't match\n"+
+				"Got: %s\n"+
 				"Expected: %s",
 			contents,
-			testLangElement)
+			testScriptElement)
 	}
 
-	cleanup(e.fs, testEpubFilename, tempDir)
-}
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	expectedElements := []string{
+		fmt.Sprintf(
+			`<item id="%s" href="%s" media-type="application/javascript"></item>`,
+			filepath.Base(testJavaScriptPath),
+			filepath.ToSlash(filepath.Join(JavaScriptFolderName, filepath.Base(testJavaScriptPath)))),
+		fmt.Sprintf(
+			`<item id="%s" href="%s" media-type="application/xhtml+xml" properties="scripted"></item>`,
+			testScriptedSectionPath,
+			filepath.ToSlash(filepath.Join(xhtmlFolderName, testScriptedSectionPath))),
+	}
+	for _, expected := range expectedElements {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Manifest items don't match\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+	testUnscriptedItem := fmt.Sprintf(
+		`<item id="%s" href="%s" media-type="application/xhtml+xml"></item>`,
+		testSectionPath,
+		filepath.ToSlash(filepath.Join(xhtmlFolderName, testSectionPath)))
+	if !strings.Contains(string(contents), testUnscriptedItem) {
+		t.Errorf("Section without scripts is marked as scripted: %s", contents)
+	}
 
-func TestEpubPpd(t *testing.T) {
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestAddSection(t *testing.T) {
 	e := NewEpubWithFs(testEpubTitle, getFs())
-	e.SetPpd(testEpubPpd)
+	testSection1Path, err := e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+	if err != nil {
+		t.Errorf("Error adding section: %s", err)
+	}
 
-	if e.Ppd() != testEpubPpd {
+	testSection2Path, err := e.AddSection(testSectionBody, testSectionTitle, "", "")
+	if err != nil {
+		t.Errorf("Error adding section: %s", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSection1Path))
+	if err != nil {
+		t.Errorf("Unexpected error reading section file: %s", err)
+	}
+
+	testSectionContents := fmt.Sprintf(testSectionContentTemplate, testSectionTitle, testSectionBody)
+	if trimAllSpace(string(contents)) != trimAllSpace(testSectionContents) {
 		t.Errorf(
-			"Ppd doesn't match\n"+
+			"Section file contents don't match\n"+
 				"Got: %s\n"+
 				"Expected: %s",
-			e.Ppd(),
-			testEpubPpd)
+			contents,
+			testSectionContents)
 	}
 
-	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
-
-	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSection2Path))
 	if err != nil {
-		t.Errorf("Unexpected error reading package file: %s", err)
+		t.Errorf("Unexpected error reading section file: %s", err)
 	}
 
-	testPpdElement := fmt.Sprintf(testPpdTemplate, testEpubPpd)
-	if !strings.Contains(string(contents), testPpdElement) {
+	if trimAllSpace(string(contents)) != trimAllSpace(testSectionContents) {
 		t.Errorf(
-			"Ppd doesn't match\n"+
-				"Got: %s"+
+			"Section file contents don't match\n"+
+				"Got: %s\n"+
 				"Expected: %s",
 			contents,
-			testPpdElement)
+			testSectionContents)
 	}
 
 	cleanup(e.fs, testEpubFilename, tempDir)
 }
 
-func TestEpubTitle(t *testing.T) {
-	// First, test the title we provide when creating the epub
+func TestAddSectionInvalidXML(t *testing.T) {
 	e := NewEpubWithFs(testEpubTitle, getFs())
-	if e.Title() != testEpubTitle {
+	for _, body := range []string{`<p>unclosed`, `<p>Tom & Jerry</p>`} {
+		_, err := e.AddSection(body, testSectionTitle, "", "")
+		if !errors.Is(err, ErrInvalidXML) {
+			t.Errorf("Adding a section with body %q should return ErrInvalidXML, got: %v", body, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "XML syntax error") {
+			t.Errorf("Error doesn't describe the parse failure: %s", err)
+		}
+	}
+
+	if len(e.Sections()) != 0 {
+		t.Errorf("Sections with invalid XML were added: %v", e.Sections())
+	}
+}
+
+func TestAddSectionFromFile(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	_, err := e.AddSectionFromFile("testdata/missing.html", testSectionTitle, "", "")
+	if err != ErrRetrievingFile {
+		t.Errorf("Adding a section from a missing file should return ErrRetrievingFile, got: %v", err)
+	}
+
+	testSectionPath, err := e.AddSectionFromFile(testSectionFromFileSource, testSectionTitle, "", "")
+	if err != nil {
+		t.Errorf("Error adding section: %s", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSectionPath))
+	if err != nil {
+		t.Errorf("Unexpected error reading section file: %s", err)
+	}
+	expected := "<body>\n<h1>Chapter 1</h1>\n    <p>It was a dark and stormy night.</p>\n</body>"
+	if !strings.Contains(string(contents), expected) {
 		t.Errorf(
-			"Title doesn't match\n"+
+			"Section body doesn't match\n"+
 				"Got: %s\n"+
 				"Expected: %s",
-			e.Title(),
-			testEpubTitle)
+			contents,
+			expected)
 	}
 
-	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
 
-	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+func TestSetSanitizeHTML(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testBody := `<p onclick="alert('hi')" class="intro"><font color="red">Hello</font></p>` +
+		`<script>alert("hi");</script><a href="javascript:void(0)">Link</a>`
+
+	testUnsanitizedPath, _ := e.AddSection(testBody, testSectionTitle, "", "")
+	e.SetSanitizeHTML(true)
+	testSectionPath, err := e.AddSection(testBody, testSectionTitle, "", "")
 	if err != nil {
-		t.Errorf("Unexpected error reading package file: %s", err)
+		t.Errorf("Error adding section: %s", err)
 	}
 
-	testTitleElement := fmt.Sprintf(testTitleTemplate, testEpubTitle)
-	if !strings.Contains(string(contents), testTitleElement) {
+	expected := `<p class="intro">Hello</p><a>Link</a>`
+	for _, section := range e.Sections() {
+		body := strings.TrimSpace(e.sections[section.Index].xhtml.body())
+		switch section.Filename {
+		case testUnsanitizedPath:
+			if body != testBody {
+				t.Errorf("Section added before sanitizing was enabled was sanitized: %s", body)
+			}
+		case testSectionPath:
+			if body != expected {
+				t.Errorf(
+					"Sanitized section body doesn't match\n"+
+						"Got: %s\n"+
+						"Expected: %s",
+					body,
+					expected)
+			}
+		}
+	}
+}
+
+func TestAddSectionWithCSS(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testBaseCSSPath, _ := e.AddCSSFromBytes([]byte("p { margin: 0; }"), "base.css")
+	testChapterCSSPath, _ := e.AddCSSFromBytes([]byte("p { color: red; }"), "chapter.css")
+	testSectionPath, err := e.AddSectionWithCSS(testSectionBody, testSectionTitle, "", []string{testBaseCSSPath, testChapterCSSPath})
+	if err != nil {
+		t.Errorf("Error adding section: %s", err)
+	}
+	testNoCSSSectionPath, err := e.AddSectionWithCSS(testSectionBody, testSectionTitle, "", []string{})
+	if err != nil {
+		t.Errorf("Error adding section: %s", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSectionPath))
+	if err != nil {
+		t.Errorf("Unexpected error reading section file: %s", err)
+	}
+	testBaseLink := fmt.Sprintf(testLinkTemplate, testBaseCSSPath)
+	testChapterLink := fmt.Sprintf(testLinkTemplate, testChapterCSSPath)
+	baseIndex := strings.Index(string(contents), testBaseLink)
+	chapterIndex := strings.Index(string(contents), testChapterLink)
+	if baseIndex == -1 || chapterIndex == -1 || baseIndex > chapterIndex {
 		t.Errorf(
-			"Title doesn't match\n"+
+			"Stylesheet links don't match\n"+
 				"Got: %s\n"+
-				"Expected: %s",
+				"Expected: %s\n%s",
 			contents,
-			testTitleElement)
+			testBaseLink,
+			testChapterLink)
+	}
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testNoCSSSectionPath))
+	if err != nil {
+		t.Errorf("Unexpected error reading section file: %s", err)
+	}
+	if strings.Contains(string(contents), "<link") {
+		t.Errorf("Section without CSS links to a stylesheet: %s", contents)
 	}
 
 	cleanup(e.fs, testEpubFilename, tempDir)
+}
 
-	// Now test changing the title
-	e.SetTitle(testEpubAuthor)
+func TestAddRawSection(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testRawSectionPath, err := e.AddRawSection(testRawSectionContents, "")
+	if err != nil {
+		t.Errorf("Error adding raw section: %s", err)
+	}
+	_, err = e.AddRawSection(`<html><body><p>unclosed</body></html>`, "")
+	if !errors.Is(err, ErrInvalidXML) {
+		t.Errorf("Adding a raw section that isn't well-formed should return ErrInvalidXML, got: %v", err)
+	}
 
-	if e.Title() != testEpubAuthor {
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testRawSectionPath))
+	if err != nil {
+		t.Errorf("Unexpected error reading section file: %s", err)
+	}
+	if string(contents) != testRawSectionContents {
 		t.Errorf(
-			"Title doesn't match\n"+
+			"Raw section file contents don't match\n"+
 				"Got: %s\n"+
 				"Expected: %s",
-			e.Title(),
-			testEpubAuthor)
+			contents,
+			testRawSectionContents)
 	}
 
-	tempDir = writeAndExtractEpub(t, e, testEpubFilename)
-
 	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
 	if err != nil {
 		t.Errorf("Unexpected error reading package file: %s", err)
 	}
-
-	testTitleElement = fmt.Sprintf(testTitleTemplate, testEpubAuthor)
-	if !strings.Contains(string(contents), testTitleElement) {
+	testItemrefElement := fmt.Sprintf(testItemrefIdrefTemplate, testRawSectionPath)
+	if !strings.Contains(string(contents), testItemrefElement) {
 		t.Errorf(
-			"Title doesn't match\n"+
+			"Spine item doesn't match\n"+
 				"Got: %s\n"+
 				"Expected: %s",
 			contents,
-			testTitleElement)
+			testItemrefElement)
 	}
 
 	cleanup(e.fs, testEpubFilename, tempDir)
 }
 
-func TestEpubIdentifier(t *testing.T) {
+func TestAddNonLinearSection(t *testing.T) {
 	e := NewEpubWithFs(testEpubTitle, getFs())
-	e.SetIdentifier(testEpubIdentifier)
+	testSection1Path, _ := e.AddSection(testSectionBody, testSectionTitle, "", "")
+	testSection2Path, err := e.AddNonLinearSection(testSectionBody, testSectionTitle, "", "")
+	if err != nil {
+		t.Errorf("Error adding non-linear section: %s", err)
+	}
 
-	if e.Identifier() != testEpubIdentifier {
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+
+	testItemrefElement := fmt.Sprintf(testItemrefNonLinearTemplate, testSection2Path)
+	if !strings.Contains(string(contents), testItemrefElement) {
 		t.Errorf(
-			"Identifier doesn't match\n"+
+			"Spine item doesn't match\n"+
 				"Got: %s\n"+
 				"Expected: %s",
-			e.Identifier(),
-			testEpubIdentifier)
+			contents,
+			testItemrefElement)
+	}
+	if strings.Contains(string(contents), fmt.Sprintf(testItemrefNonLinearTemplate, testSection1Path)) {
+		t.Errorf("Linear section is marked as non-linear: %s", contents)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestAddSubSection(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testChapterPath, err := e.AddSection(testSectionBody, "Chapter 1", "", "")
+	if err != nil {
+		t.Errorf("Error adding section: %s", err)
+	}
+	// Add a top-level section first to make sure sub-sections are placed after
+	// their parent
+	_, err = e.AddSection(testSectionBody, "Chapter 2", "section0004.xhtml", "")
+	if err != nil {
+		t.Errorf("Error adding section: %s", err)
+	}
+	_, err = e.AddSubSection(testChapterPath, testSectionBody, "Section 1.1", "section0002.xhtml", "")
+	if err != nil {
+		t.Errorf("Error adding sub-section: %s", err)
+	}
+	_, err = e.AddSubSection(testChapterPath, testSectionBody, "Section 1.2", "section0003.xhtml", "")
+	if err != nil {
+		t.Errorf("Error adding sub-section: %s", err)
+	}
+	_, err = e.AddSubSection("missing.xhtml", testSectionBody, testSectionTitle, "", "")
+	if err != ErrSectionNotFound {
+		t.Errorf("Expected ErrSectionNotFound, got: %v", err)
 	}
 
 	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
 
-	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, tocNavFilename))
 	if err != nil {
-		t.Errorf("Unexpected error reading package file: %s", err)
+		t.Errorf("Unexpected error reading nav file: %s", err)
+	}
+	if !strings.Contains(trimAllSpace(string(contents)), trimAllSpace(testNavNestedContents)) {
+		t.Errorf(
+			"Nav file contents don't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testNavNestedContents)
 	}
 
-	testIdentifierElement := fmt.Sprintf(testIdentifierTemplate, testEpubIdentifier)
-	if !strings.Contains(string(contents), testIdentifierElement) {
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, tocNcxFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading NCX file: %s", err)
+	}
+	if !strings.Contains(trimAllSpace(string(contents)), trimAllSpace(testNcxNestedContents)) {
 		t.Errorf(
-			"Identifier doesn't match\n"+
-				"Got: %s"+
+			"NCX file contents don't match\n"+
+				"Got: %s\n"+
 				"Expected: %s",
 			contents,
-			testIdentifierElement)
+			testNcxNestedContents)
 	}
 
 	cleanup(e.fs, testEpubFilename, tempDir)
 }
 
-func TestSetCover(t *testing.T) {
+func TestInsertSectionAtIndex(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testSection1Path, _ := e.AddSection(testSectionBody, testSectionTitle, "first.xhtml", "")
+	testSection3Path, _ := e.AddSection(testSectionBody, testSectionTitle, "third.xhtml", "")
+
+	testSection2Path, err := e.InsertSectionAtIndex(1, testSectionBody, testSectionTitle, "second.xhtml", "")
+	if err != nil {
+		t.Errorf("Error inserting section: %s", err)
+	}
+	for _, index := range []int{-1, 4} {
+		_, err = e.InsertSectionAtIndex(index, testSectionBody, testSectionTitle, "", "")
+		if err != ErrIndexOutOfRange {
+			t.Errorf("Expected ErrIndexOutOfRange for index %d, got: %v", index, err)
+		}
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+
+	// Make sure the sections appear in the spine in the expected order
+	lastIndex := -1
+	for _, testSectionPath := range []string{testSection1Path, testSection2Path, testSection3Path} {
+		i := strings.Index(string(contents), fmt.Sprintf(testItemrefIdrefTemplate, testSectionPath))
+		if i <= lastIndex {
+			t.Errorf("Spine order doesn't match, %s is out of place: %s", testSectionPath, contents)
+		}
+		lastIndex = i
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestSections(t *testing.T) {
 	e := NewEpubWithFs(testEpubTitle, getFs())
 	testImagePath, _ := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
 	testCSSPath, _ := e.AddCSS(testCoverCSSSource, testCoverCSSFilename)
+	testSection1Path, _ := e.AddSection(testSectionBody, testSectionTitle, "", "")
+	testSection2Path, _ := e.AddSubSection(testSection1Path, testSectionBody, "", "", "")
 	e.SetCover(testImagePath, testCSSPath)
 
+	testSections := []SectionInfo{
+		{Filename: defaultCoverXhtmlFilename, Index: 0, Linear: true},
+		{Filename: testSection1Path, Index: 1, Linear: true, Title: testSectionTitle},
+		{Filename: testSection2Path, Index: 2, Linear: true, ParentFilename: testSection1Path},
+	}
+	sections := e.Sections()
+	if !reflect.DeepEqual(sections, testSections) {
+		t.Errorf(
+			"Sections don't match\n"+
+				"Got: %#v\n"+
+				"Expected: %#v",
+			sections,
+			testSections)
+	}
+
+	// Changing the returned sections shouldn't change the EPUB
+	sections[1].Title = testEpubTitle
+	if e.Sections()[1].Title != testSectionTitle {
+		t.Errorf("Section title changed after modifying the returned section info")
+	}
+}
+
+func TestRemoveSection(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testSection1Path, _ := e.AddSection(testSectionBody, testSectionTitle, "", "")
+	testSection2Path, _ := e.AddSection(testSectionBody, testSectionTitle, "", "")
+
+	// Write once first to make sure nothing is left over from a previous write
+	err := e.Write(testEpubFilename)
+	if err != nil {
+		t.Errorf("Unexpected error writing EPUB: %s", err)
+	}
+
+	err = e.RemoveSection(testSection1Path)
+	if err != nil {
+		t.Errorf("Error removing section: %s", err)
+	}
+	err = e.RemoveSection(testSection1Path)
+	if err != ErrSectionNotFound {
+		t.Errorf("Expected ErrSectionNotFound, got: %v", err)
+	}
+
 	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
 
-	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, defaultCoverXhtmlFilename))
+	if _, err := e.fs.Stat(filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSection1Path)); err == nil {
+		t.Errorf("Removed section file exists: %s", testSection1Path)
+	}
+
+	pkgContents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
 	if err != nil {
-		t.Errorf("Unexpected error reading cover XHTML file: %s", err)
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	navContents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, tocNavFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading nav file: %s", err)
 	}
 
-	testCoverContents := fmt.Sprintf(testCoverContentTemplate, testEpubTitle, testCSSPath, testImagePath)
-	if trimAllSpace(string(contents)) != trimAllSpace(testCoverContents) {
-		t.Errorf(
-			"Cover file contents don't match\n"+
-				"Got: %s\n"+
-				"Expected: %s",
-			contents,
-			testCoverContents)
+	if strings.Contains(string(pkgContents), fmt.Sprintf(testItemrefIdrefTemplate, testSection1Path)) {
+		t.Errorf("Removed section is still in the spine: %s", pkgContents)
+	}
+	if !strings.Contains(string(pkgContents), fmt.Sprintf(testItemrefIdrefTemplate, testSection2Path)) {
+		t.Errorf("Remaining section is missing from the spine: %s", pkgContents)
+	}
+	if strings.Contains(string(navContents), fmt.Sprintf(testNavLinkTemplate, testSection1Path, testSectionTitle)) {
+		t.Errorf("Removed section is still in the nav: %s", navContents)
+	}
+	if !strings.Contains(string(navContents), fmt.Sprintf(testNavLinkTemplate, testSection2Path, testSectionTitle)) {
+		t.Errorf("Remaining section is missing from the nav: %s", navContents)
 	}
 
 	cleanup(e.fs, testEpubFilename, tempDir)
 }
 
+func TestAddLandmark(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testSectionPath, _ := e.AddSection(testSectionBody, testSectionTitle, "", "")
+
+	err := e.AddLandmark("toc", "Table of Contents", tocNavFilename)
+	if err != nil {
+		t.Errorf("Error adding landmark: %s", err)
+	}
+	err = e.AddLandmark("bodymatter", "", testSectionPath+"#start")
+	if err != nil {
+		t.Errorf("Error adding landmark: %s", err)
+	}
+	err = e.AddLandmark("cover", "Cover", "nonexistent.xhtml")
+	if err != ErrSectionNotFound {
+		t.Errorf("Adding a landmark with a nonexistent target should return ErrSectionNotFound, got: %v", err)
+	}
+	err = e.AddLandmark("", "", testSectionPath)
+	if err != ErrInvalidLandmark {
+		t.Errorf("Adding a landmark without a type should return ErrInvalidLandmark, got: %v", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, tocNavFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading TOC file: %s", err)
+	}
+
+	expectedElements := []string{
+		`<nav epub:type="landmarks" hidden="hidden">`,
+		fmt.Sprintf(testLandmarkTemplate, "toc", tocNavFilename, "Table of Contents"),
+		fmt.Sprintf(testLandmarkTemplate, "bodymatter", "xhtml/"+testSectionPath+"#start", "bodymatter"),
+	}
+	for _, expected := range expectedElements {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Landmarks don't match\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+	if strings.Contains(string(contents), `epub:type="cover"`) {
+		t.Errorf("Landmark with a nonexistent target was added: %s", contents)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestAddPageMarker(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testSection1Path, _ := e.AddSection(testSectionBody, testSectionTitle, "", "")
+	testSection2Path, _ := e.AddSection(`<p>Page 1 continued</p><span id="page2"></span>`, testSectionTitle, "", "")
+
+	err := e.AddPageMarker(testSection1Path, "1", "page1")
+	if err != nil {
+		t.Errorf("Error adding page marker: %s", err)
+	}
+	err = e.AddPageMarker(testSection2Path, "2", "page2")
+	if err != nil {
+		t.Errorf("Error adding page marker: %s", err)
+	}
+	err = e.AddPageMarker(testSection1Path, "1", "page1")
+	if err != ErrInvalidPageMarker {
+		t.Errorf("Adding a duplicate page marker should return ErrInvalidPageMarker, got: %v", err)
+	}
+	err = e.AddPageMarker("nonexistent.xhtml", "3", "page3")
+	if err != ErrSectionNotFound {
+		t.Errorf("Adding a page marker to a nonexistent section should return ErrSectionNotFound, got: %v", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, tocNavFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading TOC file: %s", err)
+	}
+	expectedElements := []string{
+		`<nav epub:type="page-list" hidden="hidden">`,
+		`<a href="xhtml/` + testSection1Path + `#page1">1</a>`,
+		`<a href="xhtml/` + testSection2Path + `#page2">2</a>`,
+	}
+	for _, expected := range expectedElements {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Page list doesn't match\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSection1Path))
+	if err != nil {
+		t.Errorf("Unexpected error reading section file: %s", err)
+	}
+	testPageBreak := `<span epub:type="pagebreak" id="page1" title="1"></span>`
+	if !strings.Contains(string(contents), testPageBreak) {
+		t.Errorf(
+			"Page break doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testPageBreak)
+	}
+
+	// The page break for page 2 is already in the section body, so it shouldn't
+	// be added again
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSection2Path))
+	if err != nil {
+		t.Errorf("Unexpected error reading section file: %s", err)
+	}
+	if strings.Count(string(contents), `id="page2"`) != 1 {
+		t.Errorf("Page break was added to a section that already contains it: %s", contents)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestEpubAuthor(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.SetAuthor(testEpubAuthor)
+
+	if e.Author() != testEpubAuthor {
+		t.Errorf(
+			"Author doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			e.Author(),
+			testEpubAuthor)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+
+	testAuthorElement := fmt.Sprintf(testAuthorTemplate, testEpubAuthor)
+	if !strings.Contains(string(contents), testAuthorElement) {
+		t.Errorf(
+			"Author doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testAuthorElement)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestEpubFileAs(t *testing.T) {
+	e := NewEpubWithFs("The Hobbit", getFs())
+	e.SetTitleFileAs("Hobbit, The")
+	// The author's file-as shouldn't be included until there's an author
+	e.SetAuthorFileAs("Tolkien, J. R. R.")
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	expectedElements := []string{
+		`<dc:title id="title">The Hobbit</dc:title>`,
+		`<meta refines="#title" property="file-as">Hobbit, The</meta>`,
+	}
+	for _, expected := range expectedElements {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Title file-as doesn't match\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+	if strings.Contains(string(contents), `refines="#creator"`) {
+		t.Errorf("Author file-as was included without an author: %s", contents)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+
+	e.SetAuthor("J. R. R. Tolkien")
+	e.SetTitleFileAs("")
+	tempDir = writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	testAuthorFileAsElement := `<meta refines="#creator" property="file-as">Tolkien, J. R. R.</meta>`
+	if !strings.Contains(string(contents), testAuthorFileAsElement) {
+		t.Errorf(
+			"Author file-as doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testAuthorFileAsElement)
+	}
+	if strings.Contains(string(contents), `refines="#title"`) || strings.Contains(string(contents), `<dc:title id=`) {
+		t.Errorf("Title file-as wasn't removed: %s", contents)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestEpubLang(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.SetLang(testEpubLang)
+
+	if e.Lang() != testEpubLang {
+		t.Errorf(
+			"Language doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			e.Lang(),
+			testEpubLang)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+
+	testLangElement := fmt.Sprintf(testLangTemplate, testEpubLang)
+	if !strings.Contains(string(contents), testLangElement) {
+		t.Errorf(
+			"Language doesn't match\n"+
+				"Got: %s"+
+				"Expected: %s",
+			contents,
+			testLangElement)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestEpubLangValidation(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+
+	for _, lang := range []string{"français", "en_US", "en-", "toolonglanguage"} {
+		if err := e.SetLang(lang); err != ErrInvalidLang {
+			t.Errorf("Setting the language to %q should return ErrInvalidLang, got: %v", lang, err)
+		}
+		if err := e.AddLang(lang); err != ErrInvalidLang {
+			t.Errorf("Adding the language %q should return ErrInvalidLang, got: %v", lang, err)
+		}
+	}
+	if e.Lang() != defaultEpubLang {
+		t.Errorf("An invalid language replaced the language of the EPUB: %s", e.Lang())
+	}
+
+	for _, lang := range []string{"zh-Hant", "zh-Hant-TW", "pt-BR", "es-419", "de-CH-1901", "x-klingon"} {
+		if err := e.SetLang(lang); err != nil {
+			t.Errorf("Unexpected error setting the language to %q: %s", lang, err)
+		}
+	}
+}
+
+func TestEpubAdditionalLangs(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.SetLang(testEpubLang)
+	e.AddLang("zh-Hant")
+	e.AddLang(testEpubLang)
+
+	expectedLangs := []string{testEpubLang, "zh-Hant"}
+	if e.Lang() != testEpubLang || !reflect.DeepEqual(e.Langs(), expectedLangs) {
+		t.Errorf(
+			"Languages don't match\n"+
+				"Got: %s, %v\n"+
+				"Expected: %s, %v",
+			e.Lang(),
+			e.Langs(),
+			testEpubLang,
+			expectedLangs)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+
+	testLangElements := fmt.Sprintf(testLangTemplate, testEpubLang) + "\n    " + fmt.Sprintf(testLangTemplate, "zh-Hant")
+	if !strings.Contains(string(contents), testLangElements) {
+		t.Errorf(
+			"Languages don't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testLangElements)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestEpubPpd(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.SetPpd(testEpubPpd)
+
+	if e.Ppd() != testEpubPpd {
+		t.Errorf(
+			"Ppd doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			e.Ppd(),
+			testEpubPpd)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+
+	testPpdElement := fmt.Sprintf(testPpdTemplate, testEpubPpd)
+	if !strings.Contains(string(contents), testPpdElement) {
+		t.Errorf(
+			"Ppd doesn't match\n"+
+				"Got: %s"+
+				"Expected: %s",
+			contents,
+			testPpdElement)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestPageSpreads(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testSectionPaths := []string{}
+	for i := 0; i < 3; i++ {
+		testSectionPath, err := e.AddSection(testSectionBody, testSectionTitle, "", "")
+		if err != nil {
+			t.Errorf("Error adding section: %s", err)
+		}
+		testSectionPaths = append(testSectionPaths, testSectionPath)
+	}
+
+	err := e.AssignPageSpreads(testSectionPaths, true)
+	if err != nil {
+		t.Errorf("Error assigning page spreads: %s", err)
+	}
+	err = e.SetPageSpread(testSectionPaths[0], "top")
+	if err != ErrInvalidPageSpread {
+		t.Errorf("Expected ErrInvalidPageSpread, got: %v", err)
+	}
+	err = e.SetPageSpread("missing.xhtml", PageSpreadLeft)
+	if err != ErrSectionNotFound {
+		t.Errorf("Expected ErrSectionNotFound, got: %v", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+
+	testSpreads := []string{PageSpreadCenter, PageSpreadRight, PageSpreadLeft}
+	for i, testSectionPath := range testSectionPaths {
+		testItemrefElement := fmt.Sprintf(testItemrefTemplate, testSectionPath, "rendition:page-spread-"+testSpreads[i])
+		if !strings.Contains(string(contents), testItemrefElement) {
+			t.Errorf(
+				"Spine item doesn't match\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				testItemrefElement)
+		}
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestEpubRights(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.SetRights(testEpubRights)
+
+	if e.Rights() != testEpubRights {
+		t.Errorf(
+			"Rights don't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			e.Rights(),
+			testEpubRights)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+
+	testRightsElement := fmt.Sprintf(testRightsTemplate, "Copyright © 2017 Hingle McCringleberry &amp; Jamie Sneed")
+	if !strings.Contains(string(contents), testRightsElement) {
+		t.Errorf(
+			"Rights don't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testRightsElement)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestEpubSource(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.SetSource(testEpubSource)
+
+	if e.Source() != testEpubSource {
+		t.Errorf(
+			"Source doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			e.Source(),
+			testEpubSource)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+
+	testSourceElement := fmt.Sprintf(testSourceTemplate, "https://example.com/books?isbn=9780261103344&amp;edition=1")
+	if !strings.Contains(string(contents), testSourceElement) {
+		t.Errorf(
+			"Source doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testSourceElement)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+
+	// An empty source shouldn't be included
+	e.SetSource("")
+	tempDir = writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	if strings.Contains(string(contents), "dc:source") {
+		t.Errorf("Package file contains an empty source: %s", contents)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestEpubSeries(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.SetSeries("Old series", 1)
+	e.SetSeries(testSeriesName, 2.5)
+
+	name, index := e.Series()
+	if name != testSeriesName || index != 2.5 {
+		t.Errorf(
+			"Series doesn't match\n"+
+				"Got: %s, %v\n"+
+				"Expected: %s, %v",
+			name,
+			index,
+			testSeriesName,
+			2.5)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	expectedElements := []string{
+		`<meta property="belongs-to-collection" id="series">` + testSeriesName + `</meta>`,
+		`<meta refines="#series" property="collection-type">series</meta>`,
+		`<meta refines="#series" property="group-position">2.5</meta>`,
+		`<meta name="calibre:series" content="` + testSeriesName + `"></meta>`,
+		`<meta name="calibre:series_index" content="2.5"></meta>`,
+	}
+	for _, expected := range expectedElements {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Series metadata doesn't match\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+	if strings.Contains(string(contents), "Old series") {
+		t.Errorf("Previous series wasn't replaced: %s", contents)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+
+	// Setting an empty name should clear the series
+	e.SetSeries("", 3)
+	tempDir = writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	if strings.Contains(string(contents), "series") {
+		t.Errorf("Series wasn't cleared: %s", contents)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestEpubSubjects(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testSubjects := []string{"Fantasy", "Sword & Sorcery"}
+	for _, subject := range testSubjects {
+		e.AddSubject(subject)
+	}
+	e.AddSubject("")
+
+	if !reflect.DeepEqual(e.Subjects(), testSubjects) {
+		t.Errorf(
+			"Subjects don't match\n"+
+				"Got: %v\n"+
+				"Expected: %v",
+			e.Subjects(),
+			testSubjects)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	testSubjectElements := `<dc:subject>Fantasy</dc:subject>
+    <dc:subject>Sword &amp; Sorcery</dc:subject>`
+	if !strings.Contains(string(contents), testSubjectElements) {
+		t.Errorf(
+			"Subject elements don't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testSubjectElements)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestEpubTitle(t *testing.T) {
+	// First, test the title we provide when creating the epub
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	if e.Title() != testEpubTitle {
+		t.Errorf(
+			"Title doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			e.Title(),
+			testEpubTitle)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+
+	testTitleElement := fmt.Sprintf(testTitleTemplate, testEpubTitle)
+	if !strings.Contains(string(contents), testTitleElement) {
+		t.Errorf(
+			"Title doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testTitleElement)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+
+	// Now test changing the title
+	e.SetTitle(testEpubAuthor)
+
+	if e.Title() != testEpubAuthor {
+		t.Errorf(
+			"Title doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			e.Title(),
+			testEpubAuthor)
+	}
+
+	tempDir = writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+
+	testTitleElement = fmt.Sprintf(testTitleTemplate, testEpubAuthor)
+	if !strings.Contains(string(contents), testTitleElement) {
+		t.Errorf(
+			"Title doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testTitleElement)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestEpubIdentifier(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.SetIdentifier(testEpubIdentifier)
+
+	if e.Identifier() != testEpubIdentifier {
+		t.Errorf(
+			"Identifier doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			e.Identifier(),
+			testEpubIdentifier)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+
+	testIdentifierElement := fmt.Sprintf(testIdentifierTemplate, testEpubIdentifier)
+	if !strings.Contains(string(contents), testIdentifierElement) {
+		t.Errorf(
+			"Identifier doesn't match\n"+
+				"Got: %s"+
+				"Expected: %s",
+			contents,
+			testIdentifierElement)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestEpubIdentifierWithScheme(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	err := e.SetIdentifierWithScheme(testEpubISBN, IdentifierSchemeISBN)
+	if err != nil {
+		t.Errorf("Error setting identifier: %s", err)
+	}
+	err = e.SetIdentifierWithScheme("978-3-16", IdentifierSchemeISBN)
+	if err != ErrInvalidIdentifierScheme {
+		t.Errorf("Setting an invalid ISBN should return ErrInvalidIdentifierScheme, got: %v", err)
+	}
+	err = e.SetIdentifierWithScheme(testEpubISBN, "ISSN")
+	if err != ErrInvalidIdentifierScheme {
+		t.Errorf("Setting an unknown scheme should return ErrInvalidIdentifierScheme, got: %v", err)
+	}
+
+	if e.Identifier() != testEpubISBN || e.IdentifierScheme() != IdentifierSchemeISBN {
+		t.Errorf(
+			"Identifier doesn't match\n"+
+				"Got: %s (%s)\n"+
+				"Expected: %s (%s)",
+			e.Identifier(),
+			e.IdentifierScheme(),
+			testEpubISBN,
+			IdentifierSchemeISBN)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	expectedElements := []string{
+		fmt.Sprintf(testIdentifierTemplate, testEpubISBN),
+		`<meta refines="#pub-id" property="identifier-type" scheme="onix:codelist5">15</meta>`,
+	}
+	for _, expected := range expectedElements {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Identifier doesn't match\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+
+	// Setting an identifier without a scheme should remove the scheme
+	e.SetIdentifier(testEpubIdentifier)
+	tempDir = writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	if strings.Contains(string(contents), "identifier-type") {
+		t.Errorf("Identifier scheme wasn't removed: %s", contents)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestPlainText(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testImagePath, _ := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	testCSSPath, _ := e.AddCSS(testCoverCSSSource, testCoverCSSFilename)
+	// The cover doesn't contain any text, so it shouldn't be included
+	e.SetCover(testImagePath, testCSSPath)
+	e.AddSection(testPlainTextBody1, testSectionTitle, "", "")
+	e.AddSection(testPlainTextBody2, "", "", "")
+
+	if e.PlainText() != testPlainText {
+		t.Errorf(
+			"Plain text doesn't match\n"+
+				"Got: %q\n"+
+				"Expected: %q",
+			e.PlainText(),
+			testPlainText)
+	}
+}
+
+func TestSetCover(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testImagePath, _ := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	testCSSPath, _ := e.AddCSS(testCoverCSSSource, testCoverCSSFilename)
+	e.SetCover(testImagePath, testCSSPath)
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, defaultCoverXhtmlFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading cover XHTML file: %s", err)
+	}
+
+	testCoverContents := fmt.Sprintf(testCoverContentTemplate, testEpubTitle, testCSSPath, testImagePath)
+	if trimAllSpace(string(contents)) != trimAllSpace(testCoverContents) {
+		t.Errorf(
+			"Cover file contents don't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testCoverContents)
+	}
+
+	// Reading systems find the cover image using the cover-image property (EPUB
+	// 3) or the cover meta element (EPUB 2)
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	expectedElements := []string{
+		fmt.Sprintf(
+			`<item id="%s" href="%s" media-type="image/png" properties="cover-image"></item>`,
+			testImageFromFileFilename,
+			filepath.ToSlash(filepath.Join(ImageFolderName, testImageFromFileFilename))),
+		fmt.Sprintf(`<meta name="cover" content="%s"></meta>`, testImageFromFileFilename),
+	}
+	for _, expected := range expectedElements {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Package file cover elements don't match\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestSetCoverFromBytes(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testImageContents, err := afero.ReadFile(e.fs, testImageFromFileSource)
+	if err != nil {
+		t.Errorf("Unexpected error reading testdata image file: %s", err)
+	}
+	testImagePath, err := e.SetCoverFromBytes(testImageContents, testImageFromFileFilename, "")
+	if err != nil {
+		t.Errorf("Error setting cover: %s", err)
+	}
+	_, err = e.SetCoverFromBytes(testImageContents, "", "")
+	if err != ErrFilenameRequired {
+		t.Errorf("Setting a cover without a filename should return ErrFilenameRequired, got: %v", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	testCoverImageItem := fmt.Sprintf(
+		`<item id="%s" href="%s" media-type="image/png" properties="cover-image"></item>`,
+		testImageFromFileFilename,
+		filepath.ToSlash(filepath.Join(ImageFolderName, testImageFromFileFilename)))
+	if !strings.Contains(string(contents), testCoverImageItem) {
+		t.Errorf(
+			"Cover image manifest item doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testCoverImageItem)
+	}
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, defaultCoverXhtmlFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading cover XHTML file: %s", err)
+	}
+	if !strings.Contains(string(contents), fmt.Sprintf(`src="%s"`, testImagePath)) {
+		t.Errorf(
+			"Cover file doesn't reference the cover image\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testImagePath)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestImageAltText(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testAltText := `A "gopher" & his <lantern>`
+	testImagePath, err := e.AddImageWithOptions(testImageFromFileSource, testImageFromFileFilename, ImageOptions{AltText: testAltText})
+	if err != nil {
+		t.Errorf("Unexpected error adding image: %s", err)
+	}
+	if e.ImageAltText(testImagePath) != testAltText {
+		t.Errorf(
+			"Image alt text doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			e.ImageAltText(testImagePath),
+			testAltText)
+	}
+	e.SetCover(testImagePath, "")
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, defaultCoverXhtmlFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading cover XHTML file: %s", err)
+	}
+	expected := `alt="A &#34;gopher&#34; &amp; his &lt;lantern&gt;"`
+	if !strings.Contains(string(contents), expected) || strings.Contains(string(contents), "Cover Image") {
+		t.Errorf(
+			"Cover alt text doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			expected)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestEpub2(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	err := e.SetVersion(EpubVersion2)
+	if err != nil {
+		t.Errorf("Error setting version: %s", err)
+	}
+	if e.Version() != EpubVersion2 {
+		t.Errorf(
+			"Version doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			e.Version(),
+			EpubVersion2)
+	}
+	err = e.SetVersion("1.0")
+	if err != ErrInvalidVersion {
+		t.Errorf("Expected ErrInvalidVersion, got: %v", err)
+	}
+
+	testImagePath, _ := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	e.SetCover(testImagePath, "")
+	testSectionPath, _ := e.AddSection(testSectionBody, testSectionTitle, "", "")
+	e.SetAuthor(testEpubAuthor)
+	e.SetPpd(testEpubPpd)
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	if _, err := e.fs.Stat(filepath.Join(tempDir, contentFolderName, tocNavFilename)); err == nil {
+		t.Errorf("EPUB 3 TOC file exists in EPUB 2")
+	}
+	if _, err := e.fs.Stat(filepath.Join(tempDir, contentFolderName, tocNcxFilename)); err != nil {
+		t.Errorf("EPUB 2 TOC file is missing: %s", err)
+	}
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	testCoverMetaElement := fmt.Sprintf(testEpub2CoverMetaTemplate, testImageFromFileFilename)
+	for _, testElement := range []string{testEpub2PkgTemplate, testCoverMetaElement} {
+		if !strings.Contains(string(contents), testElement) {
+			t.Errorf(
+				"Package file contents don't match\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				testElement)
+		}
+	}
+	// None of these are allowed in EPUB 2
+	for _, testElement := range []string{tocNavFilename, "properties=", "property=", "page-progression-direction="} {
+		if strings.Contains(string(contents), testElement) {
+			t.Errorf("Package file contains %s: %s", testElement, contents)
+		}
+	}
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSectionPath))
+	if err != nil {
+		t.Errorf("Unexpected error reading section file: %s", err)
+	}
+	if !strings.Contains(string(contents), testEpub2DoctypeElement) {
+		t.Errorf(
+			"Section doctype doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testEpub2DoctypeElement)
+	}
+
+	output, err := validateEpub(t, testEpubFilename, e.fs)
+	if err != nil {
+		t.Errorf("EPUB validation failed")
+	}
+	fmt.Println(string(output))
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestVerifyAfterWrite(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+	e.SetVerifyAfterWrite(true)
+
+	err := e.Write(testEpubFilename)
+	if err != nil {
+		t.Errorf("Unexpected error writing EPUB with verification: %s", err)
+	}
+	cleanup(e.fs, testEpubFilename, "")
+
+	// Write an archive without a mimetype file and make sure it's rejected
+	f, err := e.fs.Create(testEpubFilename)
+	if err != nil {
+		t.Fatalf("Unexpected error creating file: %s", err)
+	}
+	z := zip.NewWriter(f)
+	w, err := z.Create(testSectionFilename)
+	if err != nil {
+		t.Fatalf("Unexpected error creating zip entry: %s", err)
+	}
+	w.Write([]byte(testSectionBody))
+	z.Close()
+	f.Close()
+
+	err = e.verifyEpub(testEpubFilename)
+	if !errors.Is(err, ErrVerificationFailed) {
+		t.Errorf(
+			"Verification error doesn't match\n"+
+				"Got: %v\n"+
+				"Expected: %s",
+			err,
+			ErrVerificationFailed)
+	}
+
+	cleanup(e.fs, testEpubFilename, "")
+}
+
+func TestCompressionLevel(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.AddSection(strings.Repeat(testSectionBody, 100), testSectionTitle, "", "")
+
+	err := e.SetCompressionLevel(10)
+	if err != ErrInvalidCompressionLevel {
+		t.Errorf("Setting an invalid compression level should return ErrInvalidCompressionLevel, got: %v", err)
+	}
+
+	sizes := map[int]int{}
+	for _, level := range []int{CompressionLevelStore, CompressionLevelNone, 9} {
+		err := e.SetCompressionLevel(level)
+		if err != nil {
+			t.Errorf("Error setting compression level %d: %s", level, err)
+		}
+		err = e.Write(testEpubFilename)
+		if err != nil {
+			t.Fatalf("Unexpected error writing EPUB: %s", err)
+		}
+		contents, err := afero.ReadFile(e.fs, testEpubFilename)
+		if err != nil {
+			t.Errorf("Unexpected error reading EPUB file: %s", err)
+		}
+		sizes[level] = len(contents)
+		cleanup(e.fs, testEpubFilename, "")
+	}
+
+	if sizes[CompressionLevelNone] <= sizes[9] || sizes[CompressionLevelStore] <= sizes[9] {
+		t.Errorf("Uncompressed EPUB isn't larger than compressed EPUB: %v", sizes)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.SetDeterministic(true)
+	testImagePath, _ := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	// The default cover CSS must still be available the second time the EPUB is
+	// written
+	e.SetCover(testImagePath, "")
+	e.AddImage(testImageWebpSource, "")
+	e.AddFont(testFontFromFileSource, "")
+	e.AddCSSFromBytes([]byte("p { margin: 0; }"), "base.css")
+	e.AddCSSFromBytes([]byte("p { color: red; }"), "chapter.css")
+	e.AddSection(testSectionBody, testSectionTitle, "", "")
+
+	var epubs [][]byte
+	for i := 0; i < 2; i++ {
+		err := e.Write(testEpubFilename)
+		if err != nil {
+			t.Fatalf("Unexpected error writing EPUB: %s", err)
+		}
+		contents, err := afero.ReadFile(e.fs, testEpubFilename)
+		if err != nil {
+			t.Errorf("Unexpected error reading EPUB file: %s", err)
+		}
+		epubs = append(epubs, contents)
+		cleanup(e.fs, testEpubFilename, "")
+
+		// Make sure the modified time would change if it weren't fixed
+		if i == 0 {
+			time.Sleep(time.Second)
+		}
+	}
+
+	if !bytes.Equal(epubs[0], epubs[1]) {
+		t.Errorf("EPUB files written from the same Epub aren't identical")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.SetDeterministic(true)
+	// The metadata is set in the order it's read so the meta elements are in the
+	// same order when the opened EPUB is written
+	e.SetIdentifierWithScheme(testEpubISBN, IdentifierSchemeISBN)
+	e.SetAuthor(testEpubAuthor)
+	e.SetAuthorFileAs("Cringleberry, Hingle Mc")
+	e.SetLang(testEpubLang)
+	e.SetPpd(testEpubPpd)
+	e.SetRights(testEpubRights)
+	e.SetSeries(testSeriesName, 2)
+	setID, _ := e.AddCollection("Test set", CollectionTypeSet, 1)
+	e.AddSubCollection(setID, "Test trilogy", CollectionTypeSeries, 3)
+	e.AddSubject("Fantasy")
+	e.SetGenerator("go-epub")
+	e.SetMetadataLang("he")
+	e.SetMetadataDir(DirRtl)
+	e.SetRenditionFlow(RenditionFlowScrolledDoc)
+	e.SetDublinCore("publisher", "Sam & Sons")
+	testImagePath, _ := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	e.SetCover(testImagePath, "")
+	e.AddObfuscatedFont(testFontFromFileSource, "")
+	testCSSPath, _ := e.AddCSSFromBytes([]byte("p { margin: 0; }"), "base.css")
+	testSectionPath, _ := e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, testCSSPath)
+	e.AddSubSection(testSectionPath, testSectionBody, "Subsection", "", "")
+	e.AddSectionWithEpubType("<p>For my parents</p>", "Dedication", "dedication", "", "")
+	e.AddSectionWithLang("<p>Kapitel eins</p>", "Kapitel 1", "de", "", "")
+	e.AddNonLinearSection(testSectionBody, "", "", "")
+	e.AddRawSection(testRawSectionContents, "")
+	e.AddPageMarker(testSectionFilename, "1", "page1")
+	e.AddLandmark("bodymatter", "Start", testSectionFilename)
+
+	err := e.Write(testEpubFilename)
+	if err != nil {
+		t.Fatalf("Unexpected error writing EPUB: %s", err)
+	}
+	defer cleanup(e.fs, testEpubFilename, "")
+	contents, err := afero.ReadFile(e.fs, testEpubFilename)
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB file: %s", err)
+	}
+
+	opened, err := OpenWithFs(testEpubFilename, e.fs)
+	if err != nil {
+		t.Fatalf("Unexpected error opening EPUB: %s", err)
+	}
+
+	if opened.Title() != e.Title() || opened.Author() != e.Author() || opened.Lang() != e.Lang() {
+		t.Errorf(
+			"Metadata of the opened EPUB doesn't match\n"+
+				"Got: %q, %q, %q\n"+
+				"Expected: %q, %q, %q",
+			opened.Title(), opened.Author(), opened.Lang(),
+			e.Title(), e.Author(), e.Lang())
+	}
+	if opened.Identifier() != e.Identifier() || opened.IdentifierScheme() != e.IdentifierScheme() {
+		t.Errorf(
+			"Identifier of the opened EPUB doesn't match\n"+
+				"Got: %q (%q)\n"+
+				"Expected: %q (%q)",
+			opened.Identifier(), opened.IdentifierScheme(),
+			e.Identifier(), e.IdentifierScheme())
+	}
+	if !reflect.DeepEqual(opened.Sections(), e.Sections()) {
+		t.Errorf(
+			"Sections of the opened EPUB don't match\n"+
+				"Got: %+v\n"+
+				"Expected: %+v",
+			opened.Sections(),
+			e.Sections())
+	}
+
+	// Writing the opened EPUB should produce the same EPUB
+	opened.SetDeterministic(true)
+	err = opened.Write(testEpubFilename)
+	if err != nil {
+		t.Fatalf("Unexpected error writing opened EPUB: %s", err)
+	}
+	rewritten, err := afero.ReadFile(e.fs, testEpubFilename)
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB file: %s", err)
+	}
+	if !bytes.Equal(contents, rewritten) {
+		t.Errorf("EPUB written from the opened EPUB isn't identical to the original")
+	}
+
+	_, err = ReadFromBytes([]byte(testSectionBody))
+	if !errors.Is(err, ErrUnableToReadEpub) {
+		t.Errorf("Reading invalid data should return ErrUnableToReadEpub, got: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testImagePath, _ := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	e.SetCover(testImagePath, "")
+	e.AddSection(testSectionBody, testSectionTitle, "", "")
+
+	errs := e.Validate()
+	if errs != nil {
+		t.Errorf("Validating a valid EPUB should return nil, got: %v", errs)
+	}
+
+	e.SetCover(path.Join("..", ImageFolderName, "missing.png"), "")
+	e.AddSection(testSectionBody, testSectionTitle, "", "../css/missing.css")
+	e.SetLang("")
+
+	errs = e.Validate()
+	// The missing cover image is also a broken link in the cover page
+	if len(errs) != 4 {
+		t.Errorf(
+			"Validate didn't return the expected errors\n"+
+				"Got: %v\n"+
+				"Expected: 4 errors",
+			errs)
+	}
+	for _, err := range errs {
+		if !errors.Is(err, ErrInvalidEpub) {
+			t.Errorf("Validation errors should wrap ErrInvalidEpub, got: %v", err)
+		}
+	}
+	if len(errs) == 0 || !strings.Contains(fmt.Sprint(errs), "missing.png") {
+		t.Errorf("Validate didn't report the missing cover image: %v", errs)
+	}
+}
+
+func TestCheckLinks(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testImagePath, _ := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	e.AddSection(
+		`<h1 id="top">Section 1</h1>`+
+			`<p><a href="section0002.xhtml#notes">Notes</a> <a href="#top">Top</a></p>`+
+			`<p><a href="https://example.com/">Example</a> <img src="`+testImagePath+`" alt=""/></p>`,
+		testSectionTitle, "section0001.xhtml", "")
+	e.AddSection(
+		`<h1 id="notes">Notes</h1>`+
+			`<p><a href="missing.xhtml">Missing</a> <a href="section0001.xhtml#bottom">Bottom</a></p>`+
+			`<p><img src="../images/missing.png" alt=""/></p>`,
+		"Notes", "section0002.xhtml", "")
+
+	brokenLinks := e.CheckLinks()
+	expected := []BrokenLink{
+		{SectionFilename: "section0002.xhtml", Href: "missing.xhtml"},
+		{SectionFilename: "section0002.xhtml", Href: "section0001.xhtml#bottom"},
+		{SectionFilename: "section0002.xhtml", Href: "../images/missing.png"},
+	}
+	if !reflect.DeepEqual(brokenLinks, expected) {
+		t.Errorf(
+			"Broken links don't match\n"+
+				"Got: %+v\n"+
+				"Expected: %+v",
+			brokenLinks,
+			expected)
+	}
+
+	if errs := e.Validate(); len(errs) != len(expected) {
+		t.Errorf("Validate should report each broken link, got: %v", errs)
+	}
+}
+
+func TestSetCheckLinksOnWrite(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.AddRawSection(`<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml">
+  <head><title>Raw section</title></head>
+  <body><p><img src="../images/foo.png" alt=""/></p></body>
+</html>
+`, "raw.xhtml")
+	e.SetCheckLinksOnWrite(true)
+
+	err := e.Write(testEpubFilename)
+	if !errors.Is(err, ErrBrokenLinks) || !strings.Contains(err.Error(), "raw.xhtml links to ../images/foo.png") {
+		t.Errorf("Writing an EPUB with a broken link should return ErrBrokenLinks naming the link, got: %v", err)
+	}
+	if _, err := e.fs.Stat(testEpubFilename); err == nil {
+		t.Errorf("EPUB with broken links was written")
+		cleanup(e.fs, testEpubFilename, "")
+	}
+
+	e.AddImage(testImageFromFileSource, "foo.png")
+	err = e.Write(testEpubFilename)
+	if err != nil {
+		t.Errorf("Unexpected error writing EPUB: %s", err)
+	}
+
+	cleanup(e.fs, testEpubFilename, "")
+}
+
+func TestConcurrentAdds(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	count := 20
+
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := e.AddImage(testImageFromFileSource, ""); err != nil {
+				t.Errorf("Unexpected error adding image: %s", err)
+			}
+			if _, err := e.AddSection(testSectionBody, fmt.Sprintf("Section %d", i), "", ""); err != nil {
+				t.Errorf("Unexpected error adding section: %s", err)
+			}
+			e.SetAuthor(testEpubAuthor)
+		}(i)
+	}
+	wg.Wait()
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	for _, folderName := range []string{ImageFolderName, xhtmlFolderName} {
+		items := len(regexp.MustCompile(`<item [^>]*href="`+folderName+`/`).FindAllString(string(contents), -1))
+		if items != count {
+			t.Errorf(
+				"Package file doesn't contain the expected number of %s items\n"+
+					"Got: %d\n"+
+					"Expected: %d",
+				folderName,
+				items,
+				count)
+		}
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestSetContentFolder(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	for _, name := range []string{"", "..", metaInfFolderName, "OEBPS/content", "A<B", "A\x01B"} {
+		if err := e.SetContentFolder(name); err != ErrInvalidContentFolder {
+			t.Errorf("Setting the content folder to %q should return ErrInvalidContentFolder, got: %v", name, err)
+		}
+	}
+
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+	// The folder can be changed after files have been added
+	err := e.SetContentFolder("OEBPS")
+	if err != nil {
+		t.Errorf("Unexpected error setting content folder: %s", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, metaInfFolderName, containerFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading container file: %s", err)
+	}
+	expected := `full-path="OEBPS/package.opf"`
+	if !strings.Contains(string(contents), expected) {
+		t.Errorf(
+			"Container file doesn't point at the package file\n"+
+				"Got: %s\n"+
+				"Expected to contain: %s",
+			contents,
+			expected)
+	}
+	for _, filename := range []string{pkgFilename, filepath.Join(xhtmlFolderName, testSectionFilename)} {
+		if _, err := e.fs.Stat(filepath.Join(tempDir, "OEBPS", filename)); err != nil {
+			t.Errorf("File %s wasn't written to the content folder: %s", filename, err)
+		}
+	}
+	if _, err := e.fs.Stat(filepath.Join(tempDir, contentFolderName)); err == nil {
+		t.Errorf("The default content folder shouldn't be written")
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+
+	// Characters that are special in XML are escaped in the container file
+	testContentFolder := `Tom & Jerry's`
+	e.SetContentFolder(testContentFolder)
+	tempDir = writeAndExtractEpub(t, e, testEpubFilename)
+
+	opened, err := OpenWithFs(testEpubFilename, e.fs)
+	if err != nil {
+		t.Fatalf("Unexpected error opening EPUB: %s", err)
+	}
+	if opened.contentFolder != testContentFolder || opened.Title() != testEpubTitle {
+		t.Errorf("Content folder wasn't read: %s", opened.contentFolder)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestSetOnDuplicate(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+
+	err := e.SetOnDuplicate("ignore")
+	if err != ErrInvalidDuplicateMode {
+		t.Errorf("Setting an invalid duplicate mode should return ErrInvalidDuplicateMode, got: %v", err)
+	}
+
+	// OnDuplicateError is the default
+	testCSSPath, _ := e.AddCSSFromBytes([]byte("p { color: red; }"), "style.css")
+	_, err = e.AddCSSFromBytes([]byte("p { color: green; }"), "style.css")
+	if err != ErrFilenameAlreadyUsed {
+		t.Errorf("Adding a duplicate filename should return ErrFilenameAlreadyUsed, got: %v", err)
+	}
+
+	e.SetOnDuplicate(OnDuplicateOverwrite)
+	overwrittenPath, err := e.AddCSSFromBytes([]byte("p { color: blue; }"), "style.css")
+	if err != nil || overwrittenPath != testCSSPath {
+		t.Errorf(
+			"Overwriting a file returned an unexpected path\n"+
+				"Got: %q, %v\n"+
+				"Expected: %q",
+			overwrittenPath,
+			err,
+			testCSSPath)
+	}
+
+	e.SetOnDuplicate(OnDuplicateRename)
+	for _, expected := range []string{"style-2.css", "style-3.css"} {
+		renamedPath, err := e.AddCSSFromBytes([]byte("p { color: red; }"), "style.css")
+		expected = filepath.Join("..", CSSFolderName, expected)
+		if err != nil || renamedPath != expected {
+			t.Errorf(
+				"Renaming a file returned an unexpected path\n"+
+					"Got: %q, %v\n"+
+					"Expected: %q",
+				renamedPath,
+				err,
+				expected)
+		}
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, CSSFolderName, "style.css"))
+	if err != nil {
+		t.Errorf("Unexpected error reading CSS file: %s", err)
+	}
+	if string(contents) != "p { color: blue; }" {
+		t.Errorf("Overwritten CSS file contains the original contents: %s", contents)
+	}
+	for _, filename := range []string{"style-2.css", "style-3.css"} {
+		if _, err := e.fs.Stat(filepath.Join(tempDir, contentFolderName, CSSFolderName, filename)); err != nil {
+			t.Errorf("Renamed CSS file %s wasn't written: %s", filename, err)
+		}
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestSetSVGCover(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	err := e.SetSVGCover(path.Join("..", ImageFolderName, "missing.svg"), "")
+	if err != ErrInvalidImage {
+		t.Errorf("Setting a cover to an image that hasn't been added should return ErrInvalidImage, got: %v", err)
+	}
+
+	testImagePath, _ := e.AddImageFromBytes([]byte(testSVGImage), "cover.svg")
+	err = e.SetSVGCover(testImagePath, "")
+	if err != nil {
+		t.Errorf("Unexpected error setting SVG cover: %s", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	for _, expected := range []string{
+		`<item id="cover.svg" href="images/cover.svg" media-type="image/svg+xml" properties="cover-image"></item>`,
+		`<item id="cover.xhtml" href="xhtml/cover.xhtml" media-type="application/xhtml+xml" properties="svg"></item>`,
+	} {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Package file doesn't contain the SVG cover\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, defaultCoverXhtmlFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading cover XHTML file: %s", err)
+	}
+	testCoverBody := `viewBox="0 0 600 800" preserveAspectRatio="xMidYMid meet"><image width="600" height="800" xlink:href="../images/cover.svg" /></svg>`
+	if !strings.Contains(string(contents), testCoverBody) {
+		t.Errorf(
+			"Cover XHTML file doesn't contain the SVG element\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testCoverBody)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestSetGeneratedCover(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.SetAuthor(testEpubAuthor)
+	_, err := e.SetGeneratedCover(CoverOptions{Width: -1})
+	if err != ErrInvalidImage {
+		t.Errorf("Generating a cover with a negative width should return ErrInvalidImage, got: %v", err)
+	}
+
+	// Generating the cover again replaces the previous cover image
+	e.SetGeneratedCover(CoverOptions{})
+	testImagePath, err := e.SetGeneratedCover(CoverOptions{
+		Width:      800,
+		Height:     1200,
+		Background: color.RGBA{R: 0x80, A: 0xff},
+	})
+	if err != nil {
+		t.Errorf("Unexpected error generating cover: %s", err)
+	}
+	if len(e.images) != 1 {
+		t.Errorf("Generated cover images weren't replaced: %v", e.images)
+	}
+
+	width, height, err := e.imageDimensions(filepath.Base(testImagePath))
+	if err != nil || width != 800 || height != 1200 {
+		t.Errorf(
+			"Generated cover dimensions don't match\n"+
+				"Got: %dx%d, %v\n"+
+				"Expected: 800x1200",
+			width,
+			height,
+			err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, ImageFolderName, filepath.Base(testImagePath)))
+	if err != nil {
+		t.Errorf("Unexpected error reading generated cover image: %s", err)
+	}
+	for _, expected := range []string{`fill="#800000"`, ">" + testEpubTitle + "<", ">" + testEpubAuthor + "<"} {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Generated cover image doesn't match\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestAddAudioVideo(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testAudioPath, err := e.AddAudio(testAudioSource, "narration.mp3")
+	if err != nil {
+		t.Errorf("Unexpected error adding audio: %s", err)
+	}
+	if testAudioPath != filepath.Join("..", AudioFolderName, "narration.mp3") {
+		t.Errorf("Unexpected audio path: %s", testAudioPath)
+	}
+	testVideoPath, err := e.AddVideo(testVideoSource, "trailer.mp4")
+	if err != nil {
+		t.Errorf("Unexpected error adding video: %s", err)
+	}
+	e.AddSection(
+		`<audio src="`+testAudioPath+`" controls="controls"></audio>`+
+			`<video src="`+testVideoPath+`" controls="controls"></video>`,
+		testSectionTitle, "", "")
+
+	_, err = e.AddAudio(testAudioSource, "narration.wav")
+	if err != ErrInvalidMediaType {
+		t.Errorf("Adding audio with an unknown extension should return ErrInvalidMediaType, got: %v", err)
+	}
+	_, err = e.AddVideo(testAudioSource, "narration.mp3")
+	if err != ErrInvalidMediaType {
+		t.Errorf("Adding audio as a video should return ErrInvalidMediaType, got: %v", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	for _, expected := range []string{
+		`<item id="narration.mp3" href="audio/narration.mp3" media-type="audio/mpeg"></item>`,
+		`<item id="trailer.mp4" href="video/trailer.mp4" media-type="video/mp4"></item>`,
+	} {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Package file doesn't contain the media item\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, AudioFolderName, "narration.mp3"))
+	if err != nil {
+		t.Errorf("Unexpected error reading audio file: %s", err)
+	}
+	if !bytes.HasPrefix(contents, []byte("ID3")) {
+		t.Errorf("Audio file doesn't contain the audio: %q", contents)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestAddMediaOverlay(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.AddSection(`<p id="p1">One</p><p id="p2">Two</p>`, testSectionTitle, testSectionFilename, "")
+
+	err := e.AddMediaOverlay("missing.xhtml", testMediaOverlay)
+	if err != ErrSectionNotFound {
+		t.Errorf("Adding a media overlay to a missing section should return ErrSectionNotFound, got: %v", err)
+	}
+	// The audio hasn't been added yet
+	err = e.AddMediaOverlay(testSectionFilename, testMediaOverlay)
+	if !errors.Is(err, ErrInvalidMediaOverlay) {
+		t.Errorf("Adding a media overlay with missing audio should return ErrInvalidMediaOverlay, got: %v", err)
+	}
+
+	e.AddAudio(testAudioSource, "narration.mp3")
+	err = e.AddMediaOverlay(testSectionFilename, testMediaOverlay)
+	if err != nil {
+		t.Errorf("Unexpected error adding media overlay: %s", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	for _, expected := range []string{
+		`<item id="section0001.xhtml" href="xhtml/section0001.xhtml" media-type="application/xhtml+xml" media-overlay="section0001.smil"></item>`,
+		`<item id="section0001.smil" href="xhtml/section0001.smil" media-type="application/smil+xml"></item>`,
+		`<meta refines="#section0001.smil" property="media:duration">0:00:05.500</meta>`,
+		`<meta property="media:duration">0:00:05.500</meta>`,
+	} {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Package file doesn't contain the media overlay\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, "section0001.smil"))
+	if err != nil {
+		t.Errorf("Unexpected error reading media overlay file: %s", err)
+	}
+	if string(contents) != testMediaOverlay {
+		t.Errorf(
+			"Media overlay file contents don't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testMediaOverlay)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestSetWriteProgress(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+	e.AddCSSFromBytes([]byte("p { color: red; }"), "style.css")
+
+	calls := 0
+	lastTotal := 0
+	e.SetWriteProgress(func(current, total int) {
+		calls++
+		lastTotal = total
+		if current != calls {
+			t.Errorf("Progress callback got current %d, expected %d", current, calls)
+		}
+		if current > total {
+			t.Errorf("Progress callback got current %d greater than total %d", current, total)
+		}
+	})
+
+	err := e.Write(testEpubFilename)
+	if err != nil {
+		t.Errorf("Unexpected error writing EPUB: %s", err)
+	}
+
+	f, err := e.fs.Open(testEpubFilename)
+	if err != nil {
+		t.Fatalf("Unexpected error opening EPUB: %s", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Unexpected error getting EPUB file info: %s", err)
+	}
+	r, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB: %s", err)
+	}
+	if lastTotal != len(r.File) {
+		t.Errorf(
+			"Progress callback got an unexpected total\n"+
+				"Got: %d\n"+
+				"Expected: %d",
+			lastTotal,
+			len(r.File))
+	}
+	if calls != len(r.File) {
+		t.Errorf(
+			"Progress callback wasn't called once for each file\n"+
+				"Got: %d\n"+
+				"Expected: %d",
+			calls,
+			len(r.File))
+	}
+
+	// A nil callback disables progress reporting
+	e.SetWriteProgress(nil)
+	err = e.Write(testEpubFilename)
+	if err != nil {
+		t.Errorf("Unexpected error writing EPUB: %s", err)
+	}
+	if calls != len(r.File) {
+		t.Errorf("Progress callback was called after being removed")
+	}
+
+	// The callback can use the Epub, and changes it makes don't affect the EPUB
+	// file being written
+	e.SetWriteProgress(func(current, total int) {
+		if title := e.Title(); title != testEpubTitle {
+			t.Errorf("Progress callback got an unexpected title\nGot: %s\nExpected: %s", title, testEpubTitle)
+		}
+		e.SetContentFolder("Content")
+	})
+	done := make(chan error)
+	go func() {
+		done <- e.Write(testEpubFilename)
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("Unexpected error writing EPUB: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write deadlocked when the progress callback used the Epub")
+	}
+	tempDir, err := afero.TempDir(e.fs, "", tempDirPrefix)
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp dir: %s", err)
+	}
+	err = unzipFile(e.fs, testEpubFilename, tempDir)
+	if err != nil {
+		t.Errorf("Unexpected error extracting EPUB: %s", err)
+	}
+	_, err = e.fs.Stat(filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Changing the content folder while writing affected the EPUB file: %s", err)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestAddSectionWithNavTitle(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	docTitle := "Chapter 1: The Long Descriptive Name"
+	navTitle := "Chapter 1"
+	testSectionPath, err := e.AddSectionWithNavTitle(testSectionBody, docTitle, navTitle, "", "")
+	if err != nil {
+		t.Errorf("Error adding section: %s", err)
+	}
+	// The nav title falls back to the section title
+	testFallbackPath, err := e.AddSectionWithNavTitle(testSectionBody, testSectionTitle, "", "", "")
+	if err != nil {
+		t.Errorf("Error adding section: %s", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSectionPath))
+	if err != nil {
+		t.Errorf("Unexpected error reading section file: %s", err)
+	}
+	expected := "<title>" + docTitle + "</title>"
+	if !strings.Contains(string(contents), expected) {
+		t.Errorf(
+			"Section title doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			expected)
+	}
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, tocNavFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading nav file: %s", err)
+	}
+	for _, expected := range []string{
+		fmt.Sprintf(testNavLinkTemplate, testSectionPath, navTitle),
+		fmt.Sprintf(testNavLinkTemplate, testFallbackPath, testSectionTitle),
+	} {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Nav file doesn't contain the section\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+	if strings.Contains(string(contents), docTitle) {
+		t.Errorf("Nav file contains the section title instead of the nav title: %s", contents)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestAccessibility(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	if strings.Contains(string(contents), "schema:") {
+		t.Errorf("Package file contains accessibility metadata that wasn't set: %s", contents)
+	}
+	cleanup(e.fs, testEpubFilename, tempDir)
+
+	testSummary := "This publication meets basic accessibility requirements"
+	e.SetAccessibilitySummary(testSummary)
+	e.AddAccessibilityFeature("tableOfContents")
+	e.AddAccessibilityFeature("tableOfContents")
+
+	tempDir = writeAndExtractEpub(t, e, testEpubFilename)
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	for _, expected := range []string{
+		`<meta property="schema:accessMode">textual</meta>`,
+		`<meta property="schema:accessibilityFeature">tableOfContents</meta>`,
+		`<meta property="schema:accessibilitySummary">` + testSummary + `</meta>`,
+	} {
+		if strings.Count(string(contents), expected) != 1 {
+			t.Errorf(
+				"Package file doesn't contain the accessibility metadata once\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestManifest(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+
+	expected := []ManifestItem{
+		{ID: testImageFromFileFilename, Href: "images/" + testImageFromFileFilename, MediaType: "image/png"},
+		{ID: testSectionFilename, Href: "xhtml/" + testSectionFilename, MediaType: mediaTypeXhtml},
+		{ID: tocNavItemID, Href: tocNavFilename, MediaType: mediaTypeXhtml, Properties: tocNavItemProperties},
+		{ID: tocNcxItemID, Href: tocNcxFilename, MediaType: mediaTypeNcx},
+	}
+	manifest := e.Manifest()
+	if !reflect.DeepEqual(manifest, expected) {
+		t.Errorf(
+			"Manifest doesn't match\n"+
+				"Got: %+v\n"+
+				"Expected: %+v",
+			manifest,
+			expected)
+	}
+
+	// The returned items are copies
+	manifest[0].ID = "changed"
+	if e.Manifest()[0].ID != testImageFromFileFilename {
+		t.Errorf("Changing the returned manifest changed the EPUB")
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	for _, item := range expected {
+		if !strings.Contains(string(contents), fmt.Sprintf(`<item id="%s" href="%s" media-type="%s"`, item.ID, item.Href, item.MediaType)) {
+			t.Errorf(
+				"Package file doesn't contain the manifest item\n"+
+					"Got: %s\n"+
+					"Expected: %+v",
+				contents,
+				item)
+		}
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestSetFixedLayout(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	for _, size := range [][2]int{{-1, 1600}, {1200, 0}} {
+		if err := e.SetFixedLayout(size[0], size[1]); err != ErrInvalidFixedLayout {
+			t.Errorf("Setting fixed layout to %dx%d should return ErrInvalidFixedLayout, got: %v", size[0], size[1], err)
+		}
+	}
+
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+	err := e.SetFixedLayout(1200, 1600)
+	if err != nil {
+		t.Errorf("Unexpected error setting fixed layout: %s", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	for _, expected := range []string{
+		`<meta property="rendition:layout">pre-paginated</meta>`,
+		`<meta property="rendition:orientation">auto</meta>`,
+		`<meta property="rendition:spread">auto</meta>`,
+	} {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Package file doesn't contain the rendition metadata\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSectionFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading section file: %s", err)
+	}
+	expected := `<meta name="viewport" content="width=1200, height=1600"></meta>`
+	if !strings.Contains(string(contents), expected) {
+		t.Errorf(
+			"Section doesn't contain the viewport\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			expected)
+	}
+
+	opened, err := OpenWithFs(testEpubFilename, e.fs)
+	if err != nil {
+		t.Errorf("Unexpected error opening EPUB: %s", err)
+	} else if opened.fixedLayoutWidth != 1200 || opened.fixedLayoutHeight != 1600 {
+		t.Errorf(
+			"Fixed layout of the opened EPUB doesn't match\n"+
+				"Got: %dx%d\n"+
+				"Expected: 1200x1600",
+			opened.fixedLayoutWidth,
+			opened.fixedLayoutHeight)
+	}
+	cleanup(e.fs, testEpubFilename, tempDir)
+
+	// The EPUB can be made reflowable again
+	e.SetFixedLayout(0, 0)
+	tempDir = writeAndExtractEpub(t, e, testEpubFilename)
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	if strings.Contains(string(contents), "rendition:layout") {
+		t.Errorf("Package file still contains the rendition metadata: %s", contents)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestAddSectionWithSpineProperties(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	_, err := e.AddSectionWithSpineProperties(testSectionBody, testSectionTitle, "", "", []string{"page-spread-top"})
+	if err != ErrInvalidSpineProperty {
+		t.Errorf("Adding a section with an invalid spine property should return ErrInvalidSpineProperty, got: %v", err)
+	}
+	if len(e.Sections()) != 0 {
+		t.Errorf("Section with an invalid spine property was added")
+	}
+
+	e.AddSection(testSectionBody, testSectionTitle, "", "")
+	testSectionPath, err := e.AddSectionWithSpineProperties(testSectionBody, testSectionTitle, "", "", []string{"page-spread-left", "rendition:layout-reflowable"})
+	if err != nil {
+		t.Errorf("Error adding section: %s", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	expected := fmt.Sprintf(`<itemref idref="%s" properties="page-spread-left rendition:layout-reflowable"></itemref>`, testSectionPath)
+	if !strings.Contains(string(contents), expected) {
+		t.Errorf(
+			"Package file doesn't contain the spine properties\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			expected)
+	}
+	cleanup(e.fs, testEpubFilename, tempDir)
+
+	// Setting the page spread replaces the one set when the section was added
+	e.SetPageSpread(testSectionPath, PageSpreadRight)
+	tempDir = writeAndExtractEpub(t, e, testEpubFilename)
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	expected = fmt.Sprintf(`<itemref idref="%s" properties="rendition:layout-reflowable rendition:page-spread-right"></itemref>`, testSectionPath)
+	if !strings.Contains(string(contents), expected) {
+		t.Errorf(
+			"Package file doesn't contain the replaced page spread\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			expected)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestSetUniqueIdentifierID(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+	for _, id := range []string{"", "1st", "book:id", "book id", pkgCreatorID, testSectionFilename} {
+		if err := e.SetUniqueIdentifierID(id); err != ErrInvalidUniqueIdentifierID {
+			t.Errorf("Setting the unique identifier ID to %q should return ErrInvalidUniqueIdentifierID, got: %v", id, err)
+		}
+	}
+
+	e.SetIdentifierWithScheme(testEpubISBN, IdentifierSchemeISBN)
+	err := e.SetUniqueIdentifierID("bookid")
+	if err != nil {
+		t.Errorf("Unexpected error setting unique identifier ID: %s", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	for _, expected := range []string{
+		`unique-identifier="bookid"`,
+		`<dc:identifier id="bookid">`,
+		`<meta refines="#bookid" property="identifier-type"`,
+	} {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Package file doesn't use the unique identifier ID\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+	if strings.Contains(string(contents), pkgUniqueIdentifier) {
+		t.Errorf("Package file still contains the default unique identifier ID: %s", contents)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestAddMeta(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+	for _, prefix := range []string{"", "foaf:", "1st"} {
+		if err := e.AddVocabularyPrefix(prefix, testVocabularyURI); err != ErrInvalidVocabularyPrefix {
+			t.Errorf("Adding the vocabulary prefix %q should return ErrInvalidVocabularyPrefix, got: %v", prefix, err)
+		}
+	}
+	if err := e.AddVocabularyPrefix(testVocabularyPrefix, "foaf/spec"); err != ErrInvalidVocabularyPrefix {
+		t.Errorf("Adding a vocabulary prefix with a relative URI should return ErrInvalidVocabularyPrefix, got: %v", err)
+	}
+	for _, property := range []string{"", "foaf:given name"} {
+		if err := e.AddMeta(property, testMetaValue); err != ErrInvalidMeta {
+			t.Errorf("Adding a meta with the property %q should return ErrInvalidMeta, got: %v", property, err)
+		}
+	}
+
+	// The prefix hasn't been declared yet
+	err := e.AddMeta(testMetaProperty, testMetaValue)
+	if err != nil {
+		t.Errorf("Unexpected error adding meta: %s", err)
+	}
+	if errs := e.Validate(); len(errs) != 1 {
+		t.Errorf("Validate should report the undeclared prefix, got: %v", errs)
+	}
+
+	err = e.AddVocabularyPrefix(testVocabularyPrefix, testVocabularyURI)
+	if err != nil {
+		t.Errorf("Unexpected error adding vocabulary prefix: %s", err)
+	}
+	if errs := e.Validate(); errs != nil {
+		t.Errorf("Unexpected errors validating EPUB: %v", errs)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	for _, expected := range []string{
+		fmt.Sprintf(`prefix="%s: %s"`, testVocabularyPrefix, testVocabularyURI),
+		fmt.Sprintf(`<meta property="%s">%s</meta>`, testMetaProperty, testMetaValue),
+	} {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Package file doesn't contain the custom metadata\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+
+	opened, err := OpenWithFs(testEpubFilename, e.fs)
+	if err != nil {
+		t.Fatalf("Unexpected error opening EPUB: %s", err)
+	}
+	if len(opened.vocabularyPrefixes) != 1 || opened.vocabularyPrefixes[0].uri != testVocabularyURI {
+		t.Errorf("Vocabulary prefixes weren't read: %v", opened.vocabularyPrefixes)
+	}
+	if errs := opened.Validate(); errs != nil {
+		t.Errorf("Unexpected errors validating opened EPUB: %v", errs)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestSetTocTitle(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+	e.SetTocTitle(testTocTitle)
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, tocNavFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading nav file: %s", err)
+	}
+	for _, expected := range []string{
+		fmt.Sprintf("<title>%s</title>", testTocTitle),
+		fmt.Sprintf("<h1>%s</h1>", testTocTitle),
+	} {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Nav file doesn't use the TOC title\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+	if strings.Contains(string(contents), tocNavHeading) {
+		t.Errorf("Nav file still contains the default heading: %s", contents)
+	}
+
+	opened, err := OpenWithFs(testEpubFilename, e.fs)
+	if err != nil {
+		t.Fatalf("Unexpected error opening EPUB: %s", err)
+	}
+	if opened.toc.navTitle != testTocTitle {
+		t.Errorf(
+			"TOC title wasn't read\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			opened.toc.navTitle,
+			testTocTitle)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestNcxTitle(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+
+	// Write the EPUB once with each title, as when reusing an Epub
+	for _, title := range []string{testEpubTitle, testEpubAuthor} {
+		e.SetTitle(title)
+
+		tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+		contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, tocNcxFilename))
+		if err != nil {
+			t.Errorf("Unexpected error reading NCX file: %s", err)
+		}
+		ncx := &tocNcxRoot{}
+		if err := xml.Unmarshal(contents, ncx); err != nil {
+			t.Errorf("Unexpected error parsing NCX file: %s", err)
+		}
+		if ncx.Title != title {
+			t.Errorf(
+				"NCX docTitle doesn't match the EPUB title\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				ncx.Title,
+				title)
+		}
+
+		cleanup(e.fs, testEpubFilename, tempDir)
+	}
+}
+
+func TestClone(t *testing.T) {
+	testSubject := "Fantasy"
+	testSubject2 := "Science Fiction"
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.SetAuthor(testEpubAuthor)
+	e.AddSubject(testSubject)
+	testCSSPath, _ := e.AddCSS(testCoverCSSSource, testCoverCSSFilename)
+	e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, testCSSPath)
+
+	c := e.Clone()
+	c.SetTitle(testEpubAuthor)
+	c.AddSubject(testSubject2)
+	c.AddImage(testImageFromFileSource, "")
+	c.AddSection(testSectionBody, testSectionTitle, "", testCSSPath)
+	testJavaScriptPath, _ := c.AddJavaScript(testJavaScriptSource, "")
+	c.AddScriptToSection(testSectionFilename, testJavaScriptPath)
+
+	if len(e.Sections()) != 1 {
+		t.Errorf("Adding a section to the clone changed the original's sections: %v", e.Sections())
+	}
+	if len(c.Sections()) != 2 {
+		t.Errorf("Clone has %d sections, expected 2", len(c.Sections()))
+	}
+	if e.Title() != testEpubTitle || !reflect.DeepEqual(e.Subjects(), []string{testSubject}) {
+		t.Errorf("Changing the clone's metadata changed the original's: %s, %v", e.Title(), e.Subjects())
+	}
+	if c.Author() != testEpubAuthor || !reflect.DeepEqual(c.Subjects(), []string{testSubject, testSubject2}) {
+		t.Errorf("Clone doesn't have the original's metadata: %s, %v", c.Author(), c.Subjects())
+	}
+	if len(e.images) != 1 || len(c.images) != 2 {
+		t.Errorf("Unexpected images in original and clone: %v, %v", e.images, c.images)
+	}
+	if len(e.sections[0].xhtml.xml.Head.Scripts) != 0 {
+		t.Errorf("Adding a script to the clone's section changed the original's section")
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	if strings.Contains(string(contents), testSubject2) {
+		t.Errorf("Original's package file contains the clone's subject: %s", contents)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+
+	tempDir = writeAndExtractEpub(t, c, testEpubFilename)
+
+	contents, err = afero.ReadFile(c.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	for _, expected := range []string{testEpubAuthor, testSubject2, testCoverCSSFilename} {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Clone's package file is missing metadata or files\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+
+	cleanup(c.fs, testEpubFilename, tempDir)
+}
+
+func TestWriteToZip(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	err := e.WriteToZip(zw)
+	if err != nil {
+		t.Errorf("Unexpected error writing EPUB to zip writer: %s", err)
+	}
+	// The zip writer should still be usable
+	w, err := zw.Create("extra.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error adding file after writing EPUB: %s", err)
+	}
+	w.Write([]byte("extra"))
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Unexpected error closing zip writer: %s", err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error reading zip file: %s", err)
+	}
+	if r.File[0].Name != mimetypeFilename || r.File[0].Method != zip.Store {
+		t.Errorf("The first entry should be the uncompressed mimetype file, got: %s (method %d)", r.File[0].Name, r.File[0].Method)
+	}
+	names := make(map[string]bool)
+	for _, f := range r.File {
+		names[f.Name] = true
+	}
+	for _, expected := range []string{
+		path.Join(metaInfFolderName, containerFilename),
+		path.Join(contentFolderName, pkgFilename),
+		path.Join(contentFolderName, xhtmlFolderName, testSectionFilename),
+		"extra.txt",
+	} {
+		if !names[expected] {
+			t.Errorf("Zip file is missing %s: %v", expected, names)
+		}
+	}
+}
+
+func TestSetFilenameFormat(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	for _, format := range []string{"", "chapter.xhtml", "chapter-%s.xhtml", "chapter-%d-%d.xhtml", "chapter-%d%", "100%-%d.xhtml"} {
+		if err := e.SetSectionFilenameFormat(format); err != ErrInvalidFilenameFormat {
+			t.Errorf("Setting the section filename format to %q should return ErrInvalidFilenameFormat, got: %v", format, err)
+		}
+	}
+
+	err := e.SetSectionFilenameFormat("chapter-%04d.xhtml")
+	if err != nil {
+		t.Errorf("Unexpected error setting section filename format: %s", err)
+	}
+	err = e.SetImageFilenameFormat("img-%02d")
+	if err != nil {
+		t.Errorf("Unexpected error setting image filename format: %s", err)
+	}
+
+	e.AddSection(testSectionBody, testSectionTitle, "", "")
+	testSectionPath, err := e.AddSection(testSectionBody, testSectionTitle, "", "")
+	if err != nil {
+		t.Errorf("Unexpected error adding section: %s", err)
+	}
+	if testSectionPath != "chapter-0002.xhtml" {
+		t.Errorf(
+			"Generated section filename doesn't use the format\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			testSectionPath,
+			"chapter-0002.xhtml")
+	}
+
+	// A filename is only generated for the image if the source's filename is
+	// already used
+	e.AddImage(testImageFromFileSource, "")
+	testImagePath, err := e.AddImage(testImageFromFileSource, "")
+	if err != nil {
+		t.Errorf("Unexpected error adding image: %s", err)
+	}
+	expectedImagePath := filepath.Join("..", ImageFolderName, "img-02"+filepath.Ext(testImageFromFileSource))
+	if testImagePath != expectedImagePath {
+		t.Errorf(
+			"Generated image filename doesn't use the format\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			testImagePath,
+			expectedImagePath)
+	}
+}
+
+func TestSetMinifyXML(t *testing.T) {
+	sizes := make(map[bool]int)
+	for _, minify := range []bool{false, true} {
+		e := NewEpubWithFs(testEpubTitle, getFs())
+		e.SetAuthor(testEpubAuthor)
+		e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+		e.SetMinifyXML(minify)
+
+		tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+		for _, filename := range []string{pkgFilename, tocNavFilename, tocNcxFilename, filepath.Join(xhtmlFolderName, testSectionFilename)} {
+			contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, filename))
+			if err != nil {
+				t.Errorf("Unexpected error reading %s: %s", filename, err)
+			}
+			if err := validateXML(string(contents)); err != nil {
+				t.Errorf("%s isn't well-formed XML (minify=%t): %s", filename, minify, err)
+			}
+			if filename == pkgFilename {
+				sizes[minify] = len(contents)
+				if minify && strings.Contains(string(contents), "\n  <") {
+					t.Errorf("Minified package file is indented: %s", contents)
+				}
+			}
+		}
+
+		cleanup(e.fs, testEpubFilename, tempDir)
+	}
+
+	if sizes[true] >= sizes[false] {
+		t.Errorf("Minified package file (%d bytes) isn't smaller than the indented one (%d bytes)", sizes[true], sizes[false])
+	}
+}
+
+func TestAddCSSWithFonts(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testCSSPath, err := e.AddCSSWithFonts(testCSSWithFontsSource, "")
+	if err != nil {
+		t.Errorf("Unexpected error adding CSS with fonts: %s", err)
+	}
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, testCSSPath)
+
+	testFontFilename := filepath.Base(testFontFromFileSource)
+	if e.fonts[testFontFilename] != filepath.Join(filepath.Dir(testCSSWithFontsSource), testFontFilename) {
+		t.Errorf("The font referenced by the CSS wasn't added: %v", e.fonts)
+	}
+
+	// Adding the CSS again shouldn't add the font again
+	_, err = e.AddCSSWithFonts(testCSSWithFontsSource, "fonts2.css")
+	if err != nil {
+		t.Errorf("Unexpected error adding CSS with fonts: %s", err)
+	}
+	if len(e.fonts) != 1 {
+		t.Errorf("The font was added more than once: %v", e.fonts)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, CSSFolderName, filepath.Base(testCSSWithFontsSource)))
+	if err != nil {
+		t.Errorf("Unexpected error reading CSS file: %s", err)
+	}
+	expected := fmt.Sprintf(`url("../%s/%s")`, FontFolderName, testFontFilename)
+	if !strings.Contains(string(contents), expected) {
+		t.Errorf(
+			"Font URL wasn't rewritten\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			expected)
+	}
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	testFontItem := fmt.Sprintf(testFontItemTemplate, testFontFilename, testFontFilename)
+	if !strings.Contains(string(contents), testFontItem) {
+		t.Errorf(
+			"Font manifest item doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testFontItem)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+
+	// Fonts that don't exist should cause an error without adding anything
+	missingFontCSSSource := filepath.Join(filepath.Dir(testCSSWithFontsSource), "missing-font.css")
+	afero.WriteFile(e.fs, missingFontCSSSource, []byte(`@font-face { src: url(missing.ttf); }`), filePermissions)
+	defer e.fs.Remove(missingFontCSSSource)
+	cssCount := len(e.css)
+	_, err = e.AddCSSWithFonts(missingFontCSSSource, "")
+	if err != ErrRetrievingFile {
+		t.Errorf("Adding CSS with a missing font should return ErrRetrievingFile, got: %v", err)
+	}
+	if len(e.css) != cssCount {
+		t.Errorf("CSS with a missing font was added: %v", e.css)
+	}
+
+	// Fonts with invalid filenames should cause an error without adding anything
+	invalidFontCSSSource := filepath.Join(filepath.Dir(testCSSWithFontsSource), "invalid-font.css")
+	afero.WriteFile(e.fs, invalidFontCSSSource, []byte(`@font-face { src: url("a<b.ttf"); }`), filePermissions)
+	defer e.fs.Remove(invalidFontCSSSource)
+	_, err = e.AddCSSWithFonts(invalidFontCSSSource, "")
+	if err != ErrInvalidFilename {
+		t.Errorf("Adding CSS with an invalid font filename should return ErrInvalidFilename, got: %v", err)
+	}
+	if len(e.css) != cssCount {
+		t.Errorf("CSS with an invalid font filename was added: %v", e.css)
+	}
+}
+
+func TestAddCSSWithFontsMultipleSources(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testFontFilename := filepath.Base(testFontFromFileSource)
+	eotURL := "redacted-script-regular.eot?#iefix"
+	cssSource := filepath.Join(filepath.Dir(testCSSWithFontsSource), "multiple-sources.css")
+	afero.WriteFile(e.fs, cssSource, []byte(fmt.Sprintf(
+		`@font-face { src: url(%s) format("truetype"), url("%s") format("embedded-opentype"); }`,
+		testFontFilename,
+		eotURL)), filePermissions)
+	defer e.fs.Remove(cssSource)
+
+	// The unsupported .eot font should be left alone rather than failing
+	testCSSPath, err := e.AddCSSWithFonts(cssSource, "")
+	if err != nil {
+		t.Errorf("Unexpected error adding CSS with fonts: %s", err)
+	}
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, testCSSPath)
+	if len(e.fonts) != 1 || e.fonts[testFontFilename] == "" {
+		t.Errorf("Only the supported font should have been added: %v", e.fonts)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, CSSFolderName, filepath.Base(cssSource)))
+	if err != nil {
+		t.Errorf("Unexpected error reading CSS file: %s", err)
+	}
+	for _, expected := range []string{
+		fmt.Sprintf(`url("../%s/%s")`, FontFolderName, testFontFilename),
+		fmt.Sprintf(`url("%s")`, eotURL),
+	} {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Font URLs weren't rewritten correctly\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestAddCSSWithFontsWithoutLocking(t *testing.T) {
+	testFontData, err := ioutil.ReadFile(testFontFromFileSource)
+	if err != nil {
+		t.Fatalf("Unexpected error reading font file: %s", err)
+	}
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	blocked := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The Epub shouldn't be locked while the CSS file or fonts are being
+		// downloaded
+		done := make(chan bool)
+		go func() {
+			e.Title()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			blocked <- r.URL.Path
+		}
+		if strings.HasSuffix(r.URL.Path, ".css") {
+			w.Write([]byte(`@font-face { src: url("fonts/font.woff?v=2"); }`))
+			return
+		}
+		w.Write(testFontData)
+	}))
+	defer server.Close()
+
+	_, err = e.AddCSSWithFonts(server.URL+"/fonts.css", "")
+	if err != nil {
+		t.Errorf("Unexpected error adding CSS with fonts: %s", err)
+	}
+	close(blocked)
+	for path := range blocked {
+		t.Errorf("The EPUB was locked while downloading %s", path)
+	}
+
+	// The query of the URL shouldn't be part of the filename
+	if e.fonts["font.woff"] != server.URL+"/fonts/font.woff?v=2" {
+		t.Errorf("The font wasn't added with the filename from its URL: %v", e.fonts)
+	}
+}
+
+func TestSetPackageFilename(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	for _, filename := range []string{"", ".opf", "content.xml", "OEBPS/content.opf", "a<b.opf", `a"b.opf`} {
+		if err := e.SetPackageFilename(filename); err != ErrInvalidPackageFilename {
+			t.Errorf("Setting the package filename to %q should return ErrInvalidPackageFilename, got: %v", filename, err)
+		}
+	}
+	err := e.SetPackageFilename(testPackageFilename)
+	if err != nil {
+		t.Errorf("Unexpected error setting package filename: %s", err)
+	}
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	if _, err := e.fs.Stat(filepath.Join(tempDir, contentFolderName, testPackageFilename)); err != nil {
+		t.Errorf("Package file wasn't written to %s: %s", testPackageFilename, err)
+	}
+	if _, err := e.fs.Stat(filepath.Join(tempDir, contentFolderName, pkgFilename)); err == nil {
+		t.Errorf("Package file was also written to %s", pkgFilename)
+	}
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, metaInfFolderName, containerFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading container file: %s", err)
+	}
+	expected := fmt.Sprintf(`full-path="%s/%s"`, contentFolderName, testPackageFilename)
+	if !strings.Contains(string(contents), expected) {
+		t.Errorf(
+			"Container file doesn't point to the package file\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			expected)
+	}
+
+	opened, err := OpenWithFs(testEpubFilename, e.fs)
+	if err != nil {
+		t.Fatalf("Unexpected error opening EPUB: %s", err)
+	}
+	if opened.packageFilename != testPackageFilename {
+		t.Errorf("Package filename wasn't read: %s", opened.packageFilename)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+
+	// Characters that are special in XML are escaped in the container file
+	testSpecialPackageFilename := "a&b.opf"
+	err = e.SetPackageFilename(testSpecialPackageFilename)
+	if err != nil {
+		t.Errorf("Unexpected error setting package filename: %s", err)
+	}
+	tempDir = writeAndExtractEpub(t, e, testEpubFilename)
+
+	opened, err = OpenWithFs(testEpubFilename, e.fs)
+	if err != nil {
+		t.Fatalf("Unexpected error opening EPUB: %s", err)
+	}
+	if opened.packageFilename != testSpecialPackageFilename {
+		t.Errorf("Package filename wasn't read: %s", opened.packageFilename)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestWriteStreamsLocalMedia(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+
+	// Audio is stored without compression, so the zip writer shouldn't need
+	// to buffer it either
+	largeFileSize := 16 << 20
+	largeFileSource := filepath.Join(filepath.Dir(testImageFromFileSource), "large.mp3")
+	err := afero.WriteFile(e.fs, largeFileSource, make([]byte, largeFileSize), filePermissions)
+	if err != nil {
+		t.Fatalf("Unexpected error writing large file: %s", err)
+	}
+	defer e.fs.Remove(largeFileSource)
+	_, err = e.AddAudio(largeFileSource, "")
+	if err != nil {
+		t.Fatalf("Unexpected error adding audio: %s", err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	zw := zip.NewWriter(ioutil.Discard)
+	err = e.WriteToZip(zw)
+	if err != nil {
+		t.Errorf("Unexpected error writing EPUB: %s", err)
+	}
+	zw.Close()
+	runtime.ReadMemStats(&after)
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > uint64(largeFileSize/4) {
+		t.Errorf("Writing the EPUB allocated %d bytes for a %d byte file", allocated, largeFileSize)
+	}
+
+	e.SetVerifyAfterWrite(true)
+	err = e.Write(testEpubFilename)
+	if err != nil {
+		t.Errorf("Unexpected error writing EPUB: %s", err)
+	}
+	defer e.fs.Remove(testEpubFilename)
+
+	f, err := e.fs.Open(testEpubFilename)
+	if err != nil {
+		t.Fatalf("Unexpected error opening EPUB: %s", err)
+	}
+	defer f.Close()
+	info, _ := f.Stat()
+	r, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB: %s", err)
+	}
+	found := false
+	for _, zf := range r.File {
+		if zf.Name == path.Join(contentFolderName, AudioFolderName, "large.mp3") {
+			found = true
+			if zf.UncompressedSize64 != uint64(largeFileSize) {
+				t.Errorf("Audio file has %d bytes, expected %d", zf.UncompressedSize64, largeFileSize)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Audio file is missing from the EPUB")
+	}
+}
+
+func TestAddCollection(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.SetSeries(testSeriesName, 2)
+	setID, err := e.AddCollection("Complete Works", CollectionTypeSet, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error adding collection: %s", err)
+	}
+	seriesID, err := e.AddSubCollection(setID, "The Trilogy", CollectionTypeSeries, 1.5)
+	if err != nil {
+		t.Fatalf("Unexpected error adding sub-collection: %s", err)
+	}
+
+	if _, err := e.AddCollection("", CollectionTypeSet, 0); err != ErrInvalidCollection {
+		t.Errorf("Expected error adding a collection without a name\nGot: %v\nExpected: %s", err, ErrInvalidCollection)
+	}
+	if _, err := e.AddCollection("Complete Works", "boxset", 0); err != ErrInvalidCollection {
+		t.Errorf("Expected error adding a collection with an invalid type\nGot: %v\nExpected: %s", err, ErrInvalidCollection)
+	}
+	if _, err := e.AddSubCollection("nonexistent", "The Trilogy", CollectionTypeSeries, 0); err != ErrInvalidCollection {
+		t.Errorf("Expected error adding a sub-collection to a nonexistent collection\nGot: %v\nExpected: %s", err, ErrInvalidCollection)
+	}
+	if err := e.SetUniqueIdentifierID(setID); err != ErrInvalidUniqueIdentifierID {
+		t.Errorf("Expected error using a collection ID as the unique identifier ID\nGot: %v\nExpected: %s", err, ErrInvalidUniqueIdentifierID)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	expectedElements := []string{
+		`<meta property="belongs-to-collection" id="series">` + testSeriesName + `</meta>`,
+		`<meta property="belongs-to-collection" id="` + setID + `">Complete Works</meta>`,
+		`<meta refines="#` + setID + `" property="collection-type">set</meta>`,
+		`<meta refines="#` + setID + `" property="belongs-to-collection" id="` + seriesID + `">The Trilogy</meta>`,
+		`<meta refines="#` + seriesID + `" property="collection-type">series</meta>`,
+		`<meta refines="#` + seriesID + `" property="group-position">1.5</meta>`,
+	}
+	for _, expected := range expectedElements {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Collection metadata doesn't match\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+	if strings.Contains(string(contents), `refines="#`+setID+`" property="group-position"`) {
+		t.Errorf("Group position was written for a collection without a position: %s", contents)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestFileContents(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testSectionPath, err := e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+	if err != nil {
+		t.Fatalf("Unexpected error adding section: %s", err)
+	}
+	testCSSPath, err := e.AddCSSFromBytes([]byte("p { margin: 0; }"), "base.css")
+	if err != nil {
+		t.Fatalf("Unexpected error adding CSS: %s", err)
+	}
+
+	contents, err := e.FileContents(testSectionPath)
+	if err != nil {
+		t.Fatalf("Unexpected error getting section contents: %s", err)
+	}
+	testSectionContents := fmt.Sprintf(testSectionContentTemplate, testSectionTitle, testSectionBody)
+	if trimAllSpace(string(contents)) != trimAllSpace(testSectionContents) {
+		t.Errorf(
+			"Section contents don't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testSectionContents)
+	}
+
+	contents, err = e.FileContents(testCSSPath)
+	if err != nil {
+		t.Fatalf("Unexpected error getting CSS contents: %s", err)
+	}
+	if string(contents) != "p { margin: 0; }" {
+		t.Errorf(
+			"CSS contents don't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			"p { margin: 0; }")
+	}
+
+	// The contents should match the file written to the EPUB
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	written, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSectionFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading section file: %s", err)
+	}
+	contents, _ = e.FileContents(testSectionFilename)
+	if string(contents) != string(written) {
+		t.Errorf(
+			"Section contents don't match the written file\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			written)
+	}
+
+	if _, err := e.FileContents("../images/nonexistent.png"); err != ErrFileNotFound {
+		t.Errorf("Expected error getting the contents of a nonexistent file\nGot: %v\nExpected: %s", err, ErrFileNotFound)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestSetCoverTemplate(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	if err := e.SetCoverTemplate(`<div class="cover"><img src="{{.ImagePath}}"></div>`); !errors.Is(err, ErrInvalidCoverTemplate) {
+		t.Errorf("Expected error setting a template that doesn't generate well-formed XHTML\nGot: %v\nExpected: %s", err, ErrInvalidCoverTemplate)
+	}
+	if err := e.SetCoverTemplate(`<p>{{.Author}}</p>`); !errors.Is(err, ErrInvalidCoverTemplate) {
+		t.Errorf("Expected error setting a template with an unknown placeholder\nGot: %v\nExpected: %s", err, ErrInvalidCoverTemplate)
+	}
+	err := e.SetCoverTemplate(`<div class="cover" data-css="{{.CSSPath}}"><img src="{{.ImagePath}}" alt="{{.Title}}" /></div>`)
+	if err != nil {
+		t.Fatalf("Unexpected error setting cover template: %s", err)
+	}
+
+	testImagePath, _ := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	e.SetCover(testImagePath, "")
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, defaultCoverXhtmlFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading cover XHTML file: %s", err)
+	}
+	expected := `<div class="cover" data-css="../css/cover.css"><img src="` + testImagePath + `" alt="` + testEpubTitle + `" /></div>`
+	if !strings.Contains(string(contents), expected) {
+		t.Errorf(
+			"Cover body doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			expected)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestSetIncludeNCX(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+	e.SetIncludeNCX(false)
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	if _, err := e.fs.Stat(filepath.Join(tempDir, contentFolderName, tocNcxFilename)); !os.IsNotExist(err) {
+		t.Errorf("Expected the NCX file to be omitted\nGot: %v", err)
+	}
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	if strings.Contains(string(contents), tocNcxFilename) {
+		t.Errorf("Package file contains the NCX manifest item: %s", contents)
+	}
+	if !strings.Contains(string(contents), "<spine>") {
+		t.Errorf(
+			"Spine doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			"<spine>")
+	}
+	cleanup(e.fs, "", tempDir)
+
+	// An opened EPUB without an NCX file should be written without one
+	opened, err := OpenWithFs(testEpubFilename, e.fs)
+	if err != nil {
+		t.Fatalf("Unexpected error opening EPUB: %s", err)
+	}
+	tempDir = writeAndExtractEpub(t, opened, testEpubFilename)
+	if _, err := e.fs.Stat(filepath.Join(tempDir, contentFolderName, tocNcxFilename)); !os.IsNotExist(err) {
+		t.Errorf("Expected the NCX file to be omitted from the opened EPUB\nGot: %v", err)
+	}
+	cleanup(e.fs, testEpubFilename, tempDir)
+
+	// EPUB 2 requires the NCX file
+	e.SetVersion(EpubVersion2)
+	tempDir = writeAndExtractEpub(t, e, testEpubFilename)
+	if _, err := e.fs.Stat(filepath.Join(tempDir, contentFolderName, tocNcxFilename)); err != nil {
+		t.Errorf("Unexpected error getting the NCX file of an EPUB 2 file: %s", err)
+	}
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	if !strings.Contains(string(contents), `<spine toc="ncx">`) {
+		t.Errorf(
+			"Spine doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			`<spine toc="ncx">`)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestGuide(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testImagePath, _ := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	e.SetCover(testImagePath, "")
+	e.AddNonLinearSection(testSectionBody, "Front matter", "", "")
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	expectedElements := []string{
+		`<reference type="cover" title="Cover" href="xhtml/` + defaultCoverXhtmlFilename + `"></reference>`,
+		`<reference type="text" title="Beginning" href="xhtml/` + testSectionFilename + `"></reference>`,
+	}
+	for _, expected := range expectedElements {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Guide doesn't match\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+	cleanup(e.fs, testEpubFilename, tempDir)
+
+	// The body matter landmark is used for the start of the text
+	e.AddLandmark(landmarkBodymatter, "Start", testSectionFilename+"#start")
+	tempDir = writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	expected := `<reference type="text" title="Beginning" href="xhtml/` + testSectionFilename + `#start"></reference>`
+	if !strings.Contains(string(contents), expected) || strings.Count(string(contents), "<reference ") != 2 {
+		t.Errorf(
+			"Guide doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			expected)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestSetSpineAttribute(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.SetPpd(testEpubPpd)
+	for _, name := range []string{"", "1st", "has space", "toc", "page-progression-direction", "xmlns:foo"} {
+		if err := e.SetSpineAttribute(name, "value"); err != ErrInvalidSpineAttribute {
+			t.Errorf("Expected error setting spine attribute %q\nGot: %v\nExpected: %s", name, err, ErrInvalidSpineAttribute)
+		}
+	}
+	if err := e.SetSpineAttribute("id", "old"); err != nil {
+		t.Errorf("Unexpected error setting spine attribute: %s", err)
+	}
+	if err := e.SetSpineAttribute("id", "spine"); err != nil {
+		t.Errorf("Unexpected error setting spine attribute: %s", err)
+	}
+	if err := e.SetSpineAttribute("removed", "value"); err != nil {
+		t.Errorf("Unexpected error setting spine attribute: %s", err)
+	}
+	e.SetSpineAttribute("removed", "")
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	expected := `<spine toc="ncx" page-progression-direction="` + testEpubPpd + `" id="spine">`
+	if !strings.Contains(string(contents), expected) {
+		t.Errorf(
+			"Spine doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			expected)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestAddSectionFullDocument(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	document := `<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml">
+  <head><title>Ignored</title></head>
+  <body class="chapter">` + testSectionBody + `</body>
+</html>`
+	_, err := e.AddSection(document, testSectionTitle, testSectionFilename, "")
+	if err != nil {
+		t.Fatalf("Unexpected error adding a section with a complete document: %s", err)
+	}
+	if _, err := e.AddSection(`<html><head><title>No body</title></head></html>`, "", "", ""); !errors.Is(err, ErrInvalidXML) {
+		t.Errorf("Expected error adding a complete document without a body\nGot: %v\nExpected: %s", err, ErrInvalidXML)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSectionFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading section file: %s", err)
+	}
+	testSectionContents := fmt.Sprintf(testSectionContentTemplate, testSectionTitle, testSectionBody)
+	if trimAllSpace(string(contents)) != trimAllSpace(testSectionContents) {
+		t.Errorf(
+			"Section file contents don't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testSectionContents)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestSetPpd(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	if err := e.SetPpd("up"); err != ErrInvalidPpd {
+		t.Errorf("Expected error setting an invalid page progression direction\nGot: %v\nExpected: %s", err, ErrInvalidPpd)
+	}
+	if e.Ppd() != "" {
+		t.Errorf("Page progression direction was changed by an invalid direction: %s", e.Ppd())
+	}
+	if err := e.SetPageProgressionDirection(PpdRtl); err != nil {
+		t.Errorf("Unexpected error setting page progression direction: %s", err)
+	}
+	if e.Ppd() != PpdRtl {
+		t.Errorf(
+			"Page progression direction doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			e.Ppd(),
+			PpdRtl)
+	}
+}
+
+func TestSetNavDocument(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+	testNavDocument := `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>Contents</title></head>
+<body><nav epub:type="toc"><ol><li><a href="xhtml/` + testSectionFilename + `">Hand-made</a></li></ol></nav></body>
+</html>
+`
+	testNCXDocument := `<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1"><head></head><docTitle><text>Hand-made</text></docTitle><navMap></navMap></ncx>
+`
+	if err := e.SetNavDocument("<html><body></html>"); !errors.Is(err, ErrInvalidXML) {
+		t.Errorf("Expected error setting a nav document that isn't well-formed\nGot: %v\nExpected: %s", err, ErrInvalidXML)
+	}
+	if err := e.SetNavDocument(testNavDocument); err != nil {
+		t.Errorf("Unexpected error setting nav document: %s", err)
+	}
+	if err := e.SetNCXDocument(testNCXDocument); err != nil {
+		t.Errorf("Unexpected error setting NCX document: %s", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	for filename, expected := range map[string]string{tocNavFilename: testNavDocument, tocNcxFilename: testNCXDocument} {
+		contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, filename))
+		if err != nil {
+			t.Errorf("Unexpected error reading %s: %s", filename, err)
+		}
+		if string(contents) != expected {
+			t.Errorf(
+				"%s doesn't match\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				filename,
+				contents,
+				expected)
+		}
+	}
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	for _, filename := range []string{tocNavFilename, tocNcxFilename} {
+		if !strings.Contains(string(contents), `href="`+filename+`"`) {
+			t.Errorf("Package file doesn't contain the manifest item of %s: %s", filename, contents)
+		}
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestWordCount(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.AddSection(`<h1>Chapter 1</h1><p>The quick brown fox jumps over the lazy dog.</p>`, "", "", "")
+	e.AddSection(`<p>Once upon a&#160;time,<br/>there <em>lived</em> a fox.</p><script>var ignored = true;</script>`, "", "", "")
+	e.AddNonLinearSection(`<p>These words aren't counted.</p>`, "", "", "")
+
+	// 11 words in the first section and 8 in the second
+	expected := 19
+	if count := e.WordCount(); count != expected {
+		t.Errorf(
+			"Word count doesn't match\n"+
+				"Got: %d\n"+
+				"Expected: %d",
+			count,
+			expected)
+	}
+	expectedTime := 19 * time.Minute / 100
+	if readingTime := e.EstimatedReadingTime(100); readingTime != expectedTime {
+		t.Errorf(
+			"Estimated reading time doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			readingTime,
+			expectedTime)
+	}
+}
+
+func TestSetStoreOnly(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.AddSection(strings.Repeat(testSectionBody, 100), testSectionTitle, "", "")
+	e.AddCSSFromBytes([]byte("p { margin: 0; }"), "base.css")
+	e.SetStoreOnly(true)
+
+	err := e.Write(testEpubFilename)
+	if err != nil {
+		t.Fatalf("Unexpected error writing EPUB: %s", err)
+	}
+	defer cleanup(e.fs, testEpubFilename, "")
+
+	contents, err := afero.ReadFile(e.fs, testEpubFilename)
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB file: %s", err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(contents), int64(len(contents)))
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB: %s", err)
+	}
+	for _, f := range r.File {
+		if f.Method != zip.Store {
+			t.Errorf(
+				"Compression method of %s doesn't match\n"+
+					"Got: %d\n"+
+					"Expected: %d",
+				f.Name,
+				f.Method,
+				zip.Store)
+		}
+	}
+
+	e.SetStoreOnly(false)
+	if e.compressionLevel != CompressionLevelDefault {
+		t.Errorf(
+			"Compression level doesn't match\n"+
+				"Got: %d\n"+
+				"Expected: %d",
+			e.compressionLevel,
+			CompressionLevelDefault)
+	}
+}
+
+func TestAddMediaErrors(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	// The media type of images is determined from the content if the extension
+	// is unknown, so this needs to be something other than an image
+	_, err := e.AddImage(testCoverCSSSource, "image.xyz")
+	if !errors.Is(err, ErrUnsupportedMediaType) {
+		t.Errorf("Expected error adding an image with an unknown extension\nGot: %v\nExpected: %s", err, ErrUnsupportedMediaType)
+	}
+	_, err = e.AddImage(testImageFromFileSource, "../image.png")
+	if !errors.Is(err, ErrInvalidFilename) {
+		t.Errorf("Expected error adding an image with a path as the filename\nGot: %v\nExpected: %s", err, ErrInvalidFilename)
+	}
+	_, err = e.AddSection(testSectionBody, testSectionTitle, "chapters/section.xhtml", "")
+	if !errors.Is(err, ErrInvalidFilename) {
+		t.Errorf("Expected error adding a section with a path as the filename\nGot: %v\nExpected: %s", err, ErrInvalidFilename)
+	}
+	_, err = e.AddImage("/nonexistent/image.png", "")
+	if !errors.Is(err, ErrRetrievingFile) {
+		t.Errorf("Expected error adding an image that doesn't exist\nGot: %v\nExpected: %s", err, ErrRetrievingFile)
+	}
+	if len(e.images) != 0 || len(e.sections) != 0 {
+		t.Errorf("Files were added despite the errors: %v, %v", e.images, e.sections)
+	}
+}
+
+func TestAddImageWithMediaType(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	_, err := e.AddImageWithOptions(testImageFromFileSource, "cover", ImageOptions{MediaType: "image/xyz"})
+	if !errors.Is(err, ErrUnsupportedMediaType) {
+		t.Errorf("Expected error adding an image with an unsupported media type\nGot: %v\nExpected: %s", err, ErrUnsupportedMediaType)
+	}
+	testImagePath, err := e.AddImageWithOptions(testImageFromFileSource, "cover", ImageOptions{MediaType: mediaTypeJpeg})
+	if err != nil {
+		t.Fatalf("Unexpected error adding image: %s", err)
+	}
+	e.SetCover(testImagePath, "")
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	expected := `<item id="cover" href="images/cover" media-type="image/jpeg" properties="cover-image"></item>`
+	if !strings.Contains(string(contents), expected) {
+		t.Errorf(
+			"Manifest item doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			expected)
+	}
+
+	// The media type should be kept when the EPUB is opened
+	opened, err := OpenWithFs(testEpubFilename, e.fs)
+	if err != nil {
+		t.Fatalf("Unexpected error opening EPUB: %s", err)
+	}
+	if mediaType := opened.mediaType(ImageFolderName, "cover"); mediaType != mediaTypeJpeg {
+		t.Errorf(
+			"Media type of the opened image doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			mediaType,
+			mediaTypeJpeg)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestAddImageSniffMediaType(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testImagePath, err := e.AddImage(testImageFromFileSource, "image.dat")
+	if err != nil {
+		t.Fatalf("Unexpected error adding image: %s", err)
+	}
+	if mediaType := e.mediaType(ImageFolderName, filepath.Base(testImagePath)); mediaType != "image/png" {
+		t.Errorf(
+			"Media type of the image doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			mediaType,
+			"image/png")
+	}
+
+	// Other content shouldn't be added as an image
+	_, err = e.AddImageFromBytes([]byte("<html><body>Not found</body></html>"), "error.dat")
+	if !errors.Is(err, ErrUnsupportedMediaType) {
+		t.Errorf("Expected error adding an HTML page as an image\nGot: %v\nExpected: %s", err, ErrUnsupportedMediaType)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	expected := `<item id="image.dat" href="images/image.dat" media-type="image/png"></item>`
+	if !strings.Contains(string(contents), expected) {
+		t.Errorf(
+			"Manifest item doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			expected)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestSetCoverImageOnly(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	if err := e.SetCoverImageOnly("../images/missing.png"); err != ErrInvalidImage {
+		t.Errorf("Expected error setting a missing image as the cover\nGot: %v\nExpected: %s", err, ErrInvalidImage)
+	}
+	testImagePath, _ := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	// The cover page should be removed, but not the image
+	e.SetCover(testImagePath, "")
+	if err := e.SetCoverImageOnly(testImagePath); err != nil {
+		t.Fatalf("Unexpected error setting cover image: %s", err)
+	}
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	if _, err := e.fs.Stat(filepath.Join(tempDir, contentFolderName, xhtmlFolderName, defaultCoverXhtmlFilename)); !os.IsNotExist(err) {
+		t.Errorf("Expected the cover XHTML file to be omitted\nGot: %v", err)
+	}
+	if _, err := e.fs.Stat(filepath.Join(tempDir, contentFolderName, CSSFolderName, defaultCoverCSSFilename)); !os.IsNotExist(err) {
+		t.Errorf("Expected the cover CSS file to be omitted\nGot: %v", err)
+	}
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	expectedElements := []string{
+		`<item id="` + testImageFromFileFilename + `" href="images/` + testImageFromFileFilename + `" media-type="image/png" properties="cover-image"></item>`,
+		`<meta name="cover" content="` + testImageFromFileFilename + `"></meta>`,
+	}
+	for _, expected := range expectedElements {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Package file doesn't match\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+	if strings.Contains(string(contents), defaultCoverXhtmlFilename) {
+		t.Errorf("Package file contains the cover page: %s", contents)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestSetLocale(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.SetLocale(language.MustParse("fr-CA"))
+	testImagePath, _ := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	e.SetCover(testImagePath, "")
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	for filename, expected := range map[string]string{
+		filepath.Join(xhtmlFolderName, defaultCoverXhtmlFilename): `alt="Image de couverture"`,
+		tocNavFilename: `<h1>Table des matières</h1>`,
+		pkgFilename:    `<reference type="cover" title="Couverture"`,
+	} {
+		contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, filename))
+		if err != nil {
+			t.Errorf("Unexpected error reading %s: %s", filename, err)
+		}
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"%s doesn't match\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				filename,
+				contents,
+				expected)
+		}
+	}
+	cleanup(e.fs, "", tempDir)
+
+	// Unsupported languages fall back to English
+	e.SetLocale(language.Make("tlh"))
+	tempDir = writeAndExtractEpub(t, e, testEpubFilename)
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, tocNavFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading %s: %s", tocNavFilename, err)
+	}
+	if !strings.Contains(string(contents), "<h1>"+tocNavHeading+"</h1>") {
+		t.Errorf(
+			"%s doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			tocNavFilename,
+			contents,
+			"<h1>"+tocNavHeading+"</h1>")
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestWriteTwice(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.SetIdentifierWithScheme(testEpubISBN, IdentifierSchemeISBN)
+	e.SetSeries(testSeriesName, 2)
+	e.AddAccessibilityFeature("alternativeText")
+	testImagePath, _ := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	e.SetCover(testImagePath, "")
+	e.AddSection(testSectionBody, testSectionTitle, testSectionFilename, "")
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	first, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	cleanup(e.fs, testEpubFilename, tempDir)
+
+	tempDir = writeAndExtractEpub(t, e, testEpubFilename)
+	second, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+
+	for element, expected := range map[string]int{
+		`<meta property="dcterms:modified">`: 1,
+		`<dc:identifier `:                    1,
+		`<meta name="cover" `:                1,
+		`property="schema:accessMode"`:       2,
+		`<reference `:                        2,
+		`<itemref `:                          2,
+	} {
+		if count := strings.Count(string(second), element); count != expected {
+			t.Errorf(
+				"Number of %s elements doesn't match after writing twice\n"+
+					"Got: %d\n"+
+					"Expected: %d",
+				element,
+				count,
+				expected)
+		}
+	}
+	// Only the modified date can change
+	modifiedPattern := regexp.MustCompile(`<meta property="dcterms:modified">[^<]*</meta>`)
+	if modifiedPattern.ReplaceAllString(string(first), "") != modifiedPattern.ReplaceAllString(string(second), "") {
+		t.Errorf(
+			"Package file changed after writing twice\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			second,
+			first)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestSetTocDepth(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	chapterPath, err := e.AddSection(testSectionBody, "Chapter 1", "chapter.xhtml", "")
+	if err != nil {
+		t.Errorf("Error adding section: %s", err)
+	}
+	sectionPath, err := e.AddSubSection(chapterPath, testSectionBody, "Section 1.1", "section.xhtml", "")
+	if err != nil {
+		t.Errorf("Error adding sub-section: %s", err)
+	}
+	_, err = e.AddSubSection(sectionPath, testSectionBody, "Subsection 1.1.1", "subsection.xhtml", "")
+	if err != nil {
+		t.Errorf("Error adding sub-section: %s", err)
+	}
+	e.SetTocDepth(2)
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	for _, tocFilename := range []string{tocNavFilename, tocNcxFilename} {
+		contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, tocFilename))
+		if err != nil {
+			t.Errorf("Unexpected error reading TOC file: %s", err)
+		}
+		for _, title := range []string{"Chapter 1", "Section 1.1"} {
+			if !strings.Contains(string(contents), title) {
+				t.Errorf("Expected %s to contain %q\nGot: %s", tocFilename, title, contents)
+			}
+		}
+		if strings.Contains(string(contents), "Subsection 1.1.1") {
+			t.Errorf("Expected %s not to contain the third level\nGot: %s", tocFilename, contents)
+		}
+	}
+
+	// The section left out of the TOC should still be in the EPUB
+	if _, err := e.fs.Stat(filepath.Join(tempDir, contentFolderName, xhtmlFolderName, "subsection.xhtml")); err != nil {
+		t.Errorf("Expected the section left out of the TOC to be written: %s", err)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestSetAutoTocFromHeadings(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	sectionPath, err := e.AddSection(`<h1>Chapter 1</h1>
+<h2>First part</h2>
+<p>Text</p>
+<h2 class="part">Second <em>part</em></h2>
+<h3 id="details">Details</h3>
+<h4>Too deep</h4>`, "Chapter 1", "chapter.xhtml", "")
+	if err != nil {
+		t.Errorf("Error adding section: %s", err)
+	}
+	e.SetAutoTocFromHeadings(3)
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, sectionPath))
+	if err != nil {
+		t.Errorf("Unexpected error reading section file: %s", err)
+	}
+	for _, heading := range []string{`<h2 id="heading-1">First part</h2>`, `<h2 id="heading-2" class="part">`, `<h3 id="details">`, `<h4>Too deep</h4>`} {
+		if !strings.Contains(string(contents), heading) {
+			t.Errorf("Expected the section to contain %s\nGot: %s", heading, contents)
+		}
+	}
+
+	testNavHeadings := `<li>
+  <a href="xhtml/chapter.xhtml">Chapter 1</a>
+  <ol>
+    <li>
+      <a href="xhtml/chapter.xhtml#heading-1">First part</a>
+    </li>
+    <li>
+      <a href="xhtml/chapter.xhtml#heading-2">Second part</a>
+      <ol>
+        <li>
+          <a href="xhtml/chapter.xhtml#details">Details</a>
+        </li>
+      </ol>
+    </li>
+  </ol>
+</li>`
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, tocNavFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading nav file: %s", err)
+	}
+	if !strings.Contains(trimAllSpace(string(contents)), trimAllSpace(testNavHeadings)) {
+		t.Errorf(
+			"Nav file contents don't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			testNavHeadings)
+	}
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, tocNcxFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading NCX file: %s", err)
+	}
+	for _, src := range []string{"xhtml/chapter.xhtml#heading-1", "xhtml/chapter.xhtml#heading-2", "xhtml/chapter.xhtml#details"} {
+		if !strings.Contains(string(contents), `<content src="`+src+`">`) {
+			t.Errorf("Expected the NCX file to link to %s\nGot: %s", src, contents)
+		}
+	}
+
+	// The section itself shouldn't be changed
+	if strings.Contains(e.sections[0].xhtml.body(), "heading-1") {
+		t.Errorf("Expected the ids not to be added to the section itself")
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestAddSectionWithEpubType(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	dedicationPath, err := e.AddSectionWithEpubType("<p>For my parents</p>", "Dedication", "dedication", "dedication.xhtml", "")
+	if err != nil {
+		t.Errorf("Error adding section: %s", err)
+	}
+	_, err = e.AddSectionWithEpubType(testSectionBody, testSectionTitle, "bogus", "", "")
+	if err != ErrInvalidEpubType {
+		t.Errorf("Adding a section with an invalid epub:type should return ErrInvalidEpubType, got: %v", err)
+	}
+	_, err = e.AddSectionWithEpubType(testSectionBody, testSectionTitle, "", "", "")
+	if err != ErrInvalidEpubType {
+		t.Errorf("Adding a section with an empty epub:type should return ErrInvalidEpubType, got: %v", err)
+	}
+	if len(e.sections) != 1 {
+		t.Errorf("Expected sections with invalid epub:types not to be added, got %d sections", len(e.sections))
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, dedicationPath))
+	if err != nil {
+		t.Errorf("Unexpected error reading section file: %s", err)
+	}
+	for _, expected := range []string{`xmlns:epub="` + xmlnsEpub + `"`, `<body epub:type="dedication">`} {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Section contents don't match\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, tocNavFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading TOC file: %s", err)
+	}
+	expected := fmt.Sprintf(testLandmarkTemplate, "dedication", "xhtml/"+dedicationPath, "Dedication")
+	if !strings.Contains(string(contents), expected) {
+		t.Errorf(
+			"Landmarks don't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			expected)
+	}
+
+	// EPUB 2 doesn't support epub:type
+	e.SetVersion(EpubVersion2)
+	cleanup(e.fs, testEpubFilename, tempDir)
+	tempDir = writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, dedicationPath))
+	if err != nil {
+		t.Errorf("Unexpected error reading section file: %s", err)
+	}
+	if strings.Contains(string(contents), "epub:type") {
+		t.Errorf("Expected EPUB 2 sections not to have an epub:type\nGot: %s", contents)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestSetGenerator(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testGenerator := "go-epub 1.0"
+	e.SetGenerator(testGenerator)
+	if e.Generator() != testGenerator {
+		t.Errorf(
+			"Generator doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			e.Generator(),
+			testGenerator)
+	}
+	// Setting it again should replace the meta element rather than add another
+	e.SetGenerator("Test generator")
+	e.SetGenerator(testGenerator)
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	expected := `<meta name="generator" content="go-epub 1.0"></meta>`
+	if strings.Count(string(contents), `name="generator"`) != 1 || !strings.Contains(string(contents), expected) {
+		t.Errorf(
+			"Package file contents don't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			expected)
+	}
+	cleanup(e.fs, testEpubFilename, tempDir)
+
+	e.SetGenerator("")
+	tempDir = writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	if strings.Contains(string(contents), `name="generator"`) {
+		t.Errorf("Expected the generator to be removed\nGot: %s", contents)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestAddSectionWithLang(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.AddLang("de")
+	testSectionPath, err := e.AddSectionWithLang("<p>Kapitel eins</p>", "Kapitel 1", "de", "", "")
+	if err != nil {
+		t.Errorf("Error adding section: %s", err)
+	}
+	_, err = e.AddSectionWithLang(testSectionBody, testSectionTitle, "not a language", "", "")
+	if err != ErrInvalidLang {
+		t.Errorf("Adding a section with an invalid language should return ErrInvalidLang, got: %v", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSectionPath))
+	if err != nil {
+		t.Errorf("Unexpected error reading section file: %s", err)
+	}
+	expected := `<html xmlns="http://www.w3.org/1999/xhtml" lang="de" xml:lang="de">`
+	if !strings.Contains(string(contents), expected) {
+		t.Errorf(
+			"Section contents don't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			expected)
+	}
+	cleanup(e.fs, testEpubFilename, tempDir)
+
+	// XHTML 1.1 only supports xml:lang
+	e.SetVersion(EpubVersion2)
+	tempDir = writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, xhtmlFolderName, testSectionPath))
+	if err != nil {
+		t.Errorf("Unexpected error reading section file: %s", err)
+	}
+	expected = `<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="de">`
+	if !strings.Contains(string(contents), expected) {
+		t.Errorf(
+			"Section contents don't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			expected)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestPackageDocument(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.SetDeterministic(true)
+	e.SetAuthor(testEpubAuthor)
+	e.AddSection(testSectionBody, testSectionTitle, "", "")
+
+	contents, err := e.PackageDocument()
+	if err != nil {
+		t.Errorf("Unexpected error getting package document: %s", err)
+	}
+	expected := `<dc:creator id="creator">` + testEpubAuthor + `</dc:creator>`
+	if !strings.Contains(contents, expected) {
+		t.Errorf(
+			"Package document doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			expected)
+	}
+
+	// It should be identical to the package file of the EPUB file
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+	written, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	if contents != string(written) {
+		t.Errorf(
+			"Package document doesn't match the written package file\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			written)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestNewEpubFromTemplate(t *testing.T) {
+	tmpl := NewEpubWithFs("House style", getFs())
+	tmpl.SetAuthor(testEpubAuthor)
+	tmpl.SetRights(testEpubRights)
+	testCSSPath, _ := tmpl.AddCSS(testCoverCSSSource, "base.css")
+	testImagePath, _ := tmpl.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	tmpl.SetCover(testImagePath, "")
+	tmpl.AddSection(testSectionBody, testSectionTitle, "template.xhtml", testCSSPath)
+	tmpl.AddLandmark("bodymatter", "", "template.xhtml")
+
+	e := NewEpubFromTemplate(testEpubTitle, tmpl)
+	e.AddSection(testSectionBody, "Chapter 1", "", testCSSPath)
+	e.AddCSS(testCoverCSSSource, "extra.css")
+
+	if e.Title() != testEpubTitle || e.Author() != testEpubAuthor || e.Rights() != testEpubRights {
+		t.Errorf("New EPUB doesn't have the expected metadata: %q, %q, %q", e.Title(), e.Author(), e.Rights())
+	}
+	if e.Identifier() == tmpl.Identifier() {
+		t.Errorf("Expected the new EPUB to have a new identifier, got: %s", e.Identifier())
+	}
+	if len(e.Sections()) != 1 || e.Sections()[0].Title != "Chapter 1" {
+		t.Errorf("Expected the new EPUB to only have its own section, got: %+v", e.Sections())
+	}
+	if _, ok := e.css["base.css"]; !ok {
+		t.Errorf("Expected the new EPUB to have the template's CSS, got: %v", e.css)
+	}
+	if _, ok := tmpl.css["extra.css"]; ok {
+		t.Errorf("Adding CSS to the new EPUB changed the template's CSS: %v", tmpl.css)
+	}
+	if len(e.landmarks) != 0 {
+		t.Errorf("Expected the new EPUB not to have the template's landmarks, got: %v", e.landmarks)
+	}
+	if tmpl.Title() != "House style" || len(tmpl.Sections()) != 2 {
+		t.Errorf("Creating an EPUB from the template changed the template: %q, %+v", tmpl.Title(), tmpl.Sections())
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	for _, unexpected := range []string{testImageFromFileFilename, "template.xhtml"} {
+		if strings.Contains(string(contents), unexpected) {
+			t.Errorf("Expected the new EPUB not to contain %s\nGot: %s", unexpected, contents)
+		}
+	}
+	if !strings.Contains(string(contents), `href="css/base.css"`) {
+		t.Errorf("Expected the new EPUB to contain the template's CSS\nGot: %s", contents)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestInvalidFilenames(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	invalidFilenames := []string{
+		"../evil.png",
+		"/etc/evil.png",
+		`..\evil.png`,
+		"C:evil.png",
+		"evil?.png",
+		"evil\x00.png",
+		"evil\u0085.png",
+		"evil\ue000.png",
+		"evil.png.",
+		"..",
+		strings.Repeat("a", 252) + ".png",
+	}
+	for _, filename := range invalidFilenames {
+		_, err := e.AddImage(testImageFromFileSource, filename)
+		if !errors.Is(err, ErrInvalidFilename) {
+			t.Errorf("Expected error adding an image named %q\nGot: %v\nExpected: %s", filename, err, ErrInvalidFilename)
+		}
+		_, err = e.AddSection(testSectionBody, testSectionTitle, filename, "")
+		if !errors.Is(err, ErrInvalidFilename) {
+			t.Errorf("Expected error adding a section named %q\nGot: %v\nExpected: %s", filename, err, ErrInvalidFilename)
+		}
+		_, err = e.AddRawSection(testRawSectionContents, filename)
+		if !errors.Is(err, ErrInvalidFilename) {
+			t.Errorf("Expected error adding a raw section named %q\nGot: %v\nExpected: %s", filename, err, ErrInvalidFilename)
+		}
+	}
+	_, err := e.AddCSS(testCoverCSSSource, "../evil.css")
+	if !errors.Is(err, ErrInvalidFilename) {
+		t.Errorf("Expected error adding CSS with a path as the filename\nGot: %v\nExpected: %s", err, ErrInvalidFilename)
+	}
+	if len(e.images) != 0 || len(e.css) != 0 || len(e.sections) != 0 {
+		t.Errorf("Expected no files to be added, got: %v, %v, %v", e.images, e.css, e.Sections())
+	}
+
+	// Spaces and non-ASCII characters are allowed
+	for _, filename := range []string{"my image.png", "café.png"} {
+		if _, err := e.AddImage(testImageFromFileSource, filename); err != nil {
+			t.Errorf("Unexpected error adding an image named %q: %s", filename, err)
+		}
+	}
+}
+
+func TestSetMetadataDir(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	err := e.SetMetadataDir(DirRtl)
+	if err != nil {
+		t.Errorf("Unexpected error setting the metadata direction: %s", err)
+	}
+	err = e.SetMetadataLang("ar")
+	if err != nil {
+		t.Errorf("Unexpected error setting the metadata language: %s", err)
+	}
+	err = e.SetMetadataDir("up")
+	if err != ErrInvalidMetadataDir {
+		t.Errorf("Setting an invalid direction should return ErrInvalidMetadataDir, got: %v", err)
+	}
+	err = e.SetMetadataLang("not a language")
+	if err != ErrInvalidLang {
+		t.Errorf("Setting an invalid language should return ErrInvalidLang, got: %v", err)
+	}
+	if e.MetadataDir() != DirRtl || e.MetadataLang() != "ar" {
+		t.Errorf("Expected invalid values not to change the metadata direction and language, got: %q, %q", e.MetadataDir(), e.MetadataLang())
+	}
+
+	contents, err := e.PackageDocument()
+	if err != nil {
+		t.Errorf("Unexpected error getting package document: %s", err)
+	}
+	expected := `<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="pub-id" version="3.0" xml:lang="ar" dir="rtl">`
+	if !strings.Contains(contents, expected) {
+		t.Errorf(
+			"Package document doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			expected)
+	}
+
+	// EPUB 2 doesn't support them
+	e.SetVersion(EpubVersion2)
+	contents, err = e.PackageDocument()
+	if err != nil {
+		t.Errorf("Unexpected error getting package document: %s", err)
+	}
+	if strings.Contains(contents, `dir="rtl"`) || strings.Contains(contents, `xml:lang="ar"`) {
+		t.Errorf("Expected the EPUB 2 package document not to have the metadata direction and language\nGot: %s", contents)
+	}
+}
+
+func TestAddImageFromURLContext(t *testing.T) {
+	testImageData, err := ioutil.ReadFile(testImageFromFileSource)
+	if err != nil {
+		t.Fatalf("Unexpected error reading image file: %s", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow.png" {
+			// Wait until the client gives up
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+			return
+		}
+		if r.URL.Path != "/"+testImageFromFileFilename {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(testImageData)
+	}))
+	defer server.Close()
+
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testImagePath, err := e.AddImageFromURLContext(context.Background(), server.URL+"/"+testImageFromFileFilename, "")
+	if err != nil {
+		t.Errorf("Unexpected error adding image: %s", err)
+	}
+	if testImagePath != "../"+ImageFolderName+"/"+testImageFromFileFilename {
+		t.Errorf("Unexpected image path: %s", testImagePath)
+	}
+	_, err = e.AddImageFromURLContext(context.Background(), server.URL+"/missing.png", "")
+	if err != ErrRetrievingFile {
+		t.Errorf("Adding a missing image should return ErrRetrievingFile, got: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = e.AddImageFromURLContext(ctx, server.URL+"/slow.png", "")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the error of the context, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the download to be aborted when the context is done, took %s", elapsed)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = e.AddImageFromURLContext(ctx, server.URL+"/slow.png", "")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the error of the cancelled context, got: %v", err)
+	}
+	if len(e.images) != 1 {
+		t.Errorf("Expected only the downloaded image to be added, got: %v", e.images)
+	}
+
+	contents, err := e.FileContents(testImagePath)
+	if err != nil {
+		t.Errorf("Unexpected error getting image contents: %s", err)
+	}
+	if !bytes.Equal(contents, testImageData) {
+		t.Errorf("Image contents don't match the downloaded image")
+	}
+}
+
+// An HTTP transport that records the requests and responds with the image
+type recordingTransport struct {
+	mutex    sync.Mutex
+	requests []*http.Request
+	body     []byte
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	rt.requests = append(rt.requests, req)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"image/png"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(rt.body)),
+		Request:    req,
+	}, nil
+}
+
+func TestSetHTTPClient(t *testing.T) {
+	testImageData, err := ioutil.ReadFile(testImageFromFileSource)
+	if err != nil {
+		t.Fatalf("Unexpected error reading image file: %s", err)
+	}
+	rt := &recordingTransport{body: testImageData}
+
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.SetHTTPClient(&http.Client{Transport: rt})
+	_, err = e.AddImage("https://example.com/images/remote.png", "")
+	if err != nil {
+		t.Errorf("Unexpected error adding image: %s", err)
+	}
+	_, err = e.AddImageFromURLContext(context.Background(), "https://example.com/images/downloaded.png", "")
+	if err != nil {
+		t.Errorf("Unexpected error adding image: %s", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, ImageFolderName, "remote.png"))
+	if err != nil {
+		t.Errorf("Unexpected error reading image file: %s", err)
+	}
+	if !bytes.Equal(contents, testImageData) {
+		t.Errorf("Image contents don't match the image returned by the HTTP client")
+	}
+
+	paths := []string{}
+	for _, req := range rt.requests {
+		paths = append(paths, req.URL.Path)
+	}
+	// The remote image is retrieved when it's added and again when the EPUB is
+	// written
+	expectedPaths := []string{"/images/remote.png", "/images/downloaded.png", "/images/remote.png"}
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Errorf(
+			"Requests made with the HTTP client don't match\n"+
+				"Got: %v\n"+
+				"Expected: %v",
+			paths,
+			expectedPaths)
+	}
+
+	e.SetHTTPClient(nil)
+	if e.client() != http.DefaultClient {
+		t.Errorf("Expected a nil client to reset the HTTP client to the default")
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+// A filesystem that records the files that are created in it
+type creationRecordingFs struct {
+	afero.Fs
+	created []string
+}
+
+func (fs *creationRecordingFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&os.O_CREATE != 0 {
+		fs.created = append(fs.created, name)
+	}
+	return fs.Fs.OpenFile(name, flag, perm)
+}
+
+func TestSetSpoolThreshold(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.SetDeterministic(true)
+	// A large image that compresses poorly
+	img := image.NewRGBA(image.Rect(0, 0, 512, 512))
+	for x := 0; x < 512; x++ {
+		for y := 0; y < 512; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * y), G: uint8(x ^ y), B: uint8(x + y*7), A: 0xff})
+		}
+	}
+	var jpegData bytes.Buffer
+	err := jpeg.Encode(&jpegData, img, &jpeg.Options{Quality: 100})
+	if err != nil {
+		t.Fatalf("Unexpected error encoding JPEG: %s", err)
+	}
+	e.AddImageFromBytes(jpegData.Bytes(), "large.jpg")
+	e.AddSection(testSectionBody, testSectionTitle, "", "")
+
+	err = e.Write(testEpubFilename)
+	if err != nil {
+		t.Fatalf("Unexpected error writing EPUB: %s", err)
+	}
+	unspooled, err := afero.ReadFile(e.fs, testEpubFilename)
+	if err != nil {
+		t.Fatalf("Unexpected error reading EPUB file: %s", err)
+	}
+
+	spoolFs := &creationRecordingFs{Fs: afero.NewMemMapFs()}
+	e.SetSpoolFs(spoolFs)
+	e.SetSpoolThreshold(int64(jpegData.Len() / 2))
+	// Make sure the EPUB file built in the spool file is valid
+	e.SetVerifyAfterWrite(true)
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	if len(spoolFs.created) != 1 {
+		t.Errorf("Expected the EPUB file to be built in a spool file, got: %v", spoolFs.created)
+	} else if _, err := spoolFs.Stat(spoolFs.created[0]); err == nil {
+		t.Errorf("Expected the spool file to be removed")
+	}
+	spooled, err := afero.ReadFile(e.fs, testEpubFilename)
+	if err != nil {
+		t.Errorf("Unexpected error reading EPUB file: %s", err)
+	}
+	if !bytes.Equal(spooled, unspooled) {
+		t.Errorf("EPUB file built in a spool file isn't identical to the one built in place")
+	}
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, ImageFolderName, "large.jpg"))
+	if err != nil {
+		t.Errorf("Unexpected error reading image file: %s", err)
+	}
+	if !bytes.Equal(contents, jpegData.Bytes()) {
+		t.Errorf("Image contents don't match")
+	}
+	cleanup(e.fs, testEpubFilename, tempDir)
+
+	// Smaller EPUBs aren't spooled
+	e.SetSpoolThreshold(int64(jpegData.Len() * 2))
+	tempDir = writeAndExtractEpub(t, e, testEpubFilename)
+	if len(spoolFs.created) != 1 {
+		t.Errorf("Expected the EPUB file not to be built in a spool file, got: %v", spoolFs.created)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestSetRenditionFlow(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	err := e.SetRenditionFlow(RenditionFlowPaginated)
+	if err != nil {
+		t.Errorf("Unexpected error setting the rendition flow: %s", err)
+	}
+	err = e.SetRenditionFlow(RenditionFlowScrolledContinuous)
+	if err != nil {
+		t.Errorf("Unexpected error setting the rendition flow: %s", err)
+	}
+	err = e.SetRenditionFlow("sideways")
+	if err != ErrInvalidRenditionFlow {
+		t.Errorf("Setting an invalid flow should return ErrInvalidRenditionFlow, got: %v", err)
+	}
+	if e.RenditionFlow() != RenditionFlowScrolledContinuous {
+		t.Errorf(
+			"Rendition flow doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			e.RenditionFlow(),
+			RenditionFlowScrolledContinuous)
+	}
+
+	contents, err := e.PackageDocument()
+	if err != nil {
+		t.Errorf("Unexpected error getting package document: %s", err)
+	}
+	expected := `<meta property="rendition:flow">scrolled-continuous</meta>`
+	if strings.Count(contents, `property="rendition:flow"`) != 1 || !strings.Contains(contents, expected) {
+		t.Errorf(
+			"Package document doesn't match\n"+
+				"Got: %s\n"+
+				"Expected one: %s",
+			contents,
+			expected)
+	}
+
+	// An empty flow removes it
+	e.SetRenditionFlow("")
+	contents, err = e.PackageDocument()
+	if err != nil {
+		t.Errorf("Unexpected error getting package document: %s", err)
+	}
+	if strings.Contains(contents, "rendition:flow") {
+		t.Errorf("Expected the rendition flow to be removed, got: %s", contents)
+	}
+}
+
+func TestSetDublinCore(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	err := e.SetDublinCore("dc:type", "text")
+	if err != nil {
+		t.Errorf("Unexpected error setting a Dublin Core element: %s", err)
+	}
+	e.SetDublinCore("coverage", "Middle-earth")
+	e.SetDublinCore("coverage", "Middle-earth & Valinor")
+	e.SetDublinCore("relation", "urn:isbn:9780261103344")
+	e.SetDublinCore("relation", "")
+	err = e.SetDublinCore("dc:shelf", "top")
+	if err != ErrInvalidDublinCoreElement {
+		t.Errorf("Setting an unknown element should return ErrInvalidDublinCoreElement, got: %v", err)
+	}
+	err = e.SetDublinCore("title", "Dublin Core title")
+	if err != nil {
+		t.Errorf("Unexpected error setting a Dublin Core element: %s", err)
+	}
+	if e.Title() != "Dublin Core title" {
+		t.Errorf("Expected the title to be set by SetDublinCore, got: %s", e.Title())
+	}
+	if e.DublinCore("type") != "text" {
+		t.Errorf("Expected the type to be text, got: %s", e.DublinCore("type"))
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	for _, expected := range []string{
+		`<dc:type>text</dc:type>`,
+		`<dc:coverage>Middle-earth &amp; Valinor</dc:coverage>`,
+	} {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf(
+				"Package file doesn't match\n"+
+					"Got: %s\n"+
+					"Expected: %s",
+				contents,
+				expected)
+		}
+	}
+	if strings.Contains(string(contents), "dc:relation") {
+		t.Errorf("Expected an empty value to remove the element, got: %s", contents)
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestReorderSections(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	testSection1Path, _ := e.AddSection(testSectionBody, "First", "first.xhtml", "")
+	testSection2Path, _ := e.AddSection(testSectionBody, "Second", "second.xhtml", "")
+	testSection3Path, _ := e.AddSection(testSectionBody, "Third", "third.xhtml", "")
+
+	err := e.ReorderSections([]string{testSection3Path, "missing.xhtml"})
+	if err != ErrSectionNotFound {
+		t.Errorf("Expected ErrSectionNotFound for an unknown section, got: %v", err)
+	}
+	// The second section isn't listed, so it should come last
+	err = e.ReorderSections([]string{testSection3Path, testSection1Path})
+	if err != nil {
+		t.Errorf("Unexpected error reordering sections: %s", err)
+	}
+
+	tempDir := writeAndExtractEpub(t, e, testEpubFilename)
+
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, pkgFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading package file: %s", err)
+	}
+	navContents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, tocNavFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading EPUB 3 TOC file: %s", err)
+	}
+	ncxContents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, contentFolderName, tocNcxFilename))
+	if err != nil {
+		t.Errorf("Unexpected error reading EPUB 2 TOC file: %s", err)
+	}
+
+	// Make sure the sections appear in the spine and the TOC in the new order
+	lastIndex, lastNavIndex, lastNcxIndex := -1, -1, -1
+	for _, testSectionPath := range []string{testSection3Path, testSection1Path, testSection2Path} {
+		i := strings.Index(string(contents), fmt.Sprintf(testItemrefIdrefTemplate, testSectionPath))
+		if i <= lastIndex {
+			t.Errorf("Spine order doesn't match, %s is out of place: %s", testSectionPath, contents)
+		}
+		lastIndex = i
+
+		href := filepath.ToSlash(filepath.Join(xhtmlFolderName, testSectionPath))
+		i = strings.Index(string(navContents), href)
+		if i <= lastNavIndex {
+			t.Errorf("EPUB 3 TOC order doesn't match, %s is out of place: %s", testSectionPath, navContents)
+		}
+		lastNavIndex = i
+		i = strings.Index(string(ncxContents), href)
+		if i <= lastNcxIndex {
+			t.Errorf("EPUB 2 TOC order doesn't match, %s is out of place: %s", testSectionPath, ncxContents)
+		}
+		lastNcxIndex = i
+	}
+
+	cleanup(e.fs, testEpubFilename, tempDir)
+}
+
+func TestCoverDimensions(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	err := e.SetCoverDimensions(100, 200)
+	if err != ErrInvalidImage {
+		t.Errorf("Setting the dimensions without a cover should return ErrInvalidImage, got: %v", err)
+	}
+
+	// The test image is 16x15
+	err = e.SetCoverTemplate(`<img src="{{.ImagePath}}" width="{{.Width}}" height="{{.Height}}" alt="" />`)
+	if err != nil {
+		t.Errorf("Unexpected error setting cover template: %s", err)
+	}
+	testImagePath, _ := e.AddImage(testImageFromFileSource, testImageFromFileFilename)
+	e.SetCover(testImagePath, "")
+	width, height := e.CoverDimensions()
+	if width != 16 || height != 15 {
+		t.Errorf(
+			"Cover dimensions don't match\n"+
+				"Got: %dx%d\n"+
+				"Expected: 16x15",
+			width,
+			height)
+	}
+	contents, err := e.FileContents(defaultCoverXhtmlFilename)
+	if err != nil {
+		t.Errorf("Unexpected error getting cover page: %s", err)
+	}
+	expected := `<img src="` + testImagePath + `" width="16" height="15" alt="" />`
+	if !strings.Contains(string(contents), expected) {
+		t.Errorf(
+			"Cover page doesn't match\n"+
+				"Got: %s\n"+
+				"Expected: %s",
+			contents,
+			expected)
+	}
+
+	err = e.SetCoverDimensions(0, 200)
+	if err != ErrInvalidImage {
+		t.Errorf("Setting an invalid width should return ErrInvalidImage, got: %v", err)
+	}
+	err = e.SetCoverDimensions(100, 200)
+	if err != nil {
+		t.Errorf("Unexpected error setting the cover dimensions: %s", err)
+	}
+	if width, height := e.CoverDimensions(); width != 100 || height != 200 {
+		t.Errorf("Expected the cover dimensions to be 100x200, got: %dx%d", width, height)
+	}
+
+	// Images that can't be decoded shouldn't stop the cover from being set
+	testImagePath, _ = e.AddImageFromBytes([]byte("not an image"), "broken.png")
+	e.SetCover(testImagePath, "")
+	if width, height := e.CoverDimensions(); width != 0 || height != 0 {
+		t.Errorf("Expected unknown cover dimensions to be zero, got: %dx%d", width, height)
+	}
+	if _, err := e.FileContents(defaultCoverXhtmlFilename); err != nil {
+		t.Errorf("Expected the cover to be set even though the image can't be decoded, got: %s", err)
+	}
+}
+
+func TestAddImageWithoutLocking(t *testing.T) {
+	testImageData, err := ioutil.ReadFile(testImageFromFileSource)
+	if err != nil {
+		t.Fatalf("Unexpected error reading image file: %s", err)
+	}
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	blocked := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The Epub shouldn't be locked while the image is being downloaded
+		done := make(chan bool)
+		go func() {
+			e.Title()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			blocked <- r.URL.Path
+		}
+		w.Write(testImageData)
+	}))
+	defer server.Close()
+
+	// Without an extension, the media type is determined from the content
+	_, err = e.AddImage(server.URL+"/image", "image.dat")
+	if err != nil {
+		t.Errorf("Unexpected error adding image: %s", err)
+	}
+	_, err = e.AddImageWithOptions(server.URL+"/image.png", "", ImageOptions{AltText: "Gopher"})
+	if err != nil {
+		t.Errorf("Unexpected error adding image: %s", err)
+	}
+	close(blocked)
+	for path := range blocked {
+		t.Errorf("The EPUB was locked while downloading %s", path)
+	}
+}
+
+func TestCheckContainerFile(t *testing.T) {
+	e := NewEpubWithFs(testEpubTitle, getFs())
+	e.SetContentFolder("A&B")
+	tempDir, err := afero.TempDir(e.fs, "", tempDirPrefix)
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp directory: %s", err)
+	}
+	defer e.fs.RemoveAll(tempDir)
+	if err := e.fs.Mkdir(filepath.Join(tempDir, metaInfFolderName), dirPermissions); err != nil {
+		t.Fatalf("Unexpected error creating directory: %s", err)
+	}
+	containerFilePath := filepath.Join(tempDir, metaInfFolderName, containerFilename)
+
+	e.writeContainerFile(tempDir)
+	if err := e.checkContainerFile(tempDir); err != nil {
+		t.Errorf("Unexpected error checking container file: %s", err)
+	}
+
+	// Container files that can't be parsed, e.g. with an unescaped ampersand, or
+	// that point elsewhere can't be opened by reading systems
+	for _, fullPath := range []string{"A&B/package.opf", "A&amp;B/content.opf"} {
+		container := fmt.Sprintf(strings.Replace(containerFileTemplate, "%s/%s", "%s", 1), fullPath)
+		if err := afero.WriteFile(e.fs, containerFilePath, []byte(container), filePermissions); err != nil {
+			t.Fatalf("Unexpected error writing container file: %s", err)
+		}
+		err := e.checkContainerFile(tempDir)
+		if !errors.Is(err, ErrInvalidContainer) {
+			t.Errorf("Checking a container file pointing to %s should return ErrInvalidContainer, got: %v", fullPath, err)
+		}
+	}
+}
+
 func TestEpubValidity(t *testing.T) {
 	e := NewEpubWithFs(testEpubTitle, getFs())
 	testCSSPath, _ := e.AddCSS(testCoverCSSSource, testCoverCSSFilename)
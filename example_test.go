@@ -2,6 +2,7 @@ package epub_test
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 
 	"github.com/bmaupin/go-epub"
@@ -81,6 +82,26 @@ func ExampleEpub_AddImage() {
 	// ../images/gophercolor16x16.png
 }
 
+func ExampleEpub_AddImageFromBytes() {
+	e := epub.NewEpub("My title")
+
+	// Add an image from data already in memory. The filename is required since
+	// it's used to determine the media type
+	data, err := ioutil.ReadFile("testdata/gophercolor16x16.png")
+	if err != nil {
+		log.Fatal(err)
+	}
+	imgPath, err := e.AddImageFromBytes(data, "go-gopher.png")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println(imgPath)
+
+	// Output:
+	// ../images/go-gopher.png
+}
+
 func ExampleEpub_AddSection() {
 	e := epub.NewEpub("My title")
 
@@ -0,0 +1,106 @@
+package epub
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// The IDs added to headings that don't have one so that they can be linked
+	// to from the TOC
+	tocHeadingIDFormat = "heading-%d"
+	maxTocHeadingLevel = 6
+	minTocHeadingLevel = 2
+)
+
+// Matches the headings that can be added to the TOC. The level of the closing
+// tag isn't checked since Go regular expressions don't support backreferences.
+var tocHeadingPattern = regexp.MustCompile(`(?is)<h([2-6])(\s[^>]*)?>(.*?)</h[2-6]\s*>`)
+
+// Matches the id attributes of elements
+var tocHeadingIDPattern = regexp.MustCompile(`\sid\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+
+// A heading within a section that's added to the TOC
+type tocHeading struct {
+	id    string
+	level int
+	title string
+}
+
+// SetAutoTocFromHeadings sets whether the headings within sections are added
+// to the table of contents when the EPUB is written, nested under the entry of
+// their section, which makes long sections easier to navigate. Headings from
+// <h2> down to the given level are added, e.g. 3 to add <h2> and <h3>
+// headings; <h1> headings are left out since they're usually the title of the
+// section. Headings without an id attribute are given one (heading-1,
+// heading-2, etc) so that they can be linked to.
+//
+// A level below 2, the default, turns this off, and a level above 6 is the
+// same as 6. Only the headings of sections in the table of contents are added,
+// and raw sections (see AddRawSection) are left as-is. The levels of headings
+// count towards the depth of the table of contents (see SetTocDepth).
+func (e *Epub) SetAutoTocFromHeadings(maxLevel int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if maxLevel < minTocHeadingLevel {
+		maxLevel = 0
+	}
+	if maxLevel > maxTocHeadingLevel {
+		maxLevel = maxTocHeadingLevel
+	}
+	e.tocHeadingLevel = maxLevel
+}
+
+// Find the headings of a section body down to the given level, adding an id to
+// the headings without one. Returns the body with the ids added along with the
+// headings. Headings without any text are skipped.
+func tocHeadings(body string, maxLevel int) (string, []tocHeading) {
+	usedIDs := make(map[string]bool)
+	for _, match := range tocHeadingIDPattern.FindAllStringSubmatch(body, -1) {
+		usedIDs[match[1]+match[2]] = true
+	}
+	nextID := 1
+
+	headings := []tocHeading{}
+	var b strings.Builder
+	last := 0
+	for _, loc := range tocHeadingPattern.FindAllStringSubmatchIndex(body, -1) {
+		// The regular expression only matches digits
+		level, _ := strconv.Atoi(body[loc[2]:loc[3]])
+		title := strings.Join(strings.Fields(xhtmlToPlainText(body[loc[6]:loc[7]])), " ")
+		if level > maxLevel || title == "" {
+			continue
+		}
+
+		attributes := ""
+		if loc[4] != -1 {
+			attributes = body[loc[4]:loc[5]]
+		}
+		if match := tocHeadingIDPattern.FindStringSubmatch(attributes); match != nil {
+			// Headings with an empty id can't be linked to
+			if id := match[1] + match[2]; id != "" {
+				headings = append(headings, tocHeading{id: id, level: level, title: title})
+			}
+			continue
+		}
+
+		id := fmt.Sprintf(tocHeadingIDFormat, nextID)
+		for usedIDs[id] {
+			nextID++
+			id = fmt.Sprintf(tocHeadingIDFormat, nextID)
+		}
+		usedIDs[id] = true
+		headings = append(headings, tocHeading{id: id, level: level, title: title})
+
+		// Add the id right after the name of the element
+		b.WriteString(body[last:loc[3]])
+		b.WriteString(` id="` + id + `"`)
+		last = loc[3]
+	}
+	b.WriteString(body[last:])
+
+	return b.String(), headings
+}
@@ -0,0 +1,109 @@
+package epub
+
+import (
+	"golang.org/x/text/language"
+)
+
+// The text generated by the library, such as the headings of the table of
+// contents, in a given language
+type localeMessages struct {
+	coverAltText     string
+	guideCoverTitle  string
+	guideTextTitle   string
+	landmarksHeading string
+	navHeading       string
+	pageListHeading  string
+}
+
+// The generated text by primary language subtag (see SetLocale)
+var localeCatalog = map[string]localeMessages{
+	"de": {
+		coverAltText:     "Titelbild",
+		guideCoverTitle:  "Umschlag",
+		guideTextTitle:   "Anfang",
+		landmarksHeading: "Orientierungspunkte",
+		navHeading:       "Inhaltsverzeichnis",
+		pageListHeading:  "Seiten",
+	},
+	"en": {
+		coverAltText:     defaultCoverAltText,
+		guideCoverTitle:  pkgGuideCoverTitle,
+		guideTextTitle:   pkgGuideTextTitle,
+		landmarksHeading: tocNavLandmarksHeading,
+		navHeading:       tocNavHeading,
+		pageListHeading:  tocNavPageListHeading,
+	},
+	"es": {
+		coverAltText:     "Imagen de portada",
+		guideCoverTitle:  "Portada",
+		guideTextTitle:   "Comienzo",
+		landmarksHeading: "Puntos de referencia",
+		navHeading:       "Índice",
+		pageListHeading:  "Páginas",
+	},
+	"fr": {
+		coverAltText:     "Image de couverture",
+		guideCoverTitle:  "Couverture",
+		guideTextTitle:   "Début",
+		landmarksHeading: "Repères",
+		navHeading:       "Table des matières",
+		pageListHeading:  "Pages",
+	},
+	"it": {
+		coverAltText:     "Immagine di copertina",
+		guideCoverTitle:  "Copertina",
+		guideTextTitle:   "Inizio",
+		landmarksHeading: "Punti di riferimento",
+		navHeading:       "Indice",
+		pageListHeading:  "Pagine",
+	},
+	"nl": {
+		coverAltText:     "Omslagafbeelding",
+		guideCoverTitle:  "Omslag",
+		guideTextTitle:   "Begin",
+		landmarksHeading: "Oriëntatiepunten",
+		navHeading:       "Inhoudsopgave",
+		pageListHeading:  "Pagina's",
+	},
+	"pt": {
+		coverAltText:     "Imagem da capa",
+		guideCoverTitle:  "Capa",
+		guideTextTitle:   "Início",
+		landmarksHeading: "Pontos de referência",
+		navHeading:       "Sumário",
+		pageListHeading:  "Páginas",
+	},
+}
+
+// SetLocale sets the language of the text the library generates, such as the
+// heading of the table of contents and the alt text of the cover image, e.g.
+// language.French or language.MustParse("pt-BR"). German, Dutch, English,
+// French, Italian, Portuguese, and Spanish are supported; other languages fall
+// back to English, which is also the default. language.Und restores the
+// default.
+//
+// The locale is independent of the language of the EPUB (see SetLang). It must
+// be set before the cover is set for the alt text of the cover image to be
+// translated. Text set explicitly, such as with SetTocTitle, isn't affected.
+func (e *Epub) SetLocale(tag language.Tag) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.locale = tag
+
+	m := e.messages()
+	e.toc.setHeadings(m.navHeading, m.landmarksHeading, m.pageListHeading)
+}
+
+// Get the generated text in the language of the locale, or in English if the
+// language isn't supported
+func (e *Epub) messages() localeMessages {
+	if e.locale != language.Und {
+		base, _ := e.locale.Base()
+		if m, ok := localeCatalog[base.String()]; ok {
+			return m
+		}
+	}
+
+	return localeCatalog["en"]
+}
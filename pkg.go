@@ -4,19 +4,35 @@ import (
 	"encoding/xml"
 	"fmt"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/spf13/afero"
 )
 
 const (
-	pkgAuthorID       = "role"
-	pkgAuthorData     = "aut"
-	pkgAuthorProperty = "role"
-	pkgAuthorRefines  = "#creator"
-	pkgAuthorScheme   = "marc:relators"
-	pkgCreatorID      = "creator"
-	pkgFileTemplate   = `<?xml version="1.0" encoding="UTF-8"?>
+	pkgAccessModeAuditory           = "auditory"
+	pkgAccessModeProperty           = "schema:accessMode"
+	pkgAccessModeTextual            = "textual"
+	pkgAccessModeVisual             = "visual"
+	pkgAccessibilityFeatureProperty = "schema:accessibilityFeature"
+	pkgAccessibilitySummaryProperty = "schema:accessibilitySummary"
+	pkgAuthorID                     = "role"
+	pkgAuthorData                   = "aut"
+	pkgAuthorProperty               = "role"
+	pkgAuthorRefines                = "#creator"
+	pkgAuthorScheme                 = "marc:relators"
+	pkgCalibreSeriesIndexMetaName   = "calibre:series_index"
+	pkgCalibreSeriesMetaName        = "calibre:series"
+	pkgCollectionProperty           = "belongs-to-collection"
+	pkgCollectionTypeProperty       = "collection-type"
+	pkgCollectionIDFormat           = "collection%d"
+	pkgCollectionTypeSeries         = "series"
+	pkgCoverMetaName                = "cover"
+	pkgCreatorID                    = "creator"
+	pkgFileAsProperty               = "file-as"
+	pkgGeneratorMetaName            = "generator"
+	pkgFileTemplate                 = `<?xml version="1.0" encoding="UTF-8"?>
 <package version="3.0" unique-identifier="pub-id" xmlns="http://www.idpf.org/2007/opf">
   <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
     <dc:identifier id="pub-id"></dc:identifier>
@@ -29,10 +45,32 @@ const (
   </spine>
 </package>
 `
-	pkgModifiedProperty = "dcterms:modified"
-	pkgUniqueIdentifier = "pub-id"
-
-	xmlnsDc = "http://purl.org/dc/elements/1.1/"
+	pkgGroupPositionProperty  = "group-position"
+	pkgGuideCoverTitle        = "Cover"
+	pkgGuideCoverType         = "cover"
+	pkgGuideTextTitle         = "Beginning"
+	pkgGuideTextType          = "text"
+	pkgIdentifierTypeProperty = "identifier-type"
+	pkgIdentifierTypeScheme   = "onix:codelist5"
+	pkgMediaDurationProperty  = "media:duration"
+	pkgModifiedProperty       = "dcterms:modified"
+	// Rendition properties of fixed-layout EPUBs
+	// Spec: https://www.w3.org/TR/epub-33/#sec-fixed-layouts
+	pkgRenditionAuto                = "auto"
+	pkgRenditionFlowProperty        = "rendition:flow"
+	pkgRenditionLayoutPrePaginated  = "pre-paginated"
+	pkgRenditionLayoutProperty      = "rendition:layout"
+	pkgRenditionOrientationProperty = "rendition:orientation"
+	pkgRenditionSpreadProperty      = "rendition:spread"
+	pkgSeriesID                     = "series"
+	pkgSpineNonLinear               = "no"
+	pkgSpinePpdAttr                 = "page-progression-direction"
+	pkgSpineTocAttr                 = "toc"
+	pkgTitleID                      = "title"
+	pkgUniqueIdentifier             = "pub-id"
+
+	xmlnsDc  = "http://purl.org/dc/elements/1.1/"
+	xmlnsOpf = "http://www.idpf.org/2007/opf"
 )
 
 // pkg implements the package document file (package.opf), which contains
@@ -42,32 +80,64 @@ const (
 // Sample: https://github.com/bmaupin/epub-samples/blob/master/minimal-v3plus2/EPUB/package.opf
 // Spec: http://www.idpf.org/epub/301/spec/epub-publications.html
 type pkg struct {
-	xml          *pkgRoot
-	authorMeta   *pkgMeta
-	modifiedMeta *pkgMeta
+	xml              *pkgRoot
+	authorFileAs     string
+	authorMeta       *pkgMeta
+	coverMeta        *pkgMeta
+	identifierScheme string
+	modifiedMeta     *pkgMeta
+	titleFileAs      string
 }
 
 // This holds the actual XML for the package file
 type pkgRoot struct {
-	XMLName          xml.Name    `xml:"http://www.idpf.org/2007/opf package"`
-	UniqueIdentifier string      `xml:"unique-identifier,attr"`
-	Version          string      `xml:"version,attr"`
-	Metadata         pkgMetadata `xml:"metadata"`
-	ManifestItems    []pkgItem   `xml:"manifest>item"`
-	Spine            pkgSpine    `xml:"spine"`
+	XMLName          xml.Name `xml:"http://www.idpf.org/2007/opf package"`
+	UniqueIdentifier string   `xml:"unique-identifier,attr"`
+	Version          string   `xml:"version,attr"`
+	// Prefixes of vocabularies used by meta properties
+	// Ex: prefix="foaf: http://xmlns.com/foaf/spec/"
+	Prefix string `xml:"prefix,attr,omitempty"`
+	// The language and base direction of the text of the metadata
+	XMLLang       string      `xml:"xml:lang,attr,omitempty"`
+	Dir           string      `xml:"dir,attr,omitempty"`
+	Metadata      pkgMetadata `xml:"metadata"`
+	ManifestItems []pkgItem   `xml:"manifest>item"`
+	Spine         pkgSpine    `xml:"spine"`
+	// The guide is deprecated in EPUB 3, but EPUB 2 and many e-ink reading
+	// systems use it to find the cover and where the text starts
+	Guide *pkgGuide `xml:"guide"`
+}
+
+// The <guide> element
+type pkgGuide struct {
+	References []pkgReference `xml:"reference"`
 }
 
 // <dc:creator>, e.g. the author
+// Ex: <dc:creator id="creator">Hingle McCringleberry</dc:creator>
+//     <dc:creator id="creator" opf:role="aut" opf:file-as="McCringleberry, Hingle">Hingle McCringleberry</dc:creator> (EPUB 2)
 type pkgCreator struct {
 	XMLName xml.Name `xml:"dc:creator"`
 	ID      string   `xml:"id,attr"`
+	Role    string   `xml:"opf:role,attr,omitempty"`
+	FileAs  string   `xml:"opf:file-as,attr,omitempty"`
 	Data    string   `xml:",chardata"`
 }
 
 // <dc:identifier>, where the unique identifier is stored
 // Ex: <dc:identifier id="pub-id">urn:uuid:fe93046f-af57-475a-a0cb-a0d4bc99ba6d</dc:identifier>
+//     <dc:identifier id="pub-id" opf:scheme="ISBN">9783161484100</dc:identifier> (EPUB 2)
 type pkgIdentifier struct {
-	ID   string `xml:"id,attr"`
+	ID     string `xml:"id,attr"`
+	Scheme string `xml:"opf:scheme,attr,omitempty"`
+	Data   string `xml:",chardata"`
+}
+
+// <dc:title>, which only has an ID if it's refined by a meta element
+// Ex: <dc:title>Your title here</dc:title>
+//     <dc:title id="title">The Hobbit</dc:title>
+type pkgTitle struct {
+	ID   string `xml:"id,attr,omitempty"`
 	Data string `xml:",chardata"`
 }
 
@@ -80,43 +150,80 @@ type pkgItem struct {
 	Href       string `xml:"href,attr"`
 	MediaType  string `xml:"media-type,attr"`
 	Properties string `xml:"properties,attr,omitempty"`
+	// The ID of the media overlay of an XHTML file
+	MediaOverlay string `xml:"media-overlay,attr,omitempty"`
 }
 
 // <itemref> elements, which define the reading order
 // Ex: <itemref idref="section0001.xhtml" />
+//     <itemref idref="section0002.xhtml" properties="rendition:page-spread-left" />
+//     <itemref idref="section0003.xhtml" linear="no" />
 type pkgItemref struct {
-	Idref string `xml:"idref,attr"`
+	Idref      string `xml:"idref,attr"`
+	Linear     string `xml:"linear,attr,omitempty"`
+	Properties string `xml:"properties,attr,omitempty"`
+}
+
+// The <reference> element of the guide
+// Ex: <reference type="cover" title="Cover" href="xhtml/cover.xhtml" />
+type pkgReference struct {
+	Type  string `xml:"type,attr"`
+	Title string `xml:"title,attr,omitempty"`
+	Href  string `xml:"href,attr"`
 }
 
 // The <meta> element, which contains modified date, role of the creator (e.g.
-// author), etc
+// author), etc. EPUB 2 style meta elements use the name and content attributes
+// instead.
 // Ex: <meta refines="#creator" property="role" scheme="marc:relators" id="role">aut</meta>
 //     <meta property="dcterms:modified">2011-01-01T12:00:00Z</meta>
+//     <meta name="cover" content="cover.png" />
 type pkgMeta struct {
 	Refines  string `xml:"refines,attr,omitempty"`
-	Property string `xml:"property,attr"`
+	Property string `xml:"property,attr,omitempty"`
 	Scheme   string `xml:"scheme,attr,omitempty"`
 	ID       string `xml:"id,attr,omitempty"`
+	Name     string `xml:"name,attr,omitempty"`
+	Content  string `xml:"content,attr,omitempty"`
 	Data     string `xml:",chardata"`
 }
 
 // The <metadata> element
 type pkgMetadata struct {
 	XmlnsDc    string        `xml:"xmlns:dc,attr"`
+	XmlnsOpf   string        `xml:"xmlns:opf,attr,omitempty"`
 	Identifier pkgIdentifier `xml:"dc:identifier"`
-	// Ex: <dc:title>Your title here</dc:title>
-	Title string `xml:"dc:title"`
+	Title      pkgTitle      `xml:"dc:title"`
+	// The first language is the primary language of the EPUB
 	// Ex: <dc:language>en</dc:language>
-	Language string `xml:"dc:language"`
-	Creator  *pkgCreator
-	Meta     []pkgMeta `xml:"meta"`
+	Languages []string `xml:"dc:language"`
+	Creator   *pkgCreator
+	// Ex: <dc:subject>Fantasy</dc:subject>
+	Subjects []string `xml:"dc:subject"`
+	// Ex: <dc:rights>Copyright © 2017 Hingle McCringleberry</dc:rights>
+	Rights string `xml:"dc:rights,omitempty"`
+	// Ex: <dc:source>urn:isbn:9780261103344</dc:source>
+	Source string `xml:"dc:source,omitempty"`
+	// Other Dublin Core elements set with SetDublinCore
+	// Ex: <dc:type>text</dc:type>
+	DublinCore []pkgDublinCore
+	Meta       []pkgMeta `xml:"meta"`
+}
+
+// A Dublin Core element that doesn't have a field of its own, named after the
+// element with the dc: prefix
+type pkgDublinCore struct {
+	XMLName xml.Name
+	Data    string `xml:",chardata"`
 }
 
 // The <spine> element
 type pkgSpine struct {
 	Items []pkgItemref `xml:"itemref"`
-	Toc   string       `xml:"toc,attr"`
+	Toc   string       `xml:"toc,attr,omitempty"`
 	Ppd   string       `xml:"page-progression-direction,attr,omitempty"`
+	// Other attributes set with SetSpineAttribute
+	Attrs []xml.Attr `xml:",any,attr"`
 }
 
 // Constructor for pkg
@@ -157,14 +264,153 @@ func (p *pkg) addToManifest(id string, href string, mediaType string, properties
 	p.xml.ManifestItems = append(p.xml.ManifestItems, *i)
 }
 
-func (p *pkg) addToSpine(id string) {
+func (p *pkg) addToSpine(id string, linear bool, properties string) {
 	i := &pkgItemref{
-		Idref: id,
+		Idref:      id,
+		Properties: properties,
+	}
+	if !linear {
+		i.Linear = pkgSpineNonLinear
 	}
 
 	p.xml.Spine.Items = append(p.xml.Spine.Items, *i)
 }
 
+func (p *pkg) addToGuide(referenceType string, title string, href string) {
+	if p.xml.Guide == nil {
+		p.xml.Guide = &pkgGuide{}
+	}
+	p.xml.Guide.References = append(p.xml.Guide.References, pkgReference{
+		Type:  referenceType,
+		Title: title,
+		Href:  href,
+	})
+}
+
+func (p *pkg) clearManifestSpineAndGuide() {
+	p.xml.ManifestItems = nil
+	p.xml.Spine.Items = nil
+	p.xml.Guide = nil
+}
+
+// Link the manifest item with the given ID to its media overlay
+func (p *pkg) setMediaOverlay(id string, mediaOverlayID string) {
+	for i := range p.xml.ManifestItems {
+		if p.xml.ManifestItems[i].ID == id {
+			p.xml.ManifestItems[i].MediaOverlay = mediaOverlayID
+		}
+	}
+}
+
+// Replace the meta elements with the durations of the media overlays, along
+// with the total duration if there are any
+func (p *pkg) setMediaDurations(mediaOverlayIDs []string, durations []time.Duration) {
+	metas := []pkgMeta{}
+	for _, meta := range p.xml.Metadata.Meta {
+		if meta.Property != pkgMediaDurationProperty {
+			metas = append(metas, meta)
+		}
+	}
+
+	var total time.Duration
+	for i, id := range mediaOverlayIDs {
+		metas = append(metas, pkgMeta{
+			Refines:  "#" + id,
+			Property: pkgMediaDurationProperty,
+			Data:     formatClockValue(durations[i]),
+		})
+		total += durations[i]
+	}
+	if len(mediaOverlayIDs) > 0 {
+		metas = append(metas, pkgMeta{
+			Property: pkgMediaDurationProperty,
+			Data:     formatClockValue(total),
+		})
+	}
+
+	p.xml.Metadata.Meta = metas
+}
+
+// Replace the schema.org accessibility meta elements with the given access
+// modes, features, and summary
+func (p *pkg) setAccessibility(accessModes []string, features []string, summary string) {
+	metas := []pkgMeta{}
+	for _, meta := range p.xml.Metadata.Meta {
+		switch meta.Property {
+		case pkgAccessModeProperty, pkgAccessibilityFeatureProperty, pkgAccessibilitySummaryProperty:
+		default:
+			metas = append(metas, meta)
+		}
+	}
+
+	for _, accessMode := range accessModes {
+		metas = append(metas, pkgMeta{Property: pkgAccessModeProperty, Data: accessMode})
+	}
+	for _, feature := range features {
+		metas = append(metas, pkgMeta{Property: pkgAccessibilityFeatureProperty, Data: feature})
+	}
+	if summary != "" {
+		metas = append(metas, pkgMeta{Property: pkgAccessibilitySummaryProperty, Data: summary})
+	}
+
+	p.xml.Metadata.Meta = metas
+}
+
+func (p *pkg) addMeta(property string, value string) {
+	p.xml.Metadata.Meta = append(p.xml.Metadata.Meta, pkgMeta{Property: property, Data: value})
+}
+
+func (p *pkg) setDir(dir string) {
+	p.xml.Dir = dir
+}
+
+func (p *pkg) setXMLLang(lang string) {
+	p.xml.XMLLang = lang
+}
+
+func (p *pkg) setPrefix(prefix string) {
+	p.xml.Prefix = prefix
+}
+
+func (p *pkg) addSubject(subject string) {
+	p.xml.Metadata.Subjects = append(p.xml.Metadata.Subjects, subject)
+}
+
+// Get the value of the Dublin Core element with the given name (without the dc:
+// prefix), or an empty string if it isn't set
+func (p *pkg) dublinCore(element string) string {
+	name := xml.Name{Local: "dc:" + element}
+	for _, dc := range p.xml.Metadata.DublinCore {
+		if dc.XMLName == name {
+			return dc.Data
+		}
+	}
+
+	return ""
+}
+
+// Set the Dublin Core element with the given name (without the dc: prefix), or
+// remove it if the value is empty. Elements are listed in the order they were
+// first set.
+func (p *pkg) setDublinCore(element string, value string) {
+	name := xml.Name{Local: "dc:" + element}
+	for i, dc := range p.xml.Metadata.DublinCore {
+		if dc.XMLName != name {
+			continue
+		}
+		if value == "" {
+			p.xml.Metadata.DublinCore = append(p.xml.Metadata.DublinCore[:i], p.xml.Metadata.DublinCore[i+1:]...)
+		} else {
+			p.xml.Metadata.DublinCore[i].Data = value
+		}
+		return
+	}
+
+	if value != "" {
+		p.xml.Metadata.DublinCore = append(p.xml.Metadata.DublinCore, pkgDublinCore{XMLName: name, Data: value})
+	}
+}
+
 func (p *pkg) setAuthor(author string) {
 	p.xml.Metadata.Creator = &pkgCreator{
 		Data: author,
@@ -179,31 +425,319 @@ func (p *pkg) setAuthor(author string) {
 	}
 
 	p.xml.Metadata.Meta = updateMeta(p.xml.Metadata.Meta, p.authorMeta)
+	p.updateFileAs()
+}
+
+func (p *pkg) setAuthorFileAs(fileAs string) {
+	p.authorFileAs = fileAs
+	p.updateFileAs()
+}
+
+// Set the cover meta element to the manifest ID of the cover image, or
+// remove it if the ID is empty
+func (p *pkg) setCover(imageID string) {
+	if imageID == "" {
+		p.coverMeta = nil
+		p.xml.Metadata.Meta = removeMeta(p.xml.Metadata.Meta, &pkgMeta{Name: pkgCoverMetaName})
+		return
+	}
+
+	p.coverMeta = &pkgMeta{
+		Name:    pkgCoverMetaName,
+		Content: imageID,
+	}
+
+	p.xml.Metadata.Meta = updateMeta(p.xml.Metadata.Meta, p.coverMeta)
+}
+
+// Set the meta element with the software that produced the EPUB, or remove it
+// if the generator is empty
+func (p *pkg) setGenerator(generator string) {
+	meta := &pkgMeta{Name: pkgGeneratorMetaName, Content: generator}
+	if generator == "" {
+		p.xml.Metadata.Meta = removeMeta(p.xml.Metadata.Meta, meta)
+		return
+	}
+
+	p.xml.Metadata.Meta = updateMeta(p.xml.Metadata.Meta, meta)
+}
+
+// Set the meta element with how the content flows, or remove it if the flow is
+// empty
+func (p *pkg) setRenditionFlow(flow string) {
+	meta := &pkgMeta{Property: pkgRenditionFlowProperty, Data: flow}
+	if flow == "" {
+		p.xml.Metadata.Meta = removeMeta(p.xml.Metadata.Meta, meta)
+		return
+	}
+
+	p.xml.Metadata.Meta = updateMeta(p.xml.Metadata.Meta, meta)
 }
 
 func (p *pkg) setIdentifier(identifier string) {
 	p.xml.Metadata.Identifier.Data = identifier
 }
 
-func (p *pkg) setLang(lang string) {
-	p.xml.Metadata.Language = lang
+// Set the meta element refining the identifier with its ONIX identifier type
+// code, or remove it if the scheme is empty
+func (p *pkg) setIdentifierScheme(scheme string, code string) {
+	p.identifierScheme = scheme
+	identifierTypeMeta := &pkgMeta{
+		Refines:  "#" + p.xml.Metadata.Identifier.ID,
+		Property: pkgIdentifierTypeProperty,
+		Scheme:   pkgIdentifierTypeScheme,
+		Data:     code,
+	}
+
+	if scheme == "" {
+		p.xml.Metadata.Meta = removeMeta(p.xml.Metadata.Meta, identifierTypeMeta)
+		return
+	}
+	p.xml.Metadata.Meta = updateMeta(p.xml.Metadata.Meta, identifierTypeMeta)
+}
+
+// Change the ID of the unique identifier, along with the reference to it from
+// the package element and any meta elements refining it
+func (p *pkg) setUniqueIdentifierID(id string) {
+	oldRefines := "#" + p.xml.Metadata.Identifier.ID
+	for i := range p.xml.Metadata.Meta {
+		if p.xml.Metadata.Meta[i].Refines == oldRefines {
+			p.xml.Metadata.Meta[i].Refines = "#" + id
+		}
+	}
+	p.xml.Metadata.Identifier.ID = id
+	p.xml.UniqueIdentifier = id
+}
+
+func (p *pkg) setLangs(langs []string) {
+	p.xml.Metadata.Languages = langs
 }
 
 func (p *pkg) setPpd(direction string) {
 	p.xml.Spine.Ppd = direction
 }
 
+// Set an attribute of the spine, or remove it if the value is empty
+func (p *pkg) setSpineAttribute(name string, value string) {
+	for i, attr := range p.xml.Spine.Attrs {
+		if attr.Name.Local == name {
+			if value == "" {
+				p.xml.Spine.Attrs = append(p.xml.Spine.Attrs[:i], p.xml.Spine.Attrs[i+1:]...)
+			} else {
+				p.xml.Spine.Attrs[i].Value = value
+			}
+			return
+		}
+	}
+
+	if value != "" {
+		p.xml.Spine.Attrs = append(p.xml.Spine.Attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+	}
+}
+
+// Set the ID of the NCX file in the spine, or remove it if the ID is empty
+func (p *pkg) setSpineToc(id string) {
+	p.xml.Spine.Toc = id
+}
+
+// Set the rendition meta elements that make the EPUB fixed-layout, or remove
+// them to make it reflowable
+func (p *pkg) setFixedLayout(fixedLayout bool) {
+	metas := []pkgMeta{
+		{Property: pkgRenditionLayoutProperty, Data: pkgRenditionLayoutPrePaginated},
+		{Property: pkgRenditionOrientationProperty, Data: pkgRenditionAuto},
+		{Property: pkgRenditionSpreadProperty, Data: pkgRenditionAuto},
+	}
+
+	for i := range metas {
+		if fixedLayout {
+			p.xml.Metadata.Meta = updateMeta(p.xml.Metadata.Meta, &metas[i])
+		} else {
+			p.xml.Metadata.Meta = removeMeta(p.xml.Metadata.Meta, &metas[i])
+		}
+	}
+}
+
+// Set the modified date, replacing any existing dcterms:modified meta elements
+// so that there's only one, and keeping it after the other meta elements so
+// that writing the EPUB again generates the same package file
 func (p *pkg) setModified(timestamp string) {
 	p.modifiedMeta = &pkgMeta{
 		Data:     timestamp,
 		Property: pkgModifiedProperty,
 	}
 
-	p.xml.Metadata.Meta = updateMeta(p.xml.Metadata.Meta, p.modifiedMeta)
+	metas := []pkgMeta{}
+	for _, meta := range p.xml.Metadata.Meta {
+		if meta.Refines == "" && meta.Property == pkgModifiedProperty {
+			continue
+		}
+		metas = append(metas, meta)
+	}
+
+	p.xml.Metadata.Meta = append(metas, *p.modifiedMeta)
+}
+
+// Set the series as an EPUB 3 collection, along with the meta elements used by
+// Calibre, or remove them if the name is empty
+func (p *pkg) setSeries(name string, index float64) {
+	seriesRefines := "#" + pkgSeriesID
+	position := strconv.FormatFloat(index, 'f', -1, 64)
+	metas := []pkgMeta{
+		{Property: pkgCollectionProperty, ID: pkgSeriesID, Data: name},
+		{Refines: seriesRefines, Property: pkgCollectionTypeProperty, Data: pkgCollectionTypeSeries},
+		{Refines: seriesRefines, Property: pkgGroupPositionProperty, Data: position},
+		{Name: pkgCalibreSeriesMetaName, Content: name},
+		{Name: pkgCalibreSeriesIndexMetaName, Content: position},
+	}
+
+	for i := range metas {
+		if name == "" {
+			p.xml.Metadata.Meta = removeMeta(p.xml.Metadata.Meta, &metas[i])
+		} else {
+			p.xml.Metadata.Meta = updateMeta(p.xml.Metadata.Meta, &metas[i])
+		}
+	}
+}
+
+// Add the meta elements for a collection the EPUB belongs to. If the ID of a
+// parent collection is provided, the collection is nested within it.
+func (p *pkg) addCollection(id string, name string, collectionType string, position float64, parentID string) {
+	collection := pkgMeta{Property: pkgCollectionProperty, ID: id, Data: name}
+	if parentID != "" {
+		collection.Refines = "#" + parentID
+	}
+	metas := []pkgMeta{collection}
+	if collectionType != "" {
+		metas = append(metas, pkgMeta{Refines: "#" + id, Property: pkgCollectionTypeProperty, Data: collectionType})
+	}
+	if position != 0 {
+		metas = append(metas, pkgMeta{Refines: "#" + id, Property: pkgGroupPositionProperty, Data: strconv.FormatFloat(position, 'f', -1, 64)})
+	}
+
+	p.xml.Metadata.Meta = append(p.xml.Metadata.Meta, metas...)
+}
+
+func (p *pkg) setRights(rights string) {
+	p.xml.Metadata.Rights = rights
+}
+
+func (p *pkg) setSource(source string) {
+	p.xml.Metadata.Source = source
 }
 
 func (p *pkg) setTitle(title string) {
-	p.xml.Metadata.Title = title
+	p.xml.Metadata.Title.Data = title
+}
+
+func (p *pkg) setTitleFileAs(fileAs string) {
+	p.titleFileAs = fileAs
+	p.updateFileAs()
+}
+
+// Update the meta elements refining the title and creator with the file-as
+// values used for sorting. The refinements are only added if the file-as value
+// is set and the element it refines exists.
+func (p *pkg) updateFileAs() {
+	titleFileAsMeta := &pkgMeta{
+		Refines:  "#" + pkgTitleID,
+		Property: pkgFileAsProperty,
+		Data:     p.titleFileAs,
+	}
+	if p.titleFileAs != "" {
+		p.xml.Metadata.Title.ID = pkgTitleID
+		p.xml.Metadata.Meta = updateMeta(p.xml.Metadata.Meta, titleFileAsMeta)
+	} else {
+		p.xml.Metadata.Title.ID = ""
+		p.xml.Metadata.Meta = removeMeta(p.xml.Metadata.Meta, titleFileAsMeta)
+	}
+
+	authorFileAsMeta := &pkgMeta{
+		Refines:  "#" + pkgCreatorID,
+		Property: pkgFileAsProperty,
+		Data:     p.authorFileAs,
+	}
+	if p.authorFileAs != "" && p.xml.Metadata.Creator != nil {
+		p.xml.Metadata.Meta = updateMeta(p.xml.Metadata.Meta, authorFileAsMeta)
+	} else {
+		p.xml.Metadata.Meta = removeMeta(p.xml.Metadata.Meta, authorFileAsMeta)
+	}
+}
+
+func (p *pkg) setVersion(version string) {
+	p.xml.Version = version
+}
+
+// Make a copy of the package file that can be changed without changing the
+// original
+func (p *pkg) copy() *pkg {
+	r := *p
+	x := *p.xml
+	x.Metadata.Languages = append([]string(nil), p.xml.Metadata.Languages...)
+	x.Metadata.Subjects = append([]string(nil), p.xml.Metadata.Subjects...)
+	x.Metadata.DublinCore = append([]pkgDublinCore(nil), p.xml.Metadata.DublinCore...)
+	x.Metadata.Meta = append([]pkgMeta(nil), p.xml.Metadata.Meta...)
+	if p.xml.Metadata.Creator != nil {
+		creator := *p.xml.Metadata.Creator
+		x.Metadata.Creator = &creator
+	}
+	x.ManifestItems = append([]pkgItem(nil), p.xml.ManifestItems...)
+	x.Spine.Items = append([]pkgItemref(nil), p.xml.Spine.Items...)
+	x.Spine.Attrs = append([]xml.Attr(nil), p.xml.Spine.Attrs...)
+	if p.xml.Guide != nil {
+		x.Guide = &pkgGuide{References: append([]pkgReference(nil), p.xml.Guide.References...)}
+	}
+	r.xml = &x
+
+	for _, meta := range []**pkgMeta{&r.authorMeta, &r.coverMeta, &r.modifiedMeta} {
+		if *meta != nil {
+			m := **meta
+			*meta = &m
+		}
+	}
+
+	return &r
+}
+
+// Get a copy of the package XML that's compatible with EPUB 2, which doesn't
+// support EPUB 3 meta elements or the properties attributes
+func (p *pkg) epub2XML() *pkgRoot {
+	x := *p.xml
+
+	x.Metadata.XmlnsOpf = xmlnsOpf
+	x.Prefix = ""
+	x.XMLLang = ""
+	x.Dir = ""
+	x.Metadata.Identifier.Scheme = p.identifierScheme
+	if x.Metadata.Creator != nil {
+		creator := *x.Metadata.Creator
+		creator.Role = pkgAuthorData
+		creator.FileAs = p.authorFileAs
+		x.Metadata.Creator = &creator
+	}
+
+	x.Metadata.Meta = nil
+	for _, meta := range p.xml.Metadata.Meta {
+		if meta.Name != "" {
+			x.Metadata.Meta = append(x.Metadata.Meta, meta)
+		}
+	}
+
+	x.ManifestItems = make([]pkgItem, len(p.xml.ManifestItems))
+	for i, item := range p.xml.ManifestItems {
+		item.Properties = ""
+		item.MediaOverlay = ""
+		x.ManifestItems[i] = item
+	}
+
+	x.Spine.Items = make([]pkgItemref, len(p.xml.Spine.Items))
+	for i, itemref := range p.xml.Spine.Items {
+		itemref.Properties = ""
+		x.Spine.Items[i] = itemref
+	}
+	x.Spine.Ppd = ""
+
+	return &x
 }
 
 // Update the <meta> element
@@ -211,9 +745,9 @@ func updateMeta(a []pkgMeta, m *pkgMeta) []pkgMeta {
 	indexToReplace := -1
 
 	if len(a) > 0 {
-		// If we've already added the modified meta element to the meta array
+		// If we've already added the meta element to the meta array
 		for i, meta := range a {
-			if meta == *m {
+			if isSameMeta(meta, *m) {
 				indexToReplace = i
 				break
 			}
@@ -234,14 +768,34 @@ func updateMeta(a []pkgMeta, m *pkgMeta) []pkgMeta {
 	return a
 }
 
+// Remove the <meta> element
+func removeMeta(a []pkgMeta, m *pkgMeta) []pkgMeta {
+	metas := []pkgMeta{}
+	for _, meta := range a {
+		if !isSameMeta(meta, *m) {
+			metas = append(metas, meta)
+		}
+	}
+
+	return metas
+}
+
+// Meta elements are the same if they describe the same thing, even if their
+// values differ
+func isSameMeta(a pkgMeta, b pkgMeta) bool {
+	return a.Refines == b.Refines && a.Property == b.Property && a.Name == b.Name && a.ID == b.ID
+}
+
 // Write the package file to the temporary directory
-func (p *pkg) write(fs afero.Fs, tempDir string) {
-	now := time.Now().UTC().Format("2006-01-02T15:04:05Z")
-	p.setModified(now)
+func (p *pkg) write(fs afero.Fs, pkgFilePath string, modified time.Time, minify bool) {
+	p.setModified(modified.UTC().Format("2006-01-02T15:04:05Z"))
 
-	pkgFilePath := filepath.Join(tempDir, contentFolderName, pkgFilename)
+	x := p.xml
+	if x.Version == EpubVersion2 {
+		x = p.epub2XML()
+	}
 
-	output, err := xml.MarshalIndent(p.xml, "", "  ")
+	output, err := marshalXML(x, "", minify)
 	if err != nil {
 		panic(fmt.Sprintf(
 			"Error marshalling XML for package file: %s\n"+
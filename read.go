@@ -0,0 +1,1012 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// ErrUnableToReadEpub is thrown by Open, OpenWithFs, or ReadFromBytes if the
+// EPUB file can't be read
+var ErrUnableToReadEpub = errors.New("Unable to read EPUB file")
+
+// These hold the parts of the package file that are read from an existing EPUB.
+// Elements are matched by their local names so that the namespace prefixes used
+// by the EPUB don't matter.
+type readPkgRoot struct {
+	UniqueIdentifier string          `xml:"unique-identifier,attr"`
+	Version          string          `xml:"version,attr"`
+	Prefix           string          `xml:"prefix,attr"`
+	XMLLang          string          `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+	Dir              string          `xml:"dir,attr"`
+	Metadata         readPkgMetadata `xml:"metadata"`
+	ManifestItems    []pkgItem       `xml:"manifest>item"`
+	Spine            pkgSpine        `xml:"spine"`
+}
+
+type readPkgMetadata struct {
+	Identifiers []struct {
+		ID     string `xml:"id,attr"`
+		Scheme string `xml:"http://www.idpf.org/2007/opf scheme,attr"`
+		Data   string `xml:",chardata"`
+	} `xml:"identifier"`
+	Titles []pkgTitle `xml:"title"`
+	// Ex: <dc:language>en</dc:language>
+	Languages []string `xml:"language"`
+	Creators  []struct {
+		ID     string `xml:"id,attr"`
+		FileAs string `xml:"http://www.idpf.org/2007/opf file-as,attr"`
+		Data   string `xml:",chardata"`
+	} `xml:"creator"`
+	Subjects []string  `xml:"subject"`
+	Rights   []string  `xml:"rights"`
+	Sources  []string  `xml:"source"`
+	Meta     []pkgMeta `xml:"meta"`
+	// The other elements, including the other Dublin Core elements
+	Others []struct {
+		XMLName xml.Name
+		Data    string `xml:",chardata"`
+	} `xml:",any"`
+}
+
+// The parts of the EPUB 3 TOC file that are read from an existing EPUB
+type readNavDoc struct {
+	Navs []readNav `xml:"body>nav"`
+}
+
+type readNav struct {
+	EpubType string      `xml:"http://www.idpf.org/2007/ops type,attr"`
+	Heading  string      `xml:"h1"`
+	List     readNavList `xml:"ol"`
+}
+
+type readNavList struct {
+	Items []struct {
+		A struct {
+			EpubType string `xml:"http://www.idpf.org/2007/ops type,attr"`
+			Href     string `xml:"href,attr"`
+			Data     string `xml:",innerxml"`
+		} `xml:"a"`
+		Children *readNavList `xml:"ol"`
+	} `xml:"li"`
+}
+
+// The parts of the EPUB 2 TOC file that are read from an existing EPUB
+type readNcxNavPoint struct {
+	Text    string `xml:"navLabel>text"`
+	Content struct {
+		Src string `xml:"src,attr"`
+	} `xml:"content"`
+	Children []readNcxNavPoint `xml:"navPoint"`
+}
+
+type readNcxRoot struct {
+	NavMap []readNcxNavPoint `xml:"navMap>navPoint"`
+}
+
+// The encryption file of an existing EPUB
+type readEncryptionRoot struct {
+	EncryptedData []struct {
+		EncryptionMethod encryptionMethod `xml:"EncryptionMethod"`
+		CipherReference  cipherReference  `xml:"CipherData>CipherReference"`
+	} `xml:"EncryptedData"`
+}
+
+// An XHTML document read from an existing EPUB. Anything that can't be
+// represented by xhtmlRoot is checked so the document can be kept as-is instead.
+type readXhtmlRoot struct {
+	Attrs []xml.Attr `xml:",any,attr"`
+	Head  struct {
+		Elements []struct {
+			XMLName xml.Name
+			Attrs   []xml.Attr `xml:",any,attr"`
+			Data    string     `xml:",chardata"`
+		} `xml:",any"`
+	} `xml:"head"`
+	Body struct {
+		Attrs []xml.Attr `xml:",any,attr"`
+		XML   string     `xml:",innerxml"`
+	} `xml:"body"`
+}
+
+// An entry of the TOC of an existing EPUB
+type readTocEntry struct {
+	epubType string
+	// The path of the target within the EPUB and the fragment, if any
+	path     string
+	fragment string
+	title    string
+	// The index of the parent entry, or -1 if the entry is at the top level
+	parent int
+}
+
+// The state used while reading an existing EPUB
+type epubReader struct {
+	e     *Epub
+	files map[string]*zip.File
+	// The items of the package file manifest by ID
+	items map[string]pkgItem
+	// The folder containing the package file, which item paths are relative to
+	pkgDir string
+	// The indexes of the sections by their paths within the EPUB
+	sectionPaths map[string]int
+}
+
+// Open reads the existing EPUB file at the given path and returns an Epub that
+// can be changed and written again. The metadata, sections, TOC, and media
+// files of the EPUB are read, so an EPUB written by this package can be
+// written again without losing anything. Sections whose XHTML can't be changed
+// safely, such as ones with <meta> elements in the head, are kept as-is as if
+// they were added with AddRawSection.
+//
+// If the file isn't an EPUB or can't be read, ErrUnableToReadEpub will be
+// returned.
+func Open(epubFilePath string) (*Epub, error) {
+	return OpenWithFs(epubFilePath, nil)
+}
+
+// OpenWithFs reads the existing EPUB file at the given path the same way as
+// Open, using an Afero filesystem. The returned Epub uses the same filesystem.
+func OpenWithFs(epubFilePath string, fs afero.Fs) (*Epub, error) {
+	if fs == nil {
+		fs = afero.NewOsFs()
+	}
+
+	data, err := afero.ReadFile(fs, epubFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnableToReadEpub, err)
+	}
+
+	e, err := ReadFromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	e.fs = fs
+
+	return e, nil
+}
+
+// ReadFromBytes reads an existing EPUB from the provided data the same way as
+// Open.
+func ReadFromBytes(data []byte) (*Epub, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnableToReadEpub, err)
+	}
+
+	r := &epubReader{
+		e:            NewEpub(""),
+		files:        make(map[string]*zip.File),
+		items:        make(map[string]pkgItem),
+		sectionPaths: make(map[string]int),
+	}
+	for _, zf := range zr.File {
+		r.files[zf.Name] = zf
+	}
+
+	if err := r.read(); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnableToReadEpub, err)
+	}
+
+	return r.e, nil
+}
+
+// Read the whole EPUB
+func (r *epubReader) read() error {
+	c := &verifyContainer{}
+	if err := r.readXML(path.Join(metaInfFolderName, containerFilename), c); err != nil {
+		return err
+	}
+	if len(c.Rootfiles) == 0 {
+		return fmt.Errorf("%s doesn't contain a rootfile", containerFilename)
+	}
+
+	pkgFilePath := c.Rootfiles[0].FullPath
+	p := &readPkgRoot{}
+	if err := r.readXML(pkgFilePath, p); err != nil {
+		return err
+	}
+	r.pkgDir = path.Dir(pkgFilePath)
+	// Keep the original content folder if it can be written back; otherwise
+	// (e.g. the package file is at the root or nested) the default is used
+	r.e.SetContentFolder(r.pkgDir)
+	r.e.SetPackageFilename(path.Base(pkgFilePath))
+	for _, item := range p.ManifestItems {
+		r.items[item.ID] = item
+	}
+
+	r.readMetadata(p)
+	obfuscated, err := r.readEncryption()
+	if err != nil {
+		return err
+	}
+	if err := r.readSections(p); err != nil {
+		return err
+	}
+	r.readFixedLayout(p)
+	if err := r.readMedia(p, obfuscated); err != nil {
+		return err
+	}
+	r.checkMediaOverlays()
+	if err := r.readToc(p); err != nil {
+		return err
+	}
+	r.readCover(p)
+
+	return nil
+}
+
+// Read the metadata from the package file
+func (r *epubReader) readMetadata(p *readPkgRoot) {
+	e := r.e
+	m := p.Metadata
+
+	// EPUB 3 refinements, by the ID of the element they refine and property
+	refinements := make(map[string]string)
+	for _, meta := range m.Meta {
+		if meta.Refines != "" {
+			refinements[meta.Refines+" "+meta.Property] = strings.TrimSpace(meta.Data)
+		}
+	}
+	refinement := func(id string, property string) string {
+		if id == "" {
+			return ""
+		}
+		return refinements["#"+id+" "+property]
+	}
+
+	if strings.HasPrefix(p.Version, "2") {
+		e.SetVersion(EpubVersion2)
+	}
+
+	if len(m.Titles) > 0 {
+		e.SetTitle(strings.TrimSpace(m.Titles[0].Data))
+		e.SetTitleFileAs(refinement(m.Titles[0].ID, pkgFileAsProperty))
+	}
+
+	// Use the first identifier if none of them is the unique identifier
+	i := p.uniqueIdentifierIndex()
+	if i == -1 && len(m.Identifiers) > 0 {
+		i = 0
+	}
+	if i != -1 {
+		identifier := m.Identifiers[i]
+		value := strings.TrimSpace(identifier.Data)
+		scheme := strings.ToUpper(identifier.Scheme)
+		switch refinement(identifier.ID, pkgIdentifierTypeProperty) {
+		case onixIdentifierTypeDOI:
+			scheme = IdentifierSchemeDOI
+		case onixIdentifierTypeISBN10, onixIdentifierTypeISBN13:
+			scheme = IdentifierSchemeISBN
+		case onixIdentifierTypeURN:
+			scheme = IdentifierSchemeUUID
+		}
+		// The scheme is only kept if it's one that's supported
+		if err := e.SetIdentifierWithScheme(value, scheme); err != nil {
+			e.SetIdentifier(value)
+		}
+		// Keep the ID if it can be used, since other tools may refer to it
+		if identifier.ID != "" {
+			e.SetUniqueIdentifierID(identifier.ID)
+		}
+	}
+
+	// Languages that aren't valid are left out
+	for i, lang := range m.Languages {
+		if i == 0 {
+			e.SetLang(strings.TrimSpace(lang))
+		} else {
+			e.AddLang(strings.TrimSpace(lang))
+		}
+	}
+
+	if len(m.Creators) > 0 {
+		e.SetAuthor(strings.TrimSpace(m.Creators[0].Data))
+		fileAs := m.Creators[0].FileAs
+		if fileAs == "" {
+			fileAs = refinement(m.Creators[0].ID, pkgFileAsProperty)
+		}
+		e.SetAuthorFileAs(fileAs)
+	}
+
+	for _, subject := range m.Subjects {
+		e.AddSubject(strings.TrimSpace(subject))
+	}
+	if len(m.Rights) > 0 {
+		e.SetRights(strings.TrimSpace(m.Rights[0]))
+	}
+	if len(m.Sources) > 0 {
+		e.SetSource(strings.TrimSpace(m.Sources[0]))
+	}
+	// Only the first of each of the other Dublin Core elements is kept
+	for _, other := range m.Others {
+		if other.XMLName.Space != xmlnsDc || !dublinCoreElements[other.XMLName.Local] || e.pkg.dublinCore(other.XMLName.Local) != "" {
+			continue
+		}
+		e.SetDublinCore(other.XMLName.Local, strings.TrimSpace(other.Data))
+	}
+
+	// Prefer the first EPUB 3 series collection that isn't nested in another
+	// collection, falling back to the Calibre metadata
+	seriesID, seriesName, seriesIndex := "", "", ""
+	for _, meta := range m.Meta {
+		switch {
+		case meta.Property == pkgCollectionProperty && meta.Refines == "" && seriesID == "" && refinement(meta.ID, pkgCollectionTypeProperty) == pkgCollectionTypeSeries:
+			seriesID = meta.ID
+			seriesName = strings.TrimSpace(meta.Data)
+			seriesIndex = refinement(meta.ID, pkgGroupPositionProperty)
+		case meta.Name == pkgCalibreSeriesMetaName && seriesName == "":
+			seriesName = meta.Content
+		case meta.Name == pkgCalibreSeriesIndexMetaName && seriesIndex == "":
+			seriesIndex = meta.Content
+		}
+	}
+	if seriesName != "" {
+		index, _ := strconv.ParseFloat(seriesIndex, 64)
+		e.SetSeries(seriesName, index)
+	}
+
+	// The other collections get new IDs, so keep track of them for the nested
+	// collections
+	collectionIDs := make(map[string]string)
+	for _, meta := range m.Meta {
+		if meta.Property != pkgCollectionProperty || (meta.ID != "" && meta.ID == seriesID) {
+			continue
+		}
+		collectionType := refinement(meta.ID, pkgCollectionTypeProperty)
+		if collectionType != CollectionTypeSeries && collectionType != CollectionTypeSet {
+			collectionType = ""
+		}
+		position, _ := strconv.ParseFloat(refinement(meta.ID, pkgGroupPositionProperty), 64)
+
+		var id string
+		var err error
+		if parentID, ok := collectionIDs[strings.TrimPrefix(meta.Refines, "#")]; ok {
+			id, err = e.AddSubCollection(parentID, strings.TrimSpace(meta.Data), collectionType, position)
+		} else {
+			id, err = e.AddCollection(strings.TrimSpace(meta.Data), collectionType, position)
+		}
+		if err == nil && meta.ID != "" {
+			collectionIDs[meta.ID] = id
+		}
+	}
+
+	if p.Spine.Ppd != "" {
+		e.SetPpd(p.Spine.Ppd)
+	}
+	// Attributes in other namespaces would need their namespace declarations,
+	// which aren't kept
+	for _, attr := range p.Spine.Attrs {
+		if attr.Name.Space == "" {
+			e.SetSpineAttribute(attr.Name.Local, attr.Value)
+		}
+	}
+
+	// The access modes aren't read since they're inferred from the content
+	for _, meta := range m.Meta {
+		switch {
+		case meta.Property == pkgAccessibilityFeatureProperty:
+			e.AddAccessibilityFeature(strings.TrimSpace(meta.Data))
+		case meta.Property == pkgAccessibilitySummaryProperty:
+			e.SetAccessibilitySummary(strings.TrimSpace(meta.Data))
+		case meta.Name == pkgGeneratorMetaName:
+			e.SetGenerator(strings.TrimSpace(meta.Content))
+		case meta.Property == pkgRenditionFlowProperty && meta.Refines == "":
+			// Values that aren't valid are left out
+			e.SetRenditionFlow(strings.TrimSpace(meta.Data))
+		}
+	}
+
+	// Values that aren't valid are left out
+	e.SetMetadataLang(p.XMLLang)
+	e.SetMetadataDir(p.Dir)
+
+	// The prefix attribute is a list of "prefix: URI" pairs
+	fields := strings.Fields(p.Prefix)
+	for i := 0; i+1 < len(fields); i += 2 {
+		if strings.HasSuffix(fields[i], ":") {
+			e.AddVocabularyPrefix(strings.TrimSuffix(fields[i], ":"), fields[i+1])
+		}
+	}
+
+	// Keep any other meta properties, except the ones that are generated when
+	// the EPUB is written and ones that are refined by other meta elements
+	for _, meta := range m.Meta {
+		if meta.Property == "" || meta.Refines != "" || meta.ID != "" || isGeneratedMetaProperty(meta.Property) {
+			continue
+		}
+		e.AddMeta(meta.Property, strings.TrimSpace(meta.Data))
+	}
+}
+
+// Whether meta elements with the property are generated when the EPUB is
+// written
+func isGeneratedMetaProperty(property string) bool {
+	switch property {
+	case pkgAccessModeProperty,
+		pkgAccessibilityFeatureProperty,
+		pkgAccessibilitySummaryProperty,
+		pkgCollectionProperty,
+		pkgMediaDurationProperty,
+		pkgModifiedProperty,
+		pkgRenditionFlowProperty,
+		pkgRenditionLayoutProperty,
+		pkgRenditionOrientationProperty,
+		pkgRenditionSpreadProperty:
+		return true
+	}
+
+	return false
+}
+
+// Read the encryption file, if any, and return the paths of the obfuscated
+// fonts. Resources encrypted any other way (e.g. DRM) can't be read.
+func (r *epubReader) readEncryption() (map[string]bool, error) {
+	obfuscated := make(map[string]bool)
+	encryptionFilePath := path.Join(metaInfFolderName, encryptionFilename)
+	if _, ok := r.files[encryptionFilePath]; !ok {
+		return obfuscated, nil
+	}
+
+	enc := &readEncryptionRoot{}
+	if err := r.readXML(encryptionFilePath, enc); err != nil {
+		return nil, err
+	}
+	for _, data := range enc.EncryptedData {
+		uri, err := url.PathUnescape(data.CipherReference.URI)
+		if err != nil {
+			return nil, err
+		}
+		if data.EncryptionMethod.Algorithm != fontObfuscationAlgorithm {
+			return nil, fmt.Errorf("%s is encrypted", uri)
+		}
+		obfuscated[uri] = true
+	}
+
+	return obfuscated, nil
+}
+
+// Read the sections in the order of the spine
+func (r *epubReader) readSections(p *readPkgRoot) error {
+	e := r.e
+	for _, itemref := range p.Spine.Items {
+		item, ok := r.items[itemref.Idref]
+		// The TOC file is generated when the EPUB is written
+		if !ok || hasProperty(item.Properties, tocNavItemProperties) {
+			continue
+		}
+
+		itemPath, _, err := r.itemPath(item.Href)
+		if err != nil {
+			return err
+		}
+		contents, err := r.readFile(itemPath)
+		if err != nil {
+			return err
+		}
+		x, err := readXhtml(contents)
+		if err != nil {
+			return fmt.Errorf("unable to parse %s: %s", itemPath, err)
+		}
+
+		// Keep the filename so links between sections still work
+		filename, err := e.newSectionFilename(path.Base(itemPath))
+		if err != nil {
+			filename, _ = e.newSectionFilename("")
+		}
+		mediaOverlay := ""
+		if overlayItem, ok := r.items[item.MediaOverlay]; ok {
+			overlayPath, _, err := r.itemPath(overlayItem.Href)
+			if err != nil {
+				return err
+			}
+			contents, err := r.readFile(overlayPath)
+			if err != nil {
+				return err
+			}
+			mediaOverlay = string(contents)
+		}
+
+		r.sectionPaths[itemPath] = len(e.sections)
+		e.sections = append(e.sections, epubSection{
+			filename:        filename,
+			mediaOverlay:    mediaOverlay,
+			nonLinear:       itemref.Linear == pkgSpineNonLinear,
+			spineProperties: strings.Fields(itemref.Properties),
+			xhtml:           x,
+		})
+	}
+
+	return nil
+}
+
+// Make the EPUB fixed-layout if it's pre-paginated, using the viewport of the
+// first section that has one
+func (r *epubReader) readFixedLayout(p *readPkgRoot) {
+	prePaginated := false
+	for _, meta := range p.Metadata.Meta {
+		if meta.Property == pkgRenditionLayoutProperty && strings.TrimSpace(meta.Data) == pkgRenditionLayoutPrePaginated {
+			prePaginated = true
+		}
+	}
+	if !prePaginated {
+		return
+	}
+
+	for _, section := range r.e.sections {
+		for _, meta := range section.xhtml.xml.Head.Metas {
+			if meta.Name != xhtmlViewportMetaName {
+				continue
+			}
+			width, height := parseViewport(meta.Content)
+			if r.e.SetFixedLayout(width, height) == nil && width > 0 {
+				return
+			}
+		}
+	}
+}
+
+// Read the media files listed in the manifest
+func (r *epubReader) readMedia(p *readPkgRoot, obfuscated map[string]bool) error {
+	e := r.e
+	for _, item := range p.ManifestItems {
+		itemPath, _, err := r.itemPath(item.Href)
+		if err != nil {
+			return err
+		}
+		if _, ok := r.sectionPaths[itemPath]; ok {
+			continue
+		}
+
+		var mediaMap map[string]string
+		var mediaFileFormat, mediaFolderName string
+		mediaType := item.MediaType
+		switch {
+		case mediaType == mediaTypeCSS:
+			mediaMap, mediaFileFormat, mediaFolderName = e.css, cssFileFormat, CSSFolderName
+		case mediaType == mediaTypeJavaScript || mediaType == "text/javascript":
+			mediaMap, mediaFileFormat, mediaFolderName = e.javaScripts, javaScriptFileFormat, JavaScriptFolderName
+		case strings.HasPrefix(mediaType, "image/"):
+			mediaMap, mediaFileFormat, mediaFolderName = e.images, imageFileFormat, ImageFolderName
+		case strings.HasPrefix(mediaType, mediaTypeAudioPrefix):
+			mediaMap, mediaFileFormat, mediaFolderName = e.audios, audioFileFormat, AudioFolderName
+		case strings.HasPrefix(mediaType, mediaTypeVideoPrefix):
+			mediaMap, mediaFileFormat, mediaFolderName = e.videos, videoFileFormat, VideoFolderName
+		case strings.HasPrefix(mediaType, "font/") || strings.Contains(mediaType, "font"):
+			mediaMap, mediaFileFormat, mediaFolderName = e.fonts, fontFileFormat, FontFolderName
+		default:
+			// Other files, such as the TOC files, are generated when the EPUB is
+			// written or aren't supported
+			continue
+		}
+
+		filename := path.Base(itemPath)
+		if _, ok := mediaMap[filename]; ok {
+			continue
+		}
+		// Files whose media type can't be determined from the extension are only
+		// kept if they're images (see ImageOptions)
+		mediaTypeOverride := ""
+		if extensionMediaTypes[strings.ToLower(path.Ext(filename))] == "" {
+			if mediaFolderName != ImageFolderName || !isImageMediaType(mediaType) {
+				continue
+			}
+			mediaTypeOverride = mediaType
+		}
+		contents, err := r.readFile(itemPath)
+		if err != nil {
+			return err
+		}
+		if obfuscated[itemPath] {
+			rc := newFontObfuscator(ioutil.NopCloser(bytes.NewReader(contents)), e.Identifier())
+			if contents, err = ioutil.ReadAll(rc); err != nil {
+				return err
+			}
+			e.obfuscated[path.Join(mediaFolderName, filename)] = true
+		}
+
+		_, err = e.addMediaFile("", contents, filename, mediaTypeOverride, mediaFileFormat, mediaFolderName, mediaMap)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Drop the media overlays that reference audio files that weren't read, e.g.
+// because they're stored somewhere other than the audio folder
+func (r *epubReader) checkMediaOverlays() {
+	for i := range r.e.sections {
+		section := &r.e.sections[i]
+		if section.mediaOverlay == "" {
+			continue
+		}
+		if _, err := r.e.mediaOverlayDuration(section.mediaOverlay); err != nil {
+			section.mediaOverlay = ""
+		}
+	}
+}
+
+// Read the section titles and nesting, landmarks, and page list from the TOC.
+// The EPUB 3 TOC file is used if there is one, otherwise the EPUB 2 TOC file.
+func (r *epubReader) readToc(p *readPkgRoot) error {
+	var navItem, ncxItem *pkgItem
+	for i, item := range p.ManifestItems {
+		if hasProperty(item.Properties, tocNavItemProperties) {
+			navItem = &p.ManifestItems[i]
+		} else if item.MediaType == mediaTypeNcx {
+			ncxItem = &p.ManifestItems[i]
+		}
+	}
+
+	// Keep EPUB 3 files without an NCX file that way
+	if ncxItem == nil && navItem != nil {
+		r.e.SetIncludeNCX(false)
+	}
+
+	switch {
+	case navItem != nil:
+		return r.readNavDoc(navItem)
+	case ncxItem != nil:
+		return r.readNcxDoc(ncxItem)
+	}
+
+	return nil
+}
+
+func (r *epubReader) readNavDoc(item *pkgItem) error {
+	navPath, _, err := r.itemPath(item.Href)
+	if err != nil {
+		return err
+	}
+	n := &readNavDoc{}
+	if err := r.readXML(navPath, n); err != nil {
+		return err
+	}
+	navDir := path.Dir(navPath)
+
+	for _, nav := range n.Navs {
+		var entries []readTocEntry
+		var addEntries func(l readNavList, parent int) error
+		addEntries = func(l readNavList, parent int) error {
+			for _, li := range l.Items {
+				entry, err := newReadTocEntry(navDir, li.A.Href, xhtmlToPlainText(li.A.Data), parent)
+				if err != nil {
+					return err
+				}
+				entry.epubType = li.A.EpubType
+				entries = append(entries, entry)
+				if li.Children != nil {
+					if err := addEntries(*li.Children, len(entries)-1); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+		if err := addEntries(nav.List, -1); err != nil {
+			return err
+		}
+
+		switch nav.EpubType {
+		case tocNavEpubType:
+			r.setSectionTitles(entries)
+			if heading := strings.TrimSpace(nav.Heading); heading != tocNavHeading {
+				r.e.SetTocTitle(heading)
+			}
+
+		case tocNavLandmarksEpubType:
+			for _, entry := range entries {
+				target := tocNavFilename
+				if entry.path != navPath {
+					sectionIndex, ok := r.sectionPaths[entry.path]
+					if !ok {
+						continue
+					}
+					target = r.e.sections[sectionIndex].filename
+				}
+				if entry.fragment != "" {
+					target += "#" + entry.fragment
+				}
+				r.e.AddLandmark(entry.epubType, entry.title, target)
+			}
+
+		case tocNavPageListEpubType:
+			for _, entry := range entries {
+				sectionIndex, ok := r.sectionPaths[entry.path]
+				if !ok || entry.fragment == "" {
+					continue
+				}
+				section := &r.e.sections[sectionIndex]
+				section.pageMarkers = append(section.pageMarkers, epubPageMarker{
+					anchorID: entry.fragment,
+					pageName: entry.title,
+				})
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *epubReader) readNcxDoc(item *pkgItem) error {
+	ncxPath, _, err := r.itemPath(item.Href)
+	if err != nil {
+		return err
+	}
+	n := &readNcxRoot{}
+	if err := r.readXML(ncxPath, n); err != nil {
+		return err
+	}
+	ncxDir := path.Dir(ncxPath)
+
+	var entries []readTocEntry
+	var addEntries func(navPoints []readNcxNavPoint, parent int) error
+	addEntries = func(navPoints []readNcxNavPoint, parent int) error {
+		for _, np := range navPoints {
+			entry, err := newReadTocEntry(ncxDir, np.Content.Src, strings.TrimSpace(np.Text), parent)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			if err := addEntries(np.Children, len(entries)-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := addEntries(n.NavMap, -1); err != nil {
+		return err
+	}
+	r.setSectionTitles(entries)
+
+	return nil
+}
+
+// Set the titles and parents of the sections from the TOC entries. Only the
+// first entry for each section is used.
+func (r *epubReader) setSectionTitles(entries []readTocEntry) {
+	titled := make(map[int]bool)
+	for _, entry := range entries {
+		sectionIndex, ok := r.sectionPaths[entry.path]
+		if !ok || titled[sectionIndex] {
+			continue
+		}
+		titled[sectionIndex] = true
+
+		section := &r.e.sections[sectionIndex]
+		section.xhtml.setTitle(entry.title)
+		for parent := entry.parent; parent != -1; parent = entries[parent].parent {
+			parentIndex, ok := r.sectionPaths[entries[parent].path]
+			if ok && parentIndex != sectionIndex {
+				section.parentFilename = r.e.sections[parentIndex].filename
+				break
+			}
+		}
+	}
+}
+
+// Find the cover image and the cover page, which is the first section if it
+// isn't in the TOC and shows the cover image
+func (r *epubReader) readCover(p *readPkgRoot) {
+	e := r.e
+	coverImageID := ""
+	for _, meta := range p.Metadata.Meta {
+		if meta.Name == pkgCoverMetaName {
+			coverImageID = meta.Content
+		}
+	}
+	for _, item := range p.ManifestItems {
+		if hasProperty(item.Properties, coverImageProperties) {
+			coverImageID = item.ID
+		}
+	}
+	item, ok := r.items[coverImageID]
+	if !ok {
+		return
+	}
+	imageFilename := path.Base(item.Href)
+	if _, ok := e.images[imageFilename]; !ok {
+		return
+	}
+	e.setCoverImage(imageFilename)
+
+	if len(e.sections) == 0 {
+		return
+	}
+	section := e.sections[0]
+	if section.xhtml.raw != "" || section.xhtml.Title() != "" || !strings.Contains(section.xhtml.body(), imageFilename) {
+		return
+	}
+	e.cover.xhtmlFilename = section.filename
+	// The cover page has the same title as the EPUB
+	section.xhtml.setTitle(e.Title())
+	if links := section.xhtml.xml.Head.Links; len(links) > 0 {
+		e.cover.cssFilename = path.Base(links[0].Href)
+	}
+}
+
+// Get the index of the unique identifier, or -1 if there isn't one
+func (p *readPkgRoot) uniqueIdentifierIndex() int {
+	for i, identifier := range p.Metadata.Identifiers {
+		if identifier.ID == p.UniqueIdentifier {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Get the path within the EPUB of a manifest item or TOC entry from its href,
+// which is relative to the package file, along with the fragment if any
+func (r *epubReader) itemPath(href string) (string, string, error) {
+	return resolveHref(r.pkgDir, href)
+}
+
+// Read the contents of the file at the given path within the EPUB
+func (r *epubReader) readFile(filePath string) ([]byte, error) {
+	zf, ok := r.files[filePath]
+	if !ok {
+		return nil, fmt.Errorf("%s is missing", filePath)
+	}
+
+	return readZipFile(zf)
+}
+
+// Read and parse the XML file at the given path within the EPUB
+func (r *epubReader) readXML(filePath string, v interface{}) error {
+	contents, err := r.readFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(contents))
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+	if err := d.Decode(v); err != nil {
+		return fmt.Errorf("unable to parse %s: %s", filePath, err)
+	}
+
+	return nil
+}
+
+func newReadTocEntry(dir string, href string, title string, parent int) (readTocEntry, error) {
+	entryPath, fragment, err := resolveHref(dir, href)
+	if err != nil {
+		return readTocEntry{}, err
+	}
+
+	return readTocEntry{
+		path:     entryPath,
+		fragment: fragment,
+		title:    title,
+		parent:   parent,
+	}, nil
+}
+
+// Parse an XHTML document read from an existing EPUB
+func readXhtml(contents []byte) (*xhtml, error) {
+	doc := &readXhtmlRoot{}
+	d := xml.NewDecoder(bytes.NewReader(contents))
+	d.Entity = xml.HTMLEntity
+	if err := d.Decode(doc); err != nil {
+		return nil, err
+	}
+
+	x := newXhtml("")
+	raw := false
+	for _, attr := range doc.Body.Attrs {
+		if attr.Name.Space == xmlnsEpub && attr.Name.Local == "type" {
+			x.setBodyEpubType(attr.Value)
+		} else {
+			raw = true
+		}
+	}
+
+	for _, attr := range doc.Attrs {
+		switch {
+		case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+		case attr.Name.Space == "xmlns" && attr.Name.Local == "epub":
+			x.setXmlnsEpub(attr.Value)
+		// The lang and xml:lang attributes are set to the same value, and EPUB 2
+		// sections only have xml:lang
+		case (attr.Name.Space == "" || attr.Name.Space == xmlNamespace) && attr.Name.Local == "lang" && (x.xml.XMLLang == "" || x.xml.XMLLang == attr.Value):
+			x.setLang(attr.Value)
+		default:
+			raw = true
+		}
+	}
+
+	var cssPaths []string
+	for _, element := range doc.Head.Elements {
+		attrs := make(map[string]string)
+		for _, attr := range element.Attrs {
+			attrs[attr.Name.Local] = attr.Value
+		}
+
+		switch {
+		// The title is set from the TOC instead, since sections that aren't in
+		// the TOC don't have titles
+		case element.XMLName.Local == "title" && len(attrs) == 0:
+		case element.XMLName.Local == "link" && attrs["rel"] == xhtmlLinkRel && len(attrs) <= 3 && attrs["href"] != "":
+			cssPaths = append(cssPaths, attrs["href"])
+		case element.XMLName.Local == "script" && len(attrs) <= 2 && attrs["src"] != "" && strings.TrimSpace(element.Data) == "":
+			x.addScript(attrs["src"])
+		case element.XMLName.Local == "meta" && attrs["name"] == xhtmlViewportMetaName && len(attrs) == 2:
+			x.xml.Head.Metas = append(x.xml.Head.Metas, xhtmlMeta{Name: xhtmlViewportMetaName, Content: attrs["content"]})
+		default:
+			raw = true
+		}
+	}
+
+	// Documents that can't be represented without losing anything are kept as-is
+	if raw {
+		return newRawXhtml(string(contents)), nil
+	}
+
+	x.setCSS(cssPaths...)
+	x.xml.Body.XML = doc.Body.XML
+
+	return x, nil
+}
+
+// Get the width and height from the content of a viewport meta element, e.g.
+// width=1200, height=1600, or zero if they can't be parsed
+func parseViewport(content string) (int, int) {
+	width, height := 0, 0
+	for _, field := range strings.Split(content, ",") {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			continue
+		}
+		switch strings.TrimSpace(parts[0]) {
+		case "width":
+			width = value
+		case "height":
+			height = value
+		}
+	}
+
+	return width, height
+}
+
+// Resolve a relative URL against the given folder within the EPUB, returning
+// the path and the fragment
+func resolveHref(dir string, href string) (string, string, error) {
+	fragment := ""
+	if i := strings.Index(href, "#"); i != -1 {
+		href, fragment = href[:i], href[i+1:]
+	}
+
+	unescaped, err := url.PathUnescape(href)
+	if err != nil {
+		return "", "", err
+	}
+
+	return path.Join(dir, unescaped), fragment, nil
+}
+
+// Check whether a space-separated list of properties contains the property
+func hasProperty(properties string, property string) bool {
+	for _, p := range strings.Fields(properties) {
+		if p == property {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,58 @@
+package epub
+
+import (
+	"regexp"
+)
+
+// Elements that are removed along with their content when sanitizing section
+// bodies
+var sanitizeRemovedElementPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?is)<script(?:\s[^>]*)?(?:/>|>.*?</script\s*>)`),
+	regexp.MustCompile(`(?is)<style(?:\s[^>]*)?(?:/>|>.*?</style\s*>)`),
+}
+
+// Presentational elements that aren't part of HTML5, which are removed while
+// keeping their content when sanitizing section bodies
+var sanitizeUnwrappedElementPattern = regexp.MustCompile(`(?i)</?(?:big|blink|center|font|marquee|strike|tt)(?:\s[^>]*)?>`)
+
+// Matches start tags, whose attributes are sanitized
+var sanitizeStartTagPattern = regexp.MustCompile(`<[a-zA-Z][^>]*>`)
+
+// Attributes that are removed from start tags when sanitizing section bodies:
+// inline event handlers and javascript: URLs
+var sanitizeRemovedAttributePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\s+on[a-z]+\s*=\s*(?:"[^"]*"|'[^']*')`),
+	regexp.MustCompile(`(?i)\s+(?:action|formaction|href|src|xlink:href)\s*=\s*(?:"\s*javascript:[^"]*"|'\s*javascript:[^']*')`),
+}
+
+// SetSanitizeHTML sets whether the bodies of sections are sanitized when
+// they're added, which is off by default. Sanitizing removes constructs that
+// are disallowed in EPUB 3 or that reading systems won't run, so that content
+// from other sources doesn't need to be cleaned first. <script> and <style>
+// elements are removed along with their content, presentational elements such
+// as <font> and <center> are removed while keeping their content, and inline
+// event handlers such as onclick and javascript: URLs are removed.
+//
+// Sections added with AddRawSection aren't sanitized. Scripts can still be
+// added to sections with AddScriptToSection.
+func (e *Epub) SetSanitizeHTML(sanitize bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.sanitizeHTML = sanitize
+}
+
+// Remove disallowed elements and attributes from a section body
+func sanitizeHTML(body string) string {
+	for _, pattern := range sanitizeRemovedElementPatterns {
+		body = pattern.ReplaceAllString(body, "")
+	}
+	body = sanitizeUnwrappedElementPattern.ReplaceAllString(body, "")
+
+	return sanitizeStartTagPattern.ReplaceAllStringFunc(body, func(tag string) string {
+		for _, pattern := range sanitizeRemovedAttributePatterns {
+			tag = pattern.ReplaceAllString(tag, "")
+		}
+		return tag
+	})
+}
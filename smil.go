@@ -0,0 +1,137 @@
+package epub
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidMediaOverlay is thrown by AddMediaOverlay if the SMIL document
+// references audio that hasn't been added with AddAudio, or a clip that doesn't
+// have a valid clipEnd
+var ErrInvalidMediaOverlay = errors.New("Invalid media overlay")
+
+const (
+	mediaTypeSmil = "application/smil+xml"
+	// The file extension of media overlay documents
+	smilFileExtension = ".smil"
+)
+
+// Units of SMIL timecount values (e.g. 2.5s), in the order they must be checked
+var smilTimecountUnits = []struct {
+	suffix string
+	unit   time.Duration
+}{
+	{"ms", time.Millisecond},
+	{"min", time.Minute},
+	{"h", time.Hour},
+	{"s", time.Second},
+}
+
+// Get the filename of the media overlay document of a section, which is stored
+// alongside the section
+func mediaOverlayFilename(sectionFilename string) string {
+	return strings.TrimSuffix(sectionFilename, filepath.Ext(sectionFilename)) + smilFileExtension
+}
+
+// Get the total duration of the audio clips in a SMIL document, checking that
+// each clip references an audio file that has been added
+func (e *Epub) mediaOverlayDuration(smilDocument string) (time.Duration, error) {
+	var total time.Duration
+
+	d := xml.NewDecoder(strings.NewReader(smilDocument))
+	for {
+		t, err := d.Token()
+		if err != nil {
+			break
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok || se.Name.Local != "audio" {
+			continue
+		}
+
+		attrs := make(map[string]string)
+		for _, attr := range se.Attr {
+			attrs[attr.Name.Local] = attr.Value
+		}
+
+		// Audio paths are relative to the section files, like the SMIL document
+		folderName, filename := path.Split(path.Join(xhtmlFolderName, attrs["src"]))
+		if _, ok := e.audios[filename]; !ok || path.Clean(folderName) != AudioFolderName {
+			return 0, fmt.Errorf("%w: audio %s hasn't been added", ErrInvalidMediaOverlay, attrs["src"])
+		}
+
+		var clipBegin time.Duration
+		if attrs["clipBegin"] != "" {
+			clipBegin, err = parseClockValue(attrs["clipBegin"])
+			if err != nil {
+				return 0, fmt.Errorf("%w: %s", ErrInvalidMediaOverlay, err)
+			}
+		}
+		clipEnd, err := parseClockValue(attrs["clipEnd"])
+		if err != nil {
+			return 0, fmt.Errorf("%w: %s", ErrInvalidMediaOverlay, err)
+		}
+		if clipEnd < clipBegin {
+			return 0, fmt.Errorf("%w: clip of %s ends before it begins", ErrInvalidMediaOverlay, attrs["src"])
+		}
+		total += clipEnd - clipBegin
+	}
+
+	return total, nil
+}
+
+// Parse a SMIL clock value, e.g. 0:01:02.5, 01:02.5, 62.5s, or 62500ms
+//
+// Spec: https://www.w3.org/TR/SMIL3/smil-timing.html#q22
+func parseClockValue(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	seconds := 0.0
+
+	if strings.Contains(value, ":") {
+		parts := strings.Split(value, ":")
+		if len(parts) > 3 {
+			return 0, fmt.Errorf("invalid clock value %q", value)
+		}
+		for _, part := range parts {
+			n, err := strconv.ParseFloat(part, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid clock value %q", value)
+			}
+			seconds = seconds*60 + n
+		}
+
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+
+	unit := time.Second
+	for _, u := range smilTimecountUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			value = strings.TrimSuffix(value, u.suffix)
+			unit = u.unit
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid clock value %q", value)
+	}
+
+	return time.Duration(n * float64(unit)), nil
+}
+
+// Format a duration as a SMIL clock value, e.g. 0:01:02.500
+func formatClockValue(d time.Duration) string {
+	d = d.Round(time.Millisecond)
+	hours := d / time.Hour
+	minutes := (d % time.Hour) / time.Minute
+	seconds := (d % time.Minute) / time.Second
+	milliseconds := (d % time.Second) / time.Millisecond
+
+	return fmt.Sprintf("%d:%02d:%02d.%03d", hours, minutes, seconds, milliseconds)
+}
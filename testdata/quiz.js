@@ -0,0 +1,6 @@
+document.addEventListener("DOMContentLoaded", function () {
+  var answer = document.getElementById("answer");
+  if (answer) {
+    answer.hidden = true;
+  }
+});
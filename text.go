@@ -0,0 +1,140 @@
+package epub
+
+import (
+	"encoding/xml"
+	"strings"
+	"time"
+)
+
+const (
+	// The average silent reading speed of adults reading English prose
+	defaultWordsPerMinute     = 238
+	plainTextSectionSeparator = "\n\n"
+)
+
+// Elements that start a new line of text when converting XHTML to plain text
+var plainTextBlockElements = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true,
+	"br": true, "dd": true, "div": true, "dl": true, "dt": true,
+	"figcaption": true, "figure": true, "footer": true, "h1": true, "h2": true,
+	"h3": true, "h4": true, "h5": true, "h6": true, "header": true, "hr": true,
+	"li": true, "nav": true, "ol": true, "p": true, "pre": true, "section": true,
+	"table": true, "td": true, "th": true, "tr": true, "ul": true,
+}
+
+// Elements whose content isn't readable text
+var plainTextSkippedElements = map[string]bool{
+	"head": true, "script": true, "style": true,
+}
+
+// PlainText returns the readable text of the EPUB without any markup, e.g. for
+// full-text indexing. The text of each section is included in reading order
+// and separated by a blank line. Within a section, each block-level element
+// (paragraph, heading, etc) is placed on its own line, entities are decoded,
+// and runs of whitespace are collapsed into a single space.
+func (e *Epub) PlainText() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	texts := []string{}
+	for _, section := range e.sections {
+		text := xhtmlToPlainText(section.xhtml.body())
+		if text != "" {
+			texts = append(texts, text)
+		}
+	}
+
+	return strings.Join(texts, plainTextSectionSeparator)
+}
+
+// WordCount returns the number of words in the readable text of the linear
+// sections of the EPUB, i.e. the sections in the reading order other than those
+// added with AddNonLinearSection. The text is the same as that returned by
+// PlainText, and words are separated by whitespace, so languages that aren't
+// written with spaces between words, such as Chinese and Japanese, aren't
+// counted accurately.
+func (e *Epub) WordCount() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.wordCount()
+}
+
+// EstimatedReadingTime returns an estimate of how long it takes to read the
+// linear sections of the EPUB at the given number of words per minute, based on
+// WordCount. If the number of words per minute isn't positive, 238 words per
+// minute is used, which is the average silent reading speed of adults.
+func (e *Epub) EstimatedReadingTime(wordsPerMinute int) time.Duration {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if wordsPerMinute <= 0 {
+		wordsPerMinute = defaultWordsPerMinute
+	}
+
+	return time.Duration(e.wordCount()) * time.Minute / time.Duration(wordsPerMinute)
+}
+
+// Count the words in the linear sections without locking the Epub
+func (e *Epub) wordCount() int {
+	count := 0
+	for _, section := range e.sections {
+		if !section.nonLinear {
+			count += len(strings.Fields(xhtmlToPlainText(section.xhtml.body())))
+		}
+	}
+
+	return count
+}
+
+// Strip the markup from an XHTML fragment. The parser isn't strict so that
+// HTML entities and unclosed elements don't cause the text to be lost.
+func xhtmlToPlainText(fragment string) string {
+	d := xml.NewDecoder(strings.NewReader("<body>" + fragment + "</body>"))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	lines := []string{}
+	var line strings.Builder
+	endLine := func() {
+		if text := strings.Join(strings.Fields(line.String()), " "); text != "" {
+			lines = append(lines, text)
+		}
+		line.Reset()
+	}
+
+	skipDepth := 0
+	for {
+		t, err := d.Token()
+		if err != nil {
+			break
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			if plainTextSkippedElements[name] {
+				skipDepth++
+			}
+			if plainTextBlockElements[name] {
+				endLine()
+			}
+		case xml.EndElement:
+			name := strings.ToLower(t.Name.Local)
+			if plainTextSkippedElements[name] && skipDepth > 0 {
+				skipDepth--
+			}
+			if plainTextBlockElements[name] {
+				endLine()
+			}
+		case xml.CharData:
+			if skipDepth == 0 {
+				line.Write(t)
+			}
+		}
+	}
+	endLine()
+
+	return strings.Join(lines, "\n")
+}
@@ -12,15 +12,21 @@ import (
 const (
 	tocNavBodyTemplate = `
     <nav epub:type="toc">
-      <h1>Table of Contents</h1>
+      <h1></h1>
       <ol>
       </ol>
     </nav>
 `
-	tocNavFilename       = "nav.xhtml"
-	tocNavItemID         = "nav"
-	tocNavItemProperties = "nav"
-	tocNavEpubType       = "toc"
+	tocNavFilename          = "nav.xhtml"
+	tocNavHeading           = "Table of Contents"
+	tocNavHidden            = "hidden"
+	tocNavLandmarksEpubType = "landmarks"
+	tocNavLandmarksHeading  = "Landmarks"
+	tocNavPageListEpubType  = "page-list"
+	tocNavPageListHeading   = "Pages"
+	tocNavItemID            = "nav"
+	tocNavItemProperties    = "nav"
+	tocNavEpubType          = "toc"
 
 	tocNcxFilename = "toc.ncx"
 	tocNcxItemID   = "ncx"
@@ -48,14 +54,26 @@ type toc struct {
 	// Spec: http://www.idpf.org/epub/301/spec/epub-contentdocs.html#sec-xhtml-nav
 	navXML *tocNavBody
 
+	// These hold the page list and landmarks navs, which are added to the EPUB
+	// v3 TOC file after the table of contents if they have any entries
+	pageListXML  *tocNavHiddenList
+	landmarksXML *tocNavHiddenList
+
 	// This holds the XML for the EPUB v2 TOC file (toc.ncx). This is added so the
 	// resulting EPUB v3 file will still work with devices that only support EPUB v2
 	//
 	// Sample: https://github.com/bmaupin/epub-samples/blob/master/minimal-v3plus2/EPUB/toc.ncx
 	// Spec: http://www.idpf.org/epub/20/spec/OPF_2.0.1_draft.htm#Section2.4.1
 	ncxXML *tocNcxRoot
+	// The number of sections that have been added, used for the NCX play order
+	sectionCount int
 
 	title string // EPUB title
+	// The title and heading of the EPUB v3 TOC file. If it's empty, the EPUB title
+	// is used as the title and navHeading as the heading.
+	navTitle string
+	// The default heading of the EPUB v3 TOC file, which depends on the locale
+	navHeading string
 }
 
 type tocNavBody struct {
@@ -67,6 +85,35 @@ type tocNavBody struct {
 
 type tocNavItem struct {
 	A tocNavLink `xml:"a"`
+	// Sub-sections are nested in their own list
+	Children *tocNavList `xml:"ol,omitempty"`
+}
+
+// A nested <ol> in the nav
+type tocNavList struct {
+	Links []tocNavItem `xml:"li"`
+}
+
+// A nav that isn't displayed as part of the TOC, such as the page list or
+// landmarks
+// Ex: <nav epub:type="landmarks" hidden="hidden"><h2>Landmarks</h2><ol>...</ol></nav>
+type tocNavHiddenList struct {
+	XMLName  xml.Name           `xml:"nav"`
+	EpubType string             `xml:"epub:type,attr"`
+	Hidden   string             `xml:"hidden,attr"`
+	H2       string             `xml:"h2"`
+	Links    []tocNavHiddenItem `xml:"ol>li"`
+}
+
+type tocNavHiddenItem struct {
+	A tocNavHiddenLink `xml:"a"`
+}
+
+type tocNavHiddenLink struct {
+	XMLName  xml.Name `xml:"a"`
+	EpubType string   `xml:"epub:type,attr,omitempty"`
+	Href     string   `xml:"href,attr"`
+	Data     string   `xml:",chardata"`
 }
 
 type tocNavLink struct {
@@ -93,10 +140,12 @@ type tocNcxMeta struct {
 }
 
 type tocNcxNavPoint struct {
-	XMLName xml.Name      `xml:"navPoint"`
-	ID      string        `xml:"id,attr"`
-	Text    string        `xml:"navLabel>text"`
-	Content tocNcxContent `xml:"content"`
+	XMLName   xml.Name         `xml:"navPoint"`
+	ID        string           `xml:"id,attr"`
+	PlayOrder int              `xml:"playOrder,attr"`
+	Text      string           `xml:"navLabel>text"`
+	Content   tocNcxContent    `xml:"content"`
+	Children  []tocNcxNavPoint `xml:"navPoint,omitempty"`
 }
 
 // Constructor for toc
@@ -104,6 +153,19 @@ func newToc() *toc {
 	t := &toc{}
 
 	t.navXML = newTocNavXML()
+	t.navHeading = tocNavHeading
+	t.navXML.H1 = tocNavHeading
+
+	t.pageListXML = &tocNavHiddenList{
+		EpubType: tocNavPageListEpubType,
+		Hidden:   tocNavHidden,
+		H2:       tocNavPageListHeading,
+	}
+	t.landmarksXML = &tocNavHiddenList{
+		EpubType: tocNavLandmarksEpubType,
+		Hidden:   tocNavHidden,
+		H2:       tocNavLandmarksHeading,
+	}
 
 	t.ncxXML = newTocNcxXML()
 
@@ -147,27 +209,130 @@ func newTocNcxXML() *tocNcxRoot {
 	return n
 }
 
-// Add a section to the TOC (navXML as well as ncxXML)
-func (t *toc) addSection(index int, title string, relativePath string) {
+// Add a section to the TOC (navXML as well as ncxXML). If the path of a parent
+// section that's already in the TOC is provided, the section will be nested
+// under it; otherwise it will be added at the top level.
+func (t *toc) addSection(index int, title string, relativePath string, parentRelativePath string) {
+	t.addEntry("navPoint-"+strconv.Itoa(index), title, relativePath, parentRelativePath)
+}
+
+// Add a heading within a section to the TOC, nested under the entry of the
+// section or of another heading
+func (t *toc) addHeading(sectionIndex int, headingIndex int, title string, relativePath string, parentRelativePath string) {
+	t.addEntry(fmt.Sprintf("navPoint-%d-%d", sectionIndex, headingIndex), title, relativePath, parentRelativePath)
+}
+
+func (t *toc) addEntry(navPointID string, title string, relativePath string, parentRelativePath string) {
 	relativePath = filepath.ToSlash(relativePath)
+	parentRelativePath = filepath.ToSlash(parentRelativePath)
 	l := &tocNavItem{
 		A: tocNavLink{
 			Href: relativePath,
 			Data: title,
 		},
 	}
-	t.navXML.Links = append(t.navXML.Links, *l)
-
+	t.sectionCount++
 	np := &tocNcxNavPoint{
-		ID:   "navPoint-" + strconv.Itoa(index),
-		Text: title,
+		ID:        navPointID,
+		PlayOrder: t.sectionCount,
+		Text:      title,
 		Content: tocNcxContent{
 			Src: relativePath,
 		},
 	}
+
+	if parentRelativePath != "" {
+		parentLink := findTocNavItem(t.navXML.Links, parentRelativePath)
+		parentNavPoint := findTocNcxNavPoint(t.ncxXML.NavMap, parentRelativePath)
+		if parentLink != nil && parentNavPoint != nil {
+			if parentLink.Children == nil {
+				parentLink.Children = &tocNavList{}
+			}
+			parentLink.Children.Links = append(parentLink.Children.Links, *l)
+			parentNavPoint.Children = append(parentNavPoint.Children, *np)
+			return
+		}
+	}
+
+	t.navXML.Links = append(t.navXML.Links, *l)
 	t.ncxXML.NavMap = append(t.ncxXML.NavMap, *np)
 }
 
+// Add a landmark to the landmarks nav
+func (t *toc) addLandmark(epubType string, title string, relativePath string) {
+	l := &tocNavHiddenItem{
+		A: tocNavHiddenLink{
+			EpubType: epubType,
+			Href:     filepath.ToSlash(relativePath),
+			Data:     title,
+		},
+	}
+	t.landmarksXML.Links = append(t.landmarksXML.Links, *l)
+}
+
+// Add a page to the page list nav
+func (t *toc) addPage(pageName string, relativePath string) {
+	p := &tocNavHiddenItem{
+		A: tocNavHiddenLink{
+			Href: filepath.ToSlash(relativePath),
+			Data: pageName,
+		},
+	}
+	t.pageListXML.Links = append(t.pageListXML.Links, *p)
+}
+
+// Make a copy of the TOC that can be changed without changing the original. The
+// entries aren't copied since they're added each time the EPUB is written.
+func (t *toc) copy() *toc {
+	r := newToc()
+	r.setIdentifier(t.ncxXML.Meta.Content)
+	r.setTitle(t.title)
+	r.setHeadings(t.navHeading, t.landmarksXML.H2, t.pageListXML.H2)
+	r.setNavTitle(t.navTitle)
+
+	return r
+}
+
+// Remove the entries added to the TOC the last time the EPUB was written
+func (t *toc) clearEntries() {
+	t.landmarksXML.Links = nil
+	t.navXML.Links = nil
+	t.pageListXML.Links = nil
+	t.ncxXML.NavMap = nil
+	t.sectionCount = 0
+}
+
+// Find the nav item linking to the given path, searching nested items as well
+func findTocNavItem(items []tocNavItem, href string) *tocNavItem {
+	for i := range items {
+		if items[i].A.Href == href {
+			return &items[i]
+		}
+		if items[i].Children != nil {
+			if item := findTocNavItem(items[i].Children.Links, href); item != nil {
+				return item
+			}
+		}
+	}
+
+	return nil
+}
+
+// Find the NCX navPoint pointing to the given path, searching nested navPoints
+// as well
+func findTocNcxNavPoint(navPoints []tocNcxNavPoint, src string) *tocNcxNavPoint {
+	for i := range navPoints {
+		if navPoints[i].Content.Src == src {
+			return &navPoints[i]
+		}
+		if navPoint := findTocNcxNavPoint(navPoints[i].Children, src); navPoint != nil {
+			return navPoint
+		}
+	}
+
+	return nil
+}
+
 func (t *toc) setIdentifier(identifier string) {
 	t.ncxXML.Meta.Content = identifier
 }
@@ -176,15 +341,29 @@ func (t *toc) setTitle(title string) {
 	t.title = title
 }
 
-// Write the TOC files
-func (t *toc) write(fs afero.Fs, tempDir string) {
-	t.writeNavDoc(fs, tempDir)
-	t.writeNcxDoc(fs, tempDir)
+func (t *toc) setNavTitle(title string) {
+	t.navTitle = title
+	if title == "" {
+		t.navXML.H1 = t.navHeading
+	} else {
+		t.navXML.H1 = title
+	}
+}
+
+// Set the default headings of the EPUB v3 TOC file, the landmarks, and the page
+// list
+func (t *toc) setHeadings(navHeading string, landmarksHeading string, pageListHeading string) {
+	t.navHeading = navHeading
+	if t.navTitle == "" {
+		t.navXML.H1 = navHeading
+	}
+	t.landmarksXML.H2 = landmarksHeading
+	t.pageListXML.H2 = pageListHeading
 }
 
 // Write the the EPUB v3 TOC file (nav.xhtml) to the temporary directory
-func (t *toc) writeNavDoc(fs afero.Fs, tempDir string) {
-	navBodyContent, err := xml.MarshalIndent(t.navXML, "    ", "  ")
+func (t *toc) writeNavDoc(fs afero.Fs, contentDir string, minify bool) {
+	navBodyContent, err := marshalXML(t.navXML, "    ", minify)
 	if err != nil {
 		panic(fmt.Sprintf(
 			"Error marshalling XML for EPUB v3 TOC file: %s\n"+
@@ -193,19 +372,42 @@ func (t *toc) writeNavDoc(fs afero.Fs, tempDir string) {
 			t.navXML))
 	}
 
+	for _, hiddenList := range []*tocNavHiddenList{t.pageListXML, t.landmarksXML} {
+		if len(hiddenList.Links) == 0 {
+			continue
+		}
+		hiddenListContent, err := marshalXML(hiddenList, "    ", minify)
+		if err != nil {
+			panic(fmt.Sprintf(
+				"Error marshalling XML for EPUB v3 TOC %s: %s\n"+
+					"\tXML=%#v",
+				hiddenList.EpubType,
+				err,
+				hiddenList))
+		}
+		if !minify {
+			navBodyContent = append(navBodyContent, '\n')
+		}
+		navBodyContent = append(navBodyContent, hiddenListContent...)
+	}
+
 	n := newXhtml(string(navBodyContent))
 	n.setXmlnsEpub(xmlnsEpub)
-	n.setTitle(t.title)
+	if t.navTitle != "" {
+		n.setTitle(t.navTitle)
+	} else {
+		n.setTitle(t.title)
+	}
 
-	navFilePath := filepath.Join(tempDir, contentFolderName, tocNavFilename)
-	n.write(fs, navFilePath)
+	navFilePath := filepath.Join(contentDir, tocNavFilename)
+	n.write(fs, navFilePath, minify)
 }
 
 // Write the EPUB v2 TOC file (toc.ncx) to the temporary directory
-func (t *toc) writeNcxDoc(fs afero.Fs, tempDir string) {
+func (t *toc) writeNcxDoc(fs afero.Fs, contentDir string, minify bool) {
 	t.ncxXML.Title = t.title
 
-	ncxFileContent, err := xml.MarshalIndent(t.ncxXML, "", "  ")
+	ncxFileContent, err := marshalXML(t.ncxXML, "", minify)
 	if err != nil {
 		panic(fmt.Sprintf(
 			"Error marshalling XML for EPUB v2 TOC file: %s\n"+
@@ -219,7 +421,7 @@ func (t *toc) writeNcxDoc(fs afero.Fs, tempDir string) {
 	// It's generally nice to have files end with a newline
 	ncxFileContent = append(ncxFileContent, "\n"...)
 
-	ncxFilePath := filepath.Join(tempDir, contentFolderName, tocNcxFilename)
+	ncxFilePath := filepath.Join(contentDir, tocNcxFilename)
 	if err := afero.WriteFile(fs, ncxFilePath, []byte(ncxFileContent), filePermissions); err != nil {
 		panic(fmt.Sprintf("Error writing EPUB v2 TOC file: %s", err))
 	}
@@ -0,0 +1,441 @@
+package epub
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// ErrInvalidEpub is wrapped by each of the errors returned by Validate
+var ErrInvalidEpub = errors.New("Invalid EPUB")
+
+// ErrBrokenLinks is returned by Write if link checking is enabled (see
+// SetCheckLinksOnWrite) and any section links to or embeds a file that hasn't
+// been added to the EPUB. The returned error wraps ErrBrokenLinks and lists the
+// broken links.
+var ErrBrokenLinks = errors.New("Broken links")
+
+// ErrInvalidContainer is returned by Write if the container file
+// (META-INF/container.xml) that was written can't be parsed or doesn't point to
+// the package file, since reading systems wouldn't be able to open the EPUB.
+// The returned error wraps ErrInvalidContainer and describes the problem.
+var ErrInvalidContainer = errors.New("Invalid container file")
+
+// ErrVerificationFailed is returned by Write if verification is enabled (see
+// SetVerifyAfterWrite) and the EPUB file that was written is invalid
+var ErrVerificationFailed = errors.New("EPUB verification failed")
+
+// BrokenLink describes a link in a section that doesn't point to anything in the
+// EPUB, as returned by CheckLinks
+type BrokenLink struct {
+	// The internal filename of the section containing the link
+	SectionFilename string
+	// The target of the link as it appears in the section, e.g.
+	// section0002.xhtml#notes
+	Href string
+}
+
+// Prefixes that can be used in meta properties without being declared
+//
+// Spec: http://www.idpf.org/epub/301/spec/epub-publications.html#sec-metadata-reserved-prefixes
+var reservedVocabularyPrefixes = map[string]bool{
+	"a11y":      true,
+	"dcterms":   true,
+	"marc":      true,
+	"media":     true,
+	"msv":       true,
+	"onix":      true,
+	"prism":     true,
+	"rendition": true,
+	"schema":    true,
+	"xsd":       true,
+}
+
+// This is used to find the package file in the container file
+type verifyContainer struct {
+	Rootfiles []struct {
+		FullPath string `xml:"full-path,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+// Make sure the container file that was written to the temp directory parses
+// and points to the package file that was written
+func (e *Epub) checkContainerFile(tempDir string) error {
+	containerFilePath := path.Join(metaInfFolderName, containerFilename)
+	contents, err := afero.ReadFile(e.fs, filepath.Join(tempDir, filepath.FromSlash(containerFilePath)))
+	if err != nil {
+		panic(fmt.Sprintf("Error reading container file: %s", err))
+	}
+	c := &verifyContainer{}
+	if err := xml.Unmarshal(contents, c); err != nil {
+		return fmt.Errorf("%w: unable to parse %s: %s", ErrInvalidContainer, containerFilePath, err)
+	}
+	if len(c.Rootfiles) == 0 {
+		return fmt.Errorf("%w: %s doesn't contain a rootfile", ErrInvalidContainer, containerFilePath)
+	}
+
+	pkgFilePath := path.Join(e.contentFolder, e.packageFilename)
+	for _, rootfile := range c.Rootfiles {
+		if rootfile.FullPath != pkgFilePath {
+			return fmt.Errorf("%w: %s points to %s, but the package file was written to %s", ErrInvalidContainer, containerFilePath, rootfile.FullPath, pkgFilePath)
+		}
+	}
+
+	return nil
+}
+
+// Reopen the EPUB file at the given path and make sure it's structurally sound
+func (e *Epub) verifyEpub(epubFilePath string) error {
+	f, err := e.fs.Open(epubFilePath)
+	if err != nil {
+		return fmt.Errorf("%w: unable to open EPUB file: %s", ErrVerificationFailed, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("%w: unable to stat EPUB file: %s", ErrVerificationFailed, err)
+	}
+
+	r, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		return fmt.Errorf("%w: unable to read zip archive: %s", ErrVerificationFailed, err)
+	}
+
+	// The mimetype file must be first and uncompressed
+	if len(r.File) == 0 || r.File[0].Name != mimetypeFilename {
+		return fmt.Errorf("%w: %s is not the first file in the archive", ErrVerificationFailed, mimetypeFilename)
+	}
+	if r.File[0].Method != zip.Store {
+		return fmt.Errorf("%w: %s is compressed", ErrVerificationFailed, mimetypeFilename)
+	}
+	mimetype, err := readZipFile(r.File[0])
+	if err != nil {
+		return fmt.Errorf("%w: unable to read %s: %s", ErrVerificationFailed, mimetypeFilename, err)
+	}
+	if string(mimetype) != mediaTypeEpub {
+		return fmt.Errorf("%w: %s contains %q", ErrVerificationFailed, mimetypeFilename, mimetype)
+	}
+
+	files := make(map[string]*zip.File)
+	for _, zf := range r.File {
+		files[zf.Name] = zf
+	}
+
+	// Find the package file using the container file
+	containerFilePath := path.Join(metaInfFolderName, containerFilename)
+	zf, ok := files[containerFilePath]
+	if !ok {
+		return fmt.Errorf("%w: %s is missing", ErrVerificationFailed, containerFilePath)
+	}
+	contents, err := readZipFile(zf)
+	if err != nil {
+		return fmt.Errorf("%w: unable to read %s: %s", ErrVerificationFailed, containerFilePath, err)
+	}
+	c := &verifyContainer{}
+	if err := xml.Unmarshal(contents, c); err != nil {
+		return fmt.Errorf("%w: unable to parse %s: %s", ErrVerificationFailed, containerFilePath, err)
+	}
+	if len(c.Rootfiles) == 0 {
+		return fmt.Errorf("%w: %s doesn't contain a rootfile", ErrVerificationFailed, containerFilePath)
+	}
+
+	// Make sure the package file parses
+	pkgFilePath := c.Rootfiles[0].FullPath
+	zf, ok = files[pkgFilePath]
+	if !ok {
+		return fmt.Errorf("%w: package file %s is missing", ErrVerificationFailed, pkgFilePath)
+	}
+	contents, err = readZipFile(zf)
+	if err != nil {
+		return fmt.Errorf("%w: unable to read %s: %s", ErrVerificationFailed, pkgFilePath, err)
+	}
+	p := &pkgRoot{}
+	if err := xml.Unmarshal(contents, p); err != nil {
+		return fmt.Errorf("%w: unable to parse %s: %s", ErrVerificationFailed, pkgFilePath, err)
+	}
+
+	return nil
+}
+
+// Read the contents of a file in a zip archive
+func readZipFile(zf *zip.File) ([]byte, error) {
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return ioutil.ReadAll(rc)
+}
+
+// Validate checks the EPUB for common mistakes that would make the written EPUB
+// file invalid, such as media files that no longer exist, stylesheets or
+// scripts that haven't been added, a cover image that hasn't been added, broken
+// links (see CheckLinks), files whose internal filenames are the same, and meta
+// properties whose prefix hasn't been declared (see AddVocabularyPrefix). It
+// returns an error wrapping ErrInvalidEpub for each problem found, or nil if
+// there aren't any.
+//
+// Validate doesn't write the EPUB, so it's much faster than a full validator
+// such as epubcheck. Media files whose source is a URL aren't retrieved.
+func (e *Epub) Validate() []error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	var errs []error
+	invalid := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf("%w: %s", ErrInvalidEpub, fmt.Sprintf(format, a...)))
+	}
+
+	if e.lang == "" {
+		invalid("the language isn't set")
+	}
+
+	// Every file is listed in the package file with its internal filename as its
+	// ID, so the internal filenames must be unique
+	ids := map[string]bool{
+		tocNavItemID:                     true,
+		tocNcxItemID:                     true,
+		e.pkg.xml.Metadata.Identifier.ID: true,
+	}
+	for _, section := range e.sections {
+		if ids[section.filename] {
+			invalid("the internal filename %s is used more than once", section.filename)
+		}
+		ids[section.filename] = true
+	}
+
+	media := e.mediaFolders()
+	folderNames := make([]string, 0, len(media))
+	for folderName := range media {
+		folderNames = append(folderNames, folderName)
+	}
+	sort.Strings(folderNames)
+	for _, folderName := range folderNames {
+		filenames := make([]string, 0, len(media[folderName]))
+		for filename := range media[folderName] {
+			filenames = append(filenames, filename)
+		}
+		sort.Strings(filenames)
+
+		for _, filename := range filenames {
+			internalPath := path.Join(folderName, filename)
+			if ids[filename] {
+				invalid("the internal filename %s is used more than once", filename)
+			}
+			ids[filename] = true
+
+			if e.mediaType(folderName, filename) == "" {
+				invalid("the media type of %s is unknown", internalPath)
+			}
+			source := media[folderName][filename]
+			if _, ok := e.mediaData[internalPath]; ok {
+				continue
+			}
+			if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") && !e.isFileSourceValid(source) {
+				invalid("the source of %s doesn't exist: %s", internalPath, source)
+			}
+		}
+	}
+
+	if e.cover.imageFilename != "" {
+		if _, ok := e.images[e.cover.imageFilename]; !ok {
+			invalid("the cover image %s hasn't been added", path.Join(ImageFolderName, e.cover.imageFilename))
+		}
+	}
+
+	for _, section := range e.sections {
+		var paths []string
+		for _, link := range section.xhtml.xml.Head.Links {
+			paths = append(paths, link.Href)
+		}
+		for _, script := range section.xhtml.xml.Head.Scripts {
+			paths = append(paths, script.Src)
+		}
+
+		for _, p := range paths {
+			// Paths are relative to the section files
+			internalPath := path.Join(xhtmlFolderName, p)
+			folderName, filename := path.Split(internalPath)
+			if _, ok := media[path.Clean(folderName)][filename]; !ok {
+				invalid("%s links to %s, which hasn't been added", section.filename, p)
+			}
+		}
+	}
+
+	for _, brokenLink := range e.checkLinks() {
+		invalid("%s links to %s, which doesn't exist", brokenLink.SectionFilename, brokenLink.Href)
+	}
+
+	for _, landmark := range e.landmarks {
+		if _, ok := e.landmarkPath(landmark.target); !ok {
+			invalid("the target of the landmark %q doesn't exist: %s", landmark.title, landmark.target)
+		}
+	}
+
+	declaredPrefixes := make(map[string]bool)
+	for _, p := range e.vocabularyPrefixes {
+		declaredPrefixes[p.prefix] = true
+	}
+	for _, meta := range e.pkg.xml.Metadata.Meta {
+		i := strings.Index(meta.Property, ":")
+		if i == -1 {
+			continue
+		}
+		prefix := meta.Property[:i]
+		if !reservedVocabularyPrefixes[prefix] && !declaredPrefixes[prefix] {
+			invalid("the prefix of the meta property %s hasn't been declared", meta.Property)
+		}
+	}
+
+	return errs
+}
+
+// Get the media files by the name of the folder they're stored in
+func (e *Epub) mediaFolders() map[string]map[string]string {
+	return map[string]map[string]string{
+		AudioFolderName:      e.audios,
+		CSSFolderName:        e.css,
+		FontFolderName:       e.fonts,
+		ImageFolderName:      e.images,
+		JavaScriptFolderName: e.javaScripts,
+		VideoFolderName:      e.videos,
+	}
+}
+
+// CheckLinks checks the links (<a href>) and references to other files, such as
+// images (<img src>), audio, and video, in each section and returns the ones
+// that don't point to a section, anchor, or media file that has been added to
+// the EPUB. Links to other sites, such as http links, aren't checked. Broken
+// links are also reported by Validate, and can make Write fail (see
+// SetCheckLinksOnWrite).
+func (e *Epub) CheckLinks() []BrokenLink {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.checkLinks()
+}
+
+// SetCheckLinksOnWrite sets whether Write checks the links in each section
+// before writing the EPUB, the same way as CheckLinks. If any links are broken,
+// such as an image that's referenced by a section but was never added with
+// AddImage, Write returns an error wrapping ErrBrokenLinks and doesn't write the
+// EPUB. This is off by default.
+func (e *Epub) SetCheckLinksOnWrite(check bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.checkLinksOnWrite = check
+}
+
+// Find the broken links without locking the Epub
+func (e *Epub) checkLinks() []BrokenLink {
+	var brokenLinks []BrokenLink
+
+	refs := make(map[string]xhtmlReferences)
+	for _, section := range e.sections {
+		refs[section.filename] = e.sectionReferences(section)
+	}
+	media := e.mediaFolders()
+
+	for _, section := range e.sections {
+		for _, href := range refs[section.filename].links {
+			u, err := url.Parse(href)
+			if err != nil {
+				brokenLinks = append(brokenLinks, BrokenLink{section.filename, href})
+				continue
+			}
+			// Only check links to files in the EPUB
+			if u.Scheme != "" || u.Host != "" {
+				continue
+			}
+
+			ok := false
+			// Paths are relative to the section files
+			targetPath := path.Join(xhtmlFolderName, u.Path)
+			folderName, filename := path.Split(targetPath)
+			switch {
+			case u.Path == "":
+				ok = refs[section.filename].ids[u.Fragment]
+			case path.Clean(folderName) == xhtmlFolderName:
+				target, isSection := refs[filename]
+				ok = isSection && (u.Fragment == "" || target.ids[u.Fragment])
+			case targetPath == tocNavFilename:
+				ok = true
+			default:
+				_, ok = media[path.Clean(folderName)][filename]
+			}
+			if !ok {
+				brokenLinks = append(brokenLinks, BrokenLink{section.filename, href})
+			}
+		}
+	}
+
+	return brokenLinks
+}
+
+// The links and IDs in an XHTML document
+type xhtmlReferences struct {
+	// The targets of links and references to other files in the order they
+	// appear
+	links []string
+	ids   map[string]bool
+}
+
+// Attributes that refer to another file or an anchor
+var xhtmlReferenceAttrs = map[string]bool{
+	"data":   true,
+	"href":   true,
+	"poster": true,
+	"src":    true,
+}
+
+// Find the links and IDs in the section, including the anchors of the page
+// breaks that are added when the EPUB is written
+func (e *Epub) sectionReferences(section epubSection) xhtmlReferences {
+	refs := xhtmlReferences{
+		ids: make(map[string]bool),
+	}
+	for _, marker := range section.pageMarkers {
+		refs.ids[marker.anchorID] = true
+	}
+
+	d := xml.NewDecoder(strings.NewReader(section.xhtml.body()))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	for {
+		t, err := d.Token()
+		if err != nil {
+			// Stop at the end of the document, or where it's too malformed to read
+			break
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		for _, attr := range se.Attr {
+			switch {
+			case attr.Name.Local == "id":
+				refs.ids[attr.Value] = true
+			// Links, images, audio, video, etc. The href attribute also matches
+			// xlink:href, which is used by SVG images.
+			case xhtmlReferenceAttrs[attr.Name.Local]:
+				refs.links = append(refs.links, attr.Value)
+			}
+		}
+	}
+
+	return refs
+}
@@ -2,14 +2,19 @@ package epub
 
 import (
 	"archive/zip"
+	"compress/flate"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"html"
 	"io"
-	"net/http"
-	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/spf13/afero"
 )
@@ -19,14 +24,41 @@ import (
 var ErrUnableToCreateEpub = errors.New("Unable to create EPUB file")
 
 var extensionMediaTypes = map[string]string{
-	".css":  mediaTypeCSS,
-	".gif":  "image/gif",
-	".jpeg": mediaTypeJpeg,
-	".jpg":  mediaTypeJpeg,
-	".otf":  "application/x-font-otf",
-	".png":  "image/png",
-	".svg":  "image/svg+xml",
-	".ttf":  "application/x-font-ttf",
+	".m4a":   "audio/mp4",
+	".m4v":   "video/mp4",
+	".mp3":   "audio/mpeg",
+	".mp4":   "video/mp4",
+	".oga":   "audio/ogg",
+	".ogg":   "audio/ogg",
+	".webm":  "video/webm",
+	".css":   mediaTypeCSS,
+	".gif":   "image/gif",
+	".js":    mediaTypeJavaScript,
+	".jpeg":  mediaTypeJpeg,
+	".jpg":   mediaTypeJpeg,
+	".otf":   "application/x-font-otf",
+	".png":   "image/png",
+	".svg":   "image/svg+xml",
+	".ttf":   "application/x-font-ttf",
+	".webp":  "image/webp",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+}
+
+// Media types that are already compressed, so they're stored in the EPUB
+// without compression to save time
+var incompressibleMediaTypes = map[string]bool{
+	"audio/mp4":   true,
+	"audio/mpeg":  true,
+	"audio/ogg":   true,
+	"video/mp4":   true,
+	"video/webm":  true,
+	"font/woff":   true,
+	"font/woff2":  true,
+	"image/gif":   true,
+	mediaTypeJpeg: true,
+	"image/png":   true,
+	"image/webp":  true,
 }
 
 const (
@@ -45,22 +77,113 @@ const (
 	// Permissions for any new directories we create
 	dirPermissions = 0755
 	// Permissions for any new files we create
-	filePermissions   = 0644
-	mediaTypeCSS      = "text/css"
-	mediaTypeEpub     = "application/epub+zip"
-	mediaTypeJpeg     = "image/jpeg"
-	mediaTypeNcx      = "application/x-dtbncx+xml"
-	mediaTypeXhtml    = "application/xhtml+xml"
-	metaInfFolderName = "META-INF"
-	mimetypeFilename  = "mimetype"
-	pkgFilename       = "package.opf"
-	tempDirPrefix     = "go-epub"
-	xhtmlFolderName   = "xhtml"
+	filePermissions = 0644
+	// The landmark type of the start of the text
+	landmarkBodymatter   = "bodymatter"
+	mediaTypeAudioPrefix = "audio/"
+	mediaTypeCSS         = "text/css"
+	mediaTypeEpub        = "application/epub+zip"
+	mediaTypeJavaScript  = "application/javascript"
+	mediaTypeJpeg        = "image/jpeg"
+	mediaTypeNcx         = "application/x-dtbncx+xml"
+	mediaTypeOctetStream = "application/octet-stream"
+	mediaTypeVideoPrefix = "video/"
+	mediaTypeXhtml       = "application/xhtml+xml"
+	metaInfFolderName    = "META-INF"
+	mimetypeFilename     = "mimetype"
+	pkgFileExt           = ".opf"
+	pkgFilename          = "package.opf"
+	tempDirPrefix        = "go-epub"
+	xhtmlFolderName      = "xhtml"
 )
 
+// The modification time used for deterministic EPUBs (see SetDeterministic),
+// which is the earliest time that can be stored in a zip file
+var deterministicModTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
 // Write writes the EPUB file. The destination path must be the full path to
 // the resulting file, including filename and extension.
 func (e *Epub) Write(destFilePath string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.writeFiles(func(tempDir string) error {
+		err := e.writeEpub(tempDir, destFilePath)
+		if err != nil {
+			return err
+		}
+
+		// Must be called last
+		if e.verifyAfterWrite {
+			err = e.verifyEpub(destFilePath)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// WriteToZip writes the files of the EPUB to the zip writer, e.g. to compose
+// an EPUB inside a larger archive. The zip writer isn't closed, so the caller
+// stays in control of it.
+//
+// The mimetype file must be the first entry of an EPUB file, so the zip writer
+// must not have any entries yet. If a compression level other than the default
+// has been set (see SetCompressionLevel), a compressor for that level is
+// registered with the zip writer. Verification (see SetVerifyAfterWrite) isn't
+// done since the zip file isn't complete until the caller closes it.
+func (e *Epub) WriteToZip(zw *zip.Writer) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.writeFiles(func(tempDir string) error {
+		return e.addFilesToZip(tempDir, zw)
+	})
+}
+
+// PackageDocument returns the package file (package.opf) as Write would write
+// it with the current metadata, manifest, and spine, e.g. to check the metadata
+// without extracting the EPUB file. The other files of the EPUB are still
+// generated in a temp directory since the manifest depends on them, so the same
+// errors as Write can be returned, but no EPUB file is written. The modified
+// date is the current time unless the EPUB is deterministic (see
+// SetDeterministic).
+func (e *Epub) PackageDocument() (string, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	var contents []byte
+	err := e.writeFiles(func(tempDir string) error {
+		var err error
+		contents, err = afero.ReadFile(e.fs, filepath.Join(tempDir, e.contentFolder, e.packageFilename))
+		if err != nil {
+			panic(fmt.Sprintf("Error reading package file: %s", err))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return string(contents), nil
+}
+
+// Write the files of the EPUB to a temp directory and call the given function
+// to create the EPUB file from them, removing the temp directory afterwards
+func (e *Epub) writeFiles(writeArchive func(tempDir string) error) error {
+	// Check the links first so that nothing is written if any are broken
+	if e.checkLinksOnWrite {
+		if brokenLinks := e.checkLinks(); len(brokenLinks) > 0 {
+			descriptions := make([]string, len(brokenLinks))
+			for i, brokenLink := range brokenLinks {
+				descriptions[i] = fmt.Sprintf("%s links to %s", brokenLink.SectionFilename, brokenLink.Href)
+			}
+			return fmt.Errorf("%w: %s", ErrBrokenLinks, strings.Join(descriptions, ", "))
+		}
+	}
+
 	tempDir, err := afero.TempDir(e.fs, "", tempDirPrefix)
 	defer func() {
 		if err := e.fs.RemoveAll(tempDir); err != nil {
@@ -71,6 +194,21 @@ func (e *Epub) Write(destFilePath string) error {
 		panic(fmt.Sprintf("Error creating temp directory: %s", err))
 	}
 
+	// The manifest, spine, guide, and TOC entries are generated from the contents
+	// of the EPUB, so clear out any entries left over from a previous call to
+	// Write
+	e.pkg.clearManifestSpineAndGuide()
+	e.toc.clearEntries()
+	e.streamedFiles = make(map[string]epubStreamedFile)
+
+	// EPUB 2 reading systems find the cover image using a meta element, which is
+	// also added to EPUB 3 files since many reading systems still rely on it
+	if e.cover.imageFilename != "" {
+		e.pkg.setCover(e.cover.imageFilename)
+	} else {
+		e.pkg.setCover("")
+	}
+
 	e.writeMimetype(tempDir)
 	e.createEpubFolders(tempDir)
 
@@ -78,6 +216,13 @@ func (e *Epub) Write(destFilePath string) error {
 	// createEpubFolders()
 	e.writeContainerFile(tempDir)
 
+	// Must be called after:
+	// createEpubFolders()
+	err = e.writeAudios(tempDir)
+	if err != nil {
+		return err
+	}
+
 	// Must be called after:
 	// createEpubFolders()
 	err = e.writeCSSFiles(tempDir)
@@ -92,6 +237,10 @@ func (e *Epub) Write(destFilePath string) error {
 		return err
 	}
 
+	// Must be called after:
+	// createEpubFolders()
+	e.writeEncryptionFile(tempDir)
+
 	// Must be called after:
 	// createEpubFolders()
 	err = e.writeImages(tempDir)
@@ -99,6 +248,20 @@ func (e *Epub) Write(destFilePath string) error {
 		return err
 	}
 
+	// Must be called after:
+	// createEpubFolders()
+	err = e.writeJavaScripts(tempDir)
+	if err != nil {
+		return err
+	}
+
+	// Must be called after:
+	// createEpubFolders()
+	err = e.writeVideos(tempDir)
+	if err != nil {
+		return err
+	}
+
 	// Must be called after:
 	// createEpubFolders()
 	e.writeSections(tempDir)
@@ -110,19 +273,25 @@ func (e *Epub) Write(destFilePath string) error {
 
 	// Must be called after:
 	// createEpubFolders()
+	// writeAudios()
 	// writeCSSFiles()
 	// writeImages()
+	// writeJavaScripts()
+	// writeVideos()
 	// writeSections()
 	// writeToc()
 	e.writePackageFile(tempDir)
 
-	// Must be called last
-	err = e.writeEpub(tempDir, destFilePath)
+	// Must be called after:
+	// writeContainerFile()
+	// writePackageFile()
+	err = e.checkContainerFile(tempDir)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	// Must be called after all other files have been written
+	return writeArchive(tempDir)
 }
 
 // Create the EPUB folder structure in a temp directory
@@ -130,7 +299,7 @@ func (e *Epub) createEpubFolders(tempDir string) {
 	if err := e.fs.Mkdir(
 		filepath.Join(
 			tempDir,
-			contentFolderName,
+			e.contentFolder,
 		),
 		dirPermissions); err != nil {
 		// No reason this should happen if tempDir creation was successful
@@ -140,7 +309,7 @@ func (e *Epub) createEpubFolders(tempDir string) {
 	if err := e.fs.Mkdir(
 		filepath.Join(
 			tempDir,
-			contentFolderName,
+			e.contentFolder,
 			xhtmlFolderName,
 		),
 		dirPermissions); err != nil {
@@ -157,6 +326,11 @@ func (e *Epub) createEpubFolders(tempDir string) {
 	}
 }
 
+// Get audio files from their source and save them in the temporary directory
+func (e *Epub) writeAudios(tempDir string) error {
+	return e.writeMedia(tempDir, e.audios, AudioFolderName)
+}
+
 // Write the contatiner file (container.xml), which mostly just points to the
 // package file (package.opf)
 //
@@ -170,8 +344,9 @@ func (e *Epub) writeContainerFile(tempDir string) {
 		[]byte(
 			fmt.Sprintf(
 				containerFileTemplate,
-				contentFolderName,
-				pkgFilename,
+				// Names such as "A&B" need to be escaped
+				escapeXMLText(e.contentFolder),
+				escapeXMLText(e.packageFilename),
 			),
 		),
 		filePermissions,
@@ -183,15 +358,7 @@ func (e *Epub) writeContainerFile(tempDir string) {
 // Write the CSS files to the temporary directory and add them to the package
 // file
 func (e *Epub) writeCSSFiles(tempDir string) error {
-	err := e.writeMedia(tempDir, e.css, CSSFolderName)
-	if err != nil {
-		return err
-	}
-
-	// Clean up the cover temp file if one was created
-	e.fs.Remove(e.cover.cssTempFile)
-
-	return nil
+	return e.writeMedia(tempDir, e.css, CSSFolderName)
 }
 
 // Write the EPUB file itself by zipping up everything from a temp directory
@@ -206,15 +373,120 @@ func (e *Epub) writeEpub(tempDir string, destFilePath string) error {
 		}
 	}()
 
-	z := zip.NewWriter(f)
+	if e.spoolThreshold > 0 && e.contentSize(tempDir) > e.spoolThreshold {
+		return e.writeSpooledZip(tempDir, f)
+	}
+
+	return e.writeZip(tempDir, f)
+}
+
+// Write the zip file with everything from a temp directory
+func (e *Epub) writeZip(tempDir string, w io.Writer) error {
+	z := zip.NewWriter(w)
 	defer func() {
 		if err := z.Close(); err != nil {
 			panic(err)
 		}
 	}()
 
+	return e.addFilesToZip(tempDir, z)
+}
+
+// Write the zip file to a temp file on the spool filesystem and then copy it,
+// so that it isn't built up in memory if the EPUB uses an in-memory filesystem
+// (see SetSpoolThreshold)
+func (e *Epub) writeSpooledZip(tempDir string, w io.Writer) error {
+	spoolFs := e.spoolFs
+	if spoolFs == nil {
+		spoolFs = afero.NewOsFs()
+	}
+	spoolFile, err := afero.TempFile(spoolFs, "", tempDirPrefix)
+	if err != nil {
+		panic(fmt.Sprintf("Error creating spool file: %s", err))
+	}
+	defer func() {
+		if err := spoolFile.Close(); err != nil {
+			panic(err)
+		}
+		if err := spoolFs.Remove(spoolFile.Name()); err != nil {
+			panic(fmt.Sprintf("Error removing spool file: %s", err))
+		}
+	}()
+
+	err = e.writeZip(tempDir, spoolFile)
+	if err != nil {
+		return err
+	}
+
+	if _, err := spoolFile.Seek(0, io.SeekStart); err != nil {
+		panic(fmt.Sprintf("Error reading spool file: %s", err))
+	}
+	if _, err := io.Copy(w, spoolFile); err != nil {
+		return ErrUnableToCreateEpub
+	}
+
+	return nil
+}
+
+// Get the total size of the files of the EPUB in a temp directory, including
+// the local media files that are added straight from their sources
+func (e *Epub) contentSize(tempDir string) int64 {
+	var size int64
+	err := afero.Walk(e.fs, tempDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return err
+	})
+	if err != nil {
+		panic(fmt.Sprintf("Unable to measure files being added to EPUB: %s", err))
+	}
+
+	for _, streamedFile := range e.streamedFiles {
+		if info, err := e.fs.Stat(streamedFile.source); err == nil {
+			size += info.Size()
+		}
+	}
+
+	return size
+}
+
+// Add everything from a temp directory to the zip file, starting with the
+// mimetype file. The Epub must be locked, but it's unlocked while the write
+// progress function is called (see SetWriteProgress).
+func (e *Epub) addFilesToZip(tempDir string, z *zip.Writer) error {
+	// The Epub can be changed while it's unlocked, so keep what's needed to add
+	// the files as it was when they were written to the temp directory
+	compressionLevel := e.compressionLevel
+	contentFolder := e.contentFolder
+	deterministic := e.deterministic
+	identifier := e.identifier
+	streamedFiles := e.streamedFiles
+	writeProgress := e.writeProgress
+
+	if compressionLevel != CompressionLevelDefault && compressionLevel != CompressionLevelStore {
+		z.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, compressionLevel)
+		})
+	}
+
 	skipMimetypeFile := false
 
+	// Count the files up front so that progress can be reported as a fraction
+	totalFiles := 0
+	writtenFiles := 0
+	if writeProgress != nil {
+		err := afero.Walk(e.fs, tempDir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				totalFiles++
+			}
+			return err
+		})
+		if err != nil {
+			panic(fmt.Sprintf("Unable to count files being added to EPUB: %s", err))
+		}
+	}
+
 	var addFileToZip = func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -233,27 +505,50 @@ func (e *Epub) writeEpub(tempDir string, destFilePath string) error {
 			return nil
 		}
 
-		var w io.Writer
+		header := &zip.FileHeader{
+			Name:   relativePath,
+			Method: zip.Deflate,
+		}
+		mediaFolderName, mediaFilename := filepath.Split(strings.TrimPrefix(relativePath, contentFolder+"/"))
+		mediaType := e.mediaType(strings.TrimSuffix(mediaFolderName, "/"), mediaFilename)
+		if compressionLevel == CompressionLevelStore || incompressibleMediaTypes[mediaType] {
+			header.Method = zip.Store
+		}
 		if path == filepath.Join(tempDir, mimetypeFilename) {
 			// Skip the mimetype file if it's already been written
 			if skipMimetypeFile == true {
 				return nil
 			}
 			// The mimetype file must be uncompressed according to the EPUB spec
-			w, err = z.CreateHeader(&zip.FileHeader{
-				Name:   relativePath,
-				Method: zip.Store,
-			})
-		} else {
-			w, err = z.Create(relativePath)
+			header.Method = zip.Store
 		}
+		if deterministic {
+			header.Modified = deterministicModTime
+		}
+
+		w, err := z.CreateHeader(header)
 		if err != nil {
 			panic(fmt.Sprintf("Error creating zip writer: %s", err))
 		}
 
-		r, err := e.fs.Open(path)
-		if err != nil {
-			panic(fmt.Sprintf("Error opening file being added to EPUB: %s", err))
+		// Local media files are copied straight from their source rather than
+		// through the temp directory, which only has a placeholder for them, so
+		// that large files such as audio aren't copied twice
+		streamedFile, streamed := streamedFiles[relativePath]
+		var r io.ReadCloser
+		if streamed {
+			r, err = e.fs.Open(streamedFile.source)
+			if err != nil {
+				return ErrRetrievingFile
+			}
+			if streamedFile.obfuscated {
+				r = newFontObfuscator(r, identifier)
+			}
+		} else {
+			r, err = e.fs.Open(path)
+			if err != nil {
+				panic(fmt.Sprintf("Error opening file being added to EPUB: %s", err))
+			}
 		}
 		defer func() {
 			if err := r.Close(); err != nil {
@@ -263,9 +558,23 @@ func (e *Epub) writeEpub(tempDir string, destFilePath string) error {
 
 		_, err = io.Copy(w, r)
 		if err != nil {
+			if streamed {
+				return ErrRetrievingFile
+			}
 			panic(fmt.Sprintf("Error copying contents of file being added EPUB: %s", err))
 		}
 
+		if writeProgress != nil {
+			writtenFiles++
+			// Unlock the Epub so that the function can call its methods, locking it
+			// again even if the function panics
+			func() {
+				e.mutex.Unlock()
+				defer e.mutex.Lock()
+				writeProgress(writtenFiles, totalFiles)
+			}()
+		}
+
 		return nil
 	}
 
@@ -283,6 +592,9 @@ func (e *Epub) writeEpub(tempDir string, destFilePath string) error {
 	skipMimetypeFile = true
 
 	err = afero.Walk(e.fs, tempDir, addFileToZip)
+	if err == ErrRetrievingFile {
+		return err
+	}
 	if err != nil {
 		panic(fmt.Sprintf("Unable to add file to EPUB: %s", err))
 	}
@@ -300,43 +612,67 @@ func (e *Epub) writeImages(tempDir string) error {
 	return e.writeMedia(tempDir, e.images, ImageFolderName)
 }
 
+// Get JavaScript files from their source and save them in the temporary
+// directory
+func (e *Epub) writeJavaScripts(tempDir string) error {
+	return e.writeMedia(tempDir, e.javaScripts, JavaScriptFolderName)
+}
+
+// Get video files from their source and save them in the temporary directory
+func (e *Epub) writeVideos(tempDir string) error {
+	return e.writeMedia(tempDir, e.videos, VideoFolderName)
+}
+
 // Get images from their source and save them in the temporary directory
 func (e *Epub) writeMedia(tempDir string, mediaMap map[string]string, mediaFolderName string) error {
 	if len(mediaMap) > 0 {
-		mediaFolderPath := filepath.Join(tempDir, contentFolderName, mediaFolderName)
+		mediaFolderPath := filepath.Join(tempDir, e.contentFolder, mediaFolderName)
 		if err := e.fs.Mkdir(mediaFolderPath, dirPermissions); err != nil {
 			panic(fmt.Sprintf("Unable to create directory: %s", err))
 		}
 
-		for mediaFilename, mediaSource := range mediaMap {
-			// Get the media file from the source
-			u, err := url.Parse(mediaSource)
-			if err != nil {
-				return ErrRetrievingFile
+		for _, mediaFilename := range sortedFilenames(mediaMap) {
+			mediaSource := mediaMap[mediaFilename]
+			item := e.mediaManifestItem(mediaFilename, mediaFolderName)
+			if item.MediaType == "" {
+				panic(fmt.Sprintf(
+					"Unmatched file extension, media type not set for file: %s",
+					mediaFilename))
 			}
 
-			var r io.ReadCloser
-			var resp *http.Response
-			// If it's a URL
-			if u.Scheme == "http" || u.Scheme == "https" {
-				resp, err = http.Get(mediaSource)
-				if err != nil {
+			mediaFilePath := filepath.Join(
+				mediaFolderPath,
+				mediaFilename,
+			)
+
+			// Local files are added to the EPUB file straight from their source
+			// (see addFilesToZip), so only make sure they still exist and add a
+			// placeholder in their place
+			_, inMemory := e.mediaData[path.Join(mediaFolderName, mediaFilename)]
+			if !inMemory && isLocalSource(mediaSource) {
+				info, err := e.fs.Stat(mediaSource)
+				if err != nil || info.IsDir() {
 					return ErrRetrievingFile
 				}
-				r = resp.Body
-
-				// Otherwise, assume it's a local file
-			} else {
-				r, err = e.fs.Open(mediaSource)
+				if err := afero.WriteFile(e.fs, mediaFilePath, nil, filePermissions); err != nil {
+					panic(fmt.Sprintf("Unable to create file: %s", err))
+				}
+				e.streamedFiles[path.Join(e.contentFolder, mediaFolderName, mediaFilename)] = epubStreamedFile{
+					obfuscated: e.isObfuscated(mediaFolderName, mediaFilename),
+					source:     mediaSource,
+				}
+				e.pkg.addToManifest(item.ID, item.Href, item.MediaType, item.Properties)
+				continue
 			}
+
+			// Get the media file from memory or from the source
+			r, err := e.openMedia(mediaFolderName, mediaFilename)
 			if err != nil {
 				return ErrRetrievingFile
 			}
-
-			mediaFilePath := filepath.Join(
-				mediaFolderPath,
-				mediaFilename,
-			)
+			if e.isObfuscated(mediaFolderName, mediaFilename) {
+				r = newFontObfuscator(r, e.identifier)
+			}
 
 			// Add the file to the EPUB temp directory
 			w, err := e.fs.Create(mediaFilePath)
@@ -363,27 +699,42 @@ func (e *Epub) writeMedia(tempDir string, mediaMap map[string]string, mediaFolde
 				return ErrRetrievingFile
 			}
 
-			mediaType := extensionMediaTypes[strings.ToLower(filepath.Ext(mediaFilename))]
-			if mediaType == "" {
-				panic(fmt.Sprintf(
-					"Unmatched file extension, media type not set for file: %s",
-					mediaFilename))
-			}
-
-			// The cover image has a special value for the properties attribute
-			mediaProperties := ""
-			if mediaFilename == e.cover.imageFilename {
-				mediaProperties = coverImageProperties
-			}
-
 			// Add the file to the OPF manifest
-			e.pkg.addToManifest(mediaFilename, filepath.Join(mediaFolderName, mediaFilename), mediaType, mediaProperties)
+			e.pkg.addToManifest(item.ID, item.Href, item.MediaType, item.Properties)
 		}
 	}
 
 	return nil
 }
 
+// Get the manifest item of a media file. The media type is empty if it can't
+// be determined from the extension.
+func (e *Epub) mediaManifestItem(mediaFilename string, mediaFolderName string) ManifestItem {
+	item := ManifestItem{
+		ID:        mediaFilename,
+		Href:      filepath.Join(mediaFolderName, mediaFilename),
+		MediaType: e.mediaType(mediaFolderName, mediaFilename),
+	}
+	// The cover image has a special value for the properties attribute
+	if mediaFolderName == ImageFolderName && mediaFilename == e.cover.imageFilename {
+		item.Properties = coverImageProperties
+	}
+
+	return item
+}
+
+// Get the filenames of the media files in sorted order, so that the files are
+// always written in the same order
+func sortedFilenames(mediaMap map[string]string) []string {
+	mediaFilenames := make([]string, 0, len(mediaMap))
+	for mediaFilename := range mediaMap {
+		mediaFilenames = append(mediaFilenames, mediaFilename)
+	}
+	sort.Strings(mediaFilenames)
+
+	return mediaFilenames
+}
+
 // Write the mimetype file
 //
 // Sample: https://github.com/bmaupin/epub-samples/blob/master/minimal-v3plus2/mimetype
@@ -397,49 +748,350 @@ func (e *Epub) writeMimetype(tempDir string) {
 }
 
 func (e *Epub) writePackageFile(tempDir string) {
-	e.pkg.write(e.fs, tempDir)
+	e.pkg.setAccessibility(e.accessModes(), e.accessibilityFeatures, e.accessibilitySummary)
+	e.pkg.write(e.fs, filepath.Join(tempDir, e.contentFolder, e.packageFilename), e.modTime(), e.minifyXML)
+}
+
+// Get the schema.org access modes of the EPUB, inferred from the kinds of
+// content it contains. They're only included if other accessibility metadata
+// has been set, since they don't say much on their own.
+func (e *Epub) accessModes() []string {
+	if len(e.accessibilityFeatures) == 0 && e.accessibilitySummary == "" {
+		return nil
+	}
+
+	accessModes := []string{pkgAccessModeTextual}
+	if len(e.audios) > 0 {
+		accessModes = append(accessModes, pkgAccessModeAuditory)
+	}
+	if len(e.images) > 0 || len(e.videos) > 0 {
+		accessModes = append(accessModes, pkgAccessModeVisual)
+	}
+
+	return accessModes
+}
+
+// Get the time to use as the modified date of the EPUB and its files
+func (e *Epub) modTime() time.Time {
+	if e.deterministic {
+		return deterministicModTime
+	}
+
+	return time.Now()
 }
 
 // Write the section files to the temporary directory and add the sections to
 // the TOC and package files
 func (e *Epub) writeSections(tempDir string) {
-	if len(e.sections) > 0 {
-		// If a cover was set, add it to the package spine first so it shows up
-		// first in the reading order
-		if e.cover.xhtmlFilename != "" {
-			e.pkg.addToSpine(e.cover.xhtmlFilename)
+	var mediaOverlayIDs []string
+	var mediaOverlayDurations []time.Duration
+
+	for i, section := range e.sections {
+		relativePath := filepath.Join(xhtmlFolderName, section.filename)
+		sectionXhtml := e.sectionXhtml(section)
+		for _, marker := range section.pageMarkers {
+			e.toc.addPage(marker.pageName, relativePath+"#"+marker.anchorID)
 		}
 
-		for i, section := range e.sections {
-			// Set the title of the cover page XHTML to the title of the EPUB
-			if section.filename == e.cover.xhtmlFilename {
-				section.xhtml.setTitle(e.Title())
+		sectionFilePath := filepath.Join(tempDir, e.contentFolder, xhtmlFolderName, section.filename)
+		sectionXhtml.write(e.fs, sectionFilePath, e.minifyXML)
+
+		// Don't add pages without titles, the cover, or sections nested deeper
+		// than the TOC depth to the TOC
+		if e.isInToc(section) && e.isWithinTocDepth(e.tocLevel(section)) {
+			parentRelativePath := ""
+			if parentFilename := e.tocParentFilename(section); parentFilename != "" {
+				parentRelativePath = filepath.Join(xhtmlFolderName, parentFilename)
 			}
+			e.toc.addSection(i, section.tocTitle(), relativePath, parentRelativePath)
+			e.addTocHeadings(i, section, sectionXhtml, relativePath)
+		}
+		e.pkg.addToSpine(section.filename, !section.nonLinear, strings.Join(section.spineProperties, " "))
+		item := sectionManifestItem(section)
+		e.pkg.addToManifest(item.ID, item.Href, item.MediaType, item.Properties)
 
-			sectionFilePath := filepath.Join(tempDir, contentFolderName, xhtmlFolderName, section.filename)
-			section.xhtml.write(e.fs, sectionFilePath)
+		// EPUB 2 doesn't support media overlays
+		if section.mediaOverlay != "" && e.version != EpubVersion2 {
+			duration, err := e.mediaOverlayDuration(section.mediaOverlay)
+			if err != nil {
+				// The media overlay was checked when it was added, but the audio
+				// might have been replaced since
+				panic(fmt.Sprintf("Error reading media overlay: %s", err))
+			}
 
-			relativePath := filepath.Join(xhtmlFolderName, section.filename)
-			// Don't add pages without titles or the cover to the TOC
-			if section.xhtml.Title() != "" && section.filename != e.cover.xhtmlFilename {
-				e.toc.addSection(i, section.xhtml.Title(), relativePath)
+			smilFilename := mediaOverlayFilename(section.filename)
+			smilFilePath := filepath.Join(tempDir, e.contentFolder, xhtmlFolderName, smilFilename)
+			if err := afero.WriteFile(e.fs, smilFilePath, []byte(section.mediaOverlay), filePermissions); err != nil {
+				panic(fmt.Sprintf("Error writing media overlay file: %s", err))
 			}
-			// The cover page should have already been added to the spine first
-			if section.filename != e.cover.xhtmlFilename {
-				e.pkg.addToSpine(section.filename)
+			item := mediaOverlayManifestItem(section)
+			e.pkg.addToManifest(item.ID, item.Href, item.MediaType, item.Properties)
+			e.pkg.setMediaOverlay(section.filename, smilFilename)
+
+			mediaOverlayIDs = append(mediaOverlayIDs, smilFilename)
+			mediaOverlayDurations = append(mediaOverlayDurations, duration)
+		}
+	}
+	e.pkg.setMediaDurations(mediaOverlayIDs, mediaOverlayDurations)
+	e.addGuideReferences()
+}
+
+// Add references to the cover page and the start of the text to the guide of
+// the package file
+func (e *Epub) addGuideReferences() {
+	if e.cover.xhtmlFilename != "" {
+		e.pkg.addToGuide(pkgGuideCoverType, e.messages().guideCoverTitle, filepath.Join(xhtmlFolderName, e.cover.xhtmlFilename))
+	}
+
+	// The text starts at the body matter landmark if there is one, otherwise at
+	// the first section in the reading order after the cover
+	for _, landmark := range e.landmarks {
+		if landmark.epubType != landmarkBodymatter {
+			continue
+		}
+		if relativePath, ok := e.landmarkPath(landmark.target); ok {
+			e.pkg.addToGuide(pkgGuideTextType, e.messages().guideTextTitle, relativePath)
+			return
+		}
+	}
+	for _, section := range e.sections {
+		if section.filename != e.cover.xhtmlFilename && !section.nonLinear {
+			e.pkg.addToGuide(pkgGuideTextType, e.messages().guideTextTitle, filepath.Join(xhtmlFolderName, section.filename))
+			return
+		}
+	}
+}
+
+// Get the XHTML of a section as it's written to the EPUB
+func (e *Epub) sectionXhtml(section epubSection) *xhtml {
+	// Set the title of the cover page XHTML to the title of the EPUB
+	if section.filename == e.cover.xhtmlFilename {
+		section.xhtml.setTitle(e.title)
+	}
+
+	if e.version == EpubVersion2 {
+		section.xhtml.setDoctype(xhtmlDoctypeEpub2)
+	} else {
+		section.xhtml.setDoctype(xhtmlDoctype)
+	}
+
+	sectionXhtml := section.xhtml
+	// Page breaks can't be added to raw sections, which are written as-is
+	if len(section.pageMarkers) > 0 && section.xhtml.raw == "" {
+		sectionXhtml = e.addPageBreaks(section)
+	}
+	// Fixed-layout sections need the size of the viewport, which also can't be
+	// added to raw sections
+	if e.fixedLayoutWidth > 0 && e.version != EpubVersion2 && section.xhtml.raw == "" {
+		if sectionXhtml == section.xhtml {
+			sectionXhtml = section.xhtml.copy()
+		}
+		sectionXhtml.setViewport(e.fixedLayoutWidth, e.fixedLayoutHeight)
+	}
+	// XHTML 1.1 doesn't support the lang attribute
+	if section.xhtml.raw == "" && section.xhtml.xml.Lang != "" && e.version == EpubVersion2 {
+		if sectionXhtml == section.xhtml {
+			sectionXhtml = section.xhtml.copy()
+		}
+		sectionXhtml.xml.Lang = ""
+	}
+	// The epub:type of the body needs the epub namespace, and EPUB 2 doesn't
+	// support it
+	if section.xhtml.raw == "" && section.xhtml.xml.Body.EpubType != "" {
+		if sectionXhtml == section.xhtml {
+			sectionXhtml = section.xhtml.copy()
+		}
+		if e.version == EpubVersion2 {
+			sectionXhtml.setBodyEpubType("")
+		} else {
+			sectionXhtml.setXmlnsEpub(xmlnsEpub)
+		}
+	}
+	// Headings added to the TOC need ids to link to
+	if e.tocHeadingLevel > 0 && e.isInToc(section) && section.xhtml.raw == "" {
+		body, headings := tocHeadings(sectionXhtml.body(), e.tocHeadingLevel)
+		if len(headings) > 0 {
+			if sectionXhtml == section.xhtml {
+				sectionXhtml = section.xhtml.copy()
 			}
-			e.pkg.addToManifest(section.filename, relativePath, mediaTypeXhtml, "")
+			sectionXhtml.xml.Body.XML = body
+		}
+	}
+
+	return sectionXhtml
+}
+
+// Get the manifest item of a section
+func sectionManifestItem(section epubSection) ManifestItem {
+	// EPUB 3 requires sections that contain scripts or inline SVG to be marked
+	// as such
+	sectionProperties := []string{}
+	if section.xhtml.isScripted() {
+		sectionProperties = append(sectionProperties, xhtmlScriptedProperties)
+	}
+	if section.xhtml.hasSVG() {
+		sectionProperties = append(sectionProperties, xhtmlSVGProperties)
+	}
+
+	return ManifestItem{
+		ID:         section.filename,
+		Href:       filepath.Join(xhtmlFolderName, section.filename),
+		MediaType:  mediaTypeXhtml,
+		Properties: strings.Join(sectionProperties, " "),
+	}
+}
+
+// Get the manifest item of the media overlay of a section
+func mediaOverlayManifestItem(section epubSection) ManifestItem {
+	smilFilename := mediaOverlayFilename(section.filename)
+
+	return ManifestItem{
+		ID:        smilFilename,
+		Href:      filepath.Join(xhtmlFolderName, smilFilename),
+		MediaType: mediaTypeSmil,
+	}
+}
+
+// Get a copy of the section's XHTML with page breaks added to the start of the
+// body for each of the section's page markers that isn't already in the body
+func (e *Epub) addPageBreaks(section epubSection) *xhtml {
+	body := section.xhtml.body()
+	pageBreaks := ""
+	for _, marker := range section.pageMarkers {
+		idPattern := regexp.MustCompile(`\sid\s*=\s*["']` + regexp.QuoteMeta(marker.anchorID) + `["']`)
+		if idPattern.MatchString(body) {
+			continue
+		}
+
+		// EPUB 2 doesn't support the epub:type attribute
+		epubType := ""
+		if e.version != EpubVersion2 {
+			epubType = ` epub:type="` + xhtmlPageBreakEpubType + `"`
+		}
+		pageBreaks += fmt.Sprintf(
+			"<span%s id=\"%s\" title=\"%s\"></span>",
+			epubType,
+			html.EscapeString(marker.anchorID),
+			html.EscapeString(marker.pageName))
+	}
+
+	x := section.xhtml.copy()
+	x.xml.Body.XML = "\n" + pageBreaks + strings.TrimPrefix(body, "\n")
+	if e.version != EpubVersion2 {
+		x.setXmlnsEpub(xmlnsEpub)
+	}
+
+	return x
+}
+
+// Get the filename of the closest ancestor of the section that's in the TOC,
+// or an empty string if the section should be at the top level of the TOC
+func (e *Epub) tocParentFilename(section epubSection) string {
+	for section.parentFilename != "" {
+		i := e.sectionIndex(section.parentFilename)
+		if i == -1 {
+			break
 		}
+		section = e.sections[i]
+		if section.tocTitle() != "" {
+			return section.filename
+		}
+	}
+
+	return ""
+}
+
+// Check whether a section has an entry in the TOC, which sections without
+// titles and the cover don't
+func (e *Epub) isInToc(section epubSection) bool {
+	return section.tocTitle() != "" && section.filename != e.cover.xhtmlFilename
+}
+
+// Get the level of a section in the TOC, which is 1 for top-level sections
+func (e *Epub) tocLevel(section epubSection) int {
+	level := 1
+	for parentFilename := e.tocParentFilename(section); parentFilename != ""; level++ {
+		parentFilename = e.tocParentFilename(e.sections[e.sectionIndex(parentFilename)])
+	}
+
+	return level
+}
+
+// Check whether an entry at the given level of the TOC is within the TOC depth
+// (see SetTocDepth)
+func (e *Epub) isWithinTocDepth(level int) bool {
+	return e.tocDepth == 0 || level <= e.tocDepth
+}
+
+// Add the headings within a section to the TOC, nested under the entry of the
+// section and under each other by level (see SetAutoTocFromHeadings)
+func (e *Epub) addTocHeadings(sectionIndex int, section epubSection, sectionXhtml *xhtml, relativePath string) {
+	if e.tocHeadingLevel == 0 || section.xhtml.raw != "" {
+		return
+	}
+
+	// The ids have already been added to the body of the XHTML
+	_, headings := tocHeadings(sectionXhtml.body(), e.tocHeadingLevel)
+	sectionLevel := e.tocLevel(section)
+	// The headings that the following headings can be nested under
+	var parents []tocHeading
+	for i, heading := range headings {
+		for len(parents) > 0 && parents[len(parents)-1].level >= heading.level {
+			parents = parents[:len(parents)-1]
+		}
+		if !e.isWithinTocDepth(sectionLevel + len(parents) + 1) {
+			continue
+		}
+
+		parentRelativePath := relativePath
+		if len(parents) > 0 {
+			parentRelativePath = relativePath + "#" + parents[len(parents)-1].id
+		}
+		e.toc.addHeading(sectionIndex, i, heading.title, relativePath+"#"+heading.id, parentRelativePath)
+		parents = append(parents, heading)
 	}
 }
 
 // Write the TOC file to the temporary directory and add the TOC entries to the
 // package file
 func (e *Epub) writeToc(tempDir string) {
-	e.pkg.addToManifest(tocNavItemID, tocNavFilename, mediaTypeXhtml, tocNavItemProperties)
+	// EPUB 2 doesn't support the EPUB 3 TOC file
+	if e.version != EpubVersion2 {
+		for _, landmark := range e.landmarks {
+			// Skip landmarks pointing to sections that have since been removed
+			relativePath, ok := e.landmarkPath(landmark.target)
+			if ok {
+				e.toc.addLandmark(landmark.epubType, landmark.title, relativePath)
+			}
+		}
+
+		e.pkg.addToManifest(tocNavItemID, tocNavFilename, mediaTypeXhtml, tocNavItemProperties)
+		if e.navDocument != "" {
+			writeTocDocument(e.fs, filepath.Join(tempDir, e.contentFolder, tocNavFilename), e.navDocument)
+		} else {
+			e.toc.writeNavDoc(e.fs, filepath.Join(tempDir, e.contentFolder), e.minifyXML)
+		}
+	}
+
+	// EPUB 2 requires the NCX file
+	if !e.includeNCX && e.version != EpubVersion2 {
+		e.pkg.setSpineToc("")
+		return
+	}
+	e.pkg.setSpineToc(tocNcxItemID)
 	e.pkg.addToManifest(tocNcxItemID, tocNcxFilename, mediaTypeNcx, "")
+	if e.ncxDocument != "" {
+		writeTocDocument(e.fs, filepath.Join(tempDir, e.contentFolder, tocNcxFilename), e.ncxDocument)
+	} else {
+		e.toc.writeNcxDoc(e.fs, filepath.Join(tempDir, e.contentFolder), e.minifyXML)
+	}
+}
 
-	e.toc.write(e.fs, tempDir)
+// Write a TOC file provided with SetNavDocument or SetNCXDocument as-is
+func writeTocDocument(fs afero.Fs, tocFilePath string, content string) {
+	if err := afero.WriteFile(fs, tocFilePath, []byte(content), filePermissions); err != nil {
+		panic(fmt.Sprintf("Error writing TOC file: %s", err))
+	}
 }
 
 // If the filesystem supports it, use Lstat, else use fs.Stat
@@ -450,3 +1102,12 @@ func lstatIfPossible(fs afero.Fs, path string) (os.FileInfo, error) {
 	}
 	return fs.Stat(path)
 }
+
+// Marshal generated XML, indented with the given prefix unless minify is true
+func marshalXML(v interface{}, prefix string, minify bool) ([]byte, error) {
+	if minify {
+		return xml.Marshal(v)
+	}
+
+	return xml.MarshalIndent(v, prefix, "  ")
+}
@@ -3,6 +3,9 @@ package epub
 import (
 	"encoding/xml"
 	"fmt"
+	"io"
+	"regexp"
+	"strings"
 
 	"github.com/spf13/afero"
 )
@@ -10,8 +13,20 @@ import (
 const (
 	xhtmlDoctype = `<!DOCTYPE html>
 `
-	xhtmlLinkRel  = "stylesheet"
-	xhtmlTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+	// EPUB 2 content documents are XHTML 1.1
+	xhtmlDoctypeEpub2 = `<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.1//EN" "http://www.w3.org/TR/xhtml11/DTD/xhtml11.dtd">
+`
+	xhtmlLinkRel = "stylesheet"
+	// The manifest properties of sections that contain scripts
+	xhtmlScriptedProperties = "scripted"
+	// The manifest properties of sections that contain inline SVG
+	xhtmlSVGProperties = "svg"
+	// The epub:type of page breaks added for page markers
+	xhtmlPageBreakEpubType = "pagebreak"
+	// The viewport of fixed-layout sections
+	xhtmlViewportContentFormat = "width=%d, height=%d"
+	xhtmlViewportMetaName      = "viewport"
+	xhtmlTemplate              = `<?xml version="1.0" encoding="UTF-8"?>
 <!DOCTYPE html>
 <html xmlns="http://www.w3.org/1999/xhtml">
   <head>
@@ -20,24 +35,58 @@ const (
   <body></body>
 </html>
 `
+	// The namespace of the xml:lang attribute
+	xmlNamespace = "http://www.w3.org/XML/1998/namespace"
 )
 
+// Matches the start of a complete HTML document, which may be passed as a
+// section body by mistake
+var xhtmlDocumentStartPattern = regexp.MustCompile(`(?is)^\s*(?:<\?xml[^>]*\?>\s*)?<(?:!doctype|html|body)[\s>]`)
+
+// Matches the <body> element of a complete HTML document
+var xhtmlDocumentBodyPattern = regexp.MustCompile(`(?is)<body(?:\s[^>]*)?>(.*)</body\s*>`)
+
+// Matches the start of a <script> element
+var xhtmlScriptPattern = regexp.MustCompile(`(?i)<script[\s>/]`)
+
+// Matches the start of an inline <svg> element
+var xhtmlSVGPattern = regexp.MustCompile(`(?i)<svg[\s>/]`)
+
 // xhtml implements an XHTML document
 type xhtml struct {
+	doctype string
+	// The complete XHTML document for sections added with AddRawSection, which is
+	// written as-is instead of the generated document
+	raw string
 	xml *xhtmlRoot
 }
 
 // This holds the actual XHTML content
 type xhtmlRoot struct {
-	XMLName   xml.Name      `xml:"http://www.w3.org/1999/xhtml html"`
-	XmlnsEpub string        `xml:"xmlns:epub,attr,omitempty"`
-	Head      xhtmlHead     `xml:"head"`
-	Body      xhtmlInnerxml `xml:"body"`
+	XMLName   xml.Name `xml:"http://www.w3.org/1999/xhtml html"`
+	XmlnsEpub string   `xml:"xmlns:epub,attr,omitempty"`
+	// The language of the document, if it differs from the language of the
+	// EPUB. XHTML requires both attributes to be set to the same value, but
+	// XHTML 1.1 (EPUB 2) only supports xml:lang.
+	Lang    string        `xml:"lang,attr,omitempty"`
+	XMLLang string        `xml:"xml:lang,attr,omitempty"`
+	Head    xhtmlHead     `xml:"head"`
+	Body    xhtmlInnerxml `xml:"body"`
 }
 
 type xhtmlHead struct {
-	Title string `xml:"title"`
-	Link  *xhtmlLink
+	Title   string `xml:"title"`
+	Metas   []xhtmlMeta
+	Links   []xhtmlLink
+	Scripts []xhtmlScript
+}
+
+// The <meta> element, used for the viewport of fixed-layout sections
+// Ex: <meta name="viewport" content="width=1200, height=1600" />
+type xhtmlMeta struct {
+	XMLName xml.Name `xml:"meta"`
+	Name    string   `xml:"name,attr"`
+	Content string   `xml:"content,attr"`
 }
 
 // The <link> element, used to link to stylesheets
@@ -49,17 +98,28 @@ type xhtmlLink struct {
 	Href    string   `xml:"href,attr,omitempty"`
 }
 
+// The <script> element, used to link to JavaScript files
+// Ex: <script type="text/javascript" src="../js/quiz.js"></script>
+type xhtmlScript struct {
+	XMLName xml.Name `xml:"script"`
+	Type    string   `xml:"type,attr,omitempty"`
+	Src     string   `xml:"src,attr"`
+}
+
 // This holds the content of the XHTML document between the <body> tags. It is
 // implemented as a string because we don't know what it will contain and we
 // leave it up to the user of the package to validate the content
 type xhtmlInnerxml struct {
-	XML string `xml:",innerxml"`
+	// The role of the document in the EPUB, e.g. dedication
+	EpubType string `xml:"epub:type,attr,omitempty"`
+	XML      string `xml:",innerxml"`
 }
 
 // Constructor for xhtml
 func newXhtml(body string) *xhtml {
 	x := &xhtml{
-		xml: newXhtmlRoot(),
+		doctype: xhtmlDoctype,
+		xml:     newXhtmlRoot(),
 	}
 	x.setBody(body)
 
@@ -83,33 +143,121 @@ func newXhtmlRoot() *xhtmlRoot {
 	return r
 }
 
+// Constructor for an xhtml that holds a complete XHTML document, which will be
+// written without any changes
+func newRawXhtml(content string) *xhtml {
+	x := newXhtml("")
+	x.raw = content
+
+	return x
+}
+
+// Make a copy of the XHTML document that can be changed without changing the
+// original
+func (x *xhtml) copy() *xhtml {
+	r := *x.xml
+	r.Head.Metas = append([]xhtmlMeta(nil), x.xml.Head.Metas...)
+	r.Head.Links = append([]xhtmlLink(nil), x.xml.Head.Links...)
+	r.Head.Scripts = append([]xhtmlScript(nil), x.xml.Head.Scripts...)
+
+	return &xhtml{
+		doctype: x.doctype,
+		raw:     x.raw,
+		xml:     &r,
+	}
+}
+
 func (x *xhtml) setBody(body string) {
 	x.xml.Body.XML = "\n" + body + "\n"
 }
 
-func (x *xhtml) setCSS(path string) {
-	x.xml.Head.Link = &xhtmlLink{
-		Rel:  xhtmlLinkRel,
-		Type: mediaTypeCSS,
-		Href: path,
+// Link to the stylesheets in the given order, ignoring any empty paths
+func (x *xhtml) setCSS(paths ...string) {
+	x.xml.Head.Links = nil
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		x.xml.Head.Links = append(x.xml.Head.Links, xhtmlLink{
+			Rel:  xhtmlLinkRel,
+			Type: mediaTypeCSS,
+			Href: path,
+		})
 	}
 }
 
+func (x *xhtml) setDoctype(doctype string) {
+	x.doctype = doctype
+}
+
 func (x *xhtml) setTitle(title string) {
 	x.xml.Head.Title = title
 }
 
+// Set the size of the viewport in CSS pixels, as required for fixed-layout
+// sections
+func (x *xhtml) setViewport(width int, height int) {
+	x.xml.Head.Metas = []xhtmlMeta{
+		{
+			Name:    xhtmlViewportMetaName,
+			Content: fmt.Sprintf(xhtmlViewportContentFormat, width, height),
+		},
+	}
+}
+
 func (x *xhtml) setXmlnsEpub(xmlns string) {
 	x.xml.XmlnsEpub = xmlns
 }
 
+// Set both lang and xml:lang of the document
+func (x *xhtml) setLang(lang string) {
+	x.xml.Lang = lang
+	x.xml.XMLLang = lang
+}
+
+// Link to a JavaScript file after any already-linked JavaScript files
+func (x *xhtml) addScript(path string) {
+	x.xml.Head.Scripts = append(x.xml.Head.Scripts, xhtmlScript{
+		Type: mediaTypeJavaScript,
+		Src:  path,
+	})
+}
+
+// Set the epub:type attribute of the <body> element
+func (x *xhtml) setBodyEpubType(epubType string) {
+	x.xml.Body.EpubType = epubType
+}
+
+// Get the content of the document body, or the complete document if it's raw
+func (x *xhtml) body() string {
+	if x.raw != "" {
+		return x.raw
+	}
+
+	return x.xml.Body.XML
+}
+
+// Whether the document contains or links to any scripts
+func (x *xhtml) isScripted() bool {
+	return len(x.xml.Head.Scripts) > 0 || xhtmlScriptPattern.MatchString(x.body())
+}
+
+// Whether the document contains inline SVG
+func (x *xhtml) hasSVG() bool {
+	return xhtmlSVGPattern.MatchString(x.body())
+}
+
 func (x *xhtml) Title() string {
 	return x.xml.Head.Title
 }
 
-// Write the XHTML file to the specified path
-func (x *xhtml) write(fs afero.Fs, xhtmlFilePath string) {
-	xhtmlFileContent, err := xml.MarshalIndent(x.xml, "", "  ")
+// Get the content of the XHTML file, without indentation if minify is true
+func (x *xhtml) content(minify bool) []byte {
+	if x.raw != "" {
+		return []byte(x.raw)
+	}
+
+	xhtmlFileContent, err := marshalXML(x.xml, "", minify)
 	if err != nil {
 		panic(fmt.Sprintf(
 			"Error marshalling XML for XHTML file: %s\n"+
@@ -119,13 +267,54 @@ func (x *xhtml) write(fs afero.Fs, xhtmlFilePath string) {
 	}
 
 	// Add the doctype declaration to the output
-	xhtmlFileContent = append([]byte(xhtmlDoctype), xhtmlFileContent...)
+	xhtmlFileContent = append([]byte(x.doctype), xhtmlFileContent...)
 	// Add the xml header to the output
 	xhtmlFileContent = append([]byte(xml.Header), xhtmlFileContent...)
 	// It's generally nice to have files end with a newline
 	xhtmlFileContent = append(xhtmlFileContent, "\n"...)
 
-	if err := afero.WriteFile(fs, xhtmlFilePath, []byte(xhtmlFileContent), filePermissions); err != nil {
+	return xhtmlFileContent
+}
+
+// Check that the XHTML document is well-formed XML
+func (x *xhtml) validate() error {
+	return validateXML(string(x.content(false)))
+}
+
+// Write the XHTML file to the specified path
+func (x *xhtml) write(fs afero.Fs, xhtmlFilePath string, minify bool) {
+	if err := afero.WriteFile(fs, xhtmlFilePath, x.content(minify), filePermissions); err != nil {
 		panic(fmt.Sprintf("Error writing XHTML file: %s", err))
 	}
 }
+
+// Get the content of the <body> element if a section body is a complete HTML
+// document rather than the content of the body, which would otherwise be
+// wrapped in a second <html> element. Returns an error wrapping ErrInvalidXML
+// if it's a complete document without a body.
+func documentBody(body string) (string, error) {
+	if !xhtmlDocumentStartPattern.MatchString(body) {
+		return body, nil
+	}
+
+	match := xhtmlDocumentBodyPattern.FindStringSubmatch(body)
+	if match == nil {
+		return "", fmt.Errorf("%w: the body is a complete document without a <body> element; use AddRawSection to add it as-is", ErrInvalidXML)
+	}
+
+	return match[1], nil
+}
+
+// Check that the content is well-formed XML
+func validateXML(content string) error {
+	d := xml.NewDecoder(strings.NewReader(content))
+	for {
+		_, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidXML, err)
+		}
+	}
+}